@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domain owners can read the recent access log entries of their own domain without access to the
+// combined log file. The parent keeps the request log lines of the child in memory for each domain
+// that has an access-log-token, and answers the command "access-log <domain> <token> [count]" on the
+// tenant socket. Unlike the admin socket, everyone can connect to the tenant socket, but it only
+// accepts this command.
+
+// accessLogMarker is the part of a log line of the child that marks a request log entry.
+const accessLogMarker = " Request: "
+
+// accessLog holds the most recent request log entries per (ASCII) domain.
+var accessLog = struct {
+	sync.Mutex
+	entries map[string][]string
+}{entries: map[string][]string{}}
+
+// accessLogToken returns the access-log-token of the (ASCII) domain, or "" if the domain has none.
+func accessLogToken(domain string) secret {
+	d, ok := config.Domains[domain]
+	if !ok || d.AccessLogToken == nil {
+		return ""
+	}
+	return *d.AccessLogToken
+}
+
+// normalizeLogHost returns the ASCII domain of the host of a request, without port and trailing dot.
+func normalizeLogHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	asciiHost, err := canonicalHost(strings.Trim(host, "[]"))
+	if err != nil {
+		return ""
+	}
+	return asciiHost
+}
+
+// recordAccessLog stores a log line of the child, if it is a request log entry of a domain with an access-log-token.
+func recordAccessLog(line string) {
+	if !strings.HasPrefix(line, "C ") {
+		return
+	}
+	i := strings.Index(line, accessLogMarker)
+	if i < 0 {
+		return
+	}
+	// The entry is "<client IP> <host> <URL path>".
+	fields := strings.SplitN(line[i+len(accessLogMarker):], " ", 3)
+	if len(fields) != 3 {
+		return
+	}
+	domain := normalizeLogHost(fields[1])
+	if accessLogToken(domain) == "" {
+		return
+	}
+
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	entries := append(accessLog.entries[domain], strings.TrimPrefix(line, "C "))
+	if len(entries) > config.AccessLogEntries {
+		// Copy the entries, so that the dropped entries can be freed.
+		entries = append([]string(nil), entries[len(entries)-config.AccessLogEntries:]...)
+	}
+	accessLog.entries[domain] = entries
+}
+
+// accessLogEntries returns the last count request log entries of the (ASCII) domain.
+func accessLogEntries(domain string, count int) []string {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	entries := accessLog.entries[domain]
+	if count > 0 && count < len(entries) {
+		entries = entries[len(entries)-count:]
+	}
+	return append([]string(nil), entries...)
+}
+
+// startTenantSocket listens on the tenant socket and handles the commands of the domain owners.
+func startTenantSocket() {
+	// Remove a stale socket from a previous run.
+	os.Remove(config.TenantSocket)
+
+	ln, err := net.Listen("unix", config.TenantSocket)
+	if err != nil {
+		log.Fatal("Could not open tenant socket:", err)
+	}
+
+	// Everyone is allowed to connect. The commands are authorized with the token of the domain.
+	if err := os.Chmod(config.TenantSocket, 0666); err != nil {
+		log.Fatal("Could not set permissions for tenant socket:", err)
+	}
+
+	log.Println("Tenant socket listening on", config.TenantSocket)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println("Tenant socket:", err)
+				return
+			}
+			go handleTenantConnection(conn)
+		}
+	}()
+}
+
+// handleTenantConnection reads one command from the connection and writes the answer.
+func handleTenantConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	answer, err := handleTenantCommand(strings.Fields(line))
+	if err != nil {
+		fmt.Fprintln(conn, "error:", err)
+		return
+	}
+	fmt.Fprintln(conn, "ok:", answer)
+}
+
+// handleTenantCommand executes one tenant command and returns the answer.
+// The answer of "access-log" is the base64 encoded list of entries, separated by new lines.
+func handleTenantCommand(fields []string) (string, error) {
+	if len(fields) == 0 || fields[0] != "access-log" {
+		return "", errors.New("unknown command")
+	}
+	if len(fields) != 3 && len(fields) != 4 {
+		return "", errors.New("usage: access-log <domain> <token> [count]")
+	}
+	count := 0
+	if len(fields) == 4 {
+		var err error
+		count, err = strconv.Atoi(fields[3])
+		if err != nil || count < 1 {
+			return "", errors.New("count must be a positive number")
+		}
+	}
+
+	// Do not tell whether the domain or the token is wrong, and slow down guessing.
+	domain := normalizeLogHost(fields[1])
+	token := accessLogToken(domain)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(fields[2])) != 1 {
+		log.Println("Tenant command: access-log for", fields[1], "denied")
+		time.Sleep(time.Second)
+		return "", errors.New("access denied")
+	}
+	log.Println("Tenant command: access-log for", domain)
+
+	entries := accessLogEntries(domain, count)
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(entries, "\n"))), nil
+}
+
+// runAccessLog prints the recent access log entries of a domain from the tenant socket of the running server.
+// The token is read from the environment, so that it does not show up in the process list.
+// The config file is not read, because domain owners usually can not read it.
+func runAccessLog(args []string) {
+	if len(args) != 2 && len(args) != 3 {
+		log.Fatal("Usage: SSLSERVER_ACCESS_LOG_TOKEN=<token> sslserver access-log <tenant-socket> <domain> [count]")
+	}
+	token := os.Getenv("SSLSERVER_ACCESS_LOG_TOKEN")
+	if token == "" {
+		log.Fatal("SSLSERVER_ACCESS_LOG_TOKEN is not set")
+	}
+
+	command := "access-log " + args[1] + " " + token
+	if len(args) == 3 {
+		command += " " + args[2]
+	}
+	answer, err := socketRequest(args[0], command)
+	if err != nil {
+		log.Fatal("Could not read access log: ", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(answer)
+	if err != nil {
+		log.Fatal("Invalid answer from tenant socket: ", err)
+	}
+	if len(data) > 0 {
+		fmt.Println(string(data))
+	}
+	os.Exit(0)
+}
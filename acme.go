@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeChallengeAllowed returns true if the challenge type is in acme-challenge-types.
+func acmeChallengeAllowed(challengeType string) bool {
+	for _, t := range config.AcmeChallengeTypes {
+		if t == challengeType {
+			return true
+		}
+	}
+	return false
+}
+
+// useAutocert returns true if autocert gets the certificates of the domains without a DNS provider. Autocert only
+// creates ECDSA keys, and it always tries TLS-ALPN-01 challenges. HTTP-01 challenges are only enabled in autocert
+// if they are allowed.
+func useAutocert() bool {
+	return config.AcmeKeyType == keyTypeECDSAP256 && acmeChallengeAllowed(acmeChallengeTLSALPN01)
+}
+
+// autocertChallenge returns the challenge types that autocert uses, for the reports of the orders.
+func autocertChallenge() string {
+	if acmeChallengeAllowed(acmeChallengeHTTP01) {
+		return acmeChallengeAutocert
+	}
+	return acmeChallengeTLSALPN01
+}
+
+// acmeChallengeSolver returns the solver for the domains without a DNS provider that are not issued by autocert.
+// HTTP-01 is preferred, because it also works behind TLS terminating proxies.
+func acmeChallengeSolver() (acmeSolver, error) {
+	switch {
+	case acmeChallengeAllowed(acmeChallengeHTTP01):
+		return http01Solver{}, nil
+	case acmeChallengeAllowed(acmeChallengeTLSALPN01):
+		return tlsALPN01Solver{}, nil
+	}
+	return nil, errors.New("the domain has no dns-provider, and acme-challenge-types only allows dns-01")
+}
+
+// acmeEABKey decodes the HMAC key of the external account binding. CAs hand out the key base64url
+// encoded, with or without padding.
+func acmeEABKey() ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(string(config.AcmeEabHmac), "="))
+}
+
+// acmeExternalAccountBinding returns the external account binding for the registration of the
+// ACME account, or nil if none is configured.
+func acmeExternalAccountBinding() *acme.ExternalAccountBinding {
+	if config.AcmeEabKid == "" {
+		return nil
+	}
+	key, err := acmeEABKey()
+	if err != nil {
+		return nil
+	}
+	return &acme.ExternalAccountBinding{KID: config.AcmeEabKid, Key: key}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// When getting a certificate from Let's Encrypt fails, the domain is not tried again on every handshake. Instead,
+// the failures of each domain are tracked, and the next try is delayed with an exponential backoff between
+// acme-backoff-min and acme-backoff-max. If the CA answered with a rate limit error, the next try is not before the
+// time that the CA named (Retry-After header or "retry after" in the error detail). During the backoff, the handshakes
+// get a cached certificate if there is one, and otherwise a self-signed certificate.
+
+// acmeFailure is the failure state of a domain.
+type acmeFailure struct {
+	Count     int       // The number of consecutive failures.
+	NextTry   time.Time // The time before which the CA is not asked again.
+	LastError string    // The last error.
+}
+
+var acmeFailures = make(map[string]*acmeFailure)
+var acmeFailuresMu sync.Mutex
+
+// acmeBackoff returns the failure state of the domain if the domain is in backoff, and nil otherwise.
+func acmeBackoff(domain string) *acmeFailure {
+	acmeFailuresMu.Lock()
+	defer acmeFailuresMu.Unlock()
+	failure := acmeFailures[domain]
+	if failure == nil || !time.Now().Before(failure.NextTry) {
+		return nil
+	}
+	state := *failure
+	return &state
+}
+
+// recordACMESuccess resets the failure state of the domain.
+func recordACMESuccess(domain string) {
+	acmeFailuresMu.Lock()
+	delete(acmeFailures, domain)
+	acmeFailuresMu.Unlock()
+}
+
+// recordACMEFailure counts the failure and sets the time of the next try.
+func recordACMEFailure(domain string, err error) {
+	acmeFailuresMu.Lock()
+	defer acmeFailuresMu.Unlock()
+
+	failure := acmeFailures[domain]
+	if failure == nil {
+		failure = &acmeFailure{}
+		acmeFailures[domain] = failure
+	}
+	failure.Count++
+	failure.LastError = err.Error()
+
+	// Double the delay with every failure: min, 2*min, 4*min, ... up to max.
+	delay := config.AcmeBackoffMax
+	if failure.Count <= 32 {
+		if d := config.AcmeBackoffMin << (failure.Count - 1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	if retryAfter, limited := acmeRateLimit(err); limited {
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		log.Printf("certificate: Let's Encrypt rate limit for %s, next try in %s", domain, delay.Round(time.Second))
+	} else {
+		log.Printf("certificate: Let's Encrypt failed %d time(s) for %s, next try in %s", failure.Count, domain, delay.Round(time.Second))
+	}
+	failure.NextTry = time.Now().Add(delay)
+}
+
+// clearACMEBackoff removes the backoff of the domain, e.g. when the operator requests the certificate explicitly.
+func clearACMEBackoff(domain string) {
+	recordACMESuccess(domain)
+}
+
+// acmeRetryAfterDetail matches the time in the detail of the rate limit errors of Let's Encrypt,
+// e.g. "too many certificates already issued for this exact set of domains ... retry after 2024-05-01 12:00:00 UTC".
+var acmeRetryAfterDetail = regexp.MustCompile(`retry after (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) UTC`)
+
+// acmeRateLimit returns true if the error is a rate limit error of the CA, and the duration after which the CA
+// accepts new requests (0 if it is not known).
+func acmeRateLimit(err error) (time.Duration, bool) {
+	var detail string
+	var acmeErr *acme.Error
+	if errors.As(err, &acmeErr) {
+		if !strings.HasSuffix(strings.ToLower(acmeErr.ProblemType), ":ratelimited") {
+			return 0, false
+		}
+		if acmeErr.Header != nil {
+			if d := parseRetryAfter(acmeErr.Header.Get("Retry-After")); d > 0 {
+				return d, true
+			}
+		}
+		detail = acmeErr.Detail
+	} else {
+		// autocert does not always wrap the errors of the CA, so the text of the error is checked.
+		detail = err.Error()
+		if !strings.Contains(strings.ToLower(detail), "ratelimited") {
+			return 0, false
+		}
+	}
+
+	if match := acmeRetryAfterDetail.FindStringSubmatch(detail); match != nil {
+		if t, err := time.Parse("2006-01-02 15:04:05", match[1]); err == nil {
+			return time.Until(t), true
+		}
+	}
+	return 0, true
+}
+
+// parseRetryAfter parses the Retry-After header, which is either seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/idna"
+)
+
+// The child reports the state of its ACME orders to the parent, which keeps the last order of each domain,
+// so that the admin command "acme-orders" can answer why a certificate is not issued without debug logs.
+// For autocert, only the start and the result of an order are known, and the HTTP-01 challenge when the
+// CA fetches it. Orders with DNS-01 challenges report each step.
+
+// States of ACME orders.
+const (
+	acmeOrderPending    = "pending"    // The order was started.
+	acmeOrderDNSRecord  = "dns-record" // The TXT record was created, and the propagation delay runs.
+	acmeOrderValidating = "validating" // The CA validates the challenge.
+	acmeOrderFinalizing = "finalizing" // The challenges are valid, and the certificate is requested.
+	acmeOrderValid      = "valid"      // The certificate was issued.
+	acmeOrderFailed     = "failed"     // The order failed.
+)
+
+// Challenge types of ACME orders.
+const (
+	acmeChallengeAutocert  = "tls-alpn-01/http-01" // Autocert chooses one of them.
+	acmeChallengeHTTP01    = "http-01"
+	acmeChallengeTLSALPN01 = "tls-alpn-01"
+	acmeChallengeDNS01     = "dns-01"
+)
+
+// maxACMEOrders is the maximum number of domains for which the parent keeps the order state.
+const maxACMEOrders = 1000
+
+// acmeOrderReport is sent from the child to the parent.
+type acmeOrderReport struct {
+	Challenge string    `json:"challenge"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	NextTry   time.Time `json:"next_try"`
+}
+
+// acmeOrder is the state of the last ACME order of a domain in the parent.
+type acmeOrder struct {
+	Domain    string    `json:"domain"`
+	Challenge string    `json:"challenge"`
+	State     string    `json:"state"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try"` // After failures, the time before which the CA is not asked again.
+}
+
+var acmeOrders = make(map[string]*acmeOrder)
+var acmeOrdersMu sync.Mutex
+
+// reportACMEOrder sends the state of the order of the domain from the child to the parent.
+func reportACMEOrder(domain, challenge, state string, err error) {
+	report := acmeOrderReport{Challenge: challenge, State: state}
+	if err != nil {
+		report.Error = err.Error()
+		if failure := acmeBackoff(domain); failure != nil {
+			report.NextTry = failure.NextTry
+		}
+	}
+	data, _ := json.Marshal(report)
+	childToParentCh <- Command{Type: cmdACMEOrder, Name: domain, Data: data}
+}
+
+// updateACMEOrder stores the state of an order that the child has reported.
+func updateACMEOrder(domain string, data []byte) {
+	var report acmeOrderReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		log.Println("Invalid ACME order state from child:", err)
+		return
+	}
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+
+	acmeOrdersMu.Lock()
+	defer acmeOrdersMu.Unlock()
+	order := acmeOrders[domain]
+	if order == nil {
+		// The CA only validates challenges of started orders.
+		if report.State == acmeOrderValidating {
+			return
+		}
+		if len(acmeOrders) >= maxACMEOrders {
+			dropOldestACMEOrder()
+		}
+		order = &acmeOrder{Domain: domain, Started: now}
+		acmeOrders[domain] = order
+	}
+
+	switch report.State {
+	case acmeOrderPending:
+		// A new order. The last error is kept until the order has a result.
+		order.Started = now
+		order.NextTry = time.Time{}
+	case acmeOrderValidating:
+		// The CA fetched a challenge, which only matters for a running order.
+		if order.State != acmeOrderPending && order.State != acmeOrderDNSRecord {
+			return
+		}
+	case acmeOrderValid:
+		order.LastError = ""
+		order.NextTry = time.Time{}
+	case acmeOrderFailed:
+		order.LastError = report.Error
+		order.NextTry = report.NextTry
+		go recordACMEOrderFailure(domain)
+	}
+	order.Challenge = report.Challenge
+	order.State = report.State
+	order.Updated = now
+}
+
+// isACMEChallengeHello returns true if the handshake is the validation of a TLS-ALPN-01 challenge by the CA.
+func isACMEChallengeHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// markACMEChallengeFetched sets the order of the domain to validating, when the CA fetches an HTTP-01 challenge.
+func markACMEChallengeFetched(domain string) {
+	data, _ := json.Marshal(acmeOrderReport{Challenge: acmeChallengeHTTP01, State: acmeOrderValidating})
+	updateACMEOrder(normalizeLogHost(domain), data)
+}
+
+// dropOldestACMEOrder removes the order that was not updated for the longest time.
+// The caller must hold acmeOrdersMu.
+func dropOldestACMEOrder() {
+	var oldest *acmeOrder
+	for _, order := range acmeOrders {
+		if oldest == nil || order.Updated.Before(oldest.Updated) {
+			oldest = order
+		}
+	}
+	if oldest != nil {
+		delete(acmeOrders, oldest.Domain)
+	}
+}
+
+// listACMEOrders returns the last orders of all domains, sorted by domain, as JSON.
+func listACMEOrders() string {
+	acmeOrdersMu.Lock()
+	orders := make([]acmeOrder, 0, len(acmeOrders))
+	for _, order := range acmeOrders {
+		orders = append(orders, *order)
+	}
+	acmeOrdersMu.Unlock()
+
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Domain < orders[j].Domain })
+	data, _ := json.Marshal(orders)
+	return string(data)
+}
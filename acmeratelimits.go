@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// The parent counts the requests to the ACME CA that count against the rate limits of Let's Encrypt, within their
+// rolling windows, and warns before a limit is hit, because a hit limit blocks the certificates of the domains for
+// up to a week. The new certificates are counted when the child stores them, per exact domain (duplicate
+// certificates), and per registered domain (e.g. example.com for www.example.com) unless they renew a certificate
+// in the cache. The failed orders are counted per domain from the order states that the child reports. Both count
+// as new orders of the ACME account. The counts are kept in the certificate cache, so that they survive restarts.
+
+// acmeRateLimitsCacheKey is the name under which the counts are stored in the certificate cache.
+const acmeRateLimitsCacheKey = "acme-rate-limits+state"
+
+// acmeLimit is a rate limit of Let's Encrypt.
+type acmeLimit struct {
+	name   string
+	limit  int
+	window time.Duration
+}
+
+// The rate limits of Let's Encrypt (see https://letsencrypt.org/docs/rate-limits/).
+var (
+	acmeLimitNewOrders    = acmeLimit{"new-orders-per-account", 300, 3 * time.Hour}
+	acmeLimitCertificates = acmeLimit{"certificates-per-registered-domain", 50, 7 * 24 * time.Hour}
+	acmeLimitDuplicates   = acmeLimit{"duplicate-certificates", 5, 7 * 24 * time.Hour}
+	acmeLimitFailures     = acmeLimit{"failed-validations-per-domain", 5, time.Hour}
+)
+
+// acmeRateLimits are all counted rate limits.
+var acmeRateLimits = []acmeLimit{acmeLimitNewOrders, acmeLimitCertificates, acmeLimitDuplicates, acmeLimitFailures}
+
+// acmeRateEvents holds the times of the counted requests by limit and subject ("<limit> <subject>").
+var acmeRateEvents = map[string][]time.Time{}
+var acmeRateEventsMu sync.Mutex
+
+// acmeRateEventsStoreMu serializes the storing of the counts, so that an older snapshot does not overwrite a newer one.
+var acmeRateEventsStoreMu sync.Mutex
+
+// acmeRateUsage is the count of a limit and subject, for the admin command "acme-rate-limits".
+type acmeRateUsage struct {
+	Limit   string    `json:"limit"`
+	Subject string    `json:"subject"`
+	Count   int       `json:"count"`
+	Max     int       `json:"max"`
+	Window  string    `json:"window"`
+	Oldest  time.Time `json:"oldest"` // The count decreases when the oldest request leaves the window.
+}
+
+// loadACMERateEvents reads the counts from the certificate cache. It is called in the parent.
+func loadACMERateEvents() {
+	data, err := certStorage.Get(context.Background(), acmeRateLimitsCacheKey)
+	if err != nil {
+		return
+	}
+	acmeRateEventsMu.Lock()
+	defer acmeRateEventsMu.Unlock()
+	if err := json.Unmarshal(data, &acmeRateEvents); err != nil {
+		log.Println("Could not read the ACME rate limit counts:", err)
+		acmeRateEvents = map[string][]time.Time{}
+	}
+}
+
+// recordACMECertificate counts a new certificate of the domain, which the child has stored. Renewals do not count
+// against the certificates per registered domain.
+func recordACMECertificate(domain string, renewal bool) {
+	subjects := map[acmeLimit]string{
+		acmeLimitNewOrders:  "account",
+		acmeLimitDuplicates: domain,
+	}
+	if !renewal {
+		registeredDomain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			registeredDomain = domain
+		}
+		subjects[acmeLimitCertificates] = registeredDomain
+	}
+	recordACMERequests(subjects)
+}
+
+// recordACMEOrderFailure counts a failed order of the domain, which the child has reported.
+func recordACMEOrderFailure(domain string) {
+	recordACMERequests(map[acmeLimit]string{
+		acmeLimitNewOrders: "account",
+		acmeLimitFailures:  domain,
+	})
+}
+
+// recordACMERequests counts a request against the limits with their subjects, warns about the limits that are
+// almost used up, and stores the counts in the certificate cache.
+func recordACMERequests(subjects map[acmeLimit]string) {
+	acmeRateEventsStoreMu.Lock()
+	defer acmeRateEventsStoreMu.Unlock()
+
+	now := time.Now()
+	acmeRateEventsMu.Lock()
+	pruneACMERateEvents(now)
+	for limit, subject := range subjects {
+		key := limit.name + " " + subject
+		acmeRateEvents[key] = append(acmeRateEvents[key], now)
+		count := len(acmeRateEvents[key])
+		if config.AcmeRateLimitWarning > 0 && count*100 >= limit.limit*config.AcmeRateLimitWarning {
+			log.Printf("Warning: ACME rate limit %s: %d of %d for %s within %s. Let's Encrypt refuses further requests when the limit is reached, until %s.",
+				limit.name, count, limit.limit, subject, limit.window, acmeRateEvents[key][0].Add(limit.window).Format(time.RFC3339))
+		}
+	}
+	data, _ := json.Marshal(acmeRateEvents)
+	acmeRateEventsMu.Unlock()
+
+	if err := certStorage.Put(context.Background(), acmeRateLimitsCacheKey, data); err != nil {
+		log.Println("Could not store the ACME rate limit counts:", err)
+	}
+}
+
+// pruneACMERateEvents removes the requests that have left the window of their limit. The caller must hold
+// acmeRateEventsMu.
+func pruneACMERateEvents(now time.Time) {
+	for key, times := range acmeRateEvents {
+		name, _, _ := strings.Cut(key, " ")
+		window := time.Duration(0)
+		for _, limit := range acmeRateLimits {
+			if limit.name == name {
+				window = limit.window
+			}
+		}
+		i := 0
+		for i < len(times) && now.Sub(times[i]) > window {
+			i++
+		}
+		if i == len(times) {
+			delete(acmeRateEvents, key)
+		} else {
+			acmeRateEvents[key] = times[i:]
+		}
+	}
+}
+
+// listACMERateLimits returns the counts of all limits and subjects within their windows as JSON, sorted by limit
+// and subject.
+func listACMERateLimits() string {
+	acmeRateEventsMu.Lock()
+	pruneACMERateEvents(time.Now())
+	usages := make([]acmeRateUsage, 0, len(acmeRateEvents))
+	for key, times := range acmeRateEvents {
+		name, subject, _ := strings.Cut(key, " ")
+		for _, limit := range acmeRateLimits {
+			if limit.name == name {
+				usages = append(usages, acmeRateUsage{Limit: name, Subject: subject, Count: len(times), Max: limit.limit, Window: limit.window.String(), Oldest: times[0]})
+			}
+		}
+	}
+	acmeRateEventsMu.Unlock()
+
+	sort.Slice(usages, func(i, j int) bool {
+		return fmt.Sprint(usages[i].Limit, " ", usages[i].Subject) < fmt.Sprint(usages[j].Limit, " ", usages[j].Subject)
+	})
+	data, _ := json.Marshal(usages)
+	return string(data)
+}
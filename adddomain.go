@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// The files that are created for a new domain, if they do not exist yet.
+var addDomainSkeleton = map[string]string{
+	"index.html": "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>%[1]s</title></head>\n<body><h1>%[1]s</h1></body>\n</html>\n",
+	"robots.txt": "User-agent: *\nAllow: /\n",
+}
+
+// runAddDomain implements the `add-domain <domain> [-issue]` subcommand. It creates the directory skeleton for
+// the domain in the web root and lets the running server reload its domains via the admin socket.
+// With `-issue`, the running server also gets the certificate for the domain right away.
+func runAddDomain(args []string) {
+	var domain string
+	issue := false
+	for _, arg := range args {
+		switch {
+		case arg == "-issue":
+			issue = true
+		case strings.HasPrefix(arg, "-"):
+			log.Fatal("Unknown flag: ", arg)
+		case domain == "":
+			domain = arg
+		default:
+			log.Fatal("Usage: sslserver add-domain <domain> [-issue]")
+		}
+	}
+	if domain == "" {
+		log.Fatal("Usage: sslserver add-domain <domain> [-issue]")
+	}
+
+	// The directory name is the ASCII form of the domain, because that is what the server looks up.
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil || strings.ContainsAny(asciiDomain, `/\`) || asciiDomain == "" || asciiDomain[0] == '.' {
+		log.Fatal("Invalid domain: ", domain)
+	}
+
+	readConfig()
+
+	if err := createDomainSkeleton(asciiDomain); err != nil {
+		log.Fatal("Could not create directory for domain: ", err)
+	}
+
+	// Let the running server pick up the new domain.
+	answer, err := adminRequest("reload")
+	if err != nil {
+		log.Println("Could not reload the running server:", err)
+		log.Println("The domain will be served after the next start of the server.")
+		os.Exit(0)
+	}
+	log.Println("Reload:", answer)
+
+	if issue {
+		answer, err := adminRequest("issue " + asciiDomain)
+		if err != nil {
+			log.Fatal("Could not get certificate: ", err)
+		}
+		log.Println("Issue:", answer)
+	}
+
+	os.Exit(0)
+}
+
+// createDomainSkeleton creates the directory for the domain in the web root with the skeleton files.
+// Existing files are not overwritten.
+func createDomainSkeleton(domain string) error {
+	webRoot := config.WebRootDirectory
+	dir := filepath.Join(webRoot, domain)
+
+	// The web root is read only. Make it writable for the owner while the directory is created.
+	restore, err := makeWritable(webRoot)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		return err
+	}
+
+	for name, template := range addDomainSkeleton {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			log.Println("Keeping existing file:", path)
+			continue
+		}
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(template, domain)), 0644); err != nil {
+			return err
+		}
+		log.Println("Created:", path)
+	}
+
+	// Set the same owner and permissions as for the rest of the web root.
+	if config.ChownWebRoot {
+		if err := ChownWebRoot(dir); err != nil {
+			return err
+		}
+	}
+	return setPermissions(dir)
+}
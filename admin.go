@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+// The admin socket is a Unix socket on which the parent accepts one command per connection.
+// A command is a single line, e.g. "reload" or "issue example.com". The parent answers with
+// a single line that starts with "ok" or "error".
+
+// maxAdminCommandLength is the maximum length of an admin command line.
+const maxAdminCommandLength = 4 * 1024 * 1024
+
+// startAdminSocket listens on the admin socket and handles the commands of the administrator.
+// The certificate cache is used by commands that store data.
+func startAdminSocket(cache autocert.Cache) {
+	// Remove a stale socket from a previous run.
+	os.Remove(config.AdminSocket)
+
+	ln, err := net.Listen("unix", config.AdminSocket)
+	if err != nil {
+		log.Fatal("Could not open admin socket:", err)
+	}
+
+	// Only the user that runs the server is allowed to send commands.
+	if err := os.Chmod(config.AdminSocket, 0600); err != nil {
+		log.Fatal("Could not set permissions for admin socket:", err)
+	}
+
+	log.Println("Admin socket listening on", config.AdminSocket)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println("Admin socket:", err)
+				return
+			}
+			go handleAdminConnection(conn, cache)
+		}
+	}()
+}
+
+// handleAdminConnection reads one command from the connection and writes the answer.
+func handleAdminConnection(conn net.Conn, cache autocert.Cache) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, maxAdminCommandLength)).ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSpace(line)
+
+	// Do not log the data of commands.
+	logLine := line
+	if len(logLine) > 80 {
+		logLine = logLine[:80] + "..."
+	}
+	log.Println("Admin command:", logLine)
+
+	// The tail command streams its answer.
+	if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "tail" {
+		handleTailCommand(conn, fields[1:])
+		return
+	}
+
+	answer, err := handleAdminCommand(line, cache)
+	if err != nil {
+		fmt.Fprintln(conn, "error:", err)
+		return
+	}
+	fmt.Fprintln(conn, "ok:", answer)
+}
+
+// handleAdminCommand executes one admin command and returns the answer.
+func handleAdminCommand(line string, cache autocert.Cache) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	switch fields[0] {
+	case "reload":
+		// Let the child scan the web root for new domains and files.
+		parentToChildCh <- Command{Type: cmdReload}
+		return "reload sent to child", nil
+
+	case "issue":
+		// Let the child get the certificate for a domain.
+		if len(fields) != 2 {
+			return "", errors.New("usage: issue <domain>")
+		}
+		domain, err := idna.Lookup.ToASCII(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid domain: %s", fields[1])
+		}
+		parentToChildCh <- Command{Type: cmdIssue, Name: domain}
+		return "issue sent to child", nil
+
+	case "terminate":
+		// Shut down the child gracefully. The parent exits when the child has exited.
+		go requestTerminate()
+		return "terminate sent to child", nil
+
+	case "acme-orders":
+		// List the state of the last ACME order of each domain.
+		return listACMEOrders(), nil
+
+	case "acme-rate-limits":
+		// List the requests to the ACME CA that count against its rate limits.
+		return listACMERateLimits(), nil
+
+	case "sandbox":
+		// Show the confinement of the child, e.g. for audits.
+		return sandboxStatus()
+
+	case "rotate-self-signed":
+		// Replace the self-signed certificate of a domain with a new one with a new key.
+		if len(fields) != 2 {
+			return "", errors.New("usage: rotate-self-signed <domain>")
+		}
+		domain, err := idna.Lookup.ToASCII(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid domain: %s", fields[1])
+		}
+		if err := cache.Delete(context.Background(), selfSignedCacheKey(domain)); err != nil {
+			return "", err
+		}
+		parentToChildCh <- Command{Type: cmdRotateSelfSigned, Name: domain}
+		return "rotation sent to child", nil
+
+	case "rotate-local-ca":
+		// Replace the local CA and the certificates that it signed right away.
+		if !config.LocalCA {
+			return "", errors.New("local-ca is not enabled")
+		}
+		parentToChildCh <- Command{Type: cmdRotateLocalCA}
+		return "rotation sent to child", nil
+
+	case "forget-certificate":
+		// Let the child forget the certificates of a domain, which were revoked and deleted from the certificate cache.
+		if len(fields) != 2 {
+			return "", errors.New("usage: forget-certificate <domain>")
+		}
+		domain, err := idna.Lookup.ToASCII(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid domain: %s", fields[1])
+		}
+		parentToChildCh <- Command{Type: cmdForgetCertificate, Name: domain}
+		return "forget sent to child", nil
+
+	case "client-ca":
+		// Replace the client CA bundle of a domain.
+		if len(fields) != 3 {
+			return "", errors.New("usage: client-ca <domain> <base64 encoded PEM bundle>")
+		}
+		domain, err := idna.Lookup.ToASCII(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid domain: %s", fields[1])
+		}
+		data, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 data: %v", err)
+		}
+		if err := uploadClientCABundle(cache, domain, data); err != nil {
+			return "", err
+		}
+		return "client CA bundle stored and sent to child", nil
+	}
+
+	return "", fmt.Errorf("unknown command: %s", fields[0])
+}
+
+// adminRequest sends a command to the admin socket of the running server and returns the answer.
+func adminRequest(command string) (string, error) {
+	if config.AdminSocket == "" {
+		return "", errors.New("admin-socket is not configured")
+	}
+	return socketRequest(config.AdminSocket, command)
+}
+
+// socketRequest sends a command to the admin or tenant socket at the path and returns the answer.
+func socketRequest(path string, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+
+	if strings.HasPrefix(answer, "error:") {
+		return "", errors.New(strings.TrimSpace(strings.TrimPrefix(answer, "error:")))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(answer, "ok:")), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"matscheko.eu/sslserver/filecache"
+)
+
+// Domains with auto-index get a generated listing for the requests of directories (URL paths that end with "/")
+// that have no index file (see index-files). The listing contains the subdirectories and the files that can be requested, with
+// their sizes and modification times. It is read from the web root, or from the cache if the web root can not be
+// read (e.g. in the jail). The listing is rendered with a built-in template, which can be replaced per domain.
+
+// matchDirectoryPath matches the URL paths of directories, with the same names as matchPath.
+var matchDirectoryPath = regexp.MustCompile(`^(/[a-zA-Z0-9_-]+)*/$`).MatchString
+
+// matchDirectoryName matches the names of the subdirectories that are listed.
+var matchDirectoryName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`).MatchString
+
+// autoIndexTemplate is the built-in template of the directory listings.
+var autoIndexTemplate = template.Must(template.New("auto-index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Directory}}</title>
+<style>body{font-family:sans-serif}td,th{padding:0.2em 1em;text-align:left}td.size{text-align:right}</style>
+</head>
+<body>
+<h1>Index of {{.Directory}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if ne .Directory "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Path}}">{{.Name}}</a></td><td class="size">{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.Modified}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// autoIndexTemplates are the templates of the auto-index-template settings by file name.
+var autoIndexTemplates = map[string]*template.Template{}
+
+// autoIndexEntry is a row of a directory listing.
+type autoIndexEntry struct {
+	Path     string // URL path of the file or subdirectory
+	Name     string // Name of the file, or of the subdirectory with a trailing "/"
+	IsDir    bool
+	Size     int64
+	Modified string // Modification time in RFC 3339 format, or empty if it is unknown
+}
+
+// loadAutoIndexTemplate parses the template file of an auto-index-template setting. The templates are parsed
+// before the jail, because the file is usually not in the web root.
+func loadAutoIndexTemplate(file string) error {
+	if _, ok := autoIndexTemplates[file]; ok || file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	t, err := template.New(file).Parse(string(data))
+	if err != nil {
+		return err
+	}
+	autoIndexTemplates[file] = t
+	return nil
+}
+
+// autoIndexEntries returns the subdirectories and files of the directory with the URL path. ok is false if the
+// directory does not exist.
+func autoIndexEntries(domain, directory string) (entries []autoIndexEntry, ok bool) {
+	dirEntries, err := fs.ReadDir(webFiles.Origin, domain+strings.TrimSuffix(directory, "/"))
+	if err != nil {
+		return cachedAutoIndexEntries(domain, directory)
+	}
+	for _, d := range dirEntries {
+		// Symbolic links are not served.
+		if d.Type()&fs.ModeSymlink != 0 {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		entry := autoIndexEntry{
+			Path:     directory + d.Name(),
+			Name:     d.Name(),
+			IsDir:    d.IsDir(),
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC().Format(time.RFC3339),
+		}
+		if entry.IsDir {
+			if !matchDirectoryName(d.Name()) {
+				continue
+			}
+			entry.Path += "/"
+			entry.Name += "/"
+		} else if !matchPath(entry.Path) {
+			// Files that can not be requested are not listed.
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, true
+}
+
+// cachedAutoIndexEntries returns the subdirectories and files of the directory with the URL path from the cache.
+// The modification times of the subdirectories are not known.
+func cachedAutoIndexEntries(domain, directory string) (entries []autoIndexEntry, ok bool) {
+	prefix := domain + directory
+	directories := map[string]bool{}
+	webFiles.Range(func(key string, entry filecache.Entry, inMemory bool) {
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		ok = true
+		name := strings.TrimPrefix(key, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[:i]
+			if !directories[name] && matchDirectoryName(name) {
+				directories[name] = true
+				entries = append(entries, autoIndexEntry{Path: directory + name + "/", Name: name + "/", IsDir: true})
+			}
+			return
+		}
+		if matchPath(directory + name) {
+			entries = append(entries, autoIndexEntry{
+				Path:     directory + name,
+				Name:     name,
+				Size:     entry.Size,
+				Modified: entry.ModTime.UTC().Format(time.RFC3339),
+			})
+		}
+	})
+	return entries, ok
+}
+
+// serveAutoIndex renders the listing of the directory with the URL path.
+func serveAutoIndex(w http.ResponseWriter, r *http.Request, domain, directory string, settings domainSettings) {
+	entries, ok := autoIndexEntries(domain, directory)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Subdirectories first, then the files, each sorted by name.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	t := autoIndexTemplate
+	if settings.autoIndexTemplate != "" {
+		t = autoIndexTemplates[settings.autoIndexTemplate]
+	}
+
+	addHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// The listing is streamed to the client while it is rendered.
+	err := t.Execute(w, struct {
+		Domain    string
+		Directory string
+		Entries   []autoIndexEntry
+	}{domain, directory, entries})
+	if err != nil {
+		log.Println("Could not render directory listing:", err)
+	}
+}
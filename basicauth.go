@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Basic authentication rules protect URL path prefixes of the domains with HTTP Basic authentication. The users and
+// their bcrypt password hashes are read from htpasswd files (e.g. created with "htpasswd -B"), when the config is
+// loaded, so before the child is jailed. The first rule whose path matches the URL path wins, and it is checked
+// before all other handling of the request, so that it also protects the redirects, the proxy rules, and the
+// scripts.
+//
+// bcrypt is slow on purpose, so the credentials that were verified are remembered for a while. Clients with too many
+// failed attempts are answered with 429 Too Many Requests until the lockout period has passed.
+
+// basicAuthVerifiedTTL is the time for which verified credentials are remembered.
+const basicAuthVerifiedTTL = 5 * time.Minute
+
+// basicAuthDummyHash is compared with the passwords of unknown users, so that they take as long as known users. It
+// is created on first use.
+var basicAuthDummyHash []byte
+var basicAuthDummyHashOnce sync.Once
+
+// BasicAuthRule protects a URL path prefix with the users of an htpasswd file.
+type BasicAuthRule struct {
+	// URL path prefix, e.g. "/admin/" or "/" for all requests of the domain.
+	Path string `yaml:"path"`
+
+	// The htpasswd file with bcrypt password hashes. It must not be inside the web root.
+	HtpasswdFile string `yaml:"htpasswd-file"`
+
+	// The realm that the browsers show in the login dialog.
+	Realm string `yaml:"realm,omitempty"`
+
+	users    map[string][]byte // The password hashes by user name.
+	verified *sync.Map         // The time until which the hashes of verified credentials are remembered.
+}
+
+// matches returns true if the URL path is the path of the rule or starts with it.
+func (rule BasicAuthRule) matches(urlPath string) bool {
+	prefix := strings.TrimSuffix(rule.Path, "/")
+	return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") || rule.Path == "/"
+}
+
+// basicAuthFailure counts the failed attempts of a client within the lockout period.
+type basicAuthFailure struct {
+	count int
+	first time.Time
+}
+
+var basicAuthFailuresMu sync.Mutex
+var basicAuthFailures = map[string]*basicAuthFailure{}
+
+// checkBasicAuthRules returns an error if a rule is invalid, and reads the htpasswd files of the rules. Rules without
+// realm get "Restricted".
+func checkBasicAuthRules(rules []BasicAuthRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		clean := path.Clean(rule.Path)
+		if !strings.HasPrefix(rule.Path, "/") || (rule.Path != clean && rule.Path != clean+"/") {
+			return fmt.Errorf("the path '%s' must be a clean URL path", rule.Path)
+		}
+		if rule.Realm == "" {
+			rule.Realm = "Restricted"
+		}
+		if strings.ContainsAny(rule.Realm, "\"\\\r\n") {
+			return fmt.Errorf("the realm of '%s' must not contain quotes, backslashes, or line breaks", rule.Path)
+		}
+		if rule.HtpasswdFile == "" {
+			return fmt.Errorf("the rule for '%s' has no htpasswd-file", rule.Path)
+		}
+		if isInsideDir(rule.HtpasswdFile, config.WebRootDirectory) {
+			return fmt.Errorf("the htpasswd-file %s of '%s' is inside the web root, where it would be served", rule.HtpasswdFile, rule.Path)
+		}
+		users, err := readHtpasswdFile(rule.HtpasswdFile)
+		if err != nil {
+			return fmt.Errorf("the htpasswd-file of '%s' can not be read: %v", rule.Path, err)
+		}
+		rule.users = users
+		rule.verified = &sync.Map{}
+	}
+	return nil
+}
+
+// readHtpasswdFile returns the bcrypt password hashes of the users in the htpasswd file. Lines with other hashes are
+// logged and skipped.
+func readHtpasswdFile(name string) (map[string][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			log.Printf("Warning: %s line %d: invalid line, skipped", name, lineNumber)
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			log.Printf("Warning: %s line %d: user %s has no bcrypt hash (create it with htpasswd -B), skipped", name, lineNumber, user)
+			continue
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// checkBasicAuth checks the credentials of the request against the first basic authentication rule of the domain
+// that matches the URL path. If they are missing or wrong, it answers the request and returns false.
+func checkBasicAuth(w http.ResponseWriter, r *http.Request, urlPath string, settings domainSettings) bool {
+	for _, rule := range settings.basicAuth {
+		if !rule.matches(urlPath) {
+			continue
+		}
+		clientIP, _, err := net.SplitHostPort(logAddr(r.RemoteAddr))
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		if retryAfter := basicAuthLockout(clientIP); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return false
+		}
+
+		user, password, ok := r.BasicAuth()
+		if ok && rule.verify(user, password) {
+			return true
+		}
+		if ok {
+			log.Println("Basic authentication failed:", clientIP, strconv.Quote(user))
+			recordBasicAuthFailure(clientIP)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+rule.Realm+`", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// verify returns true if the password of the user matches its hash.
+func (rule BasicAuthRule) verify(user, password string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	now := time.Now()
+	if until, ok := rule.verified.Load(key); ok && now.Before(until.(time.Time)) {
+		return true
+	}
+
+	hash, ok := rule.users[user]
+	if !ok {
+		// Unknown users take as long as known users.
+		basicAuthDummyHashOnce.Do(func() {
+			basicAuthDummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(basicAuthDummyHash, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	rule.verified.Store(key, now.Add(basicAuthVerifiedTTL))
+	return true
+}
+
+// basicAuthLockout returns the remaining lockout time of the client, or 0.
+func basicAuthLockout(clientIP string) time.Duration {
+	basicAuthFailuresMu.Lock()
+	defer basicAuthFailuresMu.Unlock()
+	failure := basicAuthFailures[clientIP]
+	if failure == nil || failure.count < config.BasicAuthMaxFailures {
+		return 0
+	}
+	return time.Until(failure.first.Add(config.BasicAuthLockout))
+}
+
+// recordBasicAuthFailure counts a failed attempt of the client. The failures are counted from the first failure
+// until the lockout period has passed.
+func recordBasicAuthFailure(clientIP string) {
+	basicAuthFailuresMu.Lock()
+	defer basicAuthFailuresMu.Unlock()
+	now := time.Now()
+	failure := basicAuthFailures[clientIP]
+	if failure == nil || now.Sub(failure.first) > config.BasicAuthLockout {
+		if len(basicAuthFailures) >= 10000 {
+			// Forget the clients whose lockout period has passed.
+			for ip, f := range basicAuthFailures {
+				if now.Sub(f.first) > config.BasicAuthLockout {
+					delete(basicAuthFailures, ip)
+				}
+			}
+		}
+		failure = &basicAuthFailure{first: now}
+		basicAuthFailures[clientIP] = failure
+	}
+	failure.count++
+	if failure.count == config.BasicAuthMaxFailures {
+		log.Println("Basic authentication: locked out", clientIP, "for", (config.BasicAuthLockout - now.Sub(failure.first)).Round(time.Second))
+	}
+}
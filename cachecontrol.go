@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The Cache-Control header of a file is selected by the cache-control rules of its domain. The first rule whose
+// pattern matches the URL path wins. Patterns with a slash are matched against the whole URL path (e.g. "/assets/*"),
+// patterns without a slash against the file name (e.g. "*.html"). Files that match no rule get no Cache-Control
+// header, and the browsers and CDNs decide themselves, based on Last-Modified, how long they cache them.
+
+// CacheControlRule sets the Cache-Control header of the files that match the pattern.
+type CacheControlRule struct {
+	// Glob pattern (see path.Match) of the URL path, or of the file name if it has no slash.
+	Path string `yaml:"path"`
+
+	// Value of the Cache-Control header, e.g. "no-cache" or "public, max-age=31536000, immutable".
+	Value string `yaml:"value"`
+}
+
+// matches returns true if the pattern of the rule matches the URL path.
+func (rule CacheControlRule) matches(urlPath string) bool {
+	name := urlPath
+	if !strings.Contains(rule.Path, "/") {
+		name = path.Base(urlPath)
+	}
+	matched, _ := path.Match(rule.Path, name)
+	return matched
+}
+
+// checkCacheControlRules returns an error if a pattern is invalid, or if a value is empty or spans lines.
+func checkCacheControlRules(rules []CacheControlRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Path, ""); err != nil || rule.Path == "" {
+			return fmt.Errorf("the path '%s' is not a valid pattern", rule.Path)
+		}
+		if strings.TrimSpace(rule.Value) == "" || strings.ContainsAny(rule.Value, "\r\n") {
+			return errors.New("the value of '" + rule.Path + "' must not be empty and must be on one line")
+		}
+	}
+	return nil
+}
+
+// setCacheControl sets the Cache-Control header of the first rule that matches the URL path.
+func setCacheControl(w http.ResponseWriter, urlPath string, settings domainSettings) {
+	for _, rule := range settings.cacheControl {
+		if rule.matches(urlPath) {
+			w.Header().Set("Cache-Control", rule.Value)
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Host names are compared in their canonical form: lower case ASCII (Punycode), without the trailing dot of a
+// fully qualified name. So example.com., EXAMPLE.com and example.com are the same virtual host, use the same
+// files, and get the same certificate instead of a 404 or a second certificate cache entry.
+
+// canonicalHost returns the canonical form of the host name (without port).
+func canonicalHost(host string) (string, error) {
+	// The lookup profile maps the name to lower case, and keeps the trailing dot.
+	asciiHost, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(asciiHost, "."), nil
+}
+
+// canonicalHostHandler redirects requests with a host name that is not in its canonical form to the canonical URL,
+// if canonical-host-redirect is enabled. Unknown hosts are not redirected.
+func canonicalHostHandler(next http.Handler) http.Handler {
+	if !config.CanonicalHostRedirect {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port := r.Host, ""
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+		canonical, err := canonicalHost(host)
+		if err != nil || canonical == host || !isAllowedDomain(canonical) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if port != "" {
+			canonical = net.JoinHostPort(canonical, port)
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		// Other methods than GET and HEAD must be repeated with the same method and body.
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, scheme+"://"+canonical+r.URL.RequestURI(), code)
+	})
+}
@@ -0,0 +1,285 @@
+// Package certchain gets TLS certificates from a chain of sources, e.g. ACME, then certificate files, then
+// self-signed certificates. The first source that returns a certificate wins. Certificates are cached in memory
+// until they have to be renewed, and persistent data is stored in an autocert.Cache, so that any storage that
+// implements it can be used: a directory (autocert.DirCache), or a cache that forwards to another process.
+//
+// Servers that need more than the sources, like the sslserver, can keep the certificates in their own Memory,
+// serve another certificate to some clients with a Variant, and renew certificates in the background with
+// RenewInBackground. Concurrent handshakes for the same certificate wait for one call of the sources.
+//
+// Example:
+//
+//	manager := &autocert.Manager{Prompt: autocert.AcceptTOS, Cache: cache, HostPolicy: autocert.HostWhitelist("example.com")}
+//	chain := &certchain.Chain{
+//		Sources: []certchain.Source{
+//			manager,
+//			&certchain.FileSource{CertFile: "example.crt", KeyFile: "example.key"},
+//			&certchain.SelfSigned{Cache: cache, Validity: 14 * 24 * time.Hour},
+//		},
+//		RenewBefore: 48 * time.Hour,
+//	}
+//	server := &http.Server{TLSConfig: &tls.Config{GetCertificate: chain.GetCertificate}}
+package certchain
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// Source returns a certificate for the handshake. *autocert.Manager is a Source.
+type Source interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// SourceFunc is a function that is used as a Source.
+type SourceFunc func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// GetCertificate calls the function.
+func (f SourceFunc) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f(hello)
+}
+
+// Memory holds the certificates of a Chain in memory under their keys (the server name and the variant).
+// Put with a nil certificate removes the certificate.
+type Memory interface {
+	Get(key string) *tls.Certificate
+	Put(key string, cert *tls.Certificate)
+}
+
+// mapMemory is the Memory of a Chain without its own Memory.
+type mapMemory struct {
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func (m *mapMemory) Get(key string) *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.certs[key]
+}
+
+func (m *mapMemory) Put(key string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.certs == nil {
+		m.certs = map[string]*tls.Certificate{}
+	}
+	m.certs[key] = cert
+}
+
+// flight is a running call of the sources, for which the concurrent handshakes wait.
+type flight struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// Chain tries its sources one after the other, until one of them returns a certificate.
+type Chain struct {
+	// The sources in the order in which they are tried.
+	Sources []Source
+
+	// Certificates are taken from the sources again, if they expire within this duration.
+	RenewBefore time.Duration
+
+	// Tolerated difference between the system clock and the real time when the validity of certificates is evaluated.
+	Leeway time.Duration
+
+	// The server name that is used for clients that do not send one (SNI). Empty means that the handshake fails.
+	DefaultServerName string
+
+	// Variant returns a suffix of the memory key for handshakes that get another certificate than the other
+	// handshakes for the server name, e.g. "+rsa" for clients without ECDSA support. Nil means no variants.
+	Variant func(hello *tls.ClientHelloInfo) string
+
+	// Memory holds the certificates in memory. Nil means that the Chain holds them itself.
+	Memory Memory
+
+	// RenewInBackground is called with the handshake for a cached certificate that is still valid, but expires
+	// within RenewBefore. If it returns true, the handshake gets the cached certificate, and the function renews
+	// it, e.g. in a goroutine. Nil or false means that the handshake gets a certificate from the sources.
+	RenewInBackground func(hello *tls.ClientHelloInfo, cert *tls.Certificate) bool
+
+	mu      sync.Mutex
+	memory  mapMemory
+	flights map[string]*flight
+}
+
+// certs returns the Memory of the chain.
+func (c *Chain) certs() Memory {
+	if c.Memory != nil {
+		return c.Memory
+	}
+	return &c.memory
+}
+
+// GetCertificate returns the cached certificate for the server name of the handshake, or gets it from the sources.
+// It can be used as tls.Config.GetCertificate.
+func (c *Chain) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		name = c.DefaultServerName
+	}
+	name, err := NormalizeServerName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sources get the normalized server name.
+	normalized := *hello
+	normalized.ServerName = name
+	key := name
+	if c.Variant != nil {
+		key += c.Variant(&normalized)
+	}
+
+	if cert := c.Cached(&normalized); cert != nil {
+		return cert, nil
+	}
+	return c.SingleFlight(hello.Context(), key, func() (*tls.Certificate, error) {
+		// Another call of the sources can have finished after the memory was checked.
+		if cert := c.Cached(&normalized); cert != nil {
+			return cert, nil
+		}
+		return c.fromSources(&normalized, key)
+	})
+}
+
+// Cached returns the certificate for the handshake from the memory, if it does not need to be renewed yet, or if
+// RenewInBackground renews it. The server name of the handshake must be normalized.
+func (c *Chain) Cached(hello *tls.ClientHelloInfo) *tls.Certificate {
+	key := hello.ServerName
+	if c.Variant != nil {
+		key += c.Variant(hello)
+	}
+	cert := c.certs().Get(key)
+	if cert == nil || parseLeaf(cert) != nil || !ValidAt(cert.Leaf, time.Now(), c.Leeway) {
+		return nil
+	}
+	if !NeedsRenewal(cert.Leaf, c.RenewBefore, c.Leeway) {
+		return cert
+	}
+	if c.RenewInBackground != nil && c.RenewInBackground(hello, cert) {
+		return cert
+	}
+	return nil
+}
+
+// fromSources gets the certificate for the handshake from the sources, and stores it in the memory under the key.
+func (c *Chain) fromSources(hello *tls.ClientHelloInfo, key string) (*tls.Certificate, error) {
+	var errs []string
+	for _, source := range c.Sources {
+		cert, err := source.GetCertificate(hello)
+		if err == nil {
+			err = parseLeaf(cert)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		c.certs().Put(key, cert)
+		return cert, nil
+	}
+
+	// Use the cached certificate as long as it is valid, if no source can renew it.
+	if cached := c.certs().Get(key); cached != nil && parseLeaf(cached) == nil && ValidAt(cached.Leaf, time.Now(), c.Leeway) {
+		return cached, nil
+	}
+	return nil, fmt.Errorf("certchain: no certificate for %s: %s", key, strings.Join(errs, "; "))
+}
+
+// SingleFlight calls obtain for the key, unless a call for the key is already running. Then it waits for the
+// running call and returns its result. Waiting calls stop when the context ends (nil means that they do not), but
+// the running call continues. GetCertificate uses the memory key as key, so that a renewal of a certificate in the
+// background can share the call with the handshakes.
+func (c *Chain) SingleFlight(ctx context.Context, key string, obtain func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if running, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		select {
+		case <-running.done:
+			return running.cert, running.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	running := &flight{done: make(chan struct{}), err: errors.New("certchain: no certificate for: " + key)}
+	if c.flights == nil {
+		c.flights = map[string]*flight{}
+	}
+	c.flights[key] = running
+	c.mu.Unlock()
+
+	// The waiting calls get the result, even if obtain panics.
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(running.done)
+	}()
+	cert, err := obtain()
+	running.cert, running.err = cert, err
+	return cert, err
+}
+
+// Forget removes the cached certificate of the memory key, so that the next handshake gets it from the sources.
+func (c *Chain) Forget(key string) {
+	c.certs().Put(key, nil)
+}
+
+// parseLeaf parses the leaf of the certificate, if it is not parsed yet.
+func parseLeaf(cert *tls.Certificate) error {
+	if cert == nil {
+		return errors.New("certchain: no certificate")
+	}
+	if cert.Leaf != nil {
+		return nil
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("certchain: empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	return nil
+}
+
+// NormalizeServerName converts the server name to lower case ASCII (Punycode) without a trailing dot.
+// Some clients (such as cURL) do not convert the server names in the handshake to Punycode, and example.com and
+// EXAMPLE.COM have to get the same certificate. Due to the "σςΣ" problem (see https://unicode.org/faq/idn.html#22),
+// idna.Lookup is used instead of idna.Punycode.
+func NormalizeServerName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("certchain: missing server name")
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("certchain: server name contains invalid character: %s", name)
+	}
+	// A fully qualified name (example.com.) gets the certificate of the name without the trailing dot.
+	return strings.TrimSuffix(ascii, "."), nil
+}
+
+// ValidAt returns true if the certificate is valid at the given time, with the clock skew leeway on both sides.
+func ValidAt(leaf *x509.Certificate, now time.Time, leeway time.Duration) bool {
+	return !now.Before(leaf.NotBefore.Add(-leeway)) && now.Before(leaf.NotAfter.Add(leeway))
+}
+
+// NeedsRenewal returns true if the certificate expires within the renewal threshold.
+// The leeway is added to the threshold, so that the certificate is rather renewed too early than too late.
+func NeedsRenewal(leaf *x509.Certificate, threshold, leeway time.Duration) bool {
+	return time.Until(leaf.NotAfter) < threshold+leeway
+}
@@ -0,0 +1,181 @@
+package certchain
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestChainEmptyCertificate checks that a source that returns a certificate without chain is skipped.
+func TestChainEmptyCertificate(t *testing.T) {
+	chain := &Chain{Sources: []Source{
+		SourceFunc(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{}, nil
+		}),
+		&SelfSigned{Validity: time.Hour},
+	}}
+	cert, err := chain.GetCertificate(&tls.ClientHelloInfo{ServerName: "Example.COM."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("example.com"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestChainVariants checks that the variants of a server name get their own certificates, and that concurrent
+// handshakes for the same certificate wait for one call of the sources.
+func TestChainVariants(t *testing.T) {
+	var calls int32
+	selfSigned := &SelfSigned{Validity: time.Hour}
+	chain := &Chain{
+		Sources: []Source{SourceFunc(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(50 * time.Millisecond)
+			return selfSigned.GetCertificate(hello)
+		})},
+		Variant: func(hello *tls.ClientHelloInfo) string {
+			if hello.CipherSuites != nil {
+				return "+rsa"
+			}
+			return ""
+		},
+	}
+
+	certs := make([]*tls.Certificate, 10)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+			if i%2 == 1 {
+				hello.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+			}
+			cert, err := chain.GetCertificate(hello)
+			if err != nil {
+				t.Error(err)
+			}
+			certs[i] = cert
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 2 {
+		t.Errorf("the sources were called %d times, want 2", calls)
+	}
+	for i := range certs {
+		if certs[i] != certs[i%2] {
+			t.Errorf("handshake %d got another certificate than handshake %d", i, i%2)
+		}
+	}
+	if certs[0] == certs[1] {
+		t.Error("the variants got the same certificate")
+	}
+}
+
+// TestChainKeepsValidCertificate checks that a cached certificate that needs to be renewed is used while it is
+// valid, if no source can renew it, and that RenewInBackground can keep it without asking the sources.
+func TestChainKeepsValidCertificate(t *testing.T) {
+	failing := false
+	selfSigned := &SelfSigned{Validity: time.Hour}
+	chain := &Chain{
+		Sources: []Source{SourceFunc(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if failing {
+				return nil, errors.New("source is down")
+			}
+			return selfSigned.GetCertificate(hello)
+		})},
+		RenewBefore: 2 * time.Hour,
+	}
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	cert, err := chain.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing = true
+	if got, err := chain.GetCertificate(hello); err != nil || got != cert {
+		t.Errorf("got %v, %v, want the cached certificate", got, err)
+	}
+
+	renewed := false
+	chain.RenewInBackground = func(hello *tls.ClientHelloInfo, cert *tls.Certificate) bool {
+		renewed = true
+		return true
+	}
+	if got := chain.Cached(hello); got != cert || !renewed {
+		t.Errorf("got %v with renewal %t, want the cached certificate with renewal", got, renewed)
+	}
+
+	chain.Forget("example.com")
+	if _, err := chain.GetCertificate(hello); err == nil {
+		t.Error("got a certificate from the failing source")
+	}
+}
+
+// memoryCache is an autocert.Cache in memory.
+type memoryCache map[string][]byte
+
+func (c memoryCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, ok := c[name]
+	if !ok {
+		return nil, errors.New("cache miss")
+	}
+	return data, nil
+}
+
+func (c memoryCache) Put(ctx context.Context, name string, data []byte) error {
+	c[name] = data
+	return nil
+}
+
+func (c memoryCache) Delete(ctx context.Context, name string) error {
+	delete(c, name)
+	return nil
+}
+
+// TestSelfSignedIssuer checks that the certificates are signed by the Issuer, and that a persisted certificate is
+// replaced when the Issuer is set or removed.
+func TestSelfSignedIssuer(t *testing.T) {
+	cache := memoryCache{}
+	ca, err := (&SelfSigned{Validity: 24 * time.Hour}).Create("ca.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Leaf.IsCA, ca.Leaf.KeyUsage = true, x509.KeyUsageCertSign
+	issuer := func() (*x509.Certificate, crypto.Signer, error) {
+		return ca.Leaf, ca.PrivateKey.(crypto.Signer), nil
+	}
+
+	s := &SelfSigned{Cache: cache, Validity: time.Hour}
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	selfSigned, err := s.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := s.GetCertificate(hello); err != nil || !again.Leaf.Equal(selfSigned.Leaf) {
+		t.Errorf("the persisted certificate was not used: %v", err)
+	}
+
+	s.Issuer = issuer
+	signed, err := s.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Leaf.Equal(selfSigned.Leaf) || len(signed.Certificate) != 2 {
+		t.Fatal("the certificate was not replaced by one of the issuer with the chain")
+	}
+	if err := signed.Leaf.CheckSignatureFrom(ca.Leaf); err != nil {
+		t.Error(err)
+	}
+	if signed.Leaf.NotAfter.After(ca.Leaf.NotAfter) {
+		t.Error("the certificate outlives the issuer")
+	}
+}
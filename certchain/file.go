@@ -0,0 +1,65 @@
+package certchain
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSource returns the certificate from PEM files, if it is valid for the server name.
+// The files are read again when they change.
+type FileSource struct {
+	// The PEM file with the certificate chain, and the PEM file with the private key (it can be the same file).
+	CertFile string
+	KeyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate returns the certificate of the files.
+func (f *FileSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.Leaf.VerifyHostname(hello.ServerName); err != nil {
+		return nil, fmt.Errorf("certchain: %s is not valid for %s", f.CertFile, hello.ServerName)
+	}
+	return cert, nil
+}
+
+// load reads the files, if they changed since they were read last.
+func (f *FileSource) load() (*tls.Certificate, error) {
+	certInfo, err := os.Stat(f.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	modTime := certInfo.ModTime()
+	if keyInfo.ModTime().After(modTime) {
+		modTime = keyInfo.ModTime()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cert != nil && f.modTime.Equal(modTime) {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseLeaf(&cert); err != nil {
+		return nil, err
+	}
+	f.cert, f.modTime = &cert, modTime
+	return f.cert, nil
+}
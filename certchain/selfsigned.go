@@ -0,0 +1,243 @@
+package certchain
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// SelfSignedSuffix is appended to the server name for the name of a self-signed certificate in the cache.
+const SelfSignedSuffix = "+self-signed"
+
+// SelfSigned creates self-signed certificates and persists them in the cache, so that a restart does not create
+// new keys. A certificate is valid for Validity plus RenewBefore of the Chain, so that the old certificate is
+// still valid while it is replaced.
+type SelfSigned struct {
+	// The cache for the certificates. They are stored under "<server name>+self-signed". Nil means that they are not persisted.
+	Cache autocert.Cache
+
+	// The interval in which new certificates are created.
+	Validity time.Duration
+
+	// The additional validity after Validity. It should be the RenewBefore of the Chain.
+	RenewBefore time.Duration
+
+	// Certificates are backdated by the leeway, for clients with a wrong clock.
+	Leeway time.Duration
+
+	// The organization in the subject. Empty means "certchain".
+	Organization string
+
+	// HostPolicy returns an error for server names that must not get a certificate. Nil allows all server names.
+	HostPolicy autocert.HostPolicy
+
+	// NewKey creates the private key for the certificate with the cache name, and returns it with its PEM encoding.
+	// Nil means P-256 keys.
+	NewKey func(ctx context.Context, name string) (crypto.Signer, []byte, error)
+
+	// ParseKeyPair parses the certificate chain and the private key from the PEM data in the cache. It is needed
+	// for keys whose PEM block only refers to the key, e.g. in a key management service. Nil means tls.X509KeyPair.
+	ParseKeyPair func(data []byte) (tls.Certificate, error)
+
+	// KeyStored is called after a certificate with a key of NewKey is stored in the cache, and KeyUnused if no
+	// certificate with the key could be created or stored, e.g. to delete keys in a key management service.
+	KeyStored func(ctx context.Context, name string, key crypto.Signer)
+	KeyUnused func(ctx context.Context, name string, key crypto.Signer)
+
+	// Issuer returns the certificate and the key of a CA that signs the certificates, e.g. a local development CA.
+	// The certificates do not outlive the CA. Nil means that the certificates are signed by their own key.
+	Issuer func() (*x509.Certificate, crypto.Signer, error)
+
+	// Accept returns false for a persisted certificate that has to be replaced before it expires, e.g. because
+	// its CA was replaced. Nil accepts all certificates of the Issuer.
+	Accept func(leaf *x509.Certificate) bool
+}
+
+// GetCertificate returns the persisted certificate for the server name, or creates a new one.
+func (s *SelfSigned) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := context.Background()
+	name := hello.ServerName
+	if name == "" {
+		return nil, errors.New("certchain: missing server name")
+	}
+	if s.HostPolicy != nil {
+		if err := s.HostPolicy(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if cert := s.load(ctx, name); cert != nil {
+		return cert, nil
+	}
+	return s.Create(name)
+}
+
+// load returns the persisted certificate for the server name, if it does not have to be replaced yet.
+func (s *SelfSigned) load(ctx context.Context, name string) *tls.Certificate {
+	if s.Cache == nil {
+		return nil
+	}
+	data, err := s.Cache.Get(ctx, name+SelfSignedSuffix)
+	if err != nil {
+		return nil
+	}
+	cert, err := s.parseKeyPair(data)
+	if err != nil || parseLeaf(&cert) != nil {
+		return nil
+	}
+	leaf := cert.Leaf
+	if !ValidAt(leaf, time.Now(), s.Leeway) || NeedsRenewal(leaf, s.RenewBefore, s.Leeway) {
+		return nil
+	}
+
+	// Replace the certificate if the Issuer was set or removed since it was created.
+	if (s.Issuer == nil) != bytes.Equal(leaf.RawIssuer, leaf.RawSubject) {
+		return nil
+	}
+	// Replace certificates without subject alternative names, and certificates with another organization.
+	if len(leaf.DNSNames) == 0 && len(leaf.IPAddresses) == 0 {
+		return nil
+	}
+	if len(leaf.Subject.Organization) != 1 || leaf.Subject.Organization[0] != s.organization() {
+		return nil
+	}
+	if s.Accept != nil && !s.Accept(leaf) {
+		return nil
+	}
+	return &cert
+}
+
+// Create creates a certificate with a new key for the server name and persists it, also if the persisted
+// certificate is still valid.
+func (s *SelfSigned) Create(name string) (*tls.Certificate, error) {
+	ctx := context.Background()
+	key, keyPEM, err := s.newKey(ctx, name+SelfSignedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	used := false
+	defer func() {
+		if s.KeyUnused != nil && !used {
+			s.KeyUnused(ctx, name+SelfSignedSuffix, key)
+		}
+	}()
+
+	certPEM, err := s.create(name, key)
+	if err != nil {
+		return nil, err
+	}
+	data := append(keyPEM, certPEM...)
+	cert, err := s.parseKeyPair(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseLeaf(&cert); err != nil {
+		return nil, err
+	}
+	if s.Cache != nil {
+		if err := s.Cache.Put(ctx, name+SelfSignedSuffix, data); err != nil {
+			return nil, err
+		}
+		if s.KeyStored != nil {
+			s.KeyStored(ctx, name+SelfSignedSuffix, key)
+		}
+	}
+	used = true
+	return &cert, nil
+}
+
+// newKey creates the private key for the certificate with the cache name.
+func (s *SelfSigned) newKey(ctx context.Context, name string) (crypto.Signer, []byte, error) {
+	if s.NewKey != nil {
+		return s.NewKey(ctx, name)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// parseKeyPair parses the certificate chain and the private key from the PEM data.
+func (s *SelfSigned) parseKeyPair(data []byte) (tls.Certificate, error) {
+	if s.ParseKeyPair != nil {
+		return s.ParseKeyPair(data)
+	}
+	return tls.X509KeyPair(data, data)
+}
+
+// organization returns the organization in the subject of the certificates.
+func (s *SelfSigned) organization() string {
+	if s.Organization == "" {
+		return "certchain"
+	}
+	return s.Organization
+}
+
+// create returns a certificate for the server name and the key as PEM blocks, followed by the certificate of the
+// Issuer, if there is one.
+func (s *SelfSigned) create(name string, key crypto.Signer) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{s.organization()}},
+		NotBefore:             now.Add(-s.Leeway),
+		NotAfter:              now.Add(s.Validity + s.RenewBefore),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if _, ok := key.Public().(*rsa.PublicKey); ok {
+		// Clients with the RSA key exchange encrypt the premaster secret with the key.
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	parent, signer := &template, key
+	if s.Issuer != nil {
+		if parent, signer, err = s.Issuer(); err != nil {
+			return nil, err
+		}
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if s.Issuer != nil {
+		// Send the certificate of the CA with the chain.
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: parent.Raw})...)
+	}
+	return data, nil
+}
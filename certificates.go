@@ -2,20 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
-	"math/big"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/idna"
+	"matscheko.eu/sslserver/certchain"
 )
 
 // The white list of domains for self signed certificates.
@@ -27,9 +24,26 @@ var certCache map[string]*tls.Certificate = nil
 // certCacheBytes holds the cached PEM-encoded Let's Encrypt TLS certificates.
 var certCacheBytes map[string][]byte = nil
 
+// certCacheMu guards certCache and certCacheBytes, which are also updated by certificates that the parent pushes.
+var certCacheMu sync.Mutex
+
+// certificateChain gets the certificates for the handshakes, and selfSignedCertificates creates the self-signed ones.
+var certificateChain *certchain.Chain = nil
+var selfSignedCertificates *certchain.SelfSigned = nil
+
 // Create a new autocert manager.
 var m *autocert.Manager = nil
 
+// autocertIssuer is the autocert manager that gets the certificates. It has the settings of m, but it is replaced
+// when a certificate is revoked, because autocert keeps its certificates in memory and can not forget one.
+var autocertIssuer *autocert.Manager = nil
+
+// autocertIssuerMu guards autocertIssuer.
+var autocertIssuerMu sync.Mutex
+
+// dirCacheGetMu serializes the get requests to the parent, so that concurrent requests do not take each other's responses.
+var dirCacheGetMu sync.Mutex
+
 //
 // ===========================================
 //
@@ -40,11 +54,16 @@ type DirCache string
 
 // Get reads a certificate data from the specified file name.
 func (d DirCache) Get(ctx context.Context, name string) ([]byte, error) {
+	certCacheMu.Lock()
 	cert := certCacheBytes[name]
+	certCacheMu.Unlock()
 	if cert != nil {
 		return cert, nil
 	}
 
+	dirCacheGetMu.Lock()
+	defer dirCacheGetMu.Unlock()
+
 	command := Command{Type: cmdGet, Name: name}
 	childToParentCh <- command
 
@@ -63,7 +82,9 @@ func (d DirCache) Get(ctx context.Context, name string) ([]byte, error) {
 				return nil, autocert.ErrCacheMiss
 			}
 
+			certCacheMu.Lock()
 			certCacheBytes[name] = response.Data
+			certCacheMu.Unlock()
 
 			return response.Data, nil
 		default:
@@ -84,7 +105,9 @@ func (d DirCache) Put(ctx context.Context, name string, data []byte) error {
 		return errors.New("Could not store certificate: " + name)
 	}
 
+	certCacheMu.Lock()
 	certCacheBytes[name] = data
+	certCacheMu.Unlock()
 
 	command := Command{Type: cmdPut, Name: name, Data: data}
 	childToParentCh <- command
@@ -94,7 +117,9 @@ func (d DirCache) Put(ctx context.Context, name string, data []byte) error {
 
 // Delete removes the specified file name.
 func (d DirCache) Delete(ctx context.Context, name string) error {
+	certCacheMu.Lock()
 	certCacheBytes[name] = nil
+	certCacheMu.Unlock()
 
 	command := Command{Type: cmdDelete, Name: name, Data: nil}
 	childToParentCh <- command
@@ -109,6 +134,9 @@ func (d DirCache) Delete(ctx context.Context, name string) error {
 // initCertificates initializes the white list of domains for self signed certificates and also the cache for the self signed certificates.
 func initCertificates(manager *autocert.Manager) {
 	m = manager
+	autocertIssuerMu.Lock()
+	autocertIssuer = manager
+	autocertIssuerMu.Unlock()
 
 	// Initialize the white list of domains for self signed certificates.
 	allowedDomainsSelfSignedWhiteList = make(map[string]bool, len(config.SelfSignedDomains))
@@ -119,11 +147,15 @@ func initCertificates(manager *autocert.Manager) {
 	}
 
 	// Initialize the cache for the self signed certificates.
+	certCacheMu.Lock()
 	certCache = make(map[string]*tls.Certificate, len(allowedDomainsSelfSignedWhiteList))
 	certCacheBytes = make(map[string][]byte, len(config.letsEncryptDomains))
+	certCacheMu.Unlock()
+	certificateChain = newCertificateChain()
+	selfSignedCertificates = newSelfSignedCertificates()
 
 	// Initialize certificates before going to jail.
-	for serverName := range config.allDomains {
+	for _, serverName := range allowedDomains() {
 
 		_, err := MyGetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
 		if err != nil {
@@ -131,6 +163,13 @@ func initCertificates(manager *autocert.Manager) {
 			continue
 		}
 
+		// Also get the RSA certificate for old clients.
+		if config.DualCertificates && isLetsEncryptDomain(serverName) {
+			if _, err := MyGetCertificate(rsaHello(serverName)); err != nil {
+				log.Println("Error when initializing RSA certificate for:", serverName, "Error:", err)
+			}
+		}
+
 		// // Parse the certificate from a PEM-encoded byte slice.
 		// if cert.Leaf == nil {
 		// 	parsedCert, err := x509.ParseCertificate(cert.Certificate[0])
@@ -145,69 +184,35 @@ func initCertificates(manager *autocert.Manager) {
 	}
 }
 
-// GetSelfSignedCertificate creates a self-signed TLS certificate.
-func GetSelfSignedCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	name := hello.ServerName
-	if name == "" {
-		return nil, errors.New("self signed certificate: missing server name")
+// cachedCertificate reads the certificate for the domain from the certificate cache. The certificate is stored in the
+// format of autocert, which stores ECDSA certificates under the domain name and RSA certificates under "<domain>+rsa".
+func cachedCertificate(ctx context.Context, domain string) (*tls.Certificate, error) {
+	cert, err := cachedCertificateVariant(ctx, domain, "")
+	if err == autocert.ErrCacheMiss {
+		cert, err = cachedCertificateVariant(ctx, domain, rsaCertSuffix)
 	}
+	return cert, err
+}
 
-	// Note that this conversion is necessary because some server names in the handshakes
-	// started by some clients (such as cURL) are not converted to Punycode, which will
-	// prevent us from obtaining certificates for them. In addition, we should also treat
-	// example.com and EXAMPLE.COM as equivalent and return the same certificate for them.
-	// Fortunately, this conversion also helped us deal with this kind of mixedcase problems.
-	//
-	// Due to the "σςΣ" problem (see https://unicode.org/faq/idn.html#22), we can't use
-	// idna.Punycode.ToASCII (or just idna.ToASCII) here.
-	asciiName, err := idna.Lookup.ToASCII(name)
+// cachedCertificateVariant reads the certificate of the variant ("" or rsaCertSuffix) for the domain from the certificate cache.
+func cachedCertificateVariant(ctx context.Context, domain, variant string) (*tls.Certificate, error) {
+	data, err := m.Cache.Get(ctx, domain+variant)
 	if err != nil {
-		return nil, fmt.Errorf("self signed certificate: server name contains invalid character: %s", name)
+		return nil, err
 	}
-	name = asciiName
 
-	// Check if the domain name is in the white list.
-	if !allowedDomainsSelfSignedWhiteList[name] {
-		return nil, errors.New("self signed certificate: server name not in white list: " + name)
-	}
-
-	// Generate a new private key.
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	// The data contains the private key and the certificate chain as PEM blocks.
+	cert, err := parseKeyPair(data)
 	if err != nil {
-		return nil, fmt.Errorf("self signed certificate: failed to generate private key for %s: %v", name, err)
-	}
-
-	// Create a template for the certificate.
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(412294),
-		Subject: pkix.Name{
-			CommonName:   name,
-			Organization: []string{"Acme Co"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(config.CertificateExpiryRefreshThreshold + 14*24*time.Hour), // valid for two weeks plus durationToCertificateExpiryRefresh.
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+		return nil, err
 	}
-
-	// Create the certificate.
-	publicKey := &privateKey.PublicKey
-	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey, privateKey)
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		return nil, fmt.Errorf("self signed certificate: failed to create certificate for %s: %v", name, err)
+		return nil, err
 	}
-
-	// Encode the private key and certificate in PEM format.
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
-
-	// Create a TLS certificate using the PEM-encoded bytes.
-	cert, err := tls.X509KeyPair(certificatePEM, privateKeyPEM)
-	if err != nil {
-		return nil, fmt.Errorf("self signed certificate: failed to create X509 key pair: %v", err)
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		return nil, err
 	}
-
 	return &cert, nil
 }
 
@@ -220,62 +225,201 @@ func MyGetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	// Get and validate the domain name.
 	name := hello.ServerName
 	if name == "" {
-		return nil, errors.New("certificate: cannot get certificate because of missing server name")
+		// Clients without SNI, like health checkers and old scanners, get the certificate of the default domain.
+		if config.DefaultDomain == "" {
+			return nil, errors.New("certificate: cannot get certificate because of missing server name")
+		}
+		// The certificate of a domain with client authentication would show the domain to every client.
+		if settingsForDomain(config.DefaultDomain).clientAuth != clientAuthNone {
+			return nil, errors.New("certificate: cannot send the certificate of the default domain, because it uses client authentication")
+		}
+		name = config.DefaultDomain
 	}
 
-	// Convert the domain name to ASCII.
-	// Note that this conversion is necessary because some server names in the handshakes
-	// started by some clients (such as cURL) are not converted to Punycode, which will
-	// prevent us from obtaining certificates for them. In addition, we should also treat
-	// example.com and EXAMPLE.COM as equivalent and return the same certificate for them.
-	// Fortunately, this conversion also helped us deal with this kind of mixedcase problems.
-	//
-	// Due to the "σςΣ" problem (see https://unicode.org/faq/idn.html#22), we can't use
-	// idna.Punycode.ToASCII (or just idna.ToASCII) here.
-	name, err := idna.Lookup.ToASCII(name)
+	// Convert the domain name to lower case ASCII (Punycode), because some clients (such as cURL) do not
+	// convert the server names in the handshakes, and example.com and EXAMPLE.COM must get the same certificate.
+	name, err := certchain.NormalizeServerName(name)
 	if err != nil {
-		return nil, fmt.Errorf("certificate: server name contains invalid character: %s", name)
+		return nil, fmt.Errorf("certificate: server name contains invalid character: %s", hello.ServerName)
 	}
 
-	// Check the cache for an existing certificate.
-	cachedCert := certCache[name]
-	if cachedCert != nil {
-		// Parse the certificate from a PEM-encoded byte slice if not already parsed.
-		if cachedCert.Leaf == nil {
-			parsedCert, err := x509.ParseCertificate(cachedCert.Certificate[0])
-			if err != nil {
-				return nil, fmt.Errorf("certificate: error parsing cached certificate: %v", err)
-			}
-			cachedCert.Leaf = parsedCert
+	// The CA validates a TLS-ALPN-01 challenge. These handshakes must not wait for the issuance in the chain,
+	// because the issuance waits for them.
+	if isACMEChallengeHello(hello) {
+		if cert := tlsALPNChallengeCert(name); cert != nil {
+			reportACMEOrder(name, acmeChallengeTLSALPN01, acmeOrderValidating, nil)
+			return cert, nil
 		}
+		return orderCertificate(hello, name, certificateVariant(hello))
+	}
 
-		// Check certificate expiration.
-		if time.Until(cachedCert.Leaf.NotAfter) >= config.CertificateExpiryRefreshThreshold {
-			// Certificate is still valid.
-			return cachedCert, nil
-		}
+	// Prefer certificates that are provided by the operator.
+	if cert := operatorCertificate(name); cert != nil {
+		return cert, nil
+	}
+
+	normalized := *hello
+	normalized.ServerName = name
+	return certificateChain.GetCertificate(&normalized)
+}
+
+// newCertificateChain returns the chain that gets the certificates for the handshakes: from Let's Encrypt, then
+// from the certificate cache while Let's Encrypt fails, and then self-signed. It keeps the certificates in certCache.
+func newCertificateChain() *certchain.Chain {
+	return &certchain.Chain{
+		Sources: []certchain.Source{
+			certchain.SourceFunc(letsEncryptSource),
+			certchain.SourceFunc(storedCertificateSource),
+			certchain.SourceFunc(selfSignedSource),
+		},
+		RenewBefore:       config.CertificateExpiryRefreshThreshold,
+		Leeway:            config.ClockSkewLeeway,
+		DefaultServerName: config.DefaultDomain,
+		Variant:           certificateVariant,
+		Memory:            certMemory{},
+		RenewInBackground: renewInBackground,
+	}
+}
+
+// certMemory keeps the certificates of the certificate chain in certCache, where the pushed and the regenerated
+// certificates replace them.
+type certMemory struct{}
 
-		// Clear expired certificate from cache.
-		certCache[name] = nil
-		log.Printf("certificate: cert for %s expired or about to expire, fetching new certificate", name)
+func (certMemory) Get(key string) *tls.Certificate {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+	return certCache[key]
+}
+
+func (certMemory) Put(key string, cert *tls.Certificate) {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+	if certCache != nil {
+		certCache[key] = cert
 	}
+}
 
-	// Fetch a new certificate from Let's Encrypt.
-	cert, err := m.GetCertificate(hello)
-	if err == nil {
-		log.Printf("certificate: got Let's Encrypt certificate for: %s", name)
-		certCache[name] = cert
-		return cert, nil
+// renewInBackground keeps serving a Let's Encrypt certificate while it is renewed, so that a failing renewal (e.g.
+// while the CA is down) does not replace a valid certificate with a self-signed one.
+func renewInBackground(hello *tls.ClientHelloInfo, cert *tls.Certificate) bool {
+	if !isLetsEncryptDomain(hello.ServerName) || isSelfSignedLeaf(cert.Leaf) {
+		return false
 	}
-	log.Printf("certificate: Let's Encrypt error for %s: %v, creating self-signed certificate", name, err)
+	renewCertificateInBackground(hello.ServerName, certificateVariant(hello))
+	return true
+}
+
+// letsEncryptSource gets the certificate for the handshake from Let's Encrypt.
+func letsEncryptSource(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	key := hello.ServerName + certificateVariant(hello)
+	cert, err := orderCertificate(hello, hello.ServerName, certificateVariant(hello))
+	if err != nil {
+		log.Printf("certificate: Let's Encrypt error for %s: %v", key, err)
+		return nil, err
+	}
+	log.Printf("certificate: got Let's Encrypt certificate for: %s", key)
+	return cert, nil
+}
 
-	// Create a self-signed certificate if fetching from Let's Encrypt failed.
-	cert, err = GetSelfSignedCertificate(hello)
+// storedCertificateSource returns the Let's Encrypt certificate for the handshake from the certificate cache while it
+// is valid, so that a failed renewal does not replace it. The next handshake renews it in the background.
+func storedCertificateSource(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name, variant := hello.ServerName, certificateVariant(hello)
+	if !isLetsEncryptDomain(name) {
+		return nil, errors.New("certificate: no Let's Encrypt domain: " + name)
+	}
+	cert, err := cachedCertificateVariant(context.Background(), name, variant)
 	if err != nil {
-		return nil, fmt.Errorf("certificate: failed to create self-signed certificate: %v", err)
+		return nil, err
+	}
+	if !certValidAt(cert.Leaf, time.Now()) {
+		return nil, errors.New("certificate: cached certificate is not valid: " + name + variant)
 	}
+	log.Printf("certificate: using the cached certificate for %s until it expires", name+variant)
+	return cert, nil
+}
 
-	log.Printf("certificate: created self-signed certificate for: %s", name)
-	certCache[name] = cert
+// selfSignedSource returns the self-signed certificate for the handshake.
+func selfSignedSource(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := selfSignedCertificates.GetCertificate(hello)
+	if err != nil {
+		return nil, fmt.Errorf("self signed certificate: %v", err)
+	}
+	log.Printf("certificate: using self-signed certificate for: %s", hello.ServerName)
 	return cert, nil
 }
+
+// orderCertificate gets a certificate for the (ASCII) name from Let's Encrypt, or from the certificate cache during
+// the backoff after failures.
+func orderCertificate(hello *tls.ClientHelloInfo, name, variant string) (*tls.Certificate, error) {
+	var err error
+
+	// Fetch a new certificate from Let's Encrypt. Domains with a DNS provider are validated with DNS-01 challenges.
+	// After failures, Let's Encrypt is not asked again before the backoff of the domain ends.
+	var cert *tls.Certificate
+	if failure := acmeBackoff(name); failure != nil {
+		if cached, cacheErr := cachedCertificateVariant(context.Background(), name, variant); cacheErr == nil && certValidAt(cached.Leaf, time.Now()) {
+			cert = cached
+		} else {
+			err = fmt.Errorf("not asking again before %s after %d failure(s), last error: %s", failure.NextTry.Format(time.RFC3339), failure.Count, failure.LastError)
+		}
+	} else if release, cached, lockErr := acquireIssuanceLock(hello, name, variant); lockErr != nil || cached != nil {
+		// Another server orders the certificate, or has already stored it in the shared cache.
+		// This is not a failure of the CA, so there is no backoff.
+		cert, err = cached, lockErr
+	} else {
+		defer release()
+		challenge := ""
+		if provider := settingsForDomain(name).dnsProvider; provider != "" {
+			if isLetsEncryptDomain(name) {
+				cert, err = getDNS01Certificate(name, variant, provider)
+			} else {
+				err = fmt.Errorf("acme/autocert: host %q not configured in HostWhitelist", name)
+			}
+		} else if cached := leewayCachedCertificate(name); cached != nil {
+			cert = cached
+		} else if !useAutocert() {
+			// Autocert only creates ECDSA keys (and RSA-2048 keys for old clients), and it always tries TLS-ALPN-01
+			// challenges, so other key types and HTTP-01 challenges alone are ordered without autocert.
+			if isLetsEncryptDomain(name) {
+				var solver acmeSolver
+				if solver, err = acmeChallengeSolver(); err == nil {
+					cert, err = getACMECertificate(name, variant, solver)
+				}
+			} else {
+				err = fmt.Errorf("acme/autocert: host %q not configured in HostWhitelist", name)
+			}
+		} else {
+			if isLetsEncryptDomain(name) {
+				if isACMEChallengeHello(hello) {
+					// The CA validates a TLS-ALPN-01 challenge of a running order.
+					reportACMEOrder(name, acmeChallengeTLSALPN01, acmeOrderValidating, nil)
+				} else {
+					// Autocert may also answer from its cache without an order. Then the order is valid right away.
+					challenge = autocertChallenge()
+					reportACMEOrder(name, challenge, acmeOrderPending, nil)
+				}
+				err = useACMEAccountKey()
+			}
+			if err == nil {
+				autocertIssuerMu.Lock()
+				issuer := autocertIssuer
+				autocertIssuerMu.Unlock()
+				cert, err = issuer.GetCertificate(variantHello(hello, variant))
+			}
+		}
+		if err == nil {
+			recordACMESuccess(name)
+			if challenge != "" {
+				reportACMEOrder(name, challenge, acmeOrderValid, nil)
+			}
+		} else if isLetsEncryptDomain(name) {
+			// Only the domains for Let's Encrypt reach the CA. The others fail at the host policy.
+			recordACMEFailure(name, err)
+			if challenge != "" {
+				reportACMEOrder(name, challenge, acmeOrderFailed, err)
+			}
+		}
+	}
+	return cert, err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TestSelfSignedCertificateChain checks that the certificate chain of the server falls back to a persisted
+// self-signed certificate for the domains in self-signed-domains, and refuses the other domains.
+func TestSelfSignedCertificateChain(t *testing.T) {
+	savedConfig, savedManager, savedIssuer := config, m, autocertIssuer
+	savedChain, savedSelfSigned := certificateChain, selfSignedCertificates
+	savedCache, savedCacheBytes, savedWhiteList := certCache, certCacheBytes, allowedDomainsSelfSignedWhiteList
+	defer func() {
+		config, m, autocertIssuer = savedConfig, savedManager, savedIssuer
+		certificateChain, selfSignedCertificates = savedChain, savedSelfSigned
+		certCache, certCacheBytes, allowedDomainsSelfSignedWhiteList = savedCache, savedCacheBytes, savedWhiteList
+	}()
+	config.SelfSignedDomains = []string{"localhost"}
+	config.LocalCA = false
+	cache := &memoryCache{entries: map[string][]byte{}}
+	manager := &autocert.Manager{Cache: cache, HostPolicy: autocert.HostWhitelist()}
+	initCertificates(manager)
+
+	cert, err := MyGetCertificate(&tls.ClientHelloInfo{ServerName: "LOCALHOST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if org := cert.Leaf.Subject.Organization; len(org) != 1 || org[0] != config.SelfSignedOrganization {
+		t.Errorf("organization %v, want %s", org, config.SelfSignedOrganization)
+	}
+	if again, _ := MyGetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"}); again != cert {
+		t.Error("the certificate was not cached in memory")
+	}
+
+	// After a restart, the persisted certificate is used.
+	initCertificates(manager)
+	restarted, err := MyGetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.Leaf.Equal(cert.Leaf) {
+		t.Error("the persisted certificate was not used after the restart")
+	}
+
+	if _, err := MyGetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); err == nil {
+		t.Error("got a certificate for a domain that is not in self-signed-domains")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// The parent monitors the certificates in the certificate cache, logs how long they are still valid,
+// and sends an alert to the configured webhook and email address if a certificate expires soon, or if it was
+// not renewed in several checks although it is due for renewal.
+
+// renewalFailureChecks is the number of consecutive checks in which a certificate is due for renewal
+// before the renewal is considered as failing.
+const renewalFailureChecks = 3
+
+// alertRepeatInterval is the minimum interval between alerts for the same certificate.
+const alertRepeatInterval = 24 * time.Hour
+
+// certificateAlert is the JSON body that is posted to the webhook.
+type certificateAlert struct {
+	Domain   string    `json:"domain"`
+	NotAfter time.Time `json:"not-after"`
+	DaysLeft int       `json:"days-left"`
+	Reason   string    `json:"reason"`
+}
+
+var renewalDueChecks = map[string]int{}
+var lastAlerts = map[string]time.Time{}
+
+// monitorCertificates checks the certificates now and then periodically.
+func monitorCertificates() {
+	checkCertificateExpiry(time.Now())
+	jobs.every(jobCertificateMonitor, config.CertificateMonitorInterval, func() {
+		checkCertificateExpiry(time.Now())
+	})
+}
+
+// checkCertificateExpiry logs the days until expiry of the cached certificates and sends the alerts.
+func checkCertificateExpiry(now time.Time) {
+	ctx := context.Background()
+	entries, err := certStorage.List(ctx)
+	if err != nil {
+		log.Println("Certificate monitor: could not read certificate cache:", err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name
+		selfSigned := strings.HasSuffix(name, "+self-signed")
+		if !isCertificateCacheName(name) && !selfSigned {
+			continue
+		}
+		var leaf *x509.Certificate
+		if data, err := certStorage.Get(ctx, name); err == nil {
+			leaf = parseFirstCertificate(data)
+		}
+		if leaf == nil {
+			log.Println("Certificate monitor: could not read certificate:", name)
+			continue
+		}
+
+		daysLeft := int(leaf.NotAfter.Sub(now).Hours() / 24)
+		log.Printf("Certificate monitor: %s expires in %d days (%s)", name, daysLeft, leaf.NotAfter.Format(time.RFC3339))
+
+		// Self-signed certificates are created by the server itself, ahead of time or on the next handshake.
+		if selfSigned {
+			continue
+		}
+
+		if certNeedsRenewal(leaf, config.CertificateExpiryRefreshThreshold) {
+			renewalDueChecks[name]++
+		} else {
+			delete(renewalDueChecks, name)
+		}
+
+		var reason string
+		switch {
+		case !leaf.NotAfter.After(now):
+			reason = "the certificate has expired"
+		case leaf.NotAfter.Sub(now) < time.Duration(config.CertificateAlertDays)*24*time.Hour:
+			reason = fmt.Sprintf("the certificate expires within %d day(s)", config.CertificateAlertDays)
+		case renewalDueChecks[name] >= renewalFailureChecks:
+			reason = fmt.Sprintf("the renewal failed in %d consecutive checks", renewalDueChecks[name])
+		default:
+			continue
+		}
+
+		if now.Sub(lastAlerts[name]) < alertRepeatInterval {
+			continue
+		}
+		lastAlerts[name] = now
+		sendCertificateAlert(certificateAlert{Domain: name, NotAfter: leaf.NotAfter, DaysLeft: daysLeft, Reason: reason})
+	}
+}
+
+// sendCertificateAlert logs the alert and sends it to the webhook and the email address, if they are configured.
+func sendCertificateAlert(alert certificateAlert) {
+	log.Printf("Certificate alert for %s: %s", alert.Domain, alert.Reason)
+
+	if config.CertificateAlertWebhook != "" {
+		body, _ := json.Marshal(alert)
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(config.CertificateAlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Certificate alert: webhook failed:", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Println("Certificate alert: webhook returned", resp.Status)
+			}
+		}
+	}
+
+	if config.CertificateAlertEmail != "" {
+		to := config.CertificateAlertEmail
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Certificate alert for %s\r\n\r\n%s: %s.\r\nThe certificate expires on %s (in %d days).\r\n",
+			to, to, alert.Domain, alert.Domain, alert.Reason, alert.NotAfter.Format(time.RFC1123), alert.DaysLeft)
+		var auth smtp.Auth
+		if config.CertificateAlertSmtpUsername != "" {
+			host, _, _ := net.SplitHostPort(config.CertificateAlertSmtpServer)
+			auth = smtp.PlainAuth("", config.CertificateAlertSmtpUsername, string(config.CertificateAlertSmtpPassword), host)
+		}
+		if err := smtp.SendMail(config.CertificateAlertSmtpServer, auth, to, []string{to}, []byte(msg)); err != nil {
+			log.Println("Certificate alert: email failed:", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The parent watches the certificate cache directory and pushes new or changed certificates to the child.
+// This way, certificates that are renewed or placed into the directory from outside reach the in-memory
+// cache of the child, without the child needing access to the directory.
+
+// pushedCertificates holds the modification times of the certificate files that the child already knows.
+var pushedCertificates = map[string]time.Time{}
+var pushedCertificatesMu sync.Mutex
+
+// isCertificateCacheName returns true if the cache entry with the name holds a certificate and its key,
+// and not an account key, an ACME token, or a client CA bundle.
+func isCertificateCacheName(name string) bool {
+	return !strings.Contains(strings.TrimSuffix(name, "+rsa"), "+")
+}
+
+// markCertificateKnown records that the child knows the current version of the cache entry,
+// e.g. because it has sent the entry itself.
+func markCertificateKnown(name string) {
+	modTime, err := certStorage.ModTime(context.Background(), name)
+	if err != nil {
+		return
+	}
+	pushedCertificatesMu.Lock()
+	pushedCertificates[name] = modTime
+	pushedCertificatesMu.Unlock()
+}
+
+// watchCertificateCache periodically pushes new or changed certificates from the certificate cache directory to the child.
+func watchCertificateCache() {
+	// The certificates that exist at startup are fetched by the child on demand.
+	pushCertificates(false)
+
+	jobs.every(jobCertificatePush, config.CertificatePushInterval, func() {
+		pushCertificates(true)
+	})
+}
+
+// pushCertificates sends the certificates that changed since the last call to the child. If send is false,
+// the certificates are only recorded.
+func pushCertificates(send bool) {
+	ctx := context.Background()
+	entries, err := certStorage.List(ctx)
+	if err != nil {
+		log.Println("Could not read certificate cache:", err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name
+		if !isCertificateCacheName(name) {
+			continue
+		}
+
+		pushedCertificatesMu.Lock()
+		known := pushedCertificates[name].Equal(entry.ModTime)
+		pushedCertificates[name] = entry.ModTime
+		pushedCertificatesMu.Unlock()
+		if known || !send {
+			continue
+		}
+
+		data, err := certStorage.Get(ctx, name)
+		if err != nil {
+			log.Println("Could not read certificate:", err)
+			continue
+		}
+		log.Println("Pushing certificate to child:", name)
+		parentToChildCh <- Command{Type: cmdCertificate, Name: name, Data: data}
+	}
+}
+
+// receiveCertificate stores a certificate that the parent has pushed in the in-memory caches of the child.
+// The certificate is used for new handshakes right away.
+func receiveCertificate(name string, data []byte) {
+	domain := strings.TrimSuffix(name, "+rsa")
+	if !isAllowedDomain(domain) {
+		return
+	}
+
+	// The data contains the private key and the certificate chain as PEM blocks.
+	cert, err := parseKeyPair(data)
+	if err != nil {
+		log.Println("Pushed certificate is invalid:", name, err)
+		return
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || cert.Leaf.VerifyHostname(domain) != nil || !certValidAt(cert.Leaf, time.Now()) {
+		log.Println("Pushed certificate is not valid for:", domain)
+		return
+	}
+
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+	if certCache == nil {
+		// The certificates are not initialized yet. They will be fetched from the parent.
+		return
+	}
+	certCacheBytes[name] = data
+	if config.DualCertificates {
+		// The RSA certificate is cached separately.
+		certCache[name] = &cert
+	} else {
+		certCache[domain] = &cert
+	}
+	log.Println("Certificate pushed by parent for:", domain)
+}
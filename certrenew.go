@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// When a Let's Encrypt certificate enters the certificate-expiry-refresh-threshold, the handshakes keep getting it,
+// and it is renewed in the background. If the renewal fails (e.g. while the CA is down, or outside of the renewal
+// windows), the certificate is still served and the renewal is retried after the backoff of the domain, until the
+// certificate expires. Only then the handshakes fall back to a self-signed certificate.
+
+// renewingCertificates are the keys (domain and variant) of the certificates that are renewed in the background,
+// or whose renewal is scheduled to be retried.
+var renewingCertificates = map[string]bool{}
+var renewingCertificatesMu sync.Mutex
+
+// isSelfSignedLeaf returns true if the certificate is issued by itself.
+func isSelfSignedLeaf(leaf *x509.Certificate) bool {
+	return bytes.Equal(leaf.RawIssuer, leaf.RawSubject)
+}
+
+// renewCertificateInBackground starts the renewal of the certificate, unless it already runs or is scheduled.
+func renewCertificateInBackground(name, variant string) {
+	key := name + variant
+	renewingCertificatesMu.Lock()
+	if renewingCertificates[key] {
+		renewingCertificatesMu.Unlock()
+		return
+	}
+	renewingCertificates[key] = true
+	renewingCertificatesMu.Unlock()
+
+	log.Printf("certificate: cert for %s is about to expire, renewing it in the background", key)
+	go renewCertificate(name, variant)
+}
+
+// renewCertificate orders a new certificate and replaces the certificate in the cache with it. If that fails, the
+// renewal is retried after the backoff of the domain.
+func renewCertificate(name, variant string) {
+	key := name + variant
+	hello := &tls.ClientHelloInfo{ServerName: name}
+	if variant == rsaCertSuffix {
+		hello = rsaHello(name)
+	}
+
+	// Handshakes that need the certificate at the same time wait for the same order.
+	cert, err := certificateChain.SingleFlight(nil, key, func() (*tls.Certificate, error) {
+		return orderCertificate(hello, name, variant)
+	})
+	if err == nil && cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	// During the backoff, the order returns the current certificate from the cache.
+	if err == nil && certNeedsRenewal(cert.Leaf, config.CertificateExpiryRefreshThreshold) {
+		err = errors.New("no new certificate yet")
+	}
+
+	if err == nil {
+		log.Printf("certificate: renewed Let's Encrypt certificate for: %s", key)
+		certCacheMu.Lock()
+		certCache[key] = cert
+		certCacheMu.Unlock()
+		renewingCertificatesMu.Lock()
+		delete(renewingCertificates, key)
+		renewingCertificatesMu.Unlock()
+		return
+	}
+
+	retry := config.AcmeBackoffMin
+	if failure := acmeBackoff(name); failure != nil {
+		retry = time.Until(failure.NextTry)
+	}
+	log.Printf("certificate: could not renew %s, serving the current certificate and retrying in %s: %v", key, retry.Round(time.Second), err)
+	time.AfterFunc(retry, func() {
+		renewingCertificatesMu.Lock()
+		delete(renewingCertificates, key)
+		renewingCertificatesMu.Unlock()
+
+		// This starts the renewal again, unless the certificate was replaced in the meantime. After the
+		// certificate expired, the next handshake orders a new one.
+		certificateChain.Cached(hello)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+// `certs revoke` revokes the certificates of a domain at the ACME CA, e.g. after a key compromise, and removes them from
+// the certificate cache. A running server is told to forget them, so that it gets new certificates.
+
+// revocationReasons are the CRL reason codes that Let's Encrypt accepts for revocations.
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"unspecified":            acme.CRLReasonUnspecified,
+	"key-compromise":         acme.CRLReasonKeyCompromise,
+	"affiliation-changed":    acme.CRLReasonAffiliationChanged,
+	"superseded":             acme.CRLReasonSuperseded,
+	"cessation-of-operation": acme.CRLReasonCessationOfOperation,
+}
+
+// runCertsRevoke implements the `certs revoke [-reason=<reason>] <domain>` subcommand.
+func runCertsRevoke(args []string) {
+	var domain string
+	reason := acme.CRLReasonUnspecified
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "-reason="):
+			code, ok := revocationReasons[strings.TrimPrefix(arg, "-reason=")]
+			if !ok {
+				log.Fatal("Invalid reason, it must be 'unspecified', 'key-compromise', 'affiliation-changed', 'superseded', or 'cessation-of-operation': ", arg)
+			}
+			reason = code
+		case strings.HasPrefix(arg, "-"):
+			log.Fatal("Unknown flag: ", arg)
+		case domain == "":
+			domain = arg
+		default:
+			log.Fatal(certsUsage)
+		}
+	}
+	if domain == "" {
+		log.Fatal(certsUsage)
+	}
+	domain, err := idna.Lookup.ToASCII(strings.ToLower(domain))
+	if err != nil || domain == "" {
+		log.Fatal("Invalid domain: ", domain)
+	}
+
+	readConfig()
+
+	ctx := context.Background()
+	store := openCertStore()
+
+	// The revocation is signed with the account key. Without it, e.g. for imported certificates of another
+	// account, it is signed with the key of the certificate, which the CA also accepts.
+	var accountKey crypto.Signer
+	if data, err := store.Get(ctx, acmeAccountKeyName); err == nil {
+		if accountKey, err = parsePrivateKey(data); err != nil {
+			log.Fatal("Invalid ACME account key in the certificate cache: ", err)
+		}
+	} else if err != autocert.ErrCacheMiss {
+		log.Fatal("Could not read the certificate cache: ", err)
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: config.AcmeDirectoryURL, HTTPClient: certHTTPClient(0), UserAgent: "sslserver"}
+
+	revoked := 0
+	for _, name := range []string{domain, domain + rsaCertSuffix} {
+		data, err := store.Get(ctx, name)
+		if err == autocert.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			log.Fatal("Could not read the certificate cache: ", err)
+		}
+		cert, err := parseKeyPair(data)
+		if err != nil {
+			log.Fatalf("Could not read the certificate %s: %v", name, err)
+		}
+		leaf := parseFirstCertificate(data)
+		if leaf == nil {
+			log.Fatal("Could not read the certificate: ", name)
+		}
+		if leaf.Issuer.String() == leaf.Subject.String() {
+			log.Printf("Skipping the self-signed certificate %s", name)
+			continue
+		}
+
+		var key crypto.Signer
+		if accountKey == nil {
+			signer, ok := cert.PrivateKey.(crypto.Signer)
+			if !ok {
+				log.Fatalf("The key of the certificate %s can not sign the revocation", name)
+			}
+			key = signer
+		}
+		if err := client.RevokeCert(ctx, key, cert.Certificate[0], reason); err != nil && !isAlreadyRevoked(err) {
+			log.Fatalf("Could not revoke the certificate %s: %v", name, err)
+		}
+		if err := store.Delete(ctx, name); err != nil {
+			log.Fatalf("The certificate %s is revoked, but could not be removed from the certificate cache: %v", name, err)
+		}
+		log.Printf("Revoked the certificate %s (serial %s) and removed it from the certificate cache", name, fmt.Sprintf("%x", leaf.SerialNumber))
+		revoked++
+	}
+	if revoked == 0 {
+		log.Fatal("The certificate cache has no certificate from an ACME CA for: ", domain)
+	}
+
+	// The running server still has the certificates in memory.
+	if answer, err := adminRequest("forget-certificate " + domain); err != nil {
+		log.Println("Could not tell the running server to forget the revoked certificate:", err)
+		log.Println("Restart the server, if it is running, so that it gets a new certificate.")
+	} else {
+		log.Println("Forget:", answer)
+	}
+	os.Exit(0)
+}
+
+// isAlreadyRevoked returns true if the ACME CA answered that the certificate is already revoked.
+func isAlreadyRevoked(err error) bool {
+	var acmeErr *acme.Error
+	return errors.As(err, &acmeErr) && acmeErr.ProblemType == "urn:ietf:params:acme:error:alreadyRevoked"
+}
+
+// forgetCertificate removes the certificates of the domain from the memory of the child, after they were revoked.
+// autocert also keeps them in memory, so it is replaced with a new manager with the same settings.
+// The next handshake gets a new certificate.
+func forgetCertificate(domain string) {
+	certCacheMu.Lock()
+	if certCache == nil {
+		certCacheMu.Unlock()
+		return
+	}
+	for _, name := range []string{domain, domain + rsaCertSuffix} {
+		delete(certCache, name)
+		delete(certCacheBytes, name)
+	}
+	certCacheMu.Unlock()
+
+	autocertIssuerMu.Lock()
+	old := autocertIssuer
+	issuer := &autocert.Manager{
+		Prompt:                 old.Prompt,
+		Cache:                  old.Cache,
+		HostPolicy:             old.HostPolicy,
+		RenewBefore:            old.RenewBefore,
+		Client:                 old.Client,
+		Email:                  old.Email,
+		ExtraExtensions:        old.ExtraExtensions,
+		ExternalAccountBinding: old.ExternalAccountBinding,
+	}
+	// Enable the HTTP-01 challenges. The challenge responses are shared through the certificate cache,
+	// so the HTTP handler of the old manager also finds the ones of the new manager.
+	if acmeChallengeAllowed(acmeChallengeHTTP01) {
+		issuer.HTTPHandler(nil)
+	}
+	autocertIssuer = issuer
+	autocertIssuerMu.Unlock()
+
+	log.Println("Forgot the revoked certificates of:", domain)
+}
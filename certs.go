@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+// The `certs` subcommands work directly on the certificate cache, without starting the server.
+
+const certsUsage = "Usage: sslserver certs list | import [-force] <domain> <chain-file> <key-file> | revoke [-reason=<reason>] <domain>"
+
+// runCerts implements the `certs` subcommand.
+func runCerts(args []string) {
+	if len(args) == 0 {
+		log.Fatal(certsUsage)
+	}
+	switch args[0] {
+	case "list":
+		runCertsList(args[1:])
+	case "import":
+		runCertsImport(args[1:])
+	case "revoke":
+		runCertsRevoke(args[1:])
+	default:
+		log.Fatal(certsUsage)
+	}
+}
+
+// runCertsList prints a table of the certificates in the certificate cache.
+// It exits with a non-zero exit code if one of the certificates has expired, so that it can be used in cron jobs.
+func runCertsList(args []string) {
+	if len(args) != 0 {
+		log.Fatal(certsUsage)
+	}
+	readConfig()
+
+	ctx := context.Background()
+	store := openCertStore()
+	entries, err := store.List(ctx)
+	if err != nil {
+		log.Fatal("Could not read the certificate cache: ", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	// Certificates of the local CA count as self-signed, like in the server.
+	var localCAIssuer string
+	if data, err := store.Get(ctx, localCACacheKey); err == nil {
+		if leaf := parseFirstCertificate(data); leaf != nil {
+			localCAIssuer = leaf.Subject.String()
+		}
+	}
+
+	now := time.Now()
+	expired := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tISSUER\tKEY TYPE\tNOT BEFORE\tNOT AFTER\tSELF-SIGNED")
+	for _, entry := range entries {
+		name := entry.Name
+		selfSignedEntry := strings.HasSuffix(name, "+self-signed")
+		if !isCertificateCacheName(name) && !selfSignedEntry {
+			continue
+		}
+		var leaf *x509.Certificate
+		if data, err := store.Get(ctx, name); err == nil {
+			leaf = parseFirstCertificate(data)
+		}
+		if leaf == nil {
+			log.Println("Could not read certificate:", name)
+			continue
+		}
+
+		domain := strings.TrimSuffix(strings.TrimSuffix(name, "+self-signed"), rsaCertSuffix)
+		selfSigned := leaf.Issuer.String() == leaf.Subject.String() || (localCAIssuer != "" && leaf.Issuer.String() == localCAIssuer)
+		notAfter := leaf.NotAfter.UTC().Format(time.RFC3339)
+		if !leaf.NotAfter.After(now) {
+			notAfter += " (expired)"
+			expired++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", domain, certificateIssuerName(leaf), certificateKeyType(leaf), leaf.NotBefore.UTC().Format(time.RFC3339), notAfter, yesNo(selfSigned))
+	}
+	w.Flush()
+
+	if expired > 0 {
+		log.Fatalf("%d certificate(s) expired", expired)
+	}
+	os.Exit(0)
+}
+
+// runCertsImport imports an existing certificate chain and private key of the domain into the certificate cache, in the
+// format of autocert. The server then uses the certificate until it has to be renewed, instead of ordering a new one.
+// A running server pushes the certificate to the child with the next check of the certificate cache.
+func runCertsImport(args []string) {
+	var files []string
+	force := false
+	for _, arg := range args {
+		switch {
+		case arg == "-force":
+			force = true
+		case strings.HasPrefix(arg, "-"):
+			log.Fatal("Unknown flag: ", arg)
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 3 {
+		log.Fatal(certsUsage)
+	}
+	domain, err := idna.Lookup.ToASCII(strings.ToLower(files[0]))
+	if err != nil || domain == "" {
+		log.Fatal("Invalid domain: ", files[0])
+	}
+	chainPEM, err := os.ReadFile(files[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyPEM, err := os.ReadFile(files[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	readConfig()
+
+	data, leaf, err := importableCertificate(domain, chainPEM, keyPEM, time.Now())
+	if err != nil {
+		log.Fatal("Could not import the certificate: ", err)
+	}
+	if !isLetsEncryptDomain(domain) {
+		log.Printf("Warning: %s is not a Let's Encrypt domain of the web root, the certificate is only used when it becomes one", domain)
+	}
+	if certNeedsRenewal(leaf, config.CertificateExpiryRefreshThreshold) {
+		log.Printf("Warning: the certificate expires within the certificate-expiry-refresh-threshold, so the server renews it right away")
+	}
+
+	// autocert stores ECDSA and RSA certificates under the domain, and the RSA certificates of old clients under
+	// the domain with the RSA suffix. With dual-certificates, an imported RSA certificate is the one for old clients.
+	name := domain
+	if _, isRSA := leaf.PublicKey.(*rsa.PublicKey); isRSA && config.DualCertificates {
+		name += rsaCertSuffix
+	}
+
+	ctx := context.Background()
+	store := openCertStore()
+	if existing, err := store.Get(ctx, name); err == nil && !force {
+		if old := parseFirstCertificate(existing); old != nil {
+			log.Fatalf("The certificate cache already has a certificate for %s that expires on %s. Use -force to replace it.", name, old.NotAfter.UTC().Format(time.RFC3339))
+		}
+		log.Fatalf("The certificate cache already has an entry %s. Use -force to replace it.", name)
+	} else if err != nil && err != autocert.ErrCacheMiss {
+		log.Fatal("Could not read the certificate cache: ", err)
+	}
+	if err := store.Put(ctx, name, data); err != nil {
+		log.Fatal("Could not write the certificate cache: ", err)
+	}
+	log.Printf("Imported the certificate for %s from %s, valid until %s", name, certificateIssuerName(leaf), leaf.NotAfter.UTC().Format(time.RFC3339))
+	os.Exit(0)
+}
+
+// importableCertificate checks the certificate chain and the private key, and returns them as autocert cache entry:
+// the private key followed by the certificates, leaf first.
+func importableCertificate(domain string, chainPEM, keyPEM []byte, now time.Time) ([]byte, *x509.Certificate, error) {
+	pair, err := tls.X509KeyPair(chainPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain []*x509.Certificate
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, cert)
+	}
+	leaf := chain[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return nil, nil, err
+	}
+	if !certValidAt(leaf, now) {
+		return nil, nil, fmt.Errorf("the certificate is only valid from %s to %s", leaf.NotBefore.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, nil, fmt.Errorf("certificate %d of the chain is not signed by the next certificate, the chain must start with the leaf certificate: %v", i+1, err)
+		}
+	}
+
+	// autocert can only read EC and RSA keys.
+	var buf bytes.Buffer
+	switch key := pair.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case *rsa.PrivateKey:
+		pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	default:
+		return nil, nil, errors.New("only ECDSA and RSA keys are supported")
+	}
+	for _, der := range pair.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return buf.Bytes(), leaf, nil
+}
+
+// certificateIssuerName returns a short name of the issuer of the certificate.
+func certificateIssuerName(leaf *x509.Certificate) string {
+	switch {
+	case leaf.Issuer.CommonName != "":
+		return leaf.Issuer.CommonName
+	case len(leaf.Issuer.Organization) > 0:
+		return leaf.Issuer.Organization[0]
+	default:
+		return leaf.Issuer.String()
+	}
+}
+
+// certificateKeyType returns the key type of the certificate, with the names of acme-key-type where possible.
+func certificateKeyType(leaf *x509.Certificate) string {
+	switch pub := leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().Name == "P-256" {
+			return keyTypeECDSAP256
+		}
+		return "ecdsa-" + strings.ToLower(strings.ReplaceAll(pub.Curve.Params().Name, "-", ""))
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", pub.N.BitLen())
+	case ed25519.PublicKey:
+		return "ed25519"
+	default:
+		return leaf.PublicKeyAlgorithm.String()
+	}
+}
+
+// yesNo formats a boolean for tables.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
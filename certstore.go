@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The parent stores the certificate cache in a certStore. Besides the methods of autocert.Cache, a certStore
+// lists its entries with their modification times, so that the parent can push and monitor the certificates.
+
+// Backends of the certificate cache.
+const (
+	certCacheBackendDirectory = "directory" // Loose files in the certificate-cache-directory.
+	certCacheBackendSQLite    = "sqlite"    // A single SQLite file.
+	certCacheBackendRedis     = "redis"     // Redis, shared by several servers.
+	certCacheBackendS3        = "s3"        // An S3 compatible bucket.
+	certCacheBackendGCS       = "gcs"       // A Google Cloud Storage bucket (S3 compatible API).
+	certCacheBackendVault     = "vault"     // A KV secrets engine of HashiCorp Vault.
+)
+
+// certStore is the storage of the certificate cache in the parent.
+type certStore interface {
+	autocert.Cache
+
+	// List returns the names and modification times of all entries.
+	List(ctx context.Context) ([]certStoreEntry, error)
+
+	// ModTime returns the modification time of the entry.
+	ModTime(ctx context.Context, name string) (time.Time, error)
+}
+
+// certMetadataStore is implemented by the backends that store the metadata of the certificates next to the
+// entries. The encryption passes the certificate of the plain entry, because the stored entry can not be parsed.
+type certMetadataStore interface {
+	// PutWithCertificate stores the entry with the metadata of the certificate. leaf is nil for other entries.
+	PutWithCertificate(ctx context.Context, name string, data []byte, leaf *x509.Certificate) error
+}
+
+// certStoreEntry is an entry of a certStore.
+type certStoreEntry struct {
+	Name    string
+	ModTime time.Time
+}
+
+// certStorage is the certificate cache of the parent.
+var certStorage certStore
+
+// openCertStore opens the configured backend of the certificate cache, and encrypts its entries if a key is configured.
+func openCertStore() certStore {
+	store := openCertStoreBackend()
+
+	key, err := certificateCacheKey()
+	if err != nil {
+		log.Fatal("Invalid certificate-cache-encryption-key: ", err)
+	}
+	if key == nil {
+		return store
+	}
+	encrypted, err := newEncryptedCertStore(store, key)
+	if err != nil {
+		log.Fatal("Could not encrypt the certificate cache: ", err)
+	}
+	encrypted.migrate(context.Background())
+	return encrypted
+}
+
+// openCertStoreBackend opens the configured backend of the certificate cache.
+func openCertStoreBackend() certStore {
+	switch config.CertificateCacheBackend {
+	case certCacheBackendSQLite:
+		store, err := openSQLiteCertStore(config.CertificateCacheSqliteFile)
+		if err != nil {
+			log.Fatal("Could not open the SQLite certificate cache: ", err)
+		}
+		return store
+	case certCacheBackendRedis:
+		store, err := openRedisCertStore()
+		if err != nil {
+			log.Fatal("Could not connect to the Redis certificate cache: ", err)
+		}
+		return store
+	case certCacheBackendS3, certCacheBackendGCS:
+		store, err := openObjectCertStore()
+		if err != nil {
+			log.Fatal("Could not open the object storage certificate cache: ", err)
+		}
+		return store
+	case certCacheBackendVault:
+		store, err := openVaultCertStore()
+		if err != nil {
+			log.Fatal("Could not open the Vault certificate cache: ", err)
+		}
+		return store
+	default:
+		return dirCertStore{autocert.DirCache(config.CertificateCacheDirectory)}
+	}
+}
+
+// dirCertStore stores the entries as files in a directory.
+type dirCertStore struct {
+	autocert.DirCache
+}
+
+// List returns the files in the directory.
+func (d dirCertStore) List(ctx context.Context) ([]certStoreEntry, error) {
+	entries, err := os.ReadDir(string(d.DirCache))
+	if err != nil {
+		return nil, err
+	}
+	var list []certStoreEntry
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, certStoreEntry{Name: entry.Name(), ModTime: info.ModTime()})
+	}
+	return list, nil
+}
+
+// ModTime returns the modification time of the file.
+func (d dirCertStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	info, err := os.Stat(filepath.Join(string(d.DirCache), name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
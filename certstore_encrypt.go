@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The entries of the certificate cache can be encrypted with AES-256-GCM, so that the private keys are protected
+// when the certificate cache leaks, e.g. in a backup. The name of the entry is authenticated with it, so that
+// encrypted entries can not be swapped. At startup, the entries of an existing certificate cache that were written
+// without encryption are encrypted. After that, entries without the header are rejected, so that nobody with
+// write access to the cache can replace an encrypted entry (e.g. the ACME account key) with a plain one.
+
+// encryptedEntryHeader starts every encrypted entry.
+const encryptedEntryHeader = "sslserver-encrypted-v1\n"
+
+// certificateCacheKeyEnv is the environment variable with the key, if certificate-cache-encryption-key is empty.
+const certificateCacheKeyEnv = "SSLSERVER_CERTIFICATE_CACHE_KEY"
+
+// encryptedCertStore encrypts the entries of another certStore.
+type encryptedCertStore struct {
+	certStore
+	aead cipher.AEAD
+
+	// strict rejects the entries without encryption. It is set when migrate has encrypted all entries.
+	strict bool
+}
+
+// certificateCacheKey returns the configured key, or nil if the certificate cache is not encrypted.
+func certificateCacheKey() ([]byte, error) {
+	encoded := strings.TrimSpace(string(config.CertificateCacheEncryptionKey))
+	if encoded == "" {
+		encoded = strings.TrimSpace(os.Getenv(certificateCacheKeyEnv))
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key has to be 32 random bytes in base64 (e.g. from `openssl rand -base64 32`)")
+	}
+	return key, nil
+}
+
+// newEncryptedCertStore returns the store that encrypts the entries of the store with the key.
+func newEncryptedCertStore(store certStore, key []byte) (*encryptedCertStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedCertStore{certStore: store, aead: aead}, nil
+}
+
+// Get returns the decrypted entry.
+func (s *encryptedCertStore) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := s.certStore.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(encryptedEntryHeader)) {
+		if s.strict {
+			return nil, fmt.Errorf("certificate cache entry %s is not encrypted", name)
+		}
+		// The entry was written before the encryption was enabled, and could not be encrypted at startup.
+		return data, nil
+	}
+	sealed := data[len(encryptedEntryHeader):]
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted certificate cache entry %s is truncated", name)
+	}
+	plain, err := s.aead.Open(nil, sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt certificate cache entry %s (wrong key?): %v", name, err)
+	}
+	return plain, nil
+}
+
+// migrate encrypts the entries that were written without encryption, and rejects entries without encryption
+// afterwards. If an entry can not be encrypted, the entries without encryption are still accepted.
+func (s *encryptedCertStore) migrate(ctx context.Context) {
+	list, err := s.certStore.List(ctx)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("Could not encrypt the existing certificate cache entries, entries without encryption are still accepted:", err)
+		return
+	}
+
+	migrated, failed := 0, 0
+	for _, entry := range list {
+		// The issuance locks are stored without encryption.
+		if strings.HasSuffix(entry.Name, issuanceLockSuffix) {
+			continue
+		}
+		data, err := s.certStore.Get(ctx, entry.Name)
+		if err == autocert.ErrCacheMiss || (err == nil && bytes.HasPrefix(data, []byte(encryptedEntryHeader))) {
+			continue
+		}
+		if err == nil {
+			err = s.Put(ctx, entry.Name, data)
+		}
+		if err != nil {
+			log.Println("Could not encrypt the certificate cache entry", entry.Name+":", err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		log.Println("Encrypted", migrated, "certificate cache entries that were written without encryption")
+	}
+	if failed > 0 {
+		log.Println("Entries without encryption are still accepted, because", failed, "certificate cache entries could not be encrypted")
+		return
+	}
+	s.strict = true
+}
+
+// Put stores the encrypted entry.
+func (s *encryptedCertStore) Put(ctx context.Context, name string, data []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append([]byte(encryptedEntryHeader), nonce...)
+	sealed = s.aead.Seal(sealed, nonce, data, []byte(name))
+	// The metadata of the certificate (domain and validity) is public anyway, so it is stored in the clear.
+	if metadataStore, ok := s.certStore.(certMetadataStore); ok {
+		return metadataStore.PutWithCertificate(ctx, name, sealed, parseFirstCertificate(data))
+	}
+	return s.certStore.Put(ctx, name, sealed)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"matscheko.eu/sslserver/certchain"
+)
+
+// metadataCertStore is a certStore in memory that records the certificates of PutWithCertificate.
+type metadataCertStore struct {
+	memoryCache
+	leaves map[string]*x509.Certificate
+}
+
+func (s *metadataCertStore) List(ctx context.Context) ([]certStoreEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []certStoreEntry
+	for name := range s.entries {
+		list = append(list, certStoreEntry{Name: name})
+	}
+	return list, nil
+}
+
+func (s *metadataCertStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (s *metadataCertStore) PutWithCertificate(ctx context.Context, name string, data []byte, leaf *x509.Certificate) error {
+	s.leaves[name] = leaf
+	return s.Put(ctx, name, data)
+}
+
+// TestEncryptedCertStoreMetadata checks that the backends with metadata get the certificate of the plain entry.
+func TestEncryptedCertStoreMetadata(t *testing.T) {
+	backend := &metadataCertStore{memoryCache: memoryCache{entries: map[string][]byte{}}, leaves: map[string]*x509.Certificate{}}
+	store, err := newEncryptedCertStore(backend, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	cert, err := (&certchain.SelfSigned{Validity: time.Hour}).Create("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := store.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf := backend.leaves["example.com"]; leaf == nil || leaf.DNSNames[0] != "example.com" {
+		t.Errorf("the backend got the certificate %v, want the certificate for example.com", leaf)
+	}
+	if stored, _ := backend.Get(ctx, "example.com"); string(stored) == string(data) {
+		t.Error("the entry was stored without encryption")
+	}
+	if got, err := store.Get(ctx, "example.com"); err != nil || string(got) != string(data) {
+		t.Errorf("got %q, %v, want the plain entry", got, err)
+	}
+}
+
+// TestEncryptedCertStoreMigration checks that the entries without encryption are encrypted at startup, except for the
+// issuance locks, and that entries without encryption are rejected afterwards.
+func TestEncryptedCertStoreMigration(t *testing.T) {
+	ctx := context.Background()
+	backend := &metadataCertStore{memoryCache: memoryCache{entries: map[string][]byte{
+		"acme_account+key":                 []byte("account key"),
+		"example.com":                      []byte("certificate"),
+		"example.com" + issuanceLockSuffix: []byte("owner\n0"),
+	}}, leaves: map[string]*x509.Certificate{}}
+	store, err := newEncryptedCertStore(backend, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(ctx, "example.com"); err != nil || string(got) != "certificate" {
+		t.Errorf("before the migration: got %q, %v, want the entry without encryption", got, err)
+	}
+
+	store.migrate(ctx)
+	for name, want := range map[string]string{"acme_account+key": "account key", "example.com": "certificate"} {
+		if stored, _ := backend.Get(ctx, name); !bytes.HasPrefix(stored, []byte(encryptedEntryHeader)) {
+			t.Errorf("%s was not encrypted", name)
+		}
+		if got, err := store.Get(ctx, name); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if lock, _ := backend.Get(ctx, "example.com"+issuanceLockSuffix); string(lock) != "owner\n0" {
+		t.Error("the issuance lock was changed")
+	}
+
+	// An entry without encryption can not replace the account key anymore.
+	backend.Put(ctx, "acme_account+key", []byte("other account key"))
+	if got, err := store.Get(ctx, "acme_account+key"); err == nil {
+		t.Errorf("got the entry without encryption %q", got)
+	}
+}
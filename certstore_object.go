@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The object storage backend stores the certificate cache in an S3 bucket, so that the certificates survive
+// ephemeral hosts and can be shared between servers in different regions. Google Cloud Storage is used through its
+// S3 compatible XML API with HMAC keys. Each entry is one object, which is replaced atomically by a PUT.
+//
+// The requests are signed with AWS Signature Version 4 (see awssigv4.go).
+
+// objectCertStore stores the certificate cache in an S3 compatible bucket.
+type objectCertStore struct {
+	endpoint        string // e.g. "https://s3.eu-central-1.amazonaws.com"
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+}
+
+// openObjectCertStore returns the store for the bucket and checks that the bucket can be listed,
+// so that a wrong configuration stops the server at startup.
+func openObjectCertStore() (*objectCertStore, error) {
+	s := &objectCertStore{
+		endpoint:        strings.TrimSuffix(config.ObjectStorageEndpoint, "/"),
+		bucket:          config.ObjectStorageBucket,
+		prefix:          config.ObjectStoragePrefix,
+		region:          config.ObjectStorageRegion,
+		accessKeyID:     config.ObjectStorageAccessKeyId,
+		secretAccessKey: string(config.ObjectStorageSecretAccessKey),
+	}
+	if s.endpoint == "" {
+		switch config.CertificateCacheBackend {
+		case certCacheBackendGCS:
+			s.endpoint = "https://storage.googleapis.com"
+		default:
+			s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := s.list(ctx, 1); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the content of the object.
+func (s *objectCertStore) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, data, err := s.request(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, objectStorageError("GET", name, resp, data)
+	}
+	return data, nil
+}
+
+// Put stores the object.
+func (s *objectCertStore) Put(ctx context.Context, name string, data []byte) error {
+	resp, body, err := s.request(ctx, http.MethodPut, name, nil, data)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return objectStorageError("PUT", name, resp, body)
+	}
+	return nil
+}
+
+// Delete removes the object.
+func (s *objectCertStore) Delete(ctx context.Context, name string) error {
+	resp, body, err := s.request(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return objectStorageError("DELETE", name, resp, body)
+	}
+	return nil
+}
+
+// List returns the names and modification times of all objects with the prefix.
+func (s *objectCertStore) List(ctx context.Context) ([]certStoreEntry, error) {
+	return s.list(ctx, 0)
+}
+
+// ModTime returns the modification time of the object.
+func (s *objectCertStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	resp, body, err := s.request(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return time.Time{}, autocert.ErrCacheMiss
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, objectStorageError("HEAD", name, resp, body)
+	}
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+// list lists the objects with the prefix. If limit is not 0, only the first page with at most limit objects is read.
+func (s *objectCertStore) list(ctx context.Context, limit int) ([]certStoreEntry, error) {
+	var list []certStoreEntry
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if limit > 0 {
+			query.Set("max-keys", fmt.Sprint(limit))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, data, err := s.request(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, objectStorageError("LIST", s.prefix, resp, data)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			// HEAD returns the modification time in seconds, so the listing has to match it.
+			list = append(list, certStoreEntry{Name: strings.TrimPrefix(object.Key, s.prefix), ModTime: object.LastModified.Truncate(time.Second)})
+		}
+		if limit > 0 || !result.IsTruncated || result.NextContinuationToken == "" {
+			return list, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// request sends a signed request for the object with the name (with the prefix), or for the bucket if name is empty.
+func (s *objectCertStore) request(ctx context.Context, method, name string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The path style is used, because bucket names with dots do not work with the certificates of virtual hosts.
+	u.Path = "/" + s.bucket + "/"
+	u.RawPath = "/" + awsURIEncode(s.bucket, true) + "/"
+	if name != "" {
+		u.Path += s.prefix + name
+		u.RawPath += awsURIEncode(s.prefix+name, false)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	signAWSRequest(req, body, s.accessKeyID, s.secretAccessKey, s.region, "s3", time.Now())
+
+	client := certHTTPClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, data, nil
+}
+
+// objectStorageError returns the error of a failed request with the message of the error response.
+func objectStorageError(operation, name string, resp *http.Response, data []byte) error {
+	var apiError struct {
+		Code    string
+		Message string
+	}
+	xml.Unmarshal(data, &apiError)
+	return fmt.Errorf("object storage: %s %s failed with status %d: %s %s", operation, name, resp.StatusCode, apiError.Code, apiError.Message)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The Redis backend stores the certificate cache in Redis, so that several servers behind a load balancer share the
+// certificates, the ACME account, and the tokens of the HTTP-01 challenges. A server that receives a challenge request
+// for an order of another server can answer it, and a server uses a certificate that another server already got
+// instead of ordering its own. Each entry is a hash with the fields "data" and "mtime" (Unix nanoseconds), which are
+// written atomically by one HSET.
+//
+// The client only speaks the few commands that are needed (AUTH, SELECT, HSET, HGET, DEL, SCAN) over one connection.
+
+// redisCertStore stores the certificate cache in Redis.
+type redisCertStore struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	useTLS   bool
+
+	mu     sync.Mutex // Protects the connection. Redis answers the commands of a connection in order.
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// openRedisCertStore connects to Redis, so that a wrong address or password stops the server at startup.
+func openRedisCertStore() (*redisCertStore, error) {
+	s := &redisCertStore{
+		addr:     config.RedisAddr,
+		password: string(config.RedisPassword),
+		db:       config.RedisDb,
+		prefix:   config.RedisKeyPrefix,
+		useTLS:   config.RedisTls,
+	}
+	if _, err := s.do(context.Background(), "PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the data of the entry.
+func (s *redisCertStore) Get(ctx context.Context, name string) ([]byte, error) {
+	reply, err := s.do(ctx, "HGET", s.prefix+name, "data")
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+// Put stores the entry.
+func (s *redisCertStore) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.do(ctx, "HSET", s.prefix+name, "data", string(data), "mtime", strconv.FormatInt(time.Now().UnixNano(), 10))
+	return err
+}
+
+// Delete removes the entry.
+func (s *redisCertStore) Delete(ctx context.Context, name string) error {
+	_, err := s.do(ctx, "DEL", s.prefix+name)
+	return err
+}
+
+// List returns the names and modification times of all entries with the key prefix.
+func (s *redisCertStore) List(ctx context.Context) ([]certStoreEntry, error) {
+	var names []string
+	cursor := "0"
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", redisEscapePattern(s.prefix)+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, errors.New("redis: unexpected SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]interface{})
+		for _, key := range keys {
+			if key, ok := key.([]byte); ok {
+				names = append(names, strings.TrimPrefix(string(key), s.prefix))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	list := make([]certStoreEntry, 0, len(names))
+	for _, name := range names {
+		modTime, err := s.ModTime(ctx, name)
+		if err != nil {
+			// The entry was deleted in the meantime.
+			continue
+		}
+		list = append(list, certStoreEntry{Name: name, ModTime: modTime})
+	}
+	return list, nil
+}
+
+// ModTime returns the modification time of the entry.
+func (s *redisCertStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	reply, err := s.do(ctx, "HGET", s.prefix+name, "mtime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	mtime, ok := reply.([]byte)
+	if !ok {
+		return time.Time{}, autocert.ErrCacheMiss
+	}
+	nanos, err := strconv.ParseInt(string(mtime), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// do sends the command and returns the reply. It connects if necessary, and drops the connection after an error,
+// so that the next command reconnects.
+func (s *redisCertStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(ctx, args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			// The connection is in an unknown state.
+			s.conn.Close()
+			s.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// connect opens the connection, authenticates, and selects the database.
+func (s *redisCertStore) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.password != "" {
+		if _, err := s.roundTrip(ctx, "AUTH", s.password); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip(ctx, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip writes the command in the RESP format and reads the reply.
+func (s *redisCertStore) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	s.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(s.reader)
+}
+
+// redisError is an error reply of Redis. The connection is still usable after it.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRedisReply reads one reply. Bulk strings are returned as []byte, nil bulk strings as nil,
+// integers as int64, simple strings as string, and arrays as []interface{}.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisEscapePattern escapes the glob characters of Redis patterns.
+func redisEscapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The SQLite backend stores the certificate cache in a single file. Each entry is replaced atomically, and the
+// certificates have their domain, issue time, and expiry time in separate columns, so that they can be queried:
+//
+//	sqlite3 certcache.db "SELECT domain, expires_at FROM certificates WHERE expires_at IS NOT NULL ORDER BY expires_at"
+//
+// The SQLite driver is not part of the default build. It is linked with the build tag "sqlite" (see sqlite_driver.go).
+
+// sqliteCertStore stores the certificate cache in an SQLite database.
+type sqliteCertStore struct {
+	db *sql.DB
+}
+
+// openSQLiteCertStore opens the database file and creates the table, if it does not exist.
+func openSQLiteCertStore(file string) (*sqliteCertStore, error) {
+	driver := ""
+	for _, name := range sql.Drivers() {
+		if name == "sqlite" || name == "sqlite3" {
+			driver = name
+		}
+	}
+	if driver == "" {
+		return nil, errors.New("this build has no SQLite driver, build it with: go build -tags sqlite")
+	}
+
+	db, err := sql.Open(driver, file)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer at a time.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS certificates (
+		name       TEXT PRIMARY KEY,
+		data       BLOB NOT NULL,
+		domain     TEXT,
+		issued_at  TEXT,
+		expires_at TEXT,
+		updated_at INTEGER NOT NULL
+	)`)
+	if err == nil {
+		// The issuance locks of acme-issuance-lock.
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS issuance_locks (
+			name       TEXT PRIMARY KEY,
+			owner      TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteCertStore{db: db}, nil
+}
+
+// Get returns the data of the entry.
+func (s *sqliteCertStore) Get(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM certificates WHERE name = ?`, name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put stores the entry with the metadata of its certificate, if it contains one.
+func (s *sqliteCertStore) Put(ctx context.Context, name string, data []byte) error {
+	return s.PutWithCertificate(ctx, name, data, parseFirstCertificate(data))
+}
+
+// PutWithCertificate stores the entry with the metadata of the certificate, if it is not nil.
+func (s *sqliteCertStore) PutWithCertificate(ctx context.Context, name string, data []byte, leaf *x509.Certificate) error {
+	var domain, issuedAt, expiresAt sql.NullString
+	if leaf != nil {
+		domain.String, domain.Valid = leaf.Subject.CommonName, true
+		if len(leaf.DNSNames) > 0 {
+			domain.String = leaf.DNSNames[0]
+		}
+		issuedAt = sql.NullString{String: leaf.NotBefore.UTC().Format(time.RFC3339), Valid: true}
+		expiresAt = sql.NullString{String: leaf.NotAfter.UTC().Format(time.RFC3339), Valid: true}
+	}
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO certificates (name, data, domain, issued_at, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET data = excluded.data, domain = excluded.domain,
+			issued_at = excluded.issued_at, expires_at = excluded.expires_at, updated_at = excluded.updated_at`,
+		name, data, domain, issuedAt, expiresAt, time.Now().UnixNano())
+	return err
+}
+
+// Delete removes the entry.
+func (s *sqliteCertStore) Delete(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM certificates WHERE name = ?`, name)
+	return err
+}
+
+// List returns the names and modification times of all entries.
+func (s *sqliteCertStore) List(ctx context.Context) ([]certStoreEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, updated_at FROM certificates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []certStoreEntry
+	for rows.Next() {
+		var name string
+		var updatedAt int64
+		if err := rows.Scan(&name, &updatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, certStoreEntry{Name: name, ModTime: time.Unix(0, updatedAt)})
+	}
+	return list, rows.Err()
+}
+
+// ModTime returns the modification time of the entry.
+func (s *sqliteCertStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	var updatedAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT updated_at FROM certificates WHERE name = ?`, name).Scan(&updatedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, updatedAt), nil
+}
+
+// parseFirstCertificate returns the first certificate in the PEM data, or nil if there is none.
+func parseFirstCertificate(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type == "CERTIFICATE" {
+			leaf, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil
+			}
+			return leaf
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The Vault backend stores the certificate cache, including the ACME account key, as secrets in a KV secrets engine
+// of HashiCorp Vault (version 1 or 2). Each entry is one secret with the fields "data" (base64) and "mtime"
+// (Unix nanoseconds). The parent authenticates with a token or with AppRole, and logs in again when the token
+// of the AppRole login expires.
+
+// vaultCertStore stores the certificate cache in Vault.
+type vaultCertStore struct {
+	addr      string
+	mount     string
+	path      string
+	kvVersion int
+	roleID    string
+	secretID  string
+
+	mu          sync.Mutex // Protects the token.
+	token       string
+	tokenExpiry time.Time // Zero for a configured token, which is not renewed by the server.
+}
+
+// vaultSecret is the content of a secret.
+type vaultSecret struct {
+	Data  string `json:"data"`
+	Mtime string `json:"mtime"`
+}
+
+// openVaultCertStore returns the store and checks that the secrets can be listed,
+// so that a wrong configuration stops the server at startup.
+func openVaultCertStore() (*vaultCertStore, error) {
+	s := &vaultCertStore{
+		addr:      strings.TrimSuffix(config.VaultAddr, "/"),
+		mount:     strings.Trim(config.VaultMount, "/"),
+		path:      strings.Trim(config.VaultPath, "/"),
+		kvVersion: config.VaultKvVersion,
+		roleID:    config.VaultRoleId,
+		secretID:  string(config.VaultSecretId),
+		token:     string(config.VaultToken),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := s.List(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the data of the secret.
+func (s *vaultCertStore) Get(ctx context.Context, name string) ([]byte, error) {
+	secret, err := s.read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(secret.Data)
+}
+
+// Put stores the secret.
+func (s *vaultCertStore) Put(ctx context.Context, name string, data []byte) error {
+	secret := vaultSecret{Data: base64.StdEncoding.EncodeToString(data), Mtime: strconv.FormatInt(time.Now().UnixNano(), 10)}
+	var body interface{} = secret
+	if s.kvVersion == 2 {
+		body = map[string]interface{}{"data": secret}
+	}
+	status, response, err := s.request(ctx, http.MethodPost, s.secretPath("data", name), body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNoContent {
+		return vaultError("write", name, status, response)
+	}
+	return nil
+}
+
+// Delete removes the secret with all its versions.
+func (s *vaultCertStore) Delete(ctx context.Context, name string) error {
+	status, response, err := s.request(ctx, http.MethodDelete, s.secretPath("metadata", name), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNoContent && status != http.StatusNotFound {
+		return vaultError("delete", name, status, response)
+	}
+	return nil
+}
+
+// List returns the names and modification times of all secrets in the path.
+func (s *vaultCertStore) List(ctx context.Context) ([]certStoreEntry, error) {
+	status, response, err := s.request(ctx, "LIST", s.secretPath("metadata", ""), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		// There are no secrets yet.
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, vaultError("list", s.path, status, response)
+	}
+	var result struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, err
+	}
+
+	list := make([]certStoreEntry, 0, len(result.Data.Keys))
+	for _, name := range result.Data.Keys {
+		if strings.HasSuffix(name, "/") {
+			// Sub paths are not used by the server.
+			continue
+		}
+		modTime, err := s.ModTime(ctx, name)
+		if err != nil {
+			// The secret was deleted in the meantime.
+			continue
+		}
+		list = append(list, certStoreEntry{Name: name, ModTime: modTime})
+	}
+	return list, nil
+}
+
+// ModTime returns the modification time of the secret.
+func (s *vaultCertStore) ModTime(ctx context.Context, name string) (time.Time, error) {
+	secret, err := s.read(ctx, name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(secret.Mtime, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// read reads the secret.
+func (s *vaultCertStore) read(ctx context.Context, name string) (*vaultSecret, error) {
+	status, response, err := s.request(ctx, http.MethodGet, s.secretPath("data", name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	if status != http.StatusOK {
+		return nil, vaultError("read", name, status, response)
+	}
+
+	var secret vaultSecret
+	if s.kvVersion == 2 {
+		var result struct {
+			Data struct {
+				Data *vaultSecret `json:"data"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(response, &result); err != nil {
+			return nil, err
+		}
+		if result.Data.Data == nil {
+			// The latest version was deleted.
+			return nil, autocert.ErrCacheMiss
+		}
+		secret = *result.Data.Data
+	} else {
+		var result struct {
+			Data vaultSecret `json:"data"`
+		}
+		if err := json.Unmarshal(response, &result); err != nil {
+			return nil, err
+		}
+		secret = result.Data
+	}
+	return &secret, nil
+}
+
+// secretPath returns the API path of the secret. The KV engine version 2 has separate paths for the data and the
+// metadata (list and delete of all versions), version 1 has only one path.
+func (s *vaultCertStore) secretPath(kind, name string) string {
+	path := "/v1/" + s.mount + "/"
+	if s.kvVersion == 2 {
+		path += kind + "/"
+	}
+	path += s.path + "/"
+	if name != "" {
+		path += url.PathEscape(name)
+	}
+	return path
+}
+
+// request sends the authenticated request and returns the status and the body of the response.
+// If the token of an AppRole login was rejected, it logs in again and repeats the request once.
+func (s *vaultCertStore) request(ctx context.Context, method, path string, body interface{}) (int, []byte, error) {
+	token, err := s.currentToken(ctx, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	status, response, err := s.send(ctx, method, path, token, body)
+	if err == nil && status == http.StatusForbidden && s.roleID != "" {
+		if token, err = s.currentToken(ctx, true); err != nil {
+			return 0, nil, err
+		}
+		status, response, err = s.send(ctx, method, path, token, body)
+	}
+	return status, response, err
+}
+
+// currentToken returns the token. With AppRole, it logs in if there is no valid token or if relogin is true.
+func (s *vaultCertStore) currentToken(ctx context.Context, relogin bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.roleID == "" {
+		return s.token, nil
+	}
+	if !relogin && s.token != "" && (s.tokenExpiry.IsZero() || time.Now().Before(s.tokenExpiry)) {
+		return s.token, nil
+	}
+
+	status, response, err := s.send(ctx, http.MethodPost, "/v1/auth/approle/login", "", map[string]string{"role_id": s.roleID, "secret_id": s.secretID})
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", vaultError("AppRole login", s.roleID, status, response)
+	}
+	var result struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return "", err
+	}
+	if result.Auth.ClientToken == "" {
+		return "", errors.New("vault: AppRole login returned no token")
+	}
+	s.token = result.Auth.ClientToken
+	s.tokenExpiry = time.Time{}
+	if result.Auth.LeaseDuration > 0 {
+		// Log in again a bit before the token expires.
+		s.tokenExpiry = time.Now().Add(time.Duration(result.Auth.LeaseDuration) * time.Second * 9 / 10)
+	}
+	return s.token, nil
+}
+
+// send sends one request to Vault.
+func (s *vaultCertStore) send(ctx context.Context, method, path, token string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.addr+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := certHTTPClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// vaultError returns the error of a failed request with the errors of the response.
+func vaultError(operation, name string, status int, response []byte) error {
+	var result struct {
+		Errors []string `json:"errors"`
+	}
+	json.Unmarshal(response, &result)
+	return fmt.Errorf("vault: %s %s failed with status %d: %s", operation, name, status, strings.Join(result.Errors, "; "))
+}
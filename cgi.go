@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// The files in the cgi-bin directory of a domain are executed as CGI scripts, for legacy scripts. CGI is opt-in per
+// domain. The scripts run in the child, so they are confined by the sandbox: in the chroot and namespaces sandboxes
+// they only see the web root, and with Landlock they can only read the web root and execute the files of the
+// cgi-bin directories. The environment of a script only has the CGI variables of the request and the variables of
+// cgi-env, and the script is killed after cgi-timeout. Only executable files are run; all other requests below
+// cgi-bin are answered with 404 Not Found, so that the scripts are never served as files.
+
+// matchCGIScriptName matches the names of the scripts in the cgi-bin directories.
+var matchCGIScriptName = regexp.MustCompile(`^[a-zA-Z0-9_-]+(\.[a-zA-Z0-9_-]+)*$`).MatchString
+
+// checkCGIBin returns an error if the cgi-bin URL path is not the clean URL path of a directory below "/", or if the
+// scanner-action would answer the requests of its scripts.
+func checkCGIBin(cgiBin *string) error {
+	if cgiBin == nil || *cgiBin == "" {
+		return nil
+	}
+	if !strings.HasSuffix(*cgiBin, "/") || *cgiBin == "/" || !matchDirectoryPath(*cgiBin) {
+		return fmt.Errorf("'%s' must be the URL path of a directory, e.g. '/cgi-bin/'", *cgiBin)
+	}
+	return checkScriptPath(*cgiBin + "script")
+}
+
+// checkCGIEnv returns an error if a variable of cgi-env has an invalid name or value.
+func checkCGIEnv(env map[string]string) error {
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.Contains(value, "\x00") {
+			return fmt.Errorf("the variable '%s' is invalid", name)
+		}
+	}
+	return nil
+}
+
+// isCGIScriptFile returns true if the file with the name in the web root (e.g. "example.com/cgi-bin/hello") is in
+// the cgi-bin directory of its domain. The scripts keep their execute permission in the web root.
+func isCGIScriptFile(name string) bool {
+	domain, rest, _ := strings.Cut(name, "/")
+	cgiBin := settingsForDomain(domain).cgiBin
+	return cgiBin != "" && strings.HasPrefix("/"+rest, cgiBin)
+}
+
+// serveCGI executes the script of the cgi-bin directory of the domain that the URL path names. The rest of the URL
+// path after the script name is passed as PATH_INFO. It returns false if the URL path is not in the cgi-bin
+// directory.
+func serveCGI(w http.ResponseWriter, r *http.Request, domain string, settings domainSettings) bool {
+	if settings.cgiBin == "" || !strings.HasPrefix(r.URL.Path, settings.cgiBin) {
+		return false
+	}
+	script, pathInfo, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, settings.cgiBin), "/")
+	if pathInfo != "" {
+		pathInfo = "/" + pathInfo
+	}
+	// The script gets the paths in the file system of the child, which is inside the sandbox.
+	documentRoot, _ := filepath.Abs(filepath.Join(config.WebRootDirectory, domain))
+	scriptName := settings.cgiBin + script
+	scriptFile := filepath.Join(documentRoot, filepath.FromSlash(scriptName))
+	info, err := os.Stat(scriptFile)
+	if !matchCGIScriptName(script) || err != nil || !info.Mode().IsRegular() || (runtime.GOOS != "windows" && info.Mode()&0111 == 0) {
+		http.NotFound(w, r)
+		return true
+	}
+
+	params := cgiParams(r, domain, scriptName, scriptFile, documentRoot)
+	params["PATH_INFO"] = pathInfo
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = filepath.Join(documentRoot, filepath.FromSlash(path.Clean(pathInfo)))
+	}
+	for name, value := range config.CgiEnv {
+		params[name] = value
+	}
+	if err := runCGIScript(w, r, scriptFile, params); err != nil {
+		log.Println("CGI:", scriptName, "failed:", err)
+	}
+	return true
+}
+
+// runCGIScript executes the script with the params as environment, and writes its response.
+func runCGIScript(w http.ResponseWriter, r *http.Request, scriptFile string, params map[string]string) error {
+	body, err := cgiRequestBody(w, r, params)
+	if err != nil {
+		return err
+	}
+
+	// The script is killed after cgi-timeout, or when the client goes away.
+	ctx, cancel := context.WithTimeout(r.Context(), config.CgiTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, scriptFile)
+	cmd.Dir = filepath.Dir(scriptFile)
+	cmd.Env = make([]string, 0, len(params))
+	for name, value := range params {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Stdin = body
+	cmd.Stderr = &cgiStderr{script: params["SCRIPT_NAME"]}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+
+	err = writeCGIResponse(w, r, bufio.NewReader(stdout), func() {})
+	if errors.Is(err, errCGIHeader) {
+		status := http.StatusBadGateway
+		if ctx.Err() == context.DeadlineExceeded {
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, http.StatusText(status), status)
+	}
+	// The rest of the output is not needed, e.g. after a HEAD request.
+	stdout.Close()
+	waitErr := cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("killed after %s", config.CgiTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return waitErr
+}
+
+// cgiStderr logs the lines that a script writes to stderr.
+type cgiStderr struct {
+	script string
+	line   []byte
+}
+
+// Write logs the complete lines, and keeps the incomplete last line.
+func (s *cgiStderr) Write(data []byte) (int, error) {
+	s.line = append(s.line, data...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(s.line[:i])); line != "" {
+			log.Println("CGI:", s.script+":", line)
+		}
+		s.line = s.line[i+1:]
+	}
+	if len(s.line) > 4096 {
+		log.Println("CGI:", s.script+":", strings.TrimSpace(string(s.line)))
+		s.line = nil
+	}
+	return len(data), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// challengePathPrefix is the URL path prefix of ACME HTTP-01 challenges.
+const challengePathPrefix = "/.well-known/acme-challenge/"
+
+// startChallengeResponder starts an HTTP server in the parent that answers ACME HTTP-01 challenges
+// from the certificate cache and redirects all other requests to HTTPS.
+//
+// The autocert manager in the child stores the challenge responses with the "put" command under
+// the name "<token>+http-01", so the parent can answer them without the child running an HTTP server.
+func startChallengeResponder(cache autocert.Cache) *http.Server {
+	server := &http.Server{
+		Addr:         config.HttpAddr,
+		ReadTimeout:  config.MaxRequestTimeout,
+		WriteTimeout: config.MaxResponseTimeout,
+		IdleTimeout:  config.MaxIdleTimeout,
+		Handler: headerProfileHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, challengePathPrefix) {
+				serveChallenge(w, r, cache)
+				return
+			}
+			redirectToHTTPS(w, r)
+		})),
+	}
+
+	log.Println("Starting HTTP challenge responder on", server.Addr)
+
+	// Listen on the specified address.
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		// Serve HTTP connections on the listener.
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return server
+}
+
+// serveChallenge answers an ACME HTTP-01 challenge with the response stored in the cache.
+func serveChallenge(w http.ResponseWriter, r *http.Request, cache autocert.Cache) {
+	token := path.Base(r.URL.Path)
+	if token == "" || token == "." || token == "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := cache.Get(context.Background(), token+"+http-01")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if config.LogRequests {
+		log.Println("Challenge request:", logAddr(r.RemoteAddr), "", r.URL.Path)
+	}
+	markACMEChallengeFetched(r.Host)
+
+	w.Write(data)
+}
+
+// redirectToHTTPS redirects GET and HEAD requests to the same URL with the https scheme.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The chaos hooks make the child crash or hang on purpose. They are only meant for testing how the
+// parent and the operators deal with a misbehaving child, e.g. in integration tests or operational drills.
+//
+// They are enabled with the command line flag `-chaos=<mode>:<delay>`, e.g. `-chaos=crash:30s` or `-chaos=hang:1m`.
+// The parent passes the flag to the child.
+
+// Chaos modes.
+const (
+	chaosCrash = "crash"
+	chaosHang  = "hang"
+)
+
+// The chaos mode and the delay after which the child starts to misbehave.
+var chaosMode = ""
+var chaosDelay time.Duration
+
+// Is set to 1 when the child hangs.
+var chaosHanging int32
+
+// parseChaosFlag parses the value of the `-chaos` flag.
+func parseChaosFlag(value string) error {
+	mode, delay, found := strings.Cut(value, ":")
+	if mode != chaosCrash && mode != chaosHang {
+		return fmt.Errorf("unknown chaos mode: %s", mode)
+	}
+
+	chaosMode = mode
+	chaosDelay = 0
+	if found {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return fmt.Errorf("invalid chaos delay: %v", err)
+		}
+		chaosDelay = d
+	}
+	return nil
+}
+
+// chaosArgs returns the command line arguments for the child to enable the same chaos mode.
+func chaosArgs() []string {
+	if chaosMode == "" {
+		return nil
+	}
+	return []string{"-chaos=" + chaosMode + ":" + chaosDelay.String()}
+}
+
+// startChaos makes the child crash or hang after the chaos delay, if a chaos mode is set.
+func startChaos() {
+	if chaosMode == "" {
+		return
+	}
+
+	log.Printf("Warning: chaos mode enabled. The child will %s in %s.", chaosMode, chaosDelay)
+	time.AfterFunc(chaosDelay, func() {
+		switch chaosMode {
+		case chaosCrash:
+			log.Println("Chaos: crashing child")
+			os.Exit(exitChaosCrash)
+		case chaosHang:
+			log.Println("Chaos: child hangs")
+			atomic.StoreInt32(&chaosHanging, 1)
+		}
+	})
+}
+
+// chaosCheckpoint blocks forever if the child hangs.
+// It is called in all places where the child communicates with the parent or with clients.
+func chaosCheckpoint() {
+	if atomic.LoadInt32(&chaosHanging) == 1 {
+		select {}
+	}
+}
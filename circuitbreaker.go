@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Each upstream (a backend of sni-passthrough or an upstream of proxy) has a circuit breaker. After
+// circuit-breaker-failures consecutive failures, the breaker opens, and the connections for the upstream fail right
+// away instead of waiting for the dead backend. After circuit-breaker-open-duration, the breaker is half-open: one
+// connection is let through as a probe. If it succeeds, the breaker closes again, otherwise it stays open for another
+// duration. The upstreams are identified by host and port, so a backend that is used by both shares one breaker.
+
+// circuitBreaker is the state of the circuit breaker of one upstream.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int       // Consecutive failures.
+	openUntil time.Time // The breaker is open until then, if failures reached circuit-breaker-failures.
+	probing   bool      // A probe is running in the half-open state.
+}
+
+// circuitBreakers are the circuit breakers by upstream.
+var circuitBreakers = map[string]*circuitBreaker{}
+var circuitBreakersMu sync.Mutex
+
+// upstreamCircuitBreaker returns the circuit breaker of the upstream.
+func upstreamCircuitBreaker(upstream string) *circuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	b, ok := circuitBreakers[upstream]
+	if !ok {
+		b = &circuitBreaker{}
+		circuitBreakers[upstream] = b
+	}
+	return b
+}
+
+// allow returns true if a connection to the upstream may be tried. In the half-open state, only one probe is allowed.
+func (b *circuitBreaker) allow() bool {
+	if config.CircuitBreakerFailures == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < config.CircuitBreakerFailures {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success closes the circuit breaker of the upstream.
+func (b *circuitBreaker) success(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if config.CircuitBreakerFailures > 0 && b.failures >= config.CircuitBreakerFailures {
+		log.Println("Circuit breaker: closed again for", upstream)
+	}
+	b.failures, b.probing = 0, false
+}
+
+// failure counts a failure of the upstream, and opens its circuit breaker after circuit-breaker-failures failures.
+func (b *circuitBreaker) failure(upstream string) {
+	if config.CircuitBreakerFailures == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= config.CircuitBreakerFailures {
+		b.openUntil = time.Now().Add(config.CircuitBreakerOpenDuration)
+		b.probing = false
+		log.Printf("Circuit breaker: open for %s after %d failures of %s", config.CircuitBreakerOpenDuration, b.failures, upstream)
+	}
+}
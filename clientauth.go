@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Client authentication modes.
+const (
+	clientAuthNone     = "none"     // Do not ask for client certificates.
+	clientAuthOptional = "optional" // Verify client certificates, if the client sends one.
+	clientAuthRequire  = "require"  // Require a valid client certificate.
+)
+
+// clientCAs holds the pools of client CA certificates per (ASCII) domain in the child.
+// They are sent by the parent and can be replaced while the server is running.
+var clientCAs = map[string]*x509.CertPool{}
+var clientCAsMu sync.RWMutex
+
+// clientCACacheKey returns the name under which the client CA bundle of the domain is stored in the certificate cache.
+func clientCACacheKey(domain string) string {
+	return "client-ca+" + domain
+}
+
+// parseClientCABundle parses all PEM encoded certificates of the bundle.
+func parseClientCABundle(data []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return nil, errors.New("no certificates found in client CA bundle")
+	}
+	return pool, nil
+}
+
+// setClientCABundle replaces the client CA pool of the domain. It is called in the child.
+func setClientCABundle(domain string, data []byte) {
+	pool, err := parseClientCABundle(data)
+	if err != nil {
+		log.Println("Could not set client CA bundle for", domain+":", err)
+		return
+	}
+
+	clientCAsMu.Lock()
+	clientCAs[domain] = pool
+	clientCAsMu.Unlock()
+	log.Println("Client CA bundle set for:", domain)
+}
+
+// tlsClientAuthType converts the client authentication mode into the TLS client authentication type.
+func tlsClientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case clientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+// getConfigForClient returns a function for tls.Config.GetConfigForClient, which enables
+// client authentication with the current client CA pool for the domains that use it.
+func getConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		domain, err := canonicalHost(hello.ServerName)
+		if err != nil || domain == "" {
+			// Without server name, the client certificate can not be checked for the domain of the requests.
+			if clientAuthRequired() {
+				return nil, errors.New("client authentication needs a server name")
+			}
+			return nil, nil
+		}
+		mode := settingsForDomain(domain).clientAuth
+		if mode == clientAuthNone {
+			return nil, nil
+		}
+
+		clientCAsMu.RLock()
+		pool := clientCAs[domain]
+		clientCAsMu.RUnlock()
+		if pool == nil {
+			// Fail closed: without CA bundle, no client certificate can be verified.
+			return nil, fmt.Errorf("no client CA bundle for %s", domain)
+		}
+
+		cfg := base.Clone()
+		cfg.ClientAuth = tlsClientAuthType(mode)
+		cfg.ClientCAs = pool
+		if settings := settingsForDomain(domain); clientRevocationChecked(settings) {
+			cfg.VerifyPeerCertificate = verifyClientRevocation(domain, settings)
+		}
+		return cfg, nil
+	}
+}
+
+// clientAuthRequired returns true if a domain requires client certificates.
+func clientAuthRequired() bool {
+	for domain := range config.Domains {
+		if settingsForDomain(domain).clientAuth == clientAuthRequire {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClientAuth checks that a request for a domain with client authentication uses a connection whose handshake was
+// for the same domain, so that the client certificate was verified with the CA bundle of the domain. Otherwise, a
+// client could do the handshake for another domain, or reuse the connection of another domain (HTTP/2 connection
+// coalescing), and request the domain with the Host header. It answers refused requests and returns false for them.
+func checkClientAuth(w http.ResponseWriter, r *http.Request, domain string, settings domainSettings) bool {
+	if settings.clientAuth == clientAuthNone {
+		return true
+	}
+	if r.TLS == nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	if serverName, err := canonicalHost(r.TLS.ServerName); err != nil || serverName != domain {
+		// The client can repeat the request on a new connection for the domain.
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return false
+	}
+	if settings.clientAuth == clientAuthRequire && len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pushClientCABundles sends the client CA bundles of all domains with client authentication to the child.
+// A bundle that was uploaded via the admin socket (and stored in the certificate cache) has precedence over
+// the client-ca-file. It is called in the parent, which can read files outside of the jail.
+func pushClientCABundles(cache autocert.Cache) {
+	for domain, d := range config.Domains {
+		settings := settingsForDomain(domain)
+		if settings.clientAuth == clientAuthNone {
+			continue
+		}
+
+		data, err := cache.Get(context.Background(), clientCACacheKey(domain))
+		if err != nil && d.ClientCAFile != nil && *d.ClientCAFile != "" {
+			data, err = os.ReadFile(*d.ClientCAFile)
+		}
+		if err != nil {
+			log.Println("No client CA bundle for", domain+". Client authentication will fail.")
+			continue
+		}
+
+		parentToChildCh <- Command{Type: cmdClientCA, Name: domain, Data: data}
+	}
+}
+
+// uploadClientCABundle validates the bundle, stores it in the certificate cache, and sends it to the child.
+// It is called in the parent for the admin command "client-ca".
+func uploadClientCABundle(cache autocert.Cache, domain string, data []byte) error {
+	if _, err := parseClientCABundle(data); err != nil {
+		return err
+	}
+	if err := cache.Put(context.Background(), clientCACacheKey(domain), data); err != nil {
+		return err
+	}
+	parentToChildCh <- Command{Type: cmdClientCA, Name: domain, Data: data}
+	return nil
+}
+
+// runClientCA implements the `client-ca <domain> <pem-file>` subcommand. It uploads the client
+// CA bundle for the domain to the running server via the admin socket.
+func runClientCA(args []string) {
+	if len(args) != 2 {
+		log.Fatal("Usage: sslserver client-ca <domain> <pem-file>")
+	}
+
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseClientCABundle(data); err != nil {
+		log.Fatal(err)
+	}
+
+	readConfig()
+
+	answer, err := adminRequest("client-ca " + args[0] + " " + base64.StdEncoding.EncodeToString(data))
+	if err != nil {
+		log.Fatal("Could not upload client CA bundle: ", err)
+	}
+	log.Println("Client CA:", answer)
+	os.Exit(0)
+}
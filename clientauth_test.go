@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCheckClientAuth checks that domains with client authentication are only served on connections whose handshake
+// was for the domain, and with a verified client certificate if it is required.
+func TestCheckClientAuth(t *testing.T) {
+	verified := [][]*x509.Certificate{{&x509.Certificate{}}}
+	tests := []struct {
+		name       string
+		mode       string
+		tls        *tls.ConnectionState
+		wantStatus int // 0 means that the request is served.
+	}{
+		{"no client auth", clientAuthNone, &tls.ConnectionState{ServerName: "other.example"}, 0},
+		{"no client auth without TLS", clientAuthNone, nil, 0},
+		{"verified", clientAuthRequire, &tls.ConnectionState{ServerName: "example.com", VerifiedChains: verified}, 0},
+		{"verified with other case", clientAuthRequire, &tls.ConnectionState{ServerName: "Example.COM", VerifiedChains: verified}, 0},
+		{"optional without certificate", clientAuthOptional, &tls.ConnectionState{ServerName: "example.com"}, 0},
+		{"required without certificate", clientAuthRequire, &tls.ConnectionState{ServerName: "example.com"}, http.StatusForbidden},
+		{"handshake for other domain", clientAuthRequire, &tls.ConnectionState{ServerName: "other.example", VerifiedChains: verified}, http.StatusMisdirectedRequest},
+		{"optional with handshake for other domain", clientAuthOptional, &tls.ConnectionState{ServerName: "other.example"}, http.StatusMisdirectedRequest},
+		{"handshake without server name", clientAuthRequire, &tls.ConnectionState{VerifiedChains: verified}, http.StatusMisdirectedRequest},
+		{"without TLS", clientAuthRequire, nil, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		r.TLS = test.tls
+		w := httptest.NewRecorder()
+		served := checkClientAuth(w, r, "example.com", domainSettings{clientAuth: test.mode})
+		if served != (test.wantStatus == 0) {
+			t.Errorf("%s: served %t, want %t", test.name, served, test.wantStatus == 0)
+		} else if !served && w.Code != test.wantStatus {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.wantStatus)
+		}
+	}
+}
+
+// TestGetConfigForClientWithoutServerName checks that handshakes without server name fail while a domain requires
+// client certificates, because the client certificate could not be verified for the domain of the requests.
+func TestGetConfigForClientWithoutServerName(t *testing.T) {
+	savedDomains := config.Domains
+	defer func() { config.Domains = savedDomains }()
+	getConfig := getConfigForClient(&tls.Config{})
+
+	for _, mode := range []string{clientAuthNone, clientAuthOptional, clientAuthRequire} {
+		config.Domains = map[string]DomainConfig{"example.com": {ClientAuth: &mode}}
+		cfg, err := getConfig(&tls.ClientHelloInfo{})
+		if mode == clientAuthRequire {
+			if err == nil {
+				t.Errorf("%s: handshake without server name accepted", mode)
+			}
+		} else if cfg != nil || err != nil {
+			t.Errorf("%s: got %v, %v, want the base config", mode, cfg, err)
+		}
+	}
+}
+
+// TestDefaultDomainWithClientAuth checks that clients without server name do not get the certificate of a default
+// domain that uses client authentication.
+func TestDefaultDomainWithClientAuth(t *testing.T) {
+	savedDomains, savedDefaultDomain := config.Domains, config.DefaultDomain
+	defer func() { config.Domains, config.DefaultDomain = savedDomains, savedDefaultDomain }()
+	config.DefaultDomain = "example.com"
+
+	for _, mode := range []string{clientAuthOptional, clientAuthRequire} {
+		config.Domains = map[string]DomainConfig{"example.com": {ClientAuth: &mode}}
+		if cert, err := MyGetCertificate(&tls.ClientHelloInfo{}); cert != nil || err == nil {
+			t.Errorf("%s: got the certificate of the default domain", mode)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// The child checks the revocation status of client certificates after they have been verified against the client CA
+// bundle. The CRLs of client-crl-urls and the answers of the OCSP responders are cached, so that only the first
+// handshake after the cache expired waits for the CA. If the status cannot be determined, the policy decides whether
+// the handshake fails (fail-closed) or continues (fail-open). Revoked certificates are always rejected.
+//
+// The CRL files of client-crl-files can not be read in the jail. The parent reads them, checks every minute whether
+// they changed (job client-crl-reload), and sends the changed ones to the child. A CRL file is used until it is
+// replaced, but not after its next update time, so that a CA that stopped publishing is noticed.
+
+// Client revocation policies.
+const (
+	clientRevocationFailClosed = "fail-closed" // Reject the client certificate if its status is unknown.
+	clientRevocationFailOpen   = "fail-open"   // Accept the client certificate if its status is unknown.
+)
+
+// clientRevocationFetchTimeout is the maximum duration of a request for a CRL or to an OCSP responder.
+const clientRevocationFetchTimeout = 10 * time.Second
+
+// maxCRLSize is the maximum size of a CRL.
+const maxCRLSize = 16 * 1024 * 1024
+
+// errClientCertificateRevoked is returned for revoked client certificates, regardless of the policy.
+var errClientCertificateRevoked = errors.New("client certificate is revoked")
+
+// cachedCRL is a parsed CRL with the time until it is used.
+type cachedCRL struct {
+	crl     *pkix.CertificateList
+	expires time.Time
+}
+
+// cachedOCSPStatus is the OCSP status of a client certificate with the time until it is used.
+type cachedOCSPStatus struct {
+	status  int
+	expires time.Time
+}
+
+var clientCRLs = map[string]*cachedCRL{}
+var clientFileCRLs = map[string]*pkix.CertificateList{}
+var clientOCSPStatuses = map[[32]byte]*cachedOCSPStatus{}
+var clientRevocationMu sync.Mutex
+
+// clientRevocationChecked returns true if the revocation status of client certificates is checked for the domain.
+func clientRevocationChecked(settings domainSettings) bool {
+	return settings.clientAuth != clientAuthNone && (len(settings.clientCRLFiles) > 0 || len(settings.clientCRLURLs) > 0 || settings.clientOCSP)
+}
+
+// verifyClientRevocation returns a function for tls.Config.VerifyPeerCertificate, which checks the revocation
+// status of the verified client certificate of the domain.
+func verifyClientRevocation(domain string, settings domainSettings) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		// Without client certificate (client-auth optional), there is nothing to check.
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) < 2 {
+			return nil
+		}
+		leaf, issuer := verifiedChains[0][0], verifiedChains[0][1]
+
+		err := checkClientRevocation(leaf, issuer, settings)
+		if err == nil {
+			return nil
+		}
+		if err != errClientCertificateRevoked && settings.clientRevocationPolicy == clientRevocationFailOpen {
+			log.Printf("Client certificate %s for %s: revocation status unknown, accepting it (fail-open): %v", leaf.Subject, domain, err)
+			return nil
+		}
+		log.Printf("Client certificate %s for %s rejected: %v", leaf.Subject, domain, err)
+		return err
+	}
+}
+
+// checkClientRevocation checks the client certificate with the configured CRLs and with OCSP. It returns
+// errClientCertificateRevoked if the certificate is revoked, and another error if the status is unknown.
+func checkClientRevocation(leaf, issuer *x509.Certificate, settings domainSettings) error {
+	if len(settings.clientCRLFiles) > 0 || len(settings.clientCRLURLs) > 0 {
+		if err := checkClientCRLs(leaf, issuer, settings); err != nil {
+			return err
+		}
+	}
+	if settings.clientOCSP {
+		if err := checkClientOCSP(leaf, issuer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkClientCRLs checks the client certificate with the CRL of its issuer, which must be one of the CRL files or
+// one of the CRL URLs.
+func checkClientCRLs(leaf, issuer *x509.Certificate, settings domainSettings) error {
+	var lastErr error
+	sources := append(append([]string(nil), settings.clientCRLFiles...), settings.clientCRLURLs...)
+	for i, source := range sources {
+		var crl *pkix.CertificateList
+		var err error
+		if i < len(settings.clientCRLFiles) {
+			crl, err = clientFileCRL(source)
+		} else {
+			crl, err = clientCRL(source)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// Each CRL only applies to the certificates of the CA that signed it.
+		if crl.TBSCertList.Issuer.String() != issuer.Subject.String() || issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return errClientCertificateRevoked
+			}
+		}
+		return nil
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("no CRL for the issuer %s", issuer.Subject)
+}
+
+// clientCRL returns the cached CRL of the url, and fetches it if it is missing or expired.
+func clientCRL(url string) (*pkix.CertificateList, error) {
+	now := time.Now()
+	clientRevocationMu.Lock()
+	cached := clientCRLs[url]
+	clientRevocationMu.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		return cached.crl, nil
+	}
+
+	data, err := fetchClientRevocationData(url, nil, maxCRLSize)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CRL %s: %v", url, err)
+	}
+	if crl.HasExpired(now) {
+		return nil, fmt.Errorf("CRL %s has expired", url)
+	}
+
+	// The CRL is used until it expires, but at most for client-revocation-cache-duration.
+	expires := now.Add(config.ClientRevocationCacheDuration)
+	if next := crl.TBSCertList.NextUpdate; !next.IsZero() && next.Before(expires) {
+		expires = next
+	}
+	clientRevocationMu.Lock()
+	clientCRLs[url] = &cachedCRL{crl: crl, expires: expires}
+	clientRevocationMu.Unlock()
+	return crl, nil
+}
+
+// clientFileCRL returns the CRL of the file that was received from the parent.
+func clientFileCRL(name string) (*pkix.CertificateList, error) {
+	clientRevocationMu.Lock()
+	crl := clientFileCRLs[name]
+	clientRevocationMu.Unlock()
+	if crl == nil {
+		return nil, fmt.Errorf("CRL file %s is not loaded", name)
+	}
+	if crl.HasExpired(time.Now()) {
+		return nil, fmt.Errorf("CRL file %s has expired", name)
+	}
+	return crl, nil
+}
+
+// setClientCRLFile replaces the CRL of the file. It is called in the child.
+func setClientCRLFile(name string, data []byte) {
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		log.Println("Could not set CRL file", name+":", err)
+		return
+	}
+	clientRevocationMu.Lock()
+	clientFileCRLs[name] = crl
+	clientRevocationMu.Unlock()
+	log.Println("CRL file set:", name)
+}
+
+// clientCRLFileStates are the modification times and sizes of the CRL files that were sent to the child.
+var clientCRLFileStates = map[string]string{}
+var clientCRLFileStatesMu sync.Mutex
+
+// reloadClientCRLFiles sends the CRL files of client-crl-files that changed since they were sent last to the child.
+// It is called in the parent, which can read the files.
+func reloadClientCRLFiles() {
+	clientCRLFileStatesMu.Lock()
+	defer clientCRLFileStatesMu.Unlock()
+	for _, name := range clientCRLFileNames() {
+		info, err := os.Stat(name)
+		if err != nil {
+			log.Println("Could not read CRL file:", err)
+			continue
+		}
+		state := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+		if clientCRLFileStates[name] == state {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err == nil && len(data) > maxCRLSize {
+			err = fmt.Errorf("CRL file %s is larger than %d bytes", name, maxCRLSize)
+		}
+		if err == nil {
+			// A CRL that is still being written is tried again with the next check.
+			_, err = x509.ParseCRL(data)
+		}
+		if err != nil {
+			log.Println("Could not load CRL file:", err)
+			continue
+		}
+		clientCRLFileStates[name] = state
+		parentToChildCh <- Command{Type: cmdClientCRL, Name: name, Data: data}
+	}
+}
+
+// clientCRLFileNames returns the CRL files of the domains with client authentication, without duplicates.
+func clientCRLFileNames() []string {
+	var names []string
+	seen := map[string]bool{}
+	for domain := range config.Domains {
+		settings := settingsForDomain(domain)
+		if settings.clientAuth == clientAuthNone {
+			continue
+		}
+		for _, name := range settings.clientCRLFiles {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// checkClientOCSP asks the OCSP responder of the client certificate for its status, or uses the cached status.
+func checkClientOCSP(leaf, issuer *x509.Certificate) error {
+	if len(leaf.OCSPServer) == 0 {
+		return errors.New("client certificate has no OCSP responder")
+	}
+	key := sha256.Sum256(leaf.Raw)
+	now := time.Now()
+
+	clientRevocationMu.Lock()
+	cached := clientOCSPStatuses[key]
+	clientRevocationMu.Unlock()
+	if cached == nil || !now.Before(cached.expires) {
+		request, err := ocsp.CreateRequest(leaf, issuer, nil)
+		if err != nil {
+			return err
+		}
+		data, err := fetchClientRevocationData(leaf.OCSPServer[0], request, 64*1024)
+		if err != nil {
+			return err
+		}
+		response, err := ocsp.ParseResponseForCert(data, leaf, issuer)
+		if err != nil {
+			return err
+		}
+
+		// The status is used until the response expires, but at most for client-revocation-cache-duration.
+		expires := now.Add(config.ClientRevocationCacheDuration)
+		if !response.NextUpdate.IsZero() && response.NextUpdate.Before(expires) {
+			expires = response.NextUpdate
+		}
+		cached = &cachedOCSPStatus{status: response.Status, expires: expires}
+
+		clientRevocationMu.Lock()
+		// Remove the expired statuses, e.g. of clients that did not come back.
+		for k, s := range clientOCSPStatuses {
+			if now.After(s.expires) {
+				delete(clientOCSPStatuses, k)
+			}
+		}
+		clientOCSPStatuses[key] = cached
+		clientRevocationMu.Unlock()
+	}
+
+	switch cached.status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return errClientCertificateRevoked
+	}
+	return errors.New("OCSP status of the client certificate is unknown")
+}
+
+// fetchClientRevocationData gets the CRL from the url, or posts the OCSP request to it, if the request is set.
+func fetchClientRevocationData(url string, request []byte, maxSize int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if request != nil {
+		req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(request))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/ocsp-request")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := certHTTPClient(clientRevocationFetchTimeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s answered with status %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSize))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"matscheko.eu/sslserver/certchain"
+)
+
+// Hosts with a bad real time clock can be off by minutes or hours. The clock-skew-leeway is applied whenever
+// the validity period of a certificate is evaluated, so that such hosts do not reject valid certificates or
+// renew them over and over again.
+
+// certValidAt returns true if the certificate is valid at the given time, with the clock skew leeway on both sides.
+func certValidAt(leaf *x509.Certificate, now time.Time) bool {
+	return certchain.ValidAt(leaf, now, config.ClockSkewLeeway)
+}
+
+// certNeedsRenewal returns true if the certificate expires within the renewal threshold.
+// The leeway is added to the threshold, so that the certificate is rather renewed too early than too late.
+func certNeedsRenewal(leaf *x509.Certificate, threshold time.Duration) bool {
+	return certchain.NeedsRenewal(leaf, threshold, config.ClockSkewLeeway)
+}
+
+// leewayCachedCertificate returns the cached certificate of the domain, if it is only valid because of the leeway.
+// autocert rejects cached certificates that are not yet valid by the local clock, and would get a new certificate
+// on every start of a host whose clock is behind.
+func leewayCachedCertificate(domain string) *tls.Certificate {
+	if config.ClockSkewLeeway == 0 || !isLetsEncryptDomain(domain) {
+		return nil
+	}
+	cached, err := cachedCertificate(context.Background(), domain)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(cached.Leaf.NotBefore) && certValidAt(cached.Leaf, now) && !certNeedsRenewal(cached.Leaf, config.CertificateExpiryRefreshThreshold) {
+		log.Printf("certificate: using cached certificate for %s, which is only valid within the clock skew leeway", domain)
+		return cached
+	}
+	return nil
+}
+
+// checkSystemClock logs a warning if the system time looks wrong. The time is compared with the
+// modification time of the executable and with the Date header of the ACME server.
+func checkSystemClock() {
+	now := time.Now()
+
+	if executable, err := os.Executable(); err == nil {
+		if info, err := os.Stat(executable); err == nil && now.Add(config.ClockSkewLeeway).Before(info.ModTime()) {
+			log.Printf("Warning: the system time %s is before the modification time of the executable %s. The system clock seems to be wrong.",
+				now.Format(time.RFC3339), info.ModTime().Format(time.RFC3339))
+		}
+	}
+
+	go func() {
+		resp, err := certHTTPClient(30 * time.Second).Head(config.AcmeDirectoryURL)
+		if err != nil {
+			log.Println("Could not check the system time against the ACME server:", err)
+			return
+		}
+		resp.Body.Close()
+
+		serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return
+		}
+		skew := time.Since(serverTime)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > config.ClockSkewLeeway && skew > time.Minute {
+			log.Printf("Warning: the system time differs by %s from the time of the ACME server. The system clock seems to be wrong. Consider increasing clock-skew-leeway or fixing the clock.",
+				skew.Round(time.Second))
+		}
+	}()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"matscheko.eu/sslserver/filecache"
+)
+
+// Text files that are kept in memory are compressed with the first encoding of the compression setting that the
+// client accepts. The compressed content is kept in the cache with the file, so that each file is compressed once
+// per encoding, and not for each request. gzip is always available. Brotli and Zstandard need external packages,
+// which are linked with the build tags "brotli" and "zstd" (see compress_brotli.go and compress_zstd.go).
+
+// Content encodings.
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
+)
+
+// compressionEncoders are the compression functions of the encodings that this build supports.
+var compressionEncoders = map[string]func([]byte) ([]byte, error){
+	encodingGzip: compressGzip,
+}
+
+// compressionBuildTags are the build tags that add the encoders that are not always available.
+var compressionBuildTags = map[string]string{
+	encodingBrotli: "brotli",
+	encodingZstd:   "zstd",
+}
+
+// compressGzip compresses the data with gzip at the best compression level, because it is done only once.
+func compressGzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkCompression stops the server if an encoding of the compression setting is unknown or not in this build.
+func checkCompression() {
+	for _, encoding := range config.Compression {
+		if _, ok := compressionEncoders[encoding]; ok {
+			continue
+		}
+		if tag, ok := compressionBuildTags[encoding]; ok {
+			log.Fatalf("Error: compression '%s' is not supported by this build, it has to be built with: go build -tags %s", encoding, tag)
+		}
+		log.Fatalf("Error: compression '%s' is invalid, it must be '%s', '%s', or '%s'", encoding, encodingGzip, encodingBrotli, encodingZstd)
+	}
+	if config.CompressionMinSize < 0 {
+		log.Fatal("Error: compression-min-size must not be negative")
+	}
+}
+
+// isCompressibleType returns true if the media type starts with one of the compression-types.
+func isCompressibleType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	for _, prefix := range config.CompressionTypes {
+		if strings.HasPrefix(mediaType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncoding returns the encoding of the compression setting that the Accept-Encoding header prefers, or ""
+// if it accepts none. Between encodings with the same quality, the order of the compression setting decides.
+func acceptedEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[len("q="):], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range config.Compression {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressEntry returns the compressed entry of the file with the cache name, if the client accepts one of the
+// configured encodings, and sets the headers of the compressed response. Otherwise it returns the entry unchanged.
+func compressEntry(w http.ResponseWriter, r *http.Request, name string, entry filecache.Entry) filecache.Entry {
+	if len(config.Compression) == 0 || entry.File != nil || entry.Size < config.CompressionMinSize {
+		return entry
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(entry.Content)
+	}
+	if !isCompressibleType(contentType) {
+		return entry
+	}
+
+	// The response depends on the Accept-Encoding header, also if it is not compressed.
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return entry
+	}
+	compressed, err := webFiles.Compressed(name, encoding, entry, compressionEncoders[encoding])
+	if err != nil {
+		log.Println("Could not compress:", name, err)
+		return entry
+	}
+	if compressed.Size >= entry.Size {
+		// E.g. small files that are already minified.
+		return entry
+	}
+
+	// The content type must be set, because http.ServeContent would detect it from the compressed content.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", encoding)
+	return compressed
+}
@@ -0,0 +1,29 @@
+//go:build brotli
+
+package main
+
+// The Brotli encoder for compression "br". It is pure Go, and its package is in go.mod:
+//
+//	go build -tags brotli
+import (
+	"bytes"
+
+	"github.com/andybalholm/brotli"
+)
+
+func init() {
+	compressionEncoders[encodingBrotli] = compressBrotli
+}
+
+// compressBrotli compresses the data with Brotli at the best compression level, because it is done only once.
+func compressBrotli(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
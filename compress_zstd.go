@@ -0,0 +1,24 @@
+//go:build zstd
+
+package main
+
+// The Zstandard encoder for compression "zstd". It is pure Go, and its package is in go.mod:
+//
+//	go build -tags zstd
+import (
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	compressionEncoders[encodingZstd] = compressZstd
+}
+
+// compressZstd compresses the data with Zstandard at the best compression level, because it is done only once.
+func compressZstd(data []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil), nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/idna"
 	"gopkg.in/yaml.v3"
 )
@@ -18,15 +22,117 @@ type ServerConfig struct {
 	// This is also the directory in which to jail the process on Linux.
 	WebRootDirectory string `yaml:"web-root-directory"`
 
+	// The sandbox of the child: "none", "chroot", "namespaces", or "landlock" (see sandbox.go).
+	Sandbox string `yaml:"sandbox"`
+
+	// Change the owner of all files and directories in the web root to the jail user ("www" or "nobody").
+	// The permissions will then be set to `ug=r` for files and `ug=rx` for directories, so that other
+	// local users can not read the content. Only supported on Linux.
+	ChownWebRoot bool `yaml:"chown-web-root"`
+
+	// The interval in which the web root is checked for new domain directories. 0 disables the check.
+	DomainDiscoveryInterval time.Duration `yaml:"domain-discovery-interval"`
+
 	// Let's Encrypt certificates are stored in this directory.
 	CertificateCacheDirectory string `yaml:"certificate-cache-directory"`
 
+	// Where the parent stores the certificate cache: "directory" (loose files in certificate-cache-directory), "sqlite", "redis", "s3", "gcs", or "vault".
+	CertificateCacheBackend string `yaml:"certificate-cache-backend"`
+
+	// The key (32 bytes in base64) to encrypt the entries of the certificate cache. Empty means the environment
+	// variable SSLSERVER_CERTIFICATE_CACHE_KEY, and if that is empty, the entries are not encrypted.
+	CertificateCacheEncryptionKey secret `yaml:"certificate-cache-encryption-key"`
+
+	// The SQLite file for the certificate-cache-backend "sqlite".
+	CertificateCacheSqliteFile string `yaml:"certificate-cache-sqlite-file"`
+
+	// The Redis server for the certificate-cache-backend "redis" (host:port).
+	RedisAddr string `yaml:"redis-addr"`
+
+	// The password for the Redis server.
+	RedisPassword secret `yaml:"redis-password"`
+
+	// The Redis database number.
+	RedisDb int `yaml:"redis-db"`
+
+	// The prefix of the Redis keys, so that several clusters can share a Redis server.
+	RedisKeyPrefix string `yaml:"redis-key-prefix"`
+
+	// Connect to the Redis server with TLS.
+	RedisTls bool `yaml:"redis-tls"`
+
+	// The endpoint of the object storage for the certificate-cache-backend "s3" or "gcs". Empty means the endpoint of AWS or Google.
+	ObjectStorageEndpoint string `yaml:"object-storage-endpoint"`
+
+	// The bucket of the object storage.
+	ObjectStorageBucket string `yaml:"object-storage-bucket"`
+
+	// The prefix of the object names in the bucket.
+	ObjectStoragePrefix string `yaml:"object-storage-prefix"`
+
+	// The region of the bucket ("auto" for Google Cloud Storage).
+	ObjectStorageRegion string `yaml:"object-storage-region"`
+
+	// The access key ID (or the HMAC key ID of Google Cloud Storage).
+	ObjectStorageAccessKeyId string `yaml:"object-storage-access-key-id"`
+
+	// The secret access key (or the HMAC secret of Google Cloud Storage).
+	ObjectStorageSecretAccessKey secret `yaml:"object-storage-secret-access-key"`
+
+	// The address of the Vault server for the certificate-cache-backend "vault" (e.g. "https://vault.example.com:8200").
+	VaultAddr string `yaml:"vault-addr"`
+
+	// The mount path of the KV secrets engine.
+	VaultMount string `yaml:"vault-mount"`
+
+	// The version of the KV secrets engine (1 or 2).
+	VaultKvVersion int `yaml:"vault-kv-version"`
+
+	// The path of the secrets in the KV secrets engine.
+	VaultPath string `yaml:"vault-path"`
+
+	// The Vault token. Not needed with AppRole.
+	VaultToken secret `yaml:"vault-token"`
+
+	// The role ID for the AppRole login.
+	VaultRoleId string `yaml:"vault-role-id"`
+
+	// The secret ID for the AppRole login.
+	VaultSecretId secret `yaml:"vault-secret-id"`
+
 	// The HTTP address (host:port or :port) to bind the server to.
 	HttpAddr string `yaml:"http-addr"`
 
+	// URL path prefixes that are served on the HTTP address instead of being redirected to HTTPS.
+	HttpExemptPaths []string `yaml:"http-exempt-paths"`
+
+	// Handler stacks of the HTTP and the HTTPS listener: "redirect" (HTTP only), "static", or "challenge-only".
+	HttpHandler  string `yaml:"http-handler"`
+	HttpsHandler string `yaml:"https-handler"`
+
+	// Answer the ACME HTTP-01 challenges in the parent instead of the child.
+	// The parent then binds to the HTTP address and redirects all other requests to HTTPS,
+	// so the jailed child only has to run the HTTPS server.
+	HttpChallengeInParent bool `yaml:"http-challenge-in-parent"`
+
+	// Redirect requests with a host name that is not in its canonical form (e.g. EXAMPLE.com or example.com.)
+	// to the canonical URL.
+	CanonicalHostRedirect bool `yaml:"canonical-host-redirect"`
+
 	// The HTTPS address (host:port or :port) to bind the server to.
 	HttpsAddr string `yaml:"https-addr"`
 
+	// The ACME challenge types that may be used ("tls-alpn-01", "http-01", "dns-01").
+	AcmeChallengeTypes []string `yaml:"acme-challenge-types"`
+
+	// Server names whose TLS connections on the HTTPS address are not terminated, but forwarded to the backend (host:port).
+	SniPassthrough map[string]string `yaml:"sni-passthrough"`
+
+	// Consecutive failures of an upstream after which its circuit breaker opens (0 disables the circuit breakers),
+	// and the time until a probe is let through.
+	CircuitBreakerFailures     int           `yaml:"circuit-breaker-failures"`
+	CircuitBreakerOpenDuration time.Duration `yaml:"circuit-breaker-open-duration"`
+
 	// Let's Encrypt white list.
 	// These domains are allowed to fetch a Let's Encrypt certificate.
 	// This is not directly configurable. Instead, the domain directories in www_static will be used
@@ -43,12 +149,180 @@ type ServerConfig struct {
 	// Name of the web server used as Server header.
 	ServerName string `yaml:"server-name"`
 
+	// The header profile: "go" sends the headers as the Go HTTP server does, "neutral" makes the
+	// server less identifiable (common header name casing, Date rounded to minutes, neutral error pages).
+	HeaderProfile string `yaml:"header-profile"`
+
 	// Security http headers.
 	HttpHeaderXContentTypeOptions     string `yaml:"http-header-x-content-type-options"`
 	HttpHeaderStrictTransportSecurity string `yaml:"http-header-strict-transport-security"`
 	HttpHeaderContentSecurityPolicy   string `yaml:"http-header-content-security-policy"`
 	HttpHeaderXFrameOptions           string `yaml:"http-header-x-frame-options"`
 
+	// The ETag that is sent for files: "" (no ETag), "hash" (SHA-256 of the content), or "mtime-size" (modification time and size).
+	ETag string `yaml:"etag"`
+
+	// Send the Last-Modified header.
+	LastModified bool `yaml:"last-modified"`
+
+	// Answer requests with an If-Modified-Since header with 304 Not Modified, if the file did not change.
+	IfModifiedSince bool `yaml:"if-modified-since"`
+
+	// Rules that select the Cache-Control header of the files by their URL path. The first matching rule wins.
+	CacheControl []CacheControlRule `yaml:"cache-control"`
+
+	// Rules that redirect URL paths to other URL paths or URLs. The first matching rule wins.
+	Redirects []RedirectRule `yaml:"redirects"`
+
+	// Also use the rules of the _redirects file in the domain directory.
+	RedirectsFile bool `yaml:"redirects-file"`
+
+	// Rules that map URL paths to other files with regular expressions, without a redirect. The first matching rule wins.
+	Rewrites []RewriteRule `yaml:"rewrites"`
+
+	// Rules that forward URL path prefixes to upstream HTTP or HTTPS backends. The first matching rule wins.
+	Proxy []ProxyRule `yaml:"proxy"`
+
+	// Rules that forward the requests of scripts, e.g. of ".php" files, to a FastCGI server like PHP-FPM.
+	FastCGI []FastCGIRule `yaml:"fastcgi"`
+
+	// Rules that protect URL path prefixes with HTTP Basic authentication. The first matching rule wins.
+	BasicAuth []BasicAuthRule `yaml:"basic-auth"`
+
+	// The number of failed Basic authentication attempts of a client after which it is locked out.
+	BasicAuthMaxFailures int `yaml:"basic-auth-max-failures"`
+
+	// The period in which the failed attempts are counted, and the lockout lasts.
+	BasicAuthLockout time.Duration `yaml:"basic-auth-lockout"`
+
+	// The maximum duration of a CGI script, after which it is killed.
+	CgiTimeout time.Duration `yaml:"cgi-timeout"`
+
+	// Additional environment variables of the CGI scripts, e.g. PATH.
+	CgiEnv map[string]string `yaml:"cgi-env"`
+
+	// DNS providers for DNS-01 challenges. The keys are the names that are used in the per domain setting dns-provider.
+	DNSProviders map[string]DNSProviderConfig `yaml:"dns-providers"`
+
+	// Settings that are overridden per domain. The keys are the domain names.
+	Domains map[string]DomainConfig `yaml:"domains"`
+
+	// The directory URL of the ACME CA, e.g. the Let's Encrypt staging server, Buypass, or an internal ACME CA.
+	AcmeDirectoryURL string `yaml:"acme-directory-url"`
+
+	// The key type of the certificates from the ACME CA: "ecdsa-p256", "rsa2048", or "rsa4096".
+	AcmeKeyType string `yaml:"acme-key-type"`
+
+	// The key type of the ACME account key. It is only used when the account key is created.
+	AcmeAccountKeyType string `yaml:"acme-account-key-type"`
+
+	// Get an ECDSA and an RSA certificate for each domain, and give the RSA certificate to clients without ECDSA support.
+	DualCertificates bool `yaml:"dual-certificates"`
+
+	// Staple OCSP responses to the certificates of CAs that have an OCSP responder.
+	OcspStapling bool `yaml:"ocsp-stapling"`
+
+	// Request certificates with the OCSP Must-Staple extension. They are only served with a valid staple.
+	OcspMustStaple bool `yaml:"ocsp-must-staple"`
+
+	// The key ID and the (base64url encoded) HMAC key for the external account binding, which some ACME CAs
+	// like ZeroSSL or Google Trust Services require to register an account.
+	AcmeEabKid  string `yaml:"acme-eab-kid"`
+	AcmeEabHmac secret `yaml:"acme-eab-hmac"`
+
+	// The DNS servers (host:port) that are used to resolve host names for ACME and DNS-01 challenges.
+	// If empty, the resolver of the host is used.
+	CertDnsServers []string `yaml:"cert-dns-servers"`
+
+	// Maximum duration of a DNS lookup for ACME and DNS-01 challenges.
+	CertDnsTimeout time.Duration `yaml:"cert-dns-timeout"`
+
+	// Let the child resolve host names through the parent, and the duration for which the child caches the answers.
+	ResolveThroughParent bool          `yaml:"resolve-through-parent"`
+	ResolveCacheDuration time.Duration `yaml:"resolve-cache-duration"`
+
+	// The delay before Let's Encrypt is asked again for a domain after the first failure. It doubles with every failure.
+	AcmeBackoffMin time.Duration `yaml:"acme-backoff-min"`
+
+	// The maximum delay before Let's Encrypt is asked again for a domain after failures.
+	AcmeBackoffMax time.Duration `yaml:"acme-backoff-max"`
+
+	// The percentage of a Let's Encrypt rate limit from which a warning is logged. 0 disables the warnings.
+	AcmeRateLimitWarning int `yaml:"acme-rate-limit-warning"`
+
+	// Take a lock in the certificate cache backend before a certificate is ordered, so that servers that share
+	// the backend do not order the same certificate at the same time.
+	AcmeIssuanceLock bool `yaml:"acme-issuance-lock"`
+
+	// The time after which an issuance lock expires, and how long a server waits for a lock of another server.
+	AcmeIssuanceLockTtl  time.Duration `yaml:"acme-issuance-lock-ttl"`
+	AcmeIssuanceLockWait time.Duration `yaml:"acme-issuance-lock-wait"`
+
+	// Tolerated difference between the system clock and the real time when the validity of certificates is evaluated.
+	ClockSkewLeeway time.Duration `yaml:"clock-skew-leeway"`
+
+	// Interval in which the parent checks the certificate cache directory for new or changed certificates
+	// and pushes them to the child. 0 disables pushing.
+	CertificatePushInterval time.Duration `yaml:"certificate-push-interval"`
+
+	// Sign the certificates of the self-signed domains with a persistent local development CA.
+	LocalCA bool `yaml:"local-ca"`
+
+	// Validity of the local development CA, and the overlaps before and after it is replaced by the next CA.
+	LocalCAValidity time.Duration `yaml:"local-ca-validity"`
+	LocalCAOverlap  time.Duration `yaml:"local-ca-overlap"`
+
+	// Interval in which self-signed certificates get new keys. They stay valid for certificate-expiry-refresh-threshold longer.
+	SelfSignedValidity time.Duration `yaml:"self-signed-validity"`
+
+	// Interval in which the child checks if self-signed certificates have to be replaced soon, and replaces them
+	// ahead of time. 0 disables the background regeneration.
+	SelfSignedRegenerationInterval time.Duration `yaml:"self-signed-regeneration-interval"`
+
+	// The organization in the subject of self-signed certificates.
+	SelfSignedOrganization string `yaml:"self-signed-organization"`
+
+	// Maximum duration for which CRLs and OCSP responses for client certificates are cached.
+	ClientRevocationCacheDuration time.Duration `yaml:"client-revocation-cache-duration"`
+
+	// Maximum number of new certificates that are ordered per hour. 0 means unlimited.
+	HostPolicyMaxNewCertificatesPerHour int `yaml:"host-policy-max-new-certificates-per-hour"`
+
+	// Maximum number of subdomain levels in front of the registrable domain. 0 means unlimited.
+	HostPolicyMaxDepth int `yaml:"host-policy-max-depth"`
+
+	// Domains that never get a certificate. Patterns starting with "*." match all subdomains.
+	HostPolicyDenylist []string `yaml:"host-policy-denylist"`
+
+	// Interval in which the parent logs the expiry of the cached certificates and sends alerts. 0 disables the monitor.
+	CertificateMonitorInterval time.Duration `yaml:"certificate-monitor-interval"`
+
+	// Send an alert if a certificate expires within this number of days.
+	CertificateAlertDays int `yaml:"certificate-alert-days"`
+
+	// URL to which the alerts are posted as JSON.
+	CertificateAlertWebhook string `yaml:"certificate-alert-webhook"`
+
+	// Email address to which the alerts are sent, and the SMTP server (host:port) with its optional credentials.
+	CertificateAlertEmail        string `yaml:"certificate-alert-email"`
+	CertificateAlertSmtpServer   string `yaml:"certificate-alert-smtp-server"`
+	CertificateAlertSmtpUsername string `yaml:"certificate-alert-smtp-username"`
+	CertificateAlertSmtpPassword secret `yaml:"certificate-alert-smtp-password"`
+
+	// Where the private keys of self-signed and DNS-01 certificates are created and stored: "file" or "aws-kms".
+	KeyStorage string `yaml:"key-storage"`
+
+	// AWS KMS region and the credentials of an IAM user that can create, use, and delete keys.
+	AwsKmsRegion          string `yaml:"aws-kms-region"`
+	AwsKmsAccessKeyId     string `yaml:"aws-kms-access-key-id"`
+	AwsKmsSecretAccessKey secret `yaml:"aws-kms-secret-access-key"`
+
+	// The domain whose certificate is used for clients that do not send a server name (SNI). Empty means that the handshake fails.
+	DefaultDomain string `yaml:"default-domain"`
+
+	// Windows that start at the times of a cron expression, for maintenance or certificate renewals.
+	Schedules []ScheduleConfig `yaml:"schedules"`
+
 	// Renew certificates, if they expire within this duration.
 	CertificateExpiryRefreshThreshold time.Duration `yaml:"certificate-expiry-refresh-threshold"`
 
@@ -61,18 +335,146 @@ type ServerConfig struct {
 	// Maximum duration to wait for a follow up request.
 	MaxIdleTimeout time.Duration `yaml:"max-idle-timeout"`
 
+	// What happens to requests before the server is ready: "queue" (wait for it) or "unavailable" (503).
+	PreReadyRequests string `yaml:"pre-ready-requests"`
+
+	// Maximum duration that a queued request waits for the server to become ready.
+	PreReadyTimeout time.Duration `yaml:"pre-ready-timeout"`
+
+	// Maximum duration that the child waits for open requests when it shuts down.
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+
+	// Close the connections with ambiguous HTTP/1.x requests (obs-fold, duplicate Content-Length, or Transfer-Encoding with Content-Length).
+	StrictHttpParsing bool `yaml:"strict-http-parsing"`
+
+	// Preset for the TLS versions and cipher suites ("intermediate" or "modern" for TLS 1.3 only).
+	TlsPreset string `yaml:"tls-preset"`
+
+	// Minimum TLS version ("1.0" to "1.3"). Empty means the version of the preset.
+	TlsMinVersion string `yaml:"tls-min-version"`
+
+	// Maximum TLS version ("1.0" to "1.3"). Empty means the newest version.
+	TlsMaxVersion string `yaml:"tls-max-version"`
+
+	// Cipher suites for TLS 1.2 and older. Empty means the cipher suites of the preset.
+	TlsCipherSuites []string `yaml:"tls-cipher-suites"`
+
+	// Prefer the hybrid post-quantum key exchanges (X25519MLKEM768) for TLS 1.3.
+	TlsPostQuantum bool `yaml:"tls-post-quantum"`
+
+	// File to which the secrets of all TLS connections are written for debugging. It needs the flag --insecure-debug.
+	TlsKeylogFile string `yaml:"tls-keylog-file"`
+
+	// ALPN protocols of the HTTPS listener in the order of preference. The ACME protocol is always added.
+	HttpsAlpnProtocols []string `yaml:"https-alpn-protocols"`
+
+	// Allow clients to resume TLS sessions with session tickets.
+	TlsSessionTickets bool `yaml:"tls-session-tickets"`
+
+	// Maximum lifetime of session tickets. 0 means the default of Go (7 days).
+	TlsSessionTicketLifetime time.Duration `yaml:"tls-session-ticket-lifetime"`
+
+	// Log the clients that would break with this minimum TLS version ("1.2" or "1.3"), without enforcing it.
+	TlsDryRunMinVersion string `yaml:"tls-dry-run-min-version"`
+
+	// Log the clients that would break if these cipher suites were disabled, without disabling them.
+	TlsDryRunDisabledCipherSuites []string `yaml:"tls-dry-run-disabled-cipher-suites"`
+
 	// Serve files if they are not cached in memory. If this is `false`, the server will not even try to read newer files into the cache.
 	ServeFilesNotInCache bool `yaml:"serve-files-not-in-cache"`
 
 	// Maximum size for files that are cached in memory.
 	MaxCacheableFileSize int64 `yaml:"max-cacheable-file-size"`
 
+	// Maximum total size of the files that are cached in memory. 0 means unlimited.
+	MaxCacheMemory int64 `yaml:"max-cache-memory"`
+
+	// What happens when max-cache-memory is reached: "none" (new files are not cached) or "lru".
+	CacheEviction string `yaml:"cache-eviction"`
+
+	// Fit the server into 128 MB RAM: read the files on demand with a small cache, and use smaller buffers.
+	LowMemory bool `yaml:"low-memory"`
+
+	// Minify HTML, CSS, and JavaScript files when they are read into the memory cache.
+	Minify bool `yaml:"minify"`
+
+	// The content encodings with which text files are compressed, in the order of preference: "gzip", "br", or "zstd".
+	Compression []string `yaml:"compression"`
+
+	// The minimum size of files that are compressed, and the media type prefixes of the compressed files.
+	CompressionMinSize int64    `yaml:"compression-min-size"`
+	CompressionTypes   []string `yaml:"compression-types"`
+
+	// The files that are served for the requests of directories, in the order of preference.
+	IndexFiles []string `yaml:"index-files"`
+
+	// Serve a generated listing for directories without index file, optionally rendered with a custom template file.
+	AutoIndex         bool   `yaml:"auto-index"`
+	AutoIndexTemplate string `yaml:"auto-index-template"`
+
+	// The files that are served as /favicon.ico and as Apple touch icons for the domains without these files.
+	DefaultFavicon   string `yaml:"default-favicon"`
+	DefaultTouchIcon string `yaml:"default-touch-icon"`
+
+	// Requests whose URL path contains one of these patterns (case insensitive) are treated as exploit probes of scanners.
+	ScannerPatterns []string `yaml:"scanner-patterns"`
+
+	// What to do with exploit probes: "not-found", "close", "no-response", or "tarpit".
+	ScannerAction string `yaml:"scanner-action"`
+
+	// How long a scanner is held in the tarpit.
+	ScannerTarpitDuration time.Duration `yaml:"scanner-tarpit-duration"`
+
 	// Log the client IP and URL path of each request.
 	LogRequests bool `yaml:"log-requests"`
 
+	// Compute the JA3 and JA4 fingerprints of the TLS ClientHellos, and add them to the request log.
+	LogTlsFingerprints bool `yaml:"log-tls-fingerprints"`
+
 	// The name of the log file. If the name is empty, the log output will only be written to stdout.
 	LogFile string `yaml:"log-file"`
 
+	// The size in bytes from which on the log file is rotated. 0 disables the rotation.
+	LogFileMaxSize int64 `yaml:"log-file-max-size"`
+
+	// The file into which the requests are written in the W3C Extended Log File Format. If the name is empty, no W3C log is written.
+	W3cLogFile string `yaml:"w3c-log-file"`
+
+	// The fields of the W3C log entries, in this order.
+	W3cLogFields []string `yaml:"w3c-log-fields"`
+
+	// The intervals of the periodic jobs by job name, which replace the default intervals.
+	JobIntervals map[string]time.Duration `yaml:"job-intervals"`
+
+	// The commands that the parent runs on lifecycle events by event name, as program and arguments.
+	LifecycleHooks map[string][]string `yaml:"lifecycle-hooks"`
+
+	// The maximum duration of a lifecycle hook, after which it is killed.
+	LifecycleHookTimeout time.Duration `yaml:"lifecycle-hook-timeout"`
+
+	// The path of the Unix socket on which the parent accepts admin commands (e.g. "reload").
+	// If the path is empty, the admin socket is disabled.
+	AdminSocket string `yaml:"admin-socket"`
+
+	// The path of the Unix socket on which the parent accepts the commands of domain owners (e.g. "access-log").
+	// If the path is empty, the tenant socket is disabled.
+	TenantSocket string `yaml:"tenant-socket"`
+
+	// The number of request log entries that the parent keeps in memory for each domain with an access-log-token.
+	AccessLogEntries int `yaml:"access-log-entries"`
+
+	// The number of log lines that the parent keeps in memory for the admin command "tail".
+	LogTailEntries int `yaml:"log-tail-entries"`
+
+	// The maximum number of log lines per second that the admin command "tail follow" sends.
+	LogTailRate int `yaml:"log-tail-rate"`
+
+	// Maximum size of the data of a command sent between the child and the parent.
+	IpcMaxFrameSize int64 `yaml:"ipc-max-frame-size"`
+
+	// Maximum number of commands per second that the parent accepts from the child. Zero means unlimited.
+	IpcMaxCommandsPerSecond int `yaml:"ipc-max-commands-per-second"`
+
 	/*
 		TODO: Maybe:
 
@@ -87,28 +489,530 @@ type ServerConfig struct {
 
 }
 
+// DomainConfig holds the settings that can be overridden per domain.
+// Settings that are not set fall back to the global settings.
+type DomainConfig struct {
+	ETag            *string `yaml:"etag,omitempty"`
+	LastModified    *bool   `yaml:"last-modified,omitempty"`
+	IfModifiedSince *bool   `yaml:"if-modified-since,omitempty"`
+
+	// Rules for the Cache-Control header of the files of this domain, which replace the global rules.
+	CacheControl []CacheControlRule `yaml:"cache-control,omitempty"`
+
+	// Redirect rules of this domain, which replace the global rules, and whether the _redirects file is used.
+	Redirects     []RedirectRule `yaml:"redirects,omitempty"`
+	RedirectsFile *bool          `yaml:"redirects-file,omitempty"`
+
+	// Rewrite rules of this domain, which replace the global rules.
+	Rewrites []RewriteRule `yaml:"rewrites,omitempty"`
+
+	// Proxy rules of this domain, which replace the global rules.
+	Proxy []ProxyRule `yaml:"proxy,omitempty"`
+
+	// Basic authentication rules of this domain, which replace the global rules.
+	BasicAuth []BasicAuthRule `yaml:"basic-auth,omitempty"`
+
+	// FastCGI rules of this domain, which replace the global rules.
+	FastCGI []FastCGIRule `yaml:"fastcgi,omitempty"`
+
+	// The name of the DNS provider (from dns-providers) that is used to validate the domain with DNS-01 challenges.
+	DNSProvider *string `yaml:"dns-provider,omitempty"`
+
+	// Client authentication with TLS client certificates: "none", "optional", or "require".
+	ClientAuth *string `yaml:"client-auth,omitempty"`
+
+	// The PEM file with the CA certificates that are accepted for client certificates.
+	// It can be replaced at runtime with the admin command "client-ca".
+	ClientCAFile *string `yaml:"client-ca-file,omitempty"`
+
+	// URLs of the CRLs of the client CAs, and whether the OCSP responders of client certificates are asked.
+	ClientCRLURLs []string `yaml:"client-crl-urls,omitempty"`
+	ClientOCSP    *bool    `yaml:"client-ocsp,omitempty"`
+
+	// CRL files of the client CAs, which the parent reads and sends to the child again when they change.
+	ClientCRLFiles []string `yaml:"client-crl-files,omitempty"`
+
+	// What happens when the revocation status of a client certificate is unknown: "fail-closed" or "fail-open".
+	ClientRevocationPolicy *string `yaml:"client-revocation-policy,omitempty"`
+
+	// Maximum size for files of this domain that are cached in memory.
+	MaxCacheableFileSize *int64 `yaml:"max-cacheable-file-size,omitempty"`
+
+	// Minify HTML, CSS, and JavaScript files of this domain when they are read into the memory cache.
+	Minify *bool `yaml:"minify,omitempty"`
+
+	// The files that are served for the requests of directories of this domain, in the order of preference.
+	IndexFiles []string `yaml:"index-files,omitempty"`
+
+	// Serve a generated listing for directories of this domain without index file, and the template file for it.
+	AutoIndex         *bool   `yaml:"auto-index,omitempty"`
+	AutoIndexTemplate *string `yaml:"auto-index-template,omitempty"`
+
+	// Directories of the web root that are served under URL paths of this domain, merged with the domain directory.
+	Mounts []Mount `yaml:"mounts,omitempty"`
+
+	// Serve the content of another directory to a percentage of the clients, e.g. to canary a new version.
+	Rollout *RolloutConfig `yaml:"rollout,omitempty"`
+
+	// URL path of the directory whose executable files are run as CGI scripts, e.g. "/cgi-bin/".
+	CgiBin *string `yaml:"cgi-bin,omitempty"`
+
+	// Serve /index.html with status 200 for the paths of this domain that are not files, for single-page applications.
+	SpaFallback *bool `yaml:"spa-fallback,omitempty"`
+
+	// URL path of a generated page that lists the files in its directory and subdirectories with their checksums.
+	DownloadsPage *string `yaml:"downloads-page,omitempty"`
+
+	// URL path of the manifest in the format of sha256sum, against which the files of the domain are verified,
+	// and the base64 encoded Ed25519 public key that verifies the signature in "<manifest>.sig".
+	Manifest          *string `yaml:"manifest,omitempty"`
+	ManifestPublicKey *string `yaml:"manifest-public-key,omitempty"`
+
+	// URL path prefixes of the files for which ".sha256" sidecars are served and verified.
+	ChecksumSidecars []string `yaml:"checksum-sidecars,omitempty"`
+
+	// URL path prefixes that are served on the HTTP address instead of being redirected to HTTPS.
+	HttpExemptPaths []string `yaml:"http-exempt-paths,omitempty"`
+
+	// Handler stacks of the HTTP and the HTTPS listener: "redirect" (HTTP only), "static", or "challenge-only".
+	HttpHandler  *string `yaml:"http-handler,omitempty"`
+	HttpsHandler *string `yaml:"https-handler,omitempty"`
+
+	// Maximum transferred bytes and requests per day and per month (UTC). 0 means unlimited.
+	QuotaDailyBytes      *int64 `yaml:"quota-daily-bytes,omitempty"`
+	QuotaMonthlyBytes    *int64 `yaml:"quota-monthly-bytes,omitempty"`
+	QuotaDailyRequests   *int64 `yaml:"quota-daily-requests,omitempty"`
+	QuotaMonthlyRequests *int64 `yaml:"quota-monthly-requests,omitempty"`
+
+	// What happens when a quota is exceeded: "too-many-requests", "unavailable", or "warn".
+	QuotaAction *string `yaml:"quota-action,omitempty"`
+
+	// PEM files with a certificate (chain) and its private key that are used instead of Let's Encrypt or self-signed certificates.
+	CertFile *string `yaml:"cert-file,omitempty"`
+	KeyFile  *string `yaml:"key-file,omitempty"`
+
+	// The token with which the owner of the domain can read its access log entries via the tenant socket.
+	AccessLogToken *secret `yaml:"access-log-token,omitempty"`
+}
+
+// DNSProviderConfig configures a DNS provider that creates the TXT records for DNS-01 challenges.
+type DNSProviderConfig struct {
+	// The type of the provider: "cloudflare", "route53", or "rfc2136".
+	Type string `yaml:"type"`
+
+	// Cloudflare: API token with the permission to edit the DNS records of the zone.
+	APIToken string `yaml:"api-token,omitempty"`
+
+	// Route53: Credentials of an IAM user that can change the records of the hosted zone.
+	AccessKeyID     string `yaml:"access-key-id,omitempty"`
+	SecretAccessKey string `yaml:"secret-access-key,omitempty"`
+	HostedZoneID    string `yaml:"hosted-zone-id,omitempty"`
+
+	// RFC2136: The name server (host:port) that accepts dynamic updates for the zone, and the TSIG key.
+	Nameserver    string `yaml:"nameserver,omitempty"`
+	Zone          string `yaml:"zone,omitempty"`
+	TSIGKeyName   string `yaml:"tsig-key-name,omitempty"`
+	TSIGSecret    string `yaml:"tsig-secret,omitempty"`
+	TSIGAlgorithm string `yaml:"tsig-algorithm,omitempty"`
+
+	// Time to wait after the TXT record has been created, before the CA is asked to validate it.
+	PropagationDelay time.Duration `yaml:"propagation-delay,omitempty"`
+}
+
+// String returns the settings without the secrets, so that printConfig does not log them.
+func (p DNSProviderConfig) String() string {
+	hidden := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "***"
+	}
+	return fmt.Sprintf("{type: %s, api-token: %s, access-key-id: %s, secret-access-key: %s, hosted-zone-id: %s, nameserver: %s, zone: %s, tsig-key-name: %s, tsig-secret: %s, tsig-algorithm: %s, propagation-delay: %s}",
+		p.Type, hidden(p.APIToken), p.AccessKeyID, hidden(p.SecretAccessKey), p.HostedZoneID, p.Nameserver, p.Zone, p.TSIGKeyName, hidden(p.TSIGSecret), p.TSIGAlgorithm, p.PropagationDelay)
+}
+
+// secret is a config value that is not printed by printConfig.
+type secret string
+
+// String hides the secret.
+func (s secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "(hidden)"
+}
+
+// String returns the settings that are set, so that printConfig does not print pointers.
+func (d DomainConfig) String() string {
+	var parts []string
+	v := reflect.ValueOf(d)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if v.Field(i).IsNil() {
+			continue
+		}
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if v.Field(i).Kind() == reflect.Slice {
+			parts = append(parts, fmt.Sprintf("%s: %v", name, v.Field(i).Interface()))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s: %v", name, v.Field(i).Elem().Interface()))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// domainSettings are the effective settings for one domain.
+type domainSettings struct {
+	etag            string
+	lastModified    bool
+	ifModifiedSince bool
+	cacheControl    []CacheControlRule
+	redirects       []RedirectRule
+	redirectsFile   bool
+	rewrites        []RewriteRule
+	proxy           []ProxyRule
+	fastCGI         []FastCGIRule
+	basicAuth       []BasicAuthRule
+	dnsProvider     string
+	clientAuth      string
+
+	clientCRLURLs          []string
+	clientCRLFiles         []string
+	clientOCSP             bool
+	clientRevocationPolicy string
+
+	maxCacheableFileSize int64
+	minify               bool
+	indexFiles           []string
+	autoIndex            bool
+	autoIndexTemplate    string
+	spaFallback          bool
+	cgiBin               string
+	mounts               []Mount
+	rollout              *RolloutConfig
+	downloadsPage        string
+	manifest             string
+	manifestPublicKey    string
+	checksumSidecars     []string
+	httpExemptPaths      []string
+	httpHandler          string
+	httpsHandler         string
+
+	quotaDailyBytes      int64
+	quotaMonthlyBytes    int64
+	quotaDailyRequests   int64
+	quotaMonthlyRequests int64
+	quotaAction          string
+}
+
+// settingsForDomain returns the effective settings for the (ASCII) domain.
+func settingsForDomain(domain string) domainSettings {
+	// The new content version of a rollout has the settings of its domain.
+	domain = strings.TrimSuffix(domain, rolloutDomainSuffix)
+
+	settings := domainSettings{
+		etag:            config.ETag,
+		lastModified:    config.LastModified,
+		ifModifiedSince: config.IfModifiedSince,
+		cacheControl:    config.CacheControl,
+		redirects:       config.Redirects,
+		redirectsFile:   config.RedirectsFile,
+		rewrites:        config.Rewrites,
+		proxy:           config.Proxy,
+		fastCGI:         config.FastCGI,
+		basicAuth:       config.BasicAuth,
+		clientAuth:      clientAuthNone,
+
+		clientRevocationPolicy: clientRevocationFailClosed,
+
+		maxCacheableFileSize: config.MaxCacheableFileSize,
+		minify:               config.Minify,
+		indexFiles:           config.IndexFiles,
+		autoIndex:            config.AutoIndex,
+		autoIndexTemplate:    config.AutoIndexTemplate,
+		httpExemptPaths:      config.HttpExemptPaths,
+		httpHandler:          config.HttpHandler,
+		httpsHandler:         config.HttpsHandler,
+		quotaAction:          quotaActionTooManyRequests,
+	}
+
+	d, ok := config.Domains[domain]
+	if !ok {
+		return settings
+	}
+	if d.ETag != nil {
+		settings.etag = *d.ETag
+	}
+	if d.LastModified != nil {
+		settings.lastModified = *d.LastModified
+	}
+	if d.IfModifiedSince != nil {
+		settings.ifModifiedSince = *d.IfModifiedSince
+	}
+	if d.CacheControl != nil {
+		settings.cacheControl = d.CacheControl
+	}
+	if d.Redirects != nil {
+		settings.redirects = d.Redirects
+	}
+	if d.RedirectsFile != nil {
+		settings.redirectsFile = *d.RedirectsFile
+	}
+	if d.Rewrites != nil {
+		settings.rewrites = d.Rewrites
+	}
+	if d.Proxy != nil {
+		settings.proxy = d.Proxy
+	}
+	if d.FastCGI != nil {
+		settings.fastCGI = d.FastCGI
+	}
+	if d.BasicAuth != nil {
+		settings.basicAuth = d.BasicAuth
+	}
+	if d.DNSProvider != nil {
+		settings.dnsProvider = *d.DNSProvider
+	}
+	if d.ClientAuth != nil {
+		settings.clientAuth = *d.ClientAuth
+	}
+	if d.ClientCRLURLs != nil {
+		settings.clientCRLURLs = d.ClientCRLURLs
+	}
+	if d.ClientCRLFiles != nil {
+		settings.clientCRLFiles = d.ClientCRLFiles
+	}
+	if d.ClientOCSP != nil {
+		settings.clientOCSP = *d.ClientOCSP
+	}
+	if d.ClientRevocationPolicy != nil {
+		settings.clientRevocationPolicy = *d.ClientRevocationPolicy
+	}
+	if d.MaxCacheableFileSize != nil {
+		settings.maxCacheableFileSize = *d.MaxCacheableFileSize
+	}
+	if d.Minify != nil {
+		settings.minify = *d.Minify
+	}
+	if d.IndexFiles != nil {
+		settings.indexFiles = d.IndexFiles
+	}
+	if d.AutoIndex != nil {
+		settings.autoIndex = *d.AutoIndex
+	}
+	if d.AutoIndexTemplate != nil {
+		settings.autoIndexTemplate = *d.AutoIndexTemplate
+	}
+	if d.SpaFallback != nil {
+		settings.spaFallback = *d.SpaFallback
+	}
+	if d.CgiBin != nil {
+		settings.cgiBin = *d.CgiBin
+	}
+	if d.Mounts != nil {
+		settings.mounts = d.Mounts
+	}
+	if d.Rollout != nil {
+		settings.rollout = d.Rollout
+	}
+	if d.DownloadsPage != nil {
+		settings.downloadsPage = *d.DownloadsPage
+	}
+	if d.Manifest != nil {
+		settings.manifest = *d.Manifest
+	}
+	if d.ManifestPublicKey != nil {
+		settings.manifestPublicKey = *d.ManifestPublicKey
+	}
+	if d.ChecksumSidecars != nil {
+		settings.checksumSidecars = d.ChecksumSidecars
+	}
+	if d.HttpExemptPaths != nil {
+		settings.httpExemptPaths = d.HttpExemptPaths
+	}
+	if d.HttpHandler != nil {
+		settings.httpHandler = *d.HttpHandler
+	}
+	if d.HttpsHandler != nil {
+		settings.httpsHandler = *d.HttpsHandler
+	}
+	if d.QuotaDailyBytes != nil {
+		settings.quotaDailyBytes = *d.QuotaDailyBytes
+	}
+	if d.QuotaMonthlyBytes != nil {
+		settings.quotaMonthlyBytes = *d.QuotaMonthlyBytes
+	}
+	if d.QuotaDailyRequests != nil {
+		settings.quotaDailyRequests = *d.QuotaDailyRequests
+	}
+	if d.QuotaMonthlyRequests != nil {
+		settings.quotaMonthlyRequests = *d.QuotaMonthlyRequests
+	}
+	if d.QuotaAction != nil {
+		settings.quotaAction = *d.QuotaAction
+	}
+	return settings
+}
+
 // Set the default values of the config variables.
 var config = ServerConfig{
-	WebRootDirectory:                  "www_static",
-	CertificateCacheDirectory:         "certcache",
-	HttpAddr:                          ":http",
-	HttpsAddr:                         ":https",
-	letsEncryptDomains:                []string{},
-	SelfSignedDomains:                 []string{"localhost", "127.0.0.1"},
-	allDomains:                        nil,
-	ServerName:                        "dma-srv",
-	HttpHeaderXContentTypeOptions:     "nosniff",
-	HttpHeaderStrictTransportSecurity: "max-age=63072000; includeSubDomains",
-	HttpHeaderContentSecurityPolicy:   "script-src 'self'",
-	HttpHeaderXFrameOptions:           "DENY",
-	CertificateExpiryRefreshThreshold: 48 * time.Hour,
-	MaxRequestTimeout:                 15 * time.Second,
-	MaxResponseTimeout:                60 * time.Second,
-	MaxIdleTimeout:                    60 * time.Second,
-	ServeFilesNotInCache:              true,
-	MaxCacheableFileSize:              1024 * 1024,
-	LogRequests:                       true,
-	LogFile:                           "server.log",
+	WebRootDirectory:                    "www_static",
+	Sandbox:                             sandboxNone,
+	ChownWebRoot:                        false,
+	DomainDiscoveryInterval:             time.Minute,
+	CertificateCacheDirectory:           "certcache",
+	CertificateCacheBackend:             certCacheBackendDirectory,
+	CertificateCacheSqliteFile:          "certcache.db",
+	CertificateCacheEncryptionKey:       "",
+	RedisAddr:                           "127.0.0.1:6379",
+	RedisPassword:                       "",
+	RedisDb:                             0,
+	RedisKeyPrefix:                      "sslserver:",
+	RedisTls:                            false,
+	ObjectStorageEndpoint:               "",
+	ObjectStorageBucket:                 "",
+	ObjectStoragePrefix:                 "certcache/",
+	ObjectStorageRegion:                 "",
+	ObjectStorageAccessKeyId:            "",
+	ObjectStorageSecretAccessKey:        "",
+	VaultAddr:                           "",
+	VaultMount:                          "secret",
+	VaultKvVersion:                      2,
+	VaultPath:                           "sslserver",
+	VaultToken:                          "",
+	VaultRoleId:                         "",
+	VaultSecretId:                       "",
+	HttpAddr:                            ":http",
+	HttpExemptPaths:                     []string{},
+	HttpHandler:                         handlerRedirect,
+	HttpsHandler:                        handlerStatic,
+	HttpChallengeInParent:               false,
+	CanonicalHostRedirect:               false,
+	HttpsAddr:                           ":https",
+	SniPassthrough:                      map[string]string{},
+	CircuitBreakerFailures:              0,
+	CircuitBreakerOpenDuration:          30 * time.Second,
+	AcmeChallengeTypes:                  []string{acmeChallengeTLSALPN01, acmeChallengeHTTP01, acmeChallengeDNS01},
+	letsEncryptDomains:                  []string{},
+	SelfSignedDomains:                   []string{"localhost", "127.0.0.1"},
+	allDomains:                          nil,
+	ServerName:                          "dma-srv",
+	HeaderProfile:                       headerProfileGo,
+	HttpHeaderXContentTypeOptions:       "nosniff",
+	HttpHeaderStrictTransportSecurity:   "max-age=63072000; includeSubDomains",
+	HttpHeaderContentSecurityPolicy:     "script-src 'self'",
+	HttpHeaderXFrameOptions:             "DENY",
+	ETag:                                "",
+	LastModified:                        true,
+	IfModifiedSince:                     true,
+	CacheControl:                        []CacheControlRule{},
+	Redirects:                           []RedirectRule{},
+	RedirectsFile:                       false,
+	Rewrites:                            []RewriteRule{},
+	Proxy:                               []ProxyRule{},
+	FastCGI:                             []FastCGIRule{},
+	BasicAuth:                           []BasicAuthRule{},
+	BasicAuthMaxFailures:                10,
+	BasicAuthLockout:                    5 * time.Minute,
+	CgiTimeout:                          30 * time.Second,
+	CgiEnv:                              map[string]string{"PATH": "/usr/local/bin:/usr/bin:/bin"},
+	DNSProviders:                        map[string]DNSProviderConfig{},
+	Domains:                             map[string]DomainConfig{},
+	AcmeDirectoryURL:                    acme.LetsEncryptURL,
+	AcmeKeyType:                         keyTypeECDSAP256,
+	AcmeAccountKeyType:                  keyTypeECDSAP256,
+	DualCertificates:                    false,
+	OcspStapling:                        true,
+	OcspMustStaple:                      false,
+	AcmeEabKid:                          "",
+	AcmeEabHmac:                         "",
+	CertDnsServers:                      []string{},
+	CertDnsTimeout:                      10 * time.Second,
+	ResolveThroughParent:                false,
+	ResolveCacheDuration:                5 * time.Minute,
+	AcmeBackoffMin:                      time.Minute,
+	AcmeBackoffMax:                      24 * time.Hour,
+	AcmeRateLimitWarning:                80,
+	AcmeIssuanceLock:                    false,
+	AcmeIssuanceLockTtl:                 10 * time.Minute,
+	AcmeIssuanceLockWait:                30 * time.Second,
+	ClockSkewLeeway:                     5 * time.Minute,
+	CertificatePushInterval:             time.Minute,
+	LocalCA:                             false,
+	LocalCAValidity:                     10 * 365 * 24 * time.Hour,
+	LocalCAOverlap:                      30 * 24 * time.Hour,
+	SelfSignedValidity:                  14 * 24 * time.Hour,
+	SelfSignedRegenerationInterval:      time.Hour,
+	SelfSignedOrganization:              "sslserver",
+	ClientRevocationCacheDuration:       time.Hour,
+	HostPolicyMaxNewCertificatesPerHour: 0,
+	HostPolicyMaxDepth:                  0,
+	HostPolicyDenylist:                  []string{},
+	CertificateMonitorInterval:          6 * time.Hour,
+	CertificateAlertDays:                1,
+	CertificateAlertWebhook:             "",
+	CertificateAlertEmail:               "",
+	CertificateAlertSmtpServer:          "",
+	CertificateAlertSmtpUsername:        "",
+	CertificateAlertSmtpPassword:        "",
+	KeyStorage:                          keyStorageFile,
+	AwsKmsRegion:                        "",
+	AwsKmsAccessKeyId:                   "",
+	AwsKmsSecretAccessKey:               "",
+	DefaultDomain:                       "",
+	Schedules:                           []ScheduleConfig{},
+	CertificateExpiryRefreshThreshold:   48 * time.Hour,
+	MaxRequestTimeout:                   15 * time.Second,
+	MaxResponseTimeout:                  60 * time.Second,
+	MaxIdleTimeout:                      60 * time.Second,
+	PreReadyRequests:                    preReadyQueue,
+	PreReadyTimeout:                     30 * time.Second,
+	ShutdownTimeout:                     10 * time.Second,
+	StrictHttpParsing:                   false,
+	TlsPreset:                           tlsPresetIntermediate,
+	TlsMinVersion:                       "",
+	TlsMaxVersion:                       "",
+	TlsCipherSuites:                     []string{},
+	TlsPostQuantum:                      false,
+	TlsKeylogFile:                       "",
+	HttpsAlpnProtocols:                  []string{"h2", "http/1.1"},
+	TlsSessionTickets:                   true,
+	TlsSessionTicketLifetime:            0,
+	TlsDryRunMinVersion:                 "",
+	TlsDryRunDisabledCipherSuites:       []string{},
+	ServeFilesNotInCache:                true,
+	MaxCacheableFileSize:                1024 * 1024,
+	MaxCacheMemory:                      0,
+	CacheEviction:                       cacheEvictionNone,
+	LowMemory:                           false,
+	Minify:                              false,
+	Compression:                         []string{},
+	CompressionMinSize:                  1024,
+	CompressionTypes:                    []string{"text/", "application/javascript", "application/json", "application/xml", "application/manifest+json", "application/wasm", "image/svg+xml"},
+	IndexFiles:                          []string{"index.html"},
+	AutoIndex:                           false,
+	AutoIndexTemplate:                   "",
+	DefaultFavicon:                      "",
+	DefaultTouchIcon:                    "",
+	ScannerPatterns:                     []string{"/wp-admin", "/wp-login", "/xmlrpc.php", ".php", "/.env", "/.git/", "/cgi-bin/", "/phpmyadmin"},
+	ScannerAction:                       scannerActionNotFound,
+	ScannerTarpitDuration:               30 * time.Second,
+	LogRequests:                         true,
+	LogTlsFingerprints:                  false,
+	LogFile:                             "server.log",
+	LogFileMaxSize:                      0,
+	W3cLogFile:                          "",
+	W3cLogFields:                        []string{"date", "time", "c-ip", "cs-method", "cs-uri-stem", "cs-uri-query", "sc-status", "sc-bytes", "time-taken", "cs-host", "cs(User-Agent)", "cs(Referer)"},
+	JobIntervals:                        map[string]time.Duration{},
+	LifecycleHooks:                      map[string][]string{},
+	LifecycleHookTimeout:                30 * time.Second,
+	AdminSocket:                         "",
+	TenantSocket:                        "",
+	AccessLogEntries:                    1000,
+	LogTailEntries:                      10000,
+	LogTailRate:                         100,
+	IpcMaxFrameSize:                     1024 * 1024,
+	IpcMaxCommandsPerSecond:             100,
 }
 
 func readConfig() {
@@ -171,8 +1075,8 @@ func sanityChecks() {
 	// If it is not valid, set it to ":80".
 	addr, err := net.ResolveTCPAddr("tcp", config.HttpAddr)
 	if err != nil {
+		log.Println("Warning: http-addr is invalid" + ipv6AddrHint(config.HttpAddr) + ". Setting it to :80.")
 		config.HttpAddr = ":80"
-		log.Println("Warning: http-addr is invalid. Setting it to :80.")
 	} else {
 		config.HttpAddr = addr.String()
 	}
@@ -181,18 +1085,529 @@ func sanityChecks() {
 	// If it is not valid, set it to ":443".
 	addr, err = net.ResolveTCPAddr("tcp", config.HttpsAddr)
 	if err != nil {
+		log.Println("Warning: https-addr is invalid" + ipv6AddrHint(config.HttpsAddr) + ". Setting it to :443.")
 		config.HttpsAddr = ":443"
-		log.Println("Warning: https-addr is invalid. Setting it to :443.")
 	} else {
 		config.HttpsAddr = addr.String()
 	}
 
+	// Verify the key types.
+	if !isValidKeyType(config.AcmeKeyType) {
+		log.Fatalf("Error: acme-key-type '%s' is invalid, it must be '%s', '%s', or '%s'", config.AcmeKeyType, keyTypeECDSAP256, keyTypeRSA2048, keyTypeRSA4096)
+	}
+	if !isValidKeyType(config.AcmeAccountKeyType) {
+		log.Fatalf("Error: acme-account-key-type '%s' is invalid, it must be '%s', '%s', or '%s'", config.AcmeAccountKeyType, keyTypeECDSAP256, keyTypeRSA2048, keyTypeRSA4096)
+	}
+	if config.KeyStorage == keyStorageAWSKMS && config.AcmeKeyType != keyTypeECDSAP256 {
+		log.Fatalf("Error: key-storage '%s' only supports the acme-key-type '%s'", keyStorageAWSKMS, keyTypeECDSAP256)
+	}
+
+	// The second certificate of dual-certificates is an RSA certificate, so the first must be an ECDSA certificate.
+	if config.DualCertificates && config.AcmeKeyType != keyTypeECDSAP256 {
+		log.Fatalf("Error: dual-certificates needs the acme-key-type '%s'", keyTypeECDSAP256)
+	}
+	if config.DualCertificates && config.KeyStorage == keyStorageAWSKMS {
+		log.Fatalf("Error: dual-certificates is not supported with the key-storage '%s', because KMS only creates ECDSA keys", keyStorageAWSKMS)
+	}
+
+	// Must-staple certificates can only be served with stapling.
+	if config.OcspMustStaple && !config.OcspStapling {
+		log.Fatal("Error: ocsp-must-staple needs ocsp-stapling")
+	}
+
+	// Ensure that the ACME directory URL is a valid HTTPS URL.
+	directoryURL, err := url.Parse(config.AcmeDirectoryURL)
+	if err != nil || directoryURL.Scheme != "https" || directoryURL.Host == "" {
+		log.Fatalf("Error: acme-directory-url '%s' is not a valid HTTPS URL", config.AcmeDirectoryURL)
+	}
+
+	// Ensure that the session ticket lifetime is within the limits of Go's TLS server.
+	if config.TlsSessionTicketLifetime != 0 && (config.TlsSessionTicketLifetime < time.Minute || config.TlsSessionTicketLifetime > maxSessionTicketLifetime) {
+		log.Fatalf("Error: tls-session-ticket-lifetime must be between 1m and %s", maxSessionTicketLifetime)
+	}
+
+	// Ensure that the external account binding is complete and that the HMAC key can be decoded.
+	if (config.AcmeEabKid == "") != (config.AcmeEabHmac == "") {
+		log.Fatal("Error: acme-eab-kid and acme-eab-hmac must be set together")
+	}
+	if _, err := acmeEABKey(); err != nil {
+		log.Fatal("Error: acme-eab-hmac is not valid base64url: ", err)
+	}
+
+	// Ensure that the DNS servers for the certificate subsystem are IP addresses with port (default port 53).
+	for i, server := range config.CertDnsServers {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		if net.ParseIP(host) == nil {
+			log.Fatalf("Error: cert-dns-servers entry '%s' is not an IP address", server)
+		}
+		config.CertDnsServers[i] = net.JoinHostPort(host, port)
+	}
+	if config.CertDnsTimeout < time.Second {
+		config.CertDnsTimeout = time.Second
+	}
+	if config.ResolveCacheDuration < time.Second {
+		log.Fatal("Error: resolve-cache-duration must be at least 1s")
+	}
+
+	// Ensure that the TLS versions and cipher suites are valid.
+	checkTLSSettings()
+
+	// Ensure that the TLS dry-run settings are known versions and cipher suites.
+	if _, ok := tlsVersions[config.TlsDryRunMinVersion]; config.TlsDryRunMinVersion != "" && !ok {
+		log.Fatalf("Error: tls-dry-run-min-version '%s' is invalid", config.TlsDryRunMinVersion)
+	}
+	for _, name := range config.TlsDryRunDisabledCipherSuites {
+		if _, ok := cipherSuiteByName(name); !ok {
+			log.Fatalf("Error: unknown cipher suite '%s' in tls-dry-run-disabled-cipher-suites", name)
+		}
+	}
+
+	// Ensure that the key storage is known and that KMS can be used.
+	if config.KeyStorage != keyStorageFile && config.KeyStorage != keyStorageAWSKMS {
+		log.Fatalf("Error: key-storage '%s' is invalid, it must be '%s' or '%s'", config.KeyStorage, keyStorageFile, keyStorageAWSKMS)
+	}
+	if config.KeyStorage == keyStorageAWSKMS && (config.AwsKmsRegion == "" || config.AwsKmsAccessKeyId == "" || config.AwsKmsSecretAccessKey == "") {
+		log.Fatal("Error: aws-kms-region, aws-kms-access-key-id, and aws-kms-secret-access-key are needed for the key storage aws-kms")
+	}
+
+	// Convert the default domain to ASCII, like the server names of the handshakes.
+	if config.DefaultDomain != "" {
+		asciiDomain, err := idna.Lookup.ToASCII(config.DefaultDomain)
+		if err != nil {
+			log.Fatalf("Error: default-domain '%s' is invalid: %v", config.DefaultDomain, err)
+		}
+		config.DefaultDomain = asciiDomain
+	}
+
+	// Ensure that the behavior for requests before the server is ready is known.
+	if config.PreReadyRequests != preReadyQueue && config.PreReadyRequests != preReadyUnavailable {
+		log.Fatalf("Error: pre-ready-requests '%s' is invalid, it must be '%s' or '%s'", config.PreReadyRequests, preReadyQueue, preReadyUnavailable)
+	}
+	if config.PreReadyTimeout < time.Second {
+		log.Fatal("Error: pre-ready-timeout must be at least 1s")
+	}
+
+	// Ensure that the child gets some time for the open requests when it shuts down.
+	if config.ShutdownTimeout < time.Second {
+		log.Fatal("Error: shutdown-timeout must be at least 1s")
+	}
+
+	// Ensure that the log file is not rotated after every line.
+	if config.LogFileMaxSize != 0 && config.LogFileMaxSize < 64*1024 {
+		log.Fatal("Error: log-file-max-size must be 0 or at least 65536")
+	}
+
+	// Ensure that the W3C log entries can be written.
+	if err := checkW3CLogFields(config.W3cLogFields); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if config.W3cLogFile != "" && filepath.Clean(config.W3cLogFile) == filepath.Clean(config.LogFile) {
+		log.Fatal("Error: w3c-log-file must not be the log-file")
+	}
+
+	// Ensure that only known jobs are configured, and that they do not run too often.
+	if err := checkJobIntervals(); err != nil {
+		log.Fatal("Error: ", err)
+	}
+
+	// Ensure that the hooks are for known events.
+	if err := checkLifecycleHooks(); err != nil {
+		log.Fatal("Error: ", err)
+	}
+
+	// Ensure that the backend of the certificate cache is known.
+	switch config.CertificateCacheBackend {
+	case certCacheBackendDirectory, certCacheBackendSQLite, certCacheBackendRedis, certCacheBackendS3, certCacheBackendGCS, certCacheBackendVault:
+	default:
+		log.Fatalf("Error: certificate-cache-backend '%s' is invalid, it must be '%s', '%s', '%s', '%s', '%s', or '%s'", config.CertificateCacheBackend, certCacheBackendDirectory, certCacheBackendSQLite, certCacheBackendRedis, certCacheBackendS3, certCacheBackendGCS, certCacheBackendVault)
+	}
+	if config.CertificateCacheBackend == certCacheBackendVault {
+		if config.VaultAddr == "" || config.VaultMount == "" || config.VaultPath == "" {
+			log.Fatal("Error: vault-addr, vault-mount, and vault-path are needed for the certificate-cache-backend vault")
+		}
+		if config.VaultKvVersion != 1 && config.VaultKvVersion != 2 {
+			log.Fatal("Error: vault-kv-version must be 1 or 2")
+		}
+		if (config.VaultToken == "") == (config.VaultRoleId == "") {
+			log.Fatal("Error: either vault-token or vault-role-id (with vault-secret-id) is needed for the certificate-cache-backend vault")
+		}
+	}
+	if config.CertificateCacheBackend == certCacheBackendS3 || config.CertificateCacheBackend == certCacheBackendGCS {
+		if config.ObjectStorageRegion == "" {
+			config.ObjectStorageRegion = "us-east-1"
+			if config.CertificateCacheBackend == certCacheBackendGCS {
+				config.ObjectStorageRegion = "auto"
+			}
+		}
+		if config.ObjectStorageBucket == "" || config.ObjectStorageAccessKeyId == "" || config.ObjectStorageSecretAccessKey == "" {
+			log.Fatal("Error: object-storage-bucket, object-storage-access-key-id, and object-storage-secret-access-key are needed for the certificate-cache-backend s3 and gcs")
+		}
+	}
+	if config.CertificateCacheBackend == certCacheBackendRedis && config.RedisAddr == "" {
+		log.Fatal("Error: redis-addr is needed for the certificate-cache-backend redis")
+	}
+
+	// Ensure that the compression encodings are supported.
+	checkCompression()
+
+	// Ensure that the eviction strategy of the file cache is known.
+	if config.CacheEviction != cacheEvictionNone && config.CacheEviction != cacheEvictionLRU {
+		log.Fatalf("Error: cache-eviction '%s' is invalid, it must be '%s' or '%s'", config.CacheEviction, cacheEvictionNone, cacheEvictionLRU)
+	}
+
+	// The exempt paths are served by the HTTP server of the child, because the parent does not serve files.
+	for _, prefix := range config.HttpExemptPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			log.Fatalf("Error: http-exempt-paths entry '%s' must start with /", prefix)
+		}
+	}
+	if len(config.HttpExemptPaths) > 0 && config.HttpChallengeInParent {
+		log.Fatal("Error: http-exempt-paths needs the HTTP server in the child, it does not work with http-challenge-in-parent")
+	}
+
+	// Ensure that the handler stacks exist on their listeners. The parent only redirects.
+	if !validHandler(config.HttpHandler, false) {
+		log.Fatal("Error: http-handler must be redirect, static, or challenge-only")
+	}
+	if !validHandler(config.HttpsHandler, true) {
+		log.Fatal("Error: https-handler must be static or challenge-only")
+	}
+	if config.HttpHandler != handlerRedirect && config.HttpChallengeInParent {
+		log.Fatal("Error: http-handler needs the HTTP server in the child, it does not work with http-challenge-in-parent")
+	}
+
+	// Limit the memory settings for low-memory.
+	applyLowMemoryProfile()
+
+	// Ensure that the scheduled windows are valid.
+	for _, s := range config.Schedules {
+		if _, err := parseCron(s.Cron); err != nil {
+			log.Fatalf("Error: schedule '%s': %v", s.Cron, err)
+		}
+		if s.Duration < time.Minute || s.Duration > maxScheduleDuration {
+			log.Fatalf("Error: the duration of schedule '%s' must be between 1m and %s", s.Cron, maxScheduleDuration)
+		}
+		if s.Mode != scheduleModeMaintenance && s.Mode != scheduleModeRenewals && s.Mode != scheduleModeRollout {
+			log.Fatalf("Error: the mode of schedule '%s' must be '%s', '%s', or '%s'", s.Cron, scheduleModeMaintenance, scheduleModeRenewals, scheduleModeRollout)
+		}
+	}
+
+	// Ensure that the certificate alerts can be sent.
+	if config.CertificateMonitorInterval < 0 {
+		config.CertificateMonitorInterval = 0
+	}
+	if config.CertificateAlertWebhook != "" && !strings.HasPrefix(config.CertificateAlertWebhook, "https://") && !strings.HasPrefix(config.CertificateAlertWebhook, "http://") {
+		log.Fatalf("Error: certificate-alert-webhook '%s' must be an http or https URL", config.CertificateAlertWebhook)
+	}
+	if config.CertificateAlertEmail != "" {
+		if _, _, err := net.SplitHostPort(config.CertificateAlertSmtpServer); err != nil {
+			log.Fatal("Error: certificate-alert-smtp-server must be host:port if certificate-alert-email is set" + ipv6AddrHint(config.CertificateAlertSmtpServer))
+		}
+	}
+	if time.Duration(config.CertificateAlertDays)*24*time.Hour > config.CertificateExpiryRefreshThreshold {
+		log.Println("Warning: certificate-alert-days is longer than certificate-expiry-refresh-threshold, so alerts are sent for certificates that are not yet due for renewal")
+	}
+
+	// Ensure that the sandbox is available on this system.
+	if _, err := newSandbox(config.Sandbox); err != nil {
+		log.Fatal("Error: ", err)
+	}
+
+	// Ensure that the backoff after ACME failures is positive and that the maximum is not below the minimum.
+	if config.AcmeBackoffMin <= 0 || config.AcmeBackoffMax < config.AcmeBackoffMin {
+		log.Fatal("Error: acme-backoff-min must be positive and acme-backoff-max must not be less than acme-backoff-min")
+	}
+
+	// Ensure that the rate limit warning is a percentage.
+	if config.AcmeRateLimitWarning < 0 || config.AcmeRateLimitWarning > 100 {
+		log.Fatal("Error: acme-rate-limit-warning must be between 0 and 100")
+	}
+
+	// Ensure that an issuance lock does not expire before a usual order is done.
+	if config.AcmeIssuanceLockTtl < time.Minute || config.AcmeIssuanceLockWait < 0 {
+		log.Fatal("Error: acme-issuance-lock-ttl must be at least 1m and acme-issuance-lock-wait must not be negative")
+	}
+
+	// Ensure that the clock skew leeway is not negative and stays well below the lifetime of certificates.
+	if config.ClockSkewLeeway < 0 || config.ClockSkewLeeway > 24*time.Hour {
+		log.Fatal("Error: clock-skew-leeway must be between 0 and 24h")
+	}
+
+	// Ensure that self-signed certificates are not rotated too often.
+	if config.SelfSignedValidity < time.Hour {
+		config.SelfSignedValidity = time.Hour
+	}
+
+	// Ensure that the CAs are not asked for the revocation status of client certificates on every handshake.
+	if config.ClientRevocationCacheDuration < time.Minute {
+		log.Fatal("Error: client-revocation-cache-duration must be at least 1m")
+	}
+
+	// Ensure that the background regeneration does not replace the self-signed certificates on every check.
+	if config.SelfSignedRegenerationInterval < 0 || config.SelfSignedRegenerationInterval >= config.SelfSignedValidity {
+		log.Fatal("Error: self-signed-regeneration-interval must be between 0 and self-signed-validity")
+	}
+
+	// Ensure that the certificates of the local CA are not renewed on every handshake before it is replaced, and that
+	// the overlaps before and after the replacement fit into its validity.
+	if config.LocalCA && (config.LocalCAOverlap <= config.CertificateExpiryRefreshThreshold+config.SelfSignedRegenerationInterval || config.LocalCAValidity <= 2*config.LocalCAOverlap) {
+		log.Fatal("Error: local-ca-overlap must be longer than certificate-expiry-refresh-threshold plus self-signed-regeneration-interval, and local-ca-validity must be longer than twice local-ca-overlap")
+	}
+
+	// Ensure that the host policy limits are valid and that the denylist is in ASCII.
+	if config.HostPolicyMaxNewCertificatesPerHour < 0 || config.HostPolicyMaxDepth < 0 {
+		log.Fatal("Error: host-policy-max-new-certificates-per-hour and host-policy-max-depth must not be negative")
+	}
+	for i, pattern := range config.HostPolicyDenylist {
+		asciiPattern, err := idna.Lookup.ToASCII(strings.TrimPrefix(pattern, "*."))
+		if err != nil {
+			log.Fatalf("Error: host-policy-denylist entry '%s' is invalid", pattern)
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			asciiPattern = "*." + asciiPattern
+		}
+		config.HostPolicyDenylist[i] = asciiPattern
+	}
+
 	// Ensure that the CertificateExpiryRefreshThreshold parameter has a minimum value of one hour.
 	if config.CertificateExpiryRefreshThreshold < time.Hour {
 		config.CertificateExpiryRefreshThreshold = time.Hour
 		log.Println("Warning: certificate-expiry-refresh-threshold is too low. Setting it to one hour.")
 	}
 
+	// Ensure that at least one access log entry is kept.
+	if config.AccessLogEntries < 1 {
+		config.AccessLogEntries = 1
+		log.Println("Warning: access-log-entries is too low. Setting it to 1.")
+	}
+
+	// Ensure that at least one log line is kept and sent.
+	if config.LogTailEntries < 1 {
+		config.LogTailEntries = 1
+		log.Println("Warning: log-tail-entries is too low. Setting it to 1.")
+	}
+	if config.LogTailRate < 1 {
+		config.LogTailRate = 1
+		log.Println("Warning: log-tail-rate is too low. Setting it to 1.")
+	}
+
+	// Ensure that the IpcMaxFrameSize parameter is large enough for certificates.
+	if config.IpcMaxFrameSize < 64*1024 {
+		config.IpcMaxFrameSize = 64 * 1024
+		log.Println("Warning: ipc-max-frame-size is too low. Setting it to 65536.")
+	}
+
+	// Ensure that the HeaderProfile parameter has a known value.
+	// If it is not valid, set it to "go".
+	if config.HeaderProfile != headerProfileGo && config.HeaderProfile != headerProfileNeutral {
+		log.Println("Warning: header-profile is invalid. Setting it to go.")
+		config.HeaderProfile = headerProfileGo
+	}
+
+	// Ensure that the ScannerAction parameter has a known value.
+	// If it is not valid, set it to "not-found".
+	switch config.ScannerAction {
+	case scannerActionNotFound, scannerActionClose, scannerActionNoResponse, scannerActionTarpit:
+	default:
+		log.Println("Warning: scanner-action is invalid. Setting it to not-found.")
+		config.ScannerAction = scannerActionNotFound
+	}
+
+	// Ensure that the ETag parameter has a known value.
+	// If it is not valid, disable ETags.
+	if !isValidETagPolicy(config.ETag) {
+		log.Println("Warning: etag is invalid. Disabling ETags.")
+		config.ETag = ""
+	}
+
+	// Ensure that the Cache-Control rules can be matched.
+	if err := checkCacheControlRules(config.CacheControl); err != nil {
+		log.Fatalf("Error: cache-control: %v", err)
+	}
+
+	// Ensure that the redirect rules are valid, and set their default status code.
+	if err := checkRedirectRules(config.Redirects); err != nil {
+		log.Fatalf("Error: redirects: %v", err)
+	}
+
+	// Compile the patterns of the rewrite rules.
+	if err := checkRewriteRules(config.Rewrites); err != nil {
+		log.Fatalf("Error: rewrites: %v", err)
+	}
+
+	// Ensure that the proxy rules are valid, and create their proxies.
+	if err := checkProxyRules(config.Proxy); err != nil {
+		log.Fatalf("Error: proxy: %v", err)
+	}
+
+	// Ensure that the FastCGI rules are valid, and set their defaults.
+	if err := checkFastCGIRules(config.FastCGI); err != nil {
+		log.Fatalf("Error: fastcgi: %v", err)
+	}
+
+	// Ensure that the Basic authentication rules are valid, and read their htpasswd files before the child is jailed.
+	if err := checkBasicAuthRules(config.BasicAuth); err != nil {
+		log.Fatalf("Error: basic-auth: %v", err)
+	}
+	if config.BasicAuthMaxFailures < 1 {
+		log.Fatal("Error: basic-auth-max-failures must be at least 1")
+	}
+	if config.BasicAuthLockout <= 0 {
+		log.Fatal("Error: basic-auth-lockout must be positive")
+	}
+
+	// Ensure that the CGI scripts can run.
+	if config.CgiTimeout <= 0 {
+		log.Fatal("Error: cgi-timeout must be positive")
+	}
+	if err := checkCGIEnv(config.CgiEnv); err != nil {
+		log.Fatalf("Error: cgi-env: %v", err)
+	}
+
+	// Parse the template of the directory listings.
+	if err := checkIndexFiles(config.IndexFiles); err != nil {
+		log.Fatalf("Error: index-files: %v", err)
+	}
+	if err := loadAutoIndexTemplate(config.AutoIndexTemplate); err != nil {
+		log.Fatalf("Error: auto-index-template could not be loaded: %v", err)
+	}
+
+	// Read the default icons into memory.
+	if err := loadDefaultIcons(); err != nil {
+		log.Fatalf("Error: the default icons could not be loaded: %v", err)
+	}
+
+	// Verify that the DNS providers are complete.
+	for name, p := range config.DNSProviders {
+		if err := p.validate(); err != nil {
+			log.Fatalf("Error: dns-providers entry '%s' is invalid: %v", name, err)
+		}
+	}
+
+	// Convert the domain names of the per domain settings into their ASCII form, which is used for the lookup.
+	domains := make(map[string]DomainConfig, len(config.Domains))
+	for name, d := range config.Domains {
+		asciiName, err := idna.Lookup.ToASCII(name)
+		if err != nil {
+			log.Fatalf("Error: Domain '%s' in domains has invalid characters", name)
+		}
+		if d.ETag != nil && !isValidETagPolicy(*d.ETag) {
+			log.Printf("Warning: etag for domain %s is invalid. Using the global setting.", name)
+			d.ETag = nil
+		}
+		if err := checkCacheControlRules(d.CacheControl); err != nil {
+			log.Fatalf("Error: cache-control for domain %s: %v", name, err)
+		}
+		if err := checkRedirectRules(d.Redirects); err != nil {
+			log.Fatalf("Error: redirects for domain %s: %v", name, err)
+		}
+		if err := checkRewriteRules(d.Rewrites); err != nil {
+			log.Fatalf("Error: rewrites for domain %s: %v", name, err)
+		}
+		if err := checkProxyRules(d.Proxy); err != nil {
+			log.Fatalf("Error: proxy for domain %s: %v", name, err)
+		}
+		if err := checkFastCGIRules(d.FastCGI); err != nil {
+			log.Fatalf("Error: fastcgi for domain %s: %v", name, err)
+		}
+		if err := checkBasicAuthRules(d.BasicAuth); err != nil {
+			log.Fatalf("Error: basic-auth for domain %s: %v", name, err)
+		}
+		if err := checkCGIBin(d.CgiBin); err != nil {
+			log.Fatalf("Error: cgi-bin for domain %s: %v", name, err)
+		}
+		if d.DNSProvider != nil && *d.DNSProvider != "" {
+			if _, ok := config.DNSProviders[*d.DNSProvider]; !ok {
+				log.Fatalf("Error: dns-provider '%s' for domain %s is not configured in dns-providers", *d.DNSProvider, name)
+			}
+		}
+		if d.MaxCacheableFileSize != nil && *d.MaxCacheableFileSize < 0 {
+			log.Fatalf("Error: max-cacheable-file-size for domain %s must not be negative", name)
+		}
+		if err := checkIndexFiles(d.IndexFiles); err != nil {
+			log.Fatalf("Error: index-files for domain %s: %v", name, err)
+		}
+		if err := checkMounts(d.Mounts); err != nil {
+			log.Fatalf("Error: mounts for domain %s: %v", name, err)
+		}
+		if err := checkRollout(d.Rollout); err != nil {
+			log.Fatalf("Error: rollout for domain %s: %v", name, err)
+		}
+		if d.AutoIndexTemplate != nil {
+			if err := loadAutoIndexTemplate(*d.AutoIndexTemplate); err != nil {
+				log.Fatalf("Error: auto-index-template for domain %s could not be loaded: %v", name, err)
+			}
+		}
+		if d.DownloadsPage != nil && !isValidDownloadsPage(*d.DownloadsPage) {
+			log.Fatalf("Error: downloads-page '%s' for domain %s is not a valid URL path", *d.DownloadsPage, name)
+		}
+		if d.Manifest != nil && !isValidDownloadsPage(*d.Manifest) {
+			log.Fatalf("Error: manifest '%s' for domain %s is not a valid URL path", *d.Manifest, name)
+		}
+		if (d.Manifest != nil) != (d.ManifestPublicKey != nil) || (d.ManifestPublicKey != nil && !isValidManifestPublicKey(*d.ManifestPublicKey)) {
+			log.Fatalf("Error: manifest for domain %s needs a manifest-public-key with a base64 encoded Ed25519 public key", name)
+		}
+		if d.QuotaAction != nil && *d.QuotaAction != quotaActionTooManyRequests && *d.QuotaAction != quotaActionUnavailable && *d.QuotaAction != quotaActionWarn {
+			log.Fatalf("Error: quota-action '%s' for domain %s is invalid", *d.QuotaAction, name)
+		}
+		for _, prefix := range d.ChecksumSidecars {
+			if !strings.HasPrefix(prefix, "/") {
+				log.Fatalf("Error: checksum-sidecars entry '%s' for domain %s must start with /", prefix, name)
+			}
+		}
+		for _, prefix := range d.HttpExemptPaths {
+			if !strings.HasPrefix(prefix, "/") {
+				log.Fatalf("Error: http-exempt-paths entry '%s' for domain %s must start with /", prefix, name)
+			}
+		}
+		if len(d.HttpExemptPaths) > 0 && config.HttpChallengeInParent {
+			log.Fatalf("Error: http-exempt-paths for domain %s needs the HTTP server in the child, it does not work with http-challenge-in-parent", name)
+		}
+		if d.HttpHandler != nil && !validHandler(*d.HttpHandler, false) {
+			log.Fatalf("Error: http-handler for domain %s must be redirect, static, or challenge-only", name)
+		}
+		if d.HttpsHandler != nil && !validHandler(*d.HttpsHandler, true) {
+			log.Fatalf("Error: https-handler for domain %s must be static or challenge-only", name)
+		}
+		if d.HttpHandler != nil && *d.HttpHandler != handlerRedirect && config.HttpChallengeInParent {
+			log.Fatalf("Error: http-handler for domain %s needs the HTTP server in the child, it does not work with http-challenge-in-parent", name)
+		}
+		if d.AccessLogToken != nil && len(*d.AccessLogToken) < 16 {
+			log.Fatalf("Error: access-log-token for domain %s must have at least 16 characters", name)
+		}
+		if (d.CertFile == nil) != (d.KeyFile == nil) {
+			log.Fatalf("Error: cert-file and key-file for domain %s must be set together", name)
+		}
+		if d.ClientAuth != nil {
+			switch *d.ClientAuth {
+			case clientAuthNone, clientAuthOptional, clientAuthRequire:
+			default:
+				log.Fatalf("Error: client-auth for domain %s is invalid", name)
+			}
+		}
+		for _, crlURL := range d.ClientCRLURLs {
+			if u, err := url.Parse(crlURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				log.Fatalf("Error: client-crl-urls entry '%s' for domain %s must be an HTTP or HTTPS URL", crlURL, name)
+			}
+		}
+		for _, crlFile := range d.ClientCRLFiles {
+			if crlFile == "" {
+				log.Fatalf("Error: client-crl-files for domain %s must not contain an empty file name", name)
+			}
+		}
+		if d.ClientRevocationPolicy != nil && *d.ClientRevocationPolicy != clientRevocationFailClosed && *d.ClientRevocationPolicy != clientRevocationFailOpen {
+			log.Fatalf("Error: client-revocation-policy for domain %s must be fail-closed or fail-open", name)
+		}
+		if (len(d.ClientCRLURLs) > 0 || len(d.ClientCRLFiles) > 0 || (d.ClientOCSP != nil && *d.ClientOCSP)) && (d.ClientAuth == nil || *d.ClientAuth == clientAuthNone) {
+			log.Printf("Warning: client-crl-urls, client-crl-files, and client-ocsp for domain %s have no effect without client-auth", name)
+		}
+		domains[asciiName] = d
+	}
+	config.Domains = domains
+
 	// Verify that the LogFile parameter is a valid file path to an existing file.
 	// If it is not valid, set it to an empty string to disable file logging.
 	config.LogFile = filepath.Clean(config.LogFile)
@@ -235,21 +1650,56 @@ func sanityChecks() {
 	}
 
 	// Set all allowed domains
-	config.allDomains = make(map[string]bool, len(config.letsEncryptDomains)+len(config.SelfSignedDomains))
-	for _, h := range config.letsEncryptDomains {
-		if h, err := idna.Lookup.ToASCII(h); err == nil {
-			config.allDomains[h] = true
-		} else {
-			log.Fatalf("Error: Domain '%s' has invalid characters", h)
+	allDomains, err := buildAllDomains(config.letsEncryptDomains, config.SelfSignedDomains)
+	if err != nil {
+		log.Fatal("Error: ", err)
+	}
+	config.allDomains = allDomains
+
+	// Each domain needs a challenge type that it can use: dns-01 for the domains with a dns-provider, and
+	// tls-alpn-01 or http-01 for the others.
+	if len(config.AcmeChallengeTypes) == 0 {
+		log.Fatal("Error: acme-challenge-types must not be empty")
+	}
+	for _, t := range config.AcmeChallengeTypes {
+		if t != acmeChallengeTLSALPN01 && t != acmeChallengeHTTP01 && t != acmeChallengeDNS01 {
+			log.Fatalf("Error: acme-challenge-types contains '%s', it must only contain '%s', '%s', or '%s'", t, acmeChallengeTLSALPN01, acmeChallengeHTTP01, acmeChallengeDNS01)
+		}
+	}
+	for _, domain := range config.letsEncryptDomains {
+		hasProvider := settingsForDomain(domain).dnsProvider != ""
+		if hasProvider && !acmeChallengeAllowed(acmeChallengeDNS01) {
+			log.Fatalf("Error: the domain '%s' has a dns-provider, but acme-challenge-types does not contain '%s'", domain, acmeChallengeDNS01)
+		}
+		if !hasProvider && !acmeChallengeAllowed(acmeChallengeTLSALPN01) && !acmeChallengeAllowed(acmeChallengeHTTP01) {
+			log.Fatalf("Error: the domain '%s' has no dns-provider, but acme-challenge-types only contains '%s'", domain, acmeChallengeDNS01)
 		}
 	}
-	for _, h := range config.SelfSignedDomains {
-		if h, err := idna.Lookup.ToASCII(h); err == nil {
-			config.allDomains[h] = true
-		} else {
-			log.Fatalf("Error: Domain '%s' has invalid characters", h)
+
+	// Ensure that the circuit breakers do not open without failures, and stay open for a while.
+	if config.CircuitBreakerFailures < 0 {
+		log.Fatal("Error: circuit-breaker-failures must not be negative")
+	}
+	if config.CircuitBreakerOpenDuration < time.Second {
+		log.Fatal("Error: circuit-breaker-open-duration must be at least 1s")
+	}
+
+	// The server names of sni-passthrough are matched in their ASCII form, and they are not served by this server.
+	passthrough := make(map[string]string, len(config.SniPassthrough))
+	for name, backend := range config.SniPassthrough {
+		asciiName, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.ToLower(name), "."))
+		if err != nil || asciiName == "" {
+			log.Fatalf("Error: invalid server name '%s' in sni-passthrough", name)
+		}
+		if config.allDomains[asciiName] {
+			log.Fatalf("Error: the server name '%s' in sni-passthrough is also a domain of this server", name)
+		}
+		if _, port, err := net.SplitHostPort(backend); err != nil || port == "" {
+			log.Fatalf("Error: the backend '%s' of '%s' in sni-passthrough must be host:port%s", backend, name, ipv6AddrHint(backend))
 		}
+		passthrough[asciiName] = backend
 	}
+	config.SniPassthrough = passthrough
 }
 
 // getAllowedDomainsFromSubdirectories retrieves allowed domains from subdirectories in the webroot directory.
@@ -269,7 +1719,7 @@ func getAllowedDomainsFromSubdirectories(webrootDir string, selfSignedDomains []
 			return domains
 		}
 
-		if resolvedFile.IsDir() {
+		if resolvedFile.IsDir() && isDomainDirectoryName(file.Name()) {
 			domain := file.Name()
 			for _, selfSignedDomain := range selfSignedDomains {
 				if domain == selfSignedDomain {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Browsers request /favicon.ico and the Apple touch icons for every domain, also if the pages do not link them.
+// Domains without these files get the default-favicon and the default-touch-icon, which are read into memory at
+// startup (before the jail, because they are usually not in the web root). This avoids the 404 responses for them.
+
+// maxDefaultIconSize is the maximum size of the default icon files.
+const maxDefaultIconSize = 1024 * 1024
+
+// defaultIcon is a default icon in memory.
+type defaultIcon struct {
+	content     []byte
+	modTime     time.Time
+	contentType string
+}
+
+// defaultIcons are the default icons by URL path.
+var defaultIcons = map[string]*defaultIcon{}
+
+// loadDefaultIcons reads the files of default-favicon and default-touch-icon.
+func loadDefaultIcons() error {
+	for _, icon := range []struct {
+		file     string
+		urlPaths []string
+	}{
+		{config.DefaultFavicon, []string{"/favicon.ico"}},
+		{config.DefaultTouchIcon, []string{"/apple-touch-icon.png", "/apple-touch-icon-precomposed.png"}},
+	} {
+		file := icon.file
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.Size() > maxDefaultIconSize {
+			return fmt.Errorf("%s is larger than %d bytes", file, maxDefaultIconSize)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(file))
+		if contentType == "" {
+			contentType = http.DetectContentType(content)
+		}
+		for _, urlPath := range icon.urlPaths {
+			defaultIcons[urlPath] = &defaultIcon{content: content, modTime: info.ModTime(), contentType: contentType}
+		}
+	}
+	return nil
+}
+
+// serveDefaultIcon answers the request with the default icon for the URL path, and returns false if there is none.
+func serveDefaultIcon(w http.ResponseWriter, r *http.Request, urlPath string, settings domainSettings) bool {
+	icon, ok := defaultIcons[urlPath]
+	if !ok {
+		return false
+	}
+	addHeaders(w)
+	setCacheControl(w, urlPath, settings)
+	w.Header().Set("Content-Type", icon.contentType)
+	http.ServeContent(w, r, urlPath, icon.modTime, bytes.NewReader(icon.content))
+	return true
+}
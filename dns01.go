@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// dnsProvider creates and removes the TXT records for DNS-01 challenges.
+type dnsProvider interface {
+	// Present creates the TXT record with the value for the fully qualified domain name (without trailing dot).
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record again.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// validate checks that all settings that the provider type needs are set.
+func (p DNSProviderConfig) validate() error {
+	switch p.Type {
+	case "cloudflare":
+		if p.APIToken == "" {
+			return errors.New("cloudflare needs api-token")
+		}
+	case "route53":
+		if p.AccessKeyID == "" || p.SecretAccessKey == "" || p.HostedZoneID == "" {
+			return errors.New("route53 needs access-key-id, secret-access-key, and hosted-zone-id")
+		}
+	case "rfc2136":
+		if p.Nameserver == "" || p.Zone == "" {
+			return errors.New("rfc2136 needs nameserver and zone")
+		}
+		if _, err := tsigAlgorithm(p.TSIGAlgorithm); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown type: %s", p.Type)
+	}
+	return nil
+}
+
+// newDNSProvider creates the DNS provider for the configuration.
+func newDNSProvider(p DNSProviderConfig) (dnsProvider, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	switch p.Type {
+	case "cloudflare":
+		return &cloudflareProvider{apiToken: p.APIToken}, nil
+	case "route53":
+		return &route53Provider{accessKeyID: p.AccessKeyID, secretAccessKey: p.SecretAccessKey, hostedZoneID: p.HostedZoneID}, nil
+	case "rfc2136":
+		return &rfc2136Provider{nameserver: p.Nameserver, zone: p.Zone, keyName: p.TSIGKeyName, secret: p.TSIGSecret, algorithm: p.TSIGAlgorithm}, nil
+	}
+	return nil, fmt.Errorf("unknown DNS provider type: %s", p.Type)
+}
+
+// acmeSolver fulfills one type of ACME challenges.
+type acmeSolver interface {
+	// challengeType returns the type of the challenges, e.g. "dns-01".
+	challengeType() string
+	// present makes the response to the challenge for the domain available to the CA, and returns a function that removes it.
+	present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (cleanup func(), err error)
+}
+
+// dns01Solver fulfills DNS-01 challenges with a DNS provider.
+type dns01Solver struct {
+	provider         dnsProvider
+	propagationDelay time.Duration
+}
+
+func (s dns01Solver) challengeType() string {
+	return "dns-01"
+}
+
+// present creates the TXT record and waits for its propagation.
+func (s dns01Solver) present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+	log.Printf("certificate: creating DNS-01 TXT record %s", fqdn)
+	if err := s.provider.Present(ctx, fqdn, value); err != nil {
+		return nil, fmt.Errorf("could not create TXT record %s: %v", fqdn, err)
+	}
+	cleanup := func() {
+		if err := s.provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			log.Printf("certificate: could not remove DNS-01 TXT record %s: %v", fqdn, err)
+		}
+	}
+	reportACMEOrder(domain, acmeChallengeDNS01, acmeOrderDNSRecord, nil)
+
+	// Give the DNS record some time to propagate to all name servers.
+	select {
+	case <-time.After(s.propagationDelay):
+	case <-ctx.Done():
+		cleanup()
+		return nil, ctx.Err()
+	}
+	return cleanup, nil
+}
+
+// http01Solver fulfills HTTP-01 challenges. The response is stored in the certificate cache under the same name
+// as autocert uses, so that the HTTP handler of autocert in the child, or the challenge responder of the parent,
+// answers it.
+type http01Solver struct{}
+
+func (s http01Solver) challengeType() string {
+	return acmeChallengeHTTP01
+}
+
+// present stores the response to the challenge in the certificate cache.
+func (s http01Solver) present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	name := challenge.Token + "+http-01"
+	if err := m.Cache.Put(ctx, name, []byte(response)); err != nil {
+		return nil, fmt.Errorf("could not store challenge response: %v", err)
+	}
+	return func() {
+		m.Cache.Delete(context.Background(), name)
+	}, nil
+}
+
+// tlsALPN01Solver fulfills TLS-ALPN-01 challenges. The challenge certificate is returned by MyGetCertificate
+// for the handshakes of the CA with the ALPN protocol "acme-tls/1".
+type tlsALPN01Solver struct{}
+
+func (s tlsALPN01Solver) challengeType() string {
+	return acmeChallengeTLSALPN01
+}
+
+// tlsALPNChallengeCerts are the challenge certificates of the running TLS-ALPN-01 challenges by domain.
+var tlsALPNChallengeCerts = map[string]*tls.Certificate{}
+var tlsALPNChallengeCertsMu sync.Mutex
+
+// present creates the challenge certificate.
+func (s tlsALPN01Solver) present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	cert, err := client.TLSALPN01ChallengeCert(challenge.Token, domain)
+	if err != nil {
+		return nil, err
+	}
+	tlsALPNChallengeCertsMu.Lock()
+	tlsALPNChallengeCerts[domain] = &cert
+	tlsALPNChallengeCertsMu.Unlock()
+	return func() {
+		tlsALPNChallengeCertsMu.Lock()
+		delete(tlsALPNChallengeCerts, domain)
+		tlsALPNChallengeCertsMu.Unlock()
+	}, nil
+}
+
+// tlsALPNChallengeCert returns the challenge certificate of a running TLS-ALPN-01 challenge for the domain, or nil.
+func tlsALPNChallengeCert(domain string) *tls.Certificate {
+	tlsALPNChallengeCertsMu.Lock()
+	defer tlsALPNChallengeCertsMu.Unlock()
+	return tlsALPNChallengeCerts[domain]
+}
+
+// acmeOrderLocks serialize the issuances without autocert per domain and variant, so that a certificate is not issued
+// twice at the same time. The orders of other domains are not held up, e.g. by a slow DNS propagation.
+var acmeOrderLocks = map[string]*acmeOrderLock{}
+var acmeOrderLocksMu sync.Mutex
+
+// acmeOrderLock is the lock of the orders of a domain and variant, with the number of callers that hold or wait for it.
+type acmeOrderLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockACMEOrder locks the orders of the key (domain and variant), and returns the function that unlocks them.
+func lockACMEOrder(key string) (unlock func()) {
+	acmeOrderLocksMu.Lock()
+	lock := acmeOrderLocks[key]
+	if lock == nil {
+		lock = &acmeOrderLock{}
+		acmeOrderLocks[key] = lock
+	}
+	lock.users++
+	acmeOrderLocksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		acmeOrderLocksMu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(acmeOrderLocks, key)
+		}
+		acmeOrderLocksMu.Unlock()
+	}
+}
+
+// getDNS01Certificate returns the certificate for the domain from the certificate cache, or gets a new
+// one with a DNS-01 challenge if there is none or if it has to be renewed.
+func getDNS01Certificate(domain, variant, providerName string) (*tls.Certificate, error) {
+	providerConfig, ok := config.DNSProviders[providerName]
+	if !ok {
+		return nil, fmt.Errorf("dns-01: unknown DNS provider: %s", providerName)
+	}
+	provider, err := newDNSProvider(providerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dns-01: %v", err)
+	}
+	return getACMECertificate(domain, variant, dns01Solver{provider: provider, propagationDelay: providerConfig.PropagationDelay})
+}
+
+// getACMECertificate returns the certificate of the variant ("" or rsaCertSuffix) for the domain from the certificate
+// cache, or gets a new one from the ACME CA with the solver if there is none or if it has to be renewed.
+// The certificate is stored in the same format as autocert stores its certificates.
+func getACMECertificate(domain, variant string, solver acmeSolver) (*tls.Certificate, error) {
+	defer lockACMEOrder(domain + variant)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	// Use the cached certificate, if it does not have to be renewed yet.
+	cached, err := cachedCertificateVariant(ctx, domain, variant)
+	if err == nil && certValidAt(cached.Leaf, time.Now()) && !certNeedsRenewal(cached.Leaf, m.RenewBefore) {
+		return cached, nil
+	}
+
+	// Outside of the renewal windows, valid certificates are not renewed.
+	if cached != nil && certValidAt(cached.Leaf, time.Now()) && !getSchedule().RenewalsAllowed {
+		return cached, nil
+	}
+
+	// The limits of the host policy apply to new certificates only.
+	if err := checkHostPolicyLimits(domain); err != nil {
+		if cached != nil && certValidAt(cached.Leaf, time.Now()) {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	cert, err := issueACMECertificate(ctx, domain, variant, solver)
+	if err != nil {
+		if cached != nil && certValidAt(cached.Leaf, time.Now()) {
+			// The cached certificate is still valid. Use it until the renewal succeeds.
+			log.Printf("certificate: %s renewal for %s failed, using cached certificate: %v", solver.challengeType(), domain, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	return cert, nil
+}
+
+// issueACMECertificate gets a new certificate of the variant for the domain with the challenges of the solver and stores
+// it in the certificate cache. The RSA variant has an RSA-2048 key, like the RSA certificates of autocert.
+func issueACMECertificate(ctx context.Context, domain, variant string, solver acmeSolver) (cert *tls.Certificate, err error) {
+	challengeType := solver.challengeType()
+
+	// Let the parent know the state of the order.
+	reportACMEOrder(domain, challengeType, acmeOrderPending, nil)
+	defer func() {
+		if err != nil {
+			reportACMEOrder(domain, challengeType, acmeOrderFailed, err)
+		} else {
+			reportACMEOrder(domain, challengeType, acmeOrderValid, nil)
+		}
+	}()
+
+	client, err := acmeClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", challengeType, err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not create order: %v", challengeType, err)
+	}
+
+	// Fulfill the challenge of each authorization.
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not get authorization: %v", challengeType, err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, fmt.Errorf("%s: the CA did not offer a %s challenge", challengeType, strings.ToUpper(challengeType))
+		}
+
+		cleanup, err := solver.present(ctx, client, authz.Identifier.Value, challenge)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", challengeType, err)
+		}
+		defer cleanup()
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			return nil, fmt.Errorf("%s: could not accept challenge: %v", challengeType, err)
+		}
+		reportACMEOrder(domain, challengeType, acmeOrderValidating, nil)
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, fmt.Errorf("%s: authorization failed: %v", challengeType, err)
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("%s: order failed: %v", challengeType, err)
+	}
+	reportACMEOrder(domain, challengeType, acmeOrderFinalizing, nil)
+
+	// Create the key, in KMS or as a file, and the certificate request.
+	var key crypto.Signer
+	var keyPEM []byte
+	if variant == rsaCertSuffix {
+		key, keyPEM, err = newPrivateKey(keyTypeRSA2048)
+	} else if config.KeyStorage == keyStorageAWSKMS {
+		key, keyPEM, err = newKMSKey(ctx, domain)
+	} else {
+		key, keyPEM, err = newPrivateKey(config.AcmeKeyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			discardKMSKey(context.Background(), domain, key)
+		}
+	}()
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}, ExtraExtensions: m.ExtraExtensions}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not get certificate: %v", challengeType, err)
+	}
+
+	// Store the key and the certificate chain in the format of autocert.
+	var buf bytes.Buffer
+	buf.Write(keyPEM)
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	if err := m.Cache.Put(ctx, domain+variant, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("%s: could not store certificate: %v", challengeType, err)
+	}
+	stored = true
+	activateKMSKey(ctx, domain, key)
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Key types of certificates and of the ACME account.
+const (
+	keyTypeECDSAP256 = "ecdsa-p256"
+	keyTypeRSA2048   = "rsa2048"
+	keyTypeRSA4096   = "rsa4096"
+)
+
+// isValidKeyType returns true if the key type is known.
+func isValidKeyType(keyType string) bool {
+	return keyType == keyTypeECDSAP256 || keyType == keyTypeRSA2048 || keyType == keyTypeRSA4096
+}
+
+// newPrivateKey creates a key of the key type and returns it with its PEM encoding.
+func newPrivateKey(keyType string) (crypto.Signer, []byte, error) {
+	switch keyType {
+	case keyTypeRSA2048, keyTypeRSA4096:
+		bits := 2048
+		if keyType == keyTypeRSA4096 {
+			bits = 4096
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// parsePrivateKey parses a PEM encoded EC, PKCS #1, or PKCS #8 private key.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	return signer, nil
+}
+
+// acmeClient creates an ACME client with the account key of the autocert manager and registers the account.
+func acmeClient(ctx context.Context) (*acme.Client, error) {
+	key, err := acmeAccountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, UserAgent: "sslserver"}
+	if m.Client != nil {
+		client.DirectoryURL = m.Client.DirectoryURL
+		client.HTTPClient = m.Client.HTTPClient
+	}
+
+	account := &acme.Account{ExternalAccountBinding: m.ExternalAccountBinding}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	_, err = client.Register(ctx, account, autocert.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("could not register account: %v", err)
+	}
+	return client, nil
+}
+
+// acmeAccountKeyName is the name of the account key in the certificate cache, the same as autocert uses.
+const acmeAccountKeyName = "acme_account+key"
+
+// acmeAccountKeyMu serializes the creation of the account key.
+var acmeAccountKeyMu sync.Mutex
+
+// acmeAccountKey reads the account key that autocert stores in the certificate cache, or creates and stores it
+// with the acme-account-key-type. An existing key is kept, also if it has another type.
+func acmeAccountKey(ctx context.Context) (crypto.Signer, error) {
+	acmeAccountKeyMu.Lock()
+	defer acmeAccountKeyMu.Unlock()
+
+	data, err := m.Cache.Get(ctx, acmeAccountKeyName)
+	if err == nil {
+		key, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account key in cache: %v", err)
+		}
+		return key, nil
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, keyPEM, err := newPrivateKey(config.AcmeAccountKeyType)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Cache.Put(ctx, acmeAccountKeyName, keyPEM); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// useACMEAccountKey gives autocert the account key of acmeAccountKey, so that autocert does not create
+// an ECDSA key itself. It must be called before autocert is asked for a certificate.
+func useACMEAccountKey() error {
+	acmeClientKeyMu.Lock()
+	defer acmeClientKeyMu.Unlock()
+	if m.Client.Key != nil {
+		return nil
+	}
+	key, err := acmeAccountKey(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not get ACME account key: %v", err)
+	}
+	m.Client.Key = key
+	return nil
+}
+
+// acmeClientKeyMu protects setting the account key of autocert.
+var acmeClientKeyMu sync.Mutex
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare API.
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareProvider creates the TXT records with the Cloudflare API.
+type cloudflareProvider struct {
+	apiToken string
+}
+
+// cloudflareResponse is the envelope of all Cloudflare API responses.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// Present creates the TXT record.
+func (p *cloudflareProvider) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	record := map[string]interface{}{"type": "TXT", "name": fqdn, "content": value, "ttl": 120}
+	return p.request(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+// CleanUp removes the TXT record.
+func (p *cloudflareProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	var records []struct {
+		ID string `json:"id"`
+	}
+	query := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := p.request(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := p.request(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneID finds the zone that contains the name by trying all parent domains.
+func (p *cloudflareProvider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(fqdn, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		name := strings.Join(labels[i:], ".")
+		if err := p.request(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %s", fqdn)
+}
+
+// request sends a request to the Cloudflare API and decodes the result into result, if it is not nil.
+func (p *cloudflareProvider) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := certHTTPClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&response); err != nil {
+		return fmt.Errorf("cloudflare: invalid response (status %d): %v", resp.StatusCode, err)
+	}
+	if !response.Success {
+		if len(response.Errors) > 0 {
+			return errors.New("cloudflare: " + response.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare: request failed with status %d", resp.StatusCode)
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS constants that are not defined in dnsmessage.
+const (
+	dnsOpCodeUpdate = 5   // RFC 2136
+	dnsClassNone    = 254 // RFC 2136, used to delete a specific record
+	dnsClassAny     = 255
+	dnsTypeTSIG     = 250 // RFC 8945
+	tsigFudge       = 300 // Allowed time difference in seconds
+)
+
+// rfc2136Provider creates the TXT records with dynamic DNS updates (RFC 2136), signed with TSIG (RFC 8945).
+type rfc2136Provider struct {
+	nameserver string
+	zone       string
+	keyName    string
+	secret     string // Base64 encoded
+	algorithm  string
+}
+
+// tsigAlgorithm returns the hash function and the algorithm name of a TSIG algorithm.
+func tsigAlgorithm(name string) (func() hash.Hash, error) {
+	switch strings.TrimSuffix(strings.ToLower(name), ".") {
+	case "", "hmac-sha256":
+		return sha256.New, nil
+	case "hmac-sha512":
+		return sha512.New, nil
+	case "hmac-sha1":
+		return sha1.New, nil
+	}
+	return nil, fmt.Errorf("unknown TSIG algorithm: %s", name)
+}
+
+// Present creates the TXT record.
+func (p *rfc2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+// CleanUp removes the TXT record.
+func (p *rfc2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+// update sends a dynamic update that adds or deletes the TXT record.
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, add bool) error {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// Build the message without TSIG first, because the MAC is calculated over it.
+	msg, err := p.buildUpdate(id, fqdn, value, add, nil)
+	if err != nil {
+		return err
+	}
+	if p.keyName != "" {
+		tsig, err := p.tsig(msg, id, time.Now())
+		if err != nil {
+			return err
+		}
+		msg, err = p.buildUpdate(id, fqdn, value, add, tsig)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.exchange(ctx, msg)
+}
+
+// buildUpdate builds the update message. The TSIG record is added, if it is not nil.
+func (p *rfc2136Provider) buildUpdate(id uint16, fqdn, value string, add bool, tsig *dnsmessage.UnknownResource) ([]byte, error) {
+	zone, err := dnsmessage.NewName(dnsFQDN(p.zone))
+	if err != nil {
+		return nil, err
+	}
+	name, err := dnsmessage.NewName(dnsFQDN(fqdn))
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, OpCode: dnsOpCodeUpdate})
+
+	// The zone section uses the layout of the question section.
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	// The update section uses the layout of the authority section.
+	if err := b.StartAuthorities(); err != nil {
+		return nil, err
+	}
+	header := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 60}
+	if !add {
+		// Class NONE with TTL 0 deletes exactly this record.
+		header = dnsmessage.ResourceHeader{Name: name, Class: dnsClassNone, TTL: 0}
+	}
+	if err := b.TXTResource(header, dnsmessage.TXTResource{TXT: []string{value}}); err != nil {
+		return nil, err
+	}
+
+	if tsig != nil {
+		keyName, err := dnsmessage.NewName(dnsFQDN(p.keyName))
+		if err != nil {
+			return nil, err
+		}
+		if err := b.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		if err := b.UnknownResource(dnsmessage.ResourceHeader{Name: keyName, Class: dnsClassAny, TTL: 0}, *tsig); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// tsig calculates the TSIG record for the message.
+func (p *rfc2136Provider) tsig(msg []byte, id uint16, now time.Time) (*dnsmessage.UnknownResource, error) {
+	newHash, err := tsigAlgorithm(p.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(p.secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tsig-secret: %v", err)
+	}
+	algorithm := p.algorithm
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	algorithmName := dnsWireName(algorithm)
+
+	var timeSigned [6]byte
+	unix := uint64(now.Unix())
+	binary.BigEndian.PutUint16(timeSigned[0:2], uint16(unix>>32))
+	binary.BigEndian.PutUint32(timeSigned[2:6], uint32(unix))
+
+	// The MAC is calculated over the message and the TSIG variables (RFC 8945, section 4.3.3).
+	mac := hmac.New(newHash, secret)
+	mac.Write(msg)
+	mac.Write(dnsWireName(p.keyName))
+	binary.Write(mac, binary.BigEndian, uint16(dnsClassAny))
+	binary.Write(mac, binary.BigEndian, uint32(0)) // TTL
+	mac.Write(algorithmName)
+	mac.Write(timeSigned[:])
+	binary.Write(mac, binary.BigEndian, uint16(tsigFudge))
+	binary.Write(mac, binary.BigEndian, uint16(0)) // Error
+	binary.Write(mac, binary.BigEndian, uint16(0)) // Other length
+	sum := mac.Sum(nil)
+
+	// Build the RDATA of the TSIG record.
+	var rdata []byte
+	rdata = append(rdata, algorithmName...)
+	rdata = append(rdata, timeSigned[:]...)
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = appendUint16(rdata, id)
+	rdata = appendUint16(rdata, 0) // Error
+	rdata = appendUint16(rdata, 0) // Other length
+
+	return &dnsmessage.UnknownResource{Type: dnsTypeTSIG, Data: rdata}, nil
+}
+
+// exchange sends the message over TCP to the name server and checks the response code.
+func (p *rfc2136Provider) exchange(ctx context.Context, msg []byte) error {
+	addr := p.nameserver
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, err := certDialContext(dialCtx, "tcp", addr)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// Messages over TCP are prefixed with their length.
+	if _, err := conn.Write(append(appendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return err
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return errors.New("rfc2136: update failed: " + header.RCode.String())
+	}
+	return nil
+}
+
+// appendUint16 appends the value in big endian byte order.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// dnsFQDN returns the name with a trailing dot.
+func dnsFQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// dnsWireName returns the uncompressed wire format of the name in lower case.
+func dnsWireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// route53API is the endpoint of the Route53 API.
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+// route53Provider creates the TXT records with the Route53 API.
+type route53Provider struct {
+	accessKeyID     string
+	secretAccessKey string
+	hostedZoneID    string
+}
+
+// Present creates the TXT record.
+func (p *route53Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, "UPSERT", fqdn, value)
+}
+
+// CleanUp removes the TXT record.
+func (p *route53Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, "DELETE", fqdn, value)
+}
+
+// change sends a change request for the TXT record and waits until the change is in sync.
+func (p *route53Provider) change(ctx context.Context, action, fqdn, value string) error {
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/">
+<ChangeBatch><Changes><Change><Action>%s</Action><ResourceRecordSet><Name>%s.</Name><Type>TXT</Type><TTL>60</TTL>
+<ResourceRecords><ResourceRecord><Value>"%s"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet></Change></Changes></ChangeBatch>
+</ChangeResourceRecordSetsRequest>`, action, xmlEscape(fqdn), xmlEscape(value))
+
+	var info struct {
+		ID     string `xml:"ChangeInfo>Id"`
+		Status string `xml:"ChangeInfo>Status"`
+	}
+	zoneID := strings.TrimPrefix(p.hostedZoneID, "/hostedzone/")
+	if err := p.request(ctx, http.MethodPost, "/hostedzone/"+zoneID+"/rrset", []byte(body), &info); err != nil {
+		return err
+	}
+
+	// Wait until the change has been applied to all Route53 name servers.
+	for info.Status == "PENDING" {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := p.request(ctx, http.MethodGet, "/change/"+strings.TrimPrefix(info.ID, "/change/"), nil, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request sends a signed request to the Route53 API and decodes the XML result.
+func (p *route53Provider) request(ctx context.Context, method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, route53API+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	signAWSRequest(req, body, p.accessKeyID, p.secretAccessKey, "us-east-1", "route53", time.Now())
+
+	client := certHTTPClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiError struct {
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &apiError)
+		return fmt.Errorf("route53: request failed with status %d: %s", resp.StatusCode, apiError.Message)
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// xmlEscape escapes the string for XML text.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/idna"
+)
+
+// domainsMu protects config.letsEncryptDomains and config.allDomains, because they can be reloaded while the server is running.
+var domainsMu sync.RWMutex
+
+// reloadMu serializes the reloads of the domains by the admin command and by the domain discovery.
+var reloadMu sync.Mutex
+
+// buildAllDomains returns the map of all allowed domains (in ASCII form) for the given lists of domains.
+func buildAllDomains(letsEncryptDomains, selfSignedDomains []string) (map[string]bool, error) {
+	allDomains := make(map[string]bool, len(letsEncryptDomains)+len(selfSignedDomains))
+	for _, list := range [][]string{letsEncryptDomains, selfSignedDomains} {
+		for _, h := range list {
+			asciiDomain, err := idna.Lookup.ToASCII(h)
+			if err != nil {
+				return nil, fmt.Errorf("domain '%s' has invalid characters", h)
+			}
+			allDomains[asciiDomain] = true
+		}
+	}
+	return allDomains, nil
+}
+
+// isAllowedDomain returns true if the (ASCII) domain is one of the allowed domains.
+func isAllowedDomain(domain string) bool {
+	domainsMu.RLock()
+	defer domainsMu.RUnlock()
+	return config.allDomains[domain]
+}
+
+// allowedDomains returns a sorted copy of all allowed domains.
+func allowedDomains() []string {
+	domainsMu.RLock()
+	defer domainsMu.RUnlock()
+
+	domains := make([]string, 0, len(config.allDomains))
+	for domain := range config.allDomains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// letsEncryptHostPolicy allows only the domains in the Let's Encrypt white list, within the limits of the host policy.
+// Unlike autocert.HostWhitelist, it always uses the current white list, which changes when the domains are reloaded.
+func letsEncryptHostPolicy(ctx context.Context, host string) error {
+	if !isLetsEncryptDomain(host) {
+		return fmt.Errorf("acme/autocert: host %q not configured in HostWhitelist", host)
+	}
+	return checkHostPolicyLimits(host)
+}
+
+// isLetsEncryptDomain returns true if the (ASCII) host is in the Let's Encrypt white list.
+func isLetsEncryptDomain(host string) bool {
+	domainsMu.RLock()
+	defer domainsMu.RUnlock()
+
+	for _, h := range config.letsEncryptDomains {
+		if h, err := idna.Lookup.ToASCII(h); err == nil && h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadDomains scans the web root again for domain directories, updates the white lists,
+// and fills the file cache with the files of the new domains.
+func reloadDomains() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	log.Println("Reloading domains")
+
+	letsEncryptDomains := getAllowedDomainsFromSubdirectories(config.WebRootDirectory, config.SelfSignedDomains)
+	allDomains, err := buildAllDomains(letsEncryptDomains, config.SelfSignedDomains)
+	if err != nil {
+		log.Println("Could not reload domains:", err)
+		return
+	}
+
+	domainsMu.Lock()
+	config.letsEncryptDomains = letsEncryptDomains
+	config.allDomains = allDomains
+	domainsMu.Unlock()
+
+	log.Println("Caching files...")
+	if err := fillCache(config.WebRootDirectory); err != nil {
+		log.Println("Could not cache files:", err)
+	}
+
+	log.Println("Reloading domains done")
+}
+
+// discoverDomains reloads the domains, if domain directories were created in or removed from the web root
+// since the last reload. It runs every domain-discovery-interval, so that new domains are served without a
+// restart or an admin command.
+func discoverDomains() {
+	letsEncryptDomains := getAllowedDomainsFromSubdirectories(config.WebRootDirectory, config.SelfSignedDomains)
+
+	domainsMu.RLock()
+	changed := len(letsEncryptDomains) != len(config.letsEncryptDomains)
+	for i := 0; !changed && i < len(letsEncryptDomains); i++ {
+		// Both lists are sorted by the directory names.
+		changed = letsEncryptDomains[i] != config.letsEncryptDomains[i]
+	}
+	domainsMu.RUnlock()
+
+	if changed {
+		log.Println("Domain directories in the web root changed")
+		reloadDomains()
+	}
+}
+
+// issueCertificate gets the certificate for the domain, so that the first client does not have to wait for it.
+func issueCertificate(domain string) {
+	log.Println("Getting certificate for:", domain)
+	// The operator asks explicitly, so the backoff after earlier failures does not apply.
+	clearACMEBackoff(domain)
+	if _, err := MyGetCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != nil {
+		log.Println("Error when getting certificate for:", domain, "Error:", err)
+	}
+}
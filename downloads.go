@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"matscheko.eu/sslserver/filecache"
+)
+
+// Domains that host artifacts can have a generated downloads page. It lists the files in the directory of the
+// page and its subdirectories with their sizes and SHA-256 checksums. The checksums are computed when the cache is
+// filled, also for the files that are too large to be kept in memory. The page is rendered from the current
+// cache for each request, so it always reflects the cached files.
+
+// downloadsTemplate is the template of the downloads page.
+var downloadsTemplate = template.Must(template.New("downloads").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Downloads - {{.Domain}}{{.Directory}}</title>
+<style>body{font-family:sans-serif}td,th{padding:0.2em 1em;text-align:left}td.size{text-align:right}code{font-size:0.9em}</style>
+</head>
+<body>
+<h1>Downloads</h1>
+<table>
+<tr><th>File</th><th>Size</th><th>Modified</th><th>SHA-256</th></tr>
+{{range .Files}}<tr><td><a href="{{.Path}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td>{{.Modified}}</td><td><code>{{.SHA256}}</code></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// downloadFile is a row of the downloads page.
+type downloadFile struct {
+	Path     string // URL path of the file
+	Name     string // Path relative to the directory of the downloads page
+	Size     int64
+	Modified string
+	SHA256   string // Hex encoded checksum, or empty if it is unknown
+}
+
+// hashUncachedFile computes the metadata of a file that is too large for the file cache, so that it can be
+// listed on a downloads page.
+func hashUncachedFile(cache *filecache.Cache, name string, info fs.FileInfo) {
+	hash, err := filecache.HashFile(cache.Origin, name)
+	if err != nil {
+		log.Println(" Warning, could not compute checksum:", name, err)
+		return
+	}
+	cache.SetMetadata(name, filecache.Entry{ModTime: info.ModTime(), Size: info.Size(), Hash: hash})
+}
+
+// isValidDownloadsPage returns true if the path can be used as the URL path of a downloads page.
+func isValidDownloadsPage(urlPath string) bool {
+	return urlPath == path.Clean(urlPath) && matchPath(urlPath)
+}
+
+// serveDownloadsPage renders the downloads page of the domain for the files in the directory of the page.
+func serveDownloadsPage(w http.ResponseWriter, r *http.Request, domain, pagePath string) {
+	directory := path.Dir(pagePath)
+	prefix := domain + strings.TrimSuffix(directory, "/") + "/"
+
+	var files []downloadFile
+	webFiles.Range(func(key string, entry filecache.Entry, inMemory bool) {
+		urlPath := "/" + strings.TrimPrefix(key, domain+"/")
+		if !strings.HasPrefix(key, prefix) || urlPath == pagePath {
+			return
+		}
+		checksum := ""
+		if hash, err := base64.RawURLEncoding.DecodeString(entry.Hash); err == nil && entry.Hash != "" {
+			checksum = hex.EncodeToString(hash)
+		}
+		files = append(files, downloadFile{
+			Path:     urlPath,
+			Name:     strings.TrimPrefix(key, prefix),
+			Size:     entry.Size,
+			Modified: entry.ModTime.UTC().Format(time.RFC3339),
+			SHA256:   checksum,
+		})
+	})
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	addHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// The page is streamed to the client while it is rendered.
+	err := downloadsTemplate.Execute(w, struct {
+		Domain    string
+		Directory string
+		Files     []downloadFile
+	}{domain, directory, files})
+	if err != nil {
+		log.Println("Could not render downloads page:", err)
+	}
+}
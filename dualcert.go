@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+)
+
+// With dual-certificates, each domain gets an ECDSA certificate and an RSA certificate. Clients that support
+// ECDSA get the smaller and faster ECDSA certificate, and old clients get the RSA certificate. The RSA
+// certificates are stored under "<domain>+rsa", like autocert names them, and they are cached separately.
+
+// rsaCertSuffix is the suffix of the cache names of RSA certificates.
+const rsaCertSuffix = "+rsa"
+
+// certificateVariant returns the suffix of the certificate that the client gets: "" for the primary certificate,
+// or rsaCertSuffix if dual-certificates is enabled and the client does not support ECDSA certificates.
+func certificateVariant(hello *tls.ClientHelloInfo) string {
+	// Handshakes without cipher suites are internal requests, e.g. to initialize the certificates.
+	if !config.DualCertificates || hello.CipherSuites == nil || clientSupportsECDSA(hello) {
+		return ""
+	}
+	return rsaCertSuffix
+}
+
+// clientSupportsECDSA returns true if the client accepts ECDSA P-256 certificates.
+func clientSupportsECDSA(hello *tls.ClientHelloInfo) bool {
+	// The signature algorithms and the curves, if present, limit the keys that the client accepts.
+	if hello.SignatureSchemes != nil {
+		ok := false
+		for _, scheme := range hello.SignatureSchemes {
+			if scheme == tls.ECDSAWithP256AndSHA256 || scheme == tls.ECDSAWithP384AndSHA384 || scheme == tls.ECDSAWithP521AndSHA512 || scheme == tls.ECDSAWithSHA1 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if hello.SupportedCurves != nil {
+		ok := false
+		for _, curve := range hello.SupportedCurves {
+			if curve == tls.CurveP256 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	// TLS 1.3 cipher suites do not name the key type.
+	for _, version := range hello.SupportedVersions {
+		if version == tls.VersionTLS13 {
+			return true
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
+
+// variantHello returns a hello that makes autocert choose the certificate of the variant.
+// Without dual-certificates, autocert chooses by itself.
+func variantHello(hello *tls.ClientHelloInfo, variant string) *tls.ClientHelloInfo {
+	if !config.DualCertificates {
+		return hello
+	}
+	h := *hello
+	if variant == rsaCertSuffix {
+		h.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		h.SignatureSchemes = []tls.SignatureScheme{tls.PKCS1WithSHA256}
+	} else {
+		h.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+		h.SignatureSchemes = []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}
+		h.SupportedCurves = []tls.CurveID{tls.CurveP256}
+	}
+	return &h
+}
+
+// rsaHello returns an internal hello for the RSA certificate of the domain, e.g. to get it at startup.
+func rsaHello(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.PKCS1WithSHA256},
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The end-to-end tests serve a temporary web root with the handlers of the child in the test process. Unlike the
+// self-test, they do not start the parent and the child, so they do not need free ports, and the servers are
+// httptest servers with their own certificates.
+
+// e2eOtherDomain is the second domain of the web root. Its files must never be served for the other domains.
+const e2eOtherDomain = "other.example"
+
+// e2eFiles are the files of the web root of the end-to-end tests.
+var e2eFiles = map[string]string{
+	"localhost/index.html":                 "<html><body>localhost</body></html>\n",
+	"localhost/only-localhost.html":        "<html><body>only localhost</body></html>\n",
+	"localhost/style.css":                  "body { color: black; }\n",
+	e2eOtherDomain + "/index.html":         "<html><body>other</body></html>\n",
+	e2eOtherDomain + "/other-only.html":    "<html><body>only other</body></html>\n",
+	e2eOtherDomain + "/sub/deep/file.html": "<html><body>deep</body></html>\n",
+}
+
+var e2eReadyOnce sync.Once
+
+// e2eServer is the HTTPS server of an end-to-end test.
+type e2eServer struct {
+	*httptest.Server
+	webRoot string // The absolute path of the web root.
+}
+
+// newE2EServer writes the config and the web root into a temporary directory, loads them like the child does, and
+// starts an HTTPS server with the handlers of the child. The config and the file cache are restored afterwards.
+func newE2EServer(t *testing.T, extraFiles map[string][]byte) *e2eServer {
+	dir := t.TempDir()
+	webRoot := filepath.Join(dir, "www_static")
+	write := func(name string, data []byte) {
+		path := filepath.Join(webRoot, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range e2eFiles {
+		write(name, []byte(data))
+	}
+	for name, data := range extraFiles {
+		write(name, data)
+	}
+	configData := "web-root-directory: www_static\ncertificate-cache-directory: certcache\nself-signed-domains: [localhost, " + e2eOtherDomain + "]\nlog-file: \"\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yml"), []byte(configData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedConfig, savedWebFiles := config, webFiles
+	t.Cleanup(func() {
+		os.Chdir(workingDir)
+		config, webFiles = savedConfig, savedWebFiles
+	})
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the config, the domains, and the files like the child.
+	webFiles = nil
+	readConfig()
+	reloadDomains()
+	e2eReadyOnce.Do(func() {
+		// The child tells the parent that it is ready. There is no parent, so the commands are dropped.
+		commands := childToParentCh
+		go func() {
+			for range commands {
+			}
+		}()
+		markServerReady()
+	})
+
+	server := httptest.NewUnstartedServer(w3cLogHandler(headerProfileHandler(httpsHandler())))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return &e2eServer{Server: server, webRoot: webRoot}
+}
+
+// get requests the path for the domain, and returns the response with the read body.
+func (s *e2eServer) get(t *testing.T, domain, path string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = domain
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request for %s%s: %v", domain, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("response for %s%s: %v", domain, path, err)
+	}
+	return resp, string(body)
+}
+
+// expect requests the path for the domain, and checks the status and, for 200 OK, the body.
+func (s *e2eServer) expect(t *testing.T, domain, path string, status int, body string) {
+	t.Helper()
+	resp, got := s.get(t, domain, path)
+	if resp.StatusCode != status {
+		t.Errorf("%s%s: status %d, want %d", domain, path, resp.StatusCode, status)
+	} else if status == http.StatusOK && got != body {
+		t.Errorf("%s%s: body %q, want %q", domain, path, got, body)
+	}
+}
+
+func TestE2EServeFiles(t *testing.T) {
+	s := newE2EServer(t, nil)
+	s.expect(t, "localhost", "/", http.StatusOK, e2eFiles["localhost/index.html"])
+	s.expect(t, "localhost", "/index.html", http.StatusOK, e2eFiles["localhost/index.html"])
+	s.expect(t, e2eOtherDomain, "/sub/deep/file.html", http.StatusOK, e2eFiles[e2eOtherDomain+"/sub/deep/file.html"])
+}
+
+func TestE2EHeaders(t *testing.T) {
+	s := newE2EServer(t, nil)
+	tests := []struct {
+		path   string
+		header map[string]string
+	}{
+		{"/index.html", map[string]string{
+			"Content-Type":              "text/html; charset=utf-8",
+			"Strict-Transport-Security": config.HttpHeaderStrictTransportSecurity,
+			"X-Content-Type-Options":    config.HttpHeaderXContentTypeOptions,
+			"Referrer-Policy":           "no-referrer",
+		}},
+		{"/style.css", map[string]string{
+			"Content-Type":           "text/css; charset=utf-8",
+			"X-Content-Type-Options": config.HttpHeaderXContentTypeOptions,
+		}},
+	}
+	for _, test := range tests {
+		resp, _ := s.get(t, "localhost", test.path)
+		for name, want := range test.header {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("%s: header %s: %q, want %q", test.path, name, got, want)
+			}
+		}
+	}
+}
+
+func TestE2EVirtualHostIsolation(t *testing.T) {
+	s := newE2EServer(t, nil)
+	s.expect(t, e2eOtherDomain, "/", http.StatusOK, e2eFiles[e2eOtherDomain+"/index.html"])
+	s.expect(t, e2eOtherDomain, "/only-localhost.html", http.StatusNotFound, "")
+	s.expect(t, "localhost", "/other-only.html", http.StatusNotFound, "")
+	for _, path := range []string{"/../" + e2eOtherDomain + "/index.html", "/%2e%2e/" + e2eOtherDomain + "/index.html", "/..%2f" + e2eOtherDomain + "/index.html"} {
+		s.expect(t, "localhost", path, http.StatusBadRequest, "")
+	}
+
+	// Domains that are not configured get no content, also if the web root has a directory of the name.
+	s.expect(t, "unknown.example", "/", http.StatusNotFound, "")
+	s.expect(t, "www_static", "/localhost/index.html", http.StatusNotFound, "")
+}
+
+func TestE2ENotFound(t *testing.T) {
+	s := newE2EServer(t, nil)
+	for _, path := range []string{"/missing.html", "/sub/missing.html", "/missing/", "/index.html/", "/.hidden", "/index"} {
+		s.expect(t, "localhost", path, http.StatusNotFound, "")
+	}
+}
+
+// TestE2EUncleanPath checks that URL paths with "." or ".." elements or duplicate slashes are refused before the
+// rules of the domain, so that they can not bypass the basic authentication of a URL path prefix.
+func TestE2EUncleanPath(t *testing.T) {
+	secret := "<html><body>secret</body></html>\n"
+	s := newE2EServer(t, map[string][]byte{"localhost/api/admin/secret.html": []byte(secret)})
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswdFile := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswdFile, []byte("admin:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.BasicAuth = []BasicAuthRule{{Path: "/api/admin/", HtpasswdFile: htpasswdFile}}
+	if err := checkBasicAuthRules(config.BasicAuth); err != nil {
+		t.Fatal(err)
+	}
+
+	s.expect(t, "localhost", "/api/admin/secret.html", http.StatusUnauthorized, "")
+	for _, path := range []string{"/api/x/../admin/secret.html", "//api/admin/secret.html", "/api//admin/secret.html", "/api/./admin/secret.html", "/%2e/api/admin/secret.html", "//index.html", "/./index.html"} {
+		s.expect(t, "localhost", path, http.StatusBadRequest, "")
+	}
+}
+
+func TestE2ECacheRefresh(t *testing.T) {
+	s := newE2EServer(t, nil)
+	s.expect(t, "localhost", "/index.html", http.StatusOK, e2eFiles["localhost/index.html"])
+
+	// A changed file is served after the reload.
+	changed := "<html><body>changed</body></html>\n"
+	if err := os.WriteFile(filepath.Join(s.webRoot, "localhost", "index.html"), []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadDomains()
+	s.expect(t, "localhost", "/index.html", http.StatusOK, changed)
+
+	// A new file and a new domain are served after the reload.
+	for name, data := range map[string]string{"localhost/new.html": "new\n", "new.example/index.html": "new domain\n"} {
+		path := filepath.Join(s.webRoot, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloadDomains()
+	s.expect(t, "localhost", "/new.html", http.StatusOK, "new\n")
+	s.expect(t, "new.example", "/", http.StatusOK, "new domain\n")
+}
+
+func TestE2EHTTPRedirect(t *testing.T) {
+	newE2EServer(t, nil)
+	server := httptest.NewServer(httpHandler(&autocert.Manager{}))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/index.html", nil)
+	req.Host = "localhost"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); resp.StatusCode < 300 || resp.StatusCode > 399 || location != "https://localhost/index.html" {
+		t.Errorf("status %d and location %q, want a redirect to https://localhost/index.html", resp.StatusCode, location)
+	}
+}
+
+// TestE2EGracefulShutdown checks that a download that is running when the shutdown starts is finished, and that new
+// connections are refused in the meantime.
+func TestE2EGracefulShutdown(t *testing.T) {
+	large := make([]byte, 16*1024*1024)
+	rand.Read(large)
+	s := newE2EServer(t, map[string][]byte{"localhost/large.bin": large})
+	config.ShutdownTimeout = 30 * time.Second
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/large.bin", nil)
+	req.Host = "localhost"
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	drained := make(chan bool, 1)
+	go func() { drained <- terminateServerList(s.Config) }()
+
+	// New connections are refused while the download is drained.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", s.Listener.Addr().String(), time.Second)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("the server still accepts connections after the shutdown started")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("the download was not finished during the shutdown: %v", err)
+	}
+	if !bytes.Equal(body, large) {
+		t.Fatalf("the download returned %d bytes instead of %d", len(body), len(large))
+	}
+	select {
+	case ok := <-drained:
+		if !ok {
+			t.Error("the shutdown closed connections, but all requests were finished")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("the shutdown did not finish after the download")
+	}
+}
+
+// TestE2EShutdownTimeout checks that the connections that are still open after shutdown-timeout are closed.
+func TestE2EShutdownTimeout(t *testing.T) {
+	large := make([]byte, 16*1024*1024)
+	s := newE2EServer(t, map[string][]byte{"localhost/large.bin": large})
+	config.ShutdownTimeout = 200 * time.Millisecond
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/large.bin", nil)
+	req.Host = "localhost"
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The client does not read, so the download can not finish within shutdown-timeout.
+	if terminateServerList(s.Config) {
+		t.Error("the shutdown reported that all requests were finished")
+	}
+	if body, err := io.ReadAll(resp.Body); err == nil && len(body) == len(large) {
+		t.Error("the download was finished, although its connection was closed")
+	}
+}
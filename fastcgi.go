@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastCGI rules forward the requests of scripts, e.g. of the files with the extension ".php", to a FastCGI server
+// like PHP-FPM, so that simple PHP sites can be hosted. The scripts are files of the domain directory: only the
+// URL paths of existing files are forwarded, after the rewrites and the index files, and the other files of the
+// domain are served as usual. The FastCGI server runs outside of the jail, so it gets the path of the script
+// (SCRIPT_FILENAME) below the document-root of the rule, which is the web root as the FastCGI server sees it.
+//
+// The child connects to the FastCGI server for each request, through the circuit breaker of its address. The
+// response is parsed like a CGI response: the Status header sets the status code, and a Location header without
+// Status redirects with 302 Found. The lines that the script writes to stderr are logged.
+
+// FastCGI record types and roles (see the FastCGI specification).
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiMaxContent   = 65535
+	fcgiRequestID    = 1 // Each connection has only one request.
+)
+
+// cgiMaxBufferedBody limits the request bodies of scripts without Content-Length, which are read into memory,
+// because CONTENT_LENGTH must be known before the body is sent.
+const cgiMaxBufferedBody = 32 << 20
+
+// matchScriptExtension matches the extensions of the scripts, e.g. ".php".
+var matchScriptExtension = regexp.MustCompile(`^\.[a-zA-Z0-9]+$`).MatchString
+
+// FastCGIRule forwards the requests of the scripts with the extensions below a URL path prefix to a FastCGI server.
+type FastCGIRule struct {
+	// URL path prefix of the scripts, e.g. "/blog/". The default is "/".
+	Path string `yaml:"path,omitempty"`
+
+	// Extensions of the scripts, e.g. [".php"].
+	Extensions []string `yaml:"extensions"`
+
+	// Address of the FastCGI server, "host:port" or "unix:/path/to/socket".
+	Address string `yaml:"address"`
+
+	// The web root directory as the FastCGI server sees it. The default is the absolute path of web-root-directory.
+	DocumentRoot string `yaml:"document-root,omitempty"`
+
+	// Additional parameters for the scripts, e.g. PHP_VALUE.
+	Params map[string]string `yaml:"params,omitempty"`
+
+	// Maximum time until the FastCGI server sends the response header.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// matches returns true if the URL path is a script of the rule.
+func (rule FastCGIRule) matches(urlPath string) bool {
+	prefix := strings.TrimSuffix(rule.Path, "/")
+	if !strings.HasPrefix(urlPath, prefix+"/") {
+		return false
+	}
+	for _, extension := range rule.Extensions {
+		if strings.EqualFold(path.Ext(urlPath), extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to the FastCGI server.
+func (rule FastCGIRule) dial(ctx context.Context) (net.Conn, error) {
+	if socket := strings.TrimPrefix(rule.Address, "unix:"); socket != rule.Address {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	return upstreamDialContext(ctx, "tcp", rule.Address)
+}
+
+// checkFastCGIRules returns an error if a rule is invalid, and sets the defaults of the path, the document root, and
+// the timeout (60 seconds).
+func checkFastCGIRules(rules []FastCGIRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Path == "" {
+			rule.Path = "/"
+		}
+		clean := path.Clean(rule.Path)
+		if !strings.HasPrefix(rule.Path, "/") || (rule.Path != clean && rule.Path != clean+"/") {
+			return fmt.Errorf("the path '%s' must be a clean URL path", rule.Path)
+		}
+		if len(rule.Extensions) == 0 {
+			return fmt.Errorf("the rule for '%s' has no extensions", rule.Path)
+		}
+		for _, extension := range rule.Extensions {
+			if !matchScriptExtension(extension) {
+				return fmt.Errorf("the extension '%s' of '%s' must start with a dot, e.g. '.php'", extension, rule.Path)
+			}
+			if err := checkScriptPath(path.Join(rule.Path, "index"+extension)); err != nil {
+				return err
+			}
+		}
+		if socket := strings.TrimPrefix(rule.Address, "unix:"); socket != rule.Address {
+			if socket == "" {
+				return fmt.Errorf("the address '%s' of '%s' has no socket path", rule.Address, rule.Path)
+			}
+		} else if _, _, err := net.SplitHostPort(rule.Address); err != nil {
+			return fmt.Errorf("the address '%s' of '%s' must be host:port or unix:/path/to/socket%s", rule.Address, rule.Path, ipv6AddrHint(rule.Address))
+		}
+		if rule.DocumentRoot == "" {
+			webRoot, err := filepath.Abs(config.WebRootDirectory)
+			if err != nil {
+				return err
+			}
+			rule.DocumentRoot = filepath.ToSlash(webRoot)
+		}
+		if !strings.HasPrefix(rule.DocumentRoot, "/") {
+			return fmt.Errorf("the document-root '%s' of '%s' must be an absolute path", rule.DocumentRoot, rule.Path)
+		}
+		for name, value := range rule.Params {
+			if name == "" || strings.ContainsAny(name, "\x00=") || strings.Contains(value, "\x00") {
+				return fmt.Errorf("the param '%s' of '%s' is invalid", name, rule.Path)
+			}
+		}
+		if rule.Timeout < 0 {
+			return fmt.Errorf("the timeout of '%s' must not be negative", rule.Path)
+		}
+		if rule.Timeout == 0 {
+			rule.Timeout = 60 * time.Second
+		}
+	}
+	return nil
+}
+
+// serveFastCGI forwards the request to the FastCGI server of the first rule of the domain that matches the URL path,
+// if the script exists. It returns false if no rule matches or the script does not exist.
+func serveFastCGI(w http.ResponseWriter, r *http.Request, domain, urlPath string, settings domainSettings) bool {
+	for _, rule := range settings.fastCGI {
+		if !rule.matches(urlPath) {
+			continue
+		}
+		entry, err := webFiles.Get(domain + urlPath)
+		if err != nil {
+			return false
+		}
+		if entry.File != nil {
+			entry.File.Close()
+		}
+
+		// The script and the domain directory can be in another directory, with a mount or a rollout.
+		scriptFile := rule.DocumentRoot + "/" + webRootSource(domain+urlPath)
+		documentRoot := rule.DocumentRoot + "/" + webRootSource(domain)
+		params := cgiParams(r, domain, urlPath, scriptFile, documentRoot)
+		for name, value := range rule.Params {
+			params[name] = value
+		}
+		if err := forwardFastCGI(w, r, rule, params); err != nil {
+			log.Println("FastCGI:", rule.Address, urlPath, "failed:", err)
+		}
+		return true
+	}
+	return false
+}
+
+// cgiParams returns the CGI meta-variables of the request for the script. The request headers are passed as HTTP_*
+// variables, except for Proxy, which some scripts would use as their HTTP proxy (httpoxy).
+func cgiParams(r *http.Request, domain, scriptName, scriptFile, documentRoot string) map[string]string {
+	remoteHost, remotePort, _ := net.SplitHostPort(logAddr(r.RemoteAddr))
+	serverHost, serverPort := "", ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		serverHost, serverPort, _ = net.SplitHostPort(logAddr(addr.String()))
+	}
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "sslserver",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       strings.TrimSuffix(domain, rolloutDomainSuffix),
+		"SERVER_ADDR":       serverHost,
+		"SERVER_PORT":       serverPort,
+		"REMOTE_ADDR":       remoteHost,
+		"REMOTE_PORT":       remotePort,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   scriptFile,
+		"DOCUMENT_URI":      scriptName,
+		"DOCUMENT_ROOT":     documentRoot,
+		"PATH_INFO":         "",
+		"REDIRECT_STATUS":   "200", // PHP refuses to run without it, if cgi.force_redirect is set.
+		"HTTP_HOST":         r.Host,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+	}
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	if r.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for name, values := range r.Header {
+		if name == "Proxy" || name == "Content-Type" || name == "Content-Length" {
+			continue
+		}
+		params["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+// cgiRequestBody returns the request body for a script, and sets CONTENT_LENGTH for a body without Content-Length,
+// which is read into memory. If it fails, the error is already answered.
+func cgiRequestBody(w http.ResponseWriter, r *http.Request, params map[string]string) (io.Reader, error) {
+	if r.ContentLength >= 0 {
+		return r.Body, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, cgiMaxBufferedBody+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, err
+	}
+	if len(data) > cgiMaxBufferedBody {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return nil, errors.New("the request body without Content-Length is too large")
+	}
+	if len(data) > 0 {
+		params["CONTENT_LENGTH"] = strconv.Itoa(len(data))
+	}
+	return bytes.NewReader(data), nil
+}
+
+// forwardFastCGI sends the request with the params to the FastCGI server, and writes its response.
+func forwardFastCGI(w http.ResponseWriter, r *http.Request, rule FastCGIRule, params map[string]string) error {
+	body, err := cgiRequestBody(w, r, params)
+	if err != nil {
+		return err
+	}
+
+	// While the circuit breaker of the FastCGI server is open, the request fails right away.
+	breaker := upstreamCircuitBreaker(rule.Address)
+	if !breaker.allow() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return errCircuitOpen
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), proxyDialTimeout)
+	conn, err := rule.dial(ctx)
+	cancel()
+	if err != nil {
+		breaker.failure(rule.Address)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return err
+	}
+	breaker.success(rule.Address)
+	defer conn.Close()
+
+	// The connection is closed if the client goes away.
+	ctx, cancel = context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(rule.Timeout))
+	out := bufio.NewWriter(conn)
+	if err := writeFastCGIRequest(out, params, body); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return err
+	}
+
+	response := &fastCGIResponse{r: bufio.NewReader(conn), script: params["SCRIPT_NAME"]}
+	err = writeCGIResponse(w, r, bufio.NewReader(response), func() { conn.SetDeadline(time.Time{}) })
+	if errors.Is(err, errCGIHeader) {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+	return err
+}
+
+// writeFastCGIRequest writes the begin request record, the params, and the body as stdin.
+func writeFastCGIRequest(out *bufio.Writer, params map[string]string, body io.Reader) error {
+	// The connection is not kept open after the request.
+	writeFastCGIRecord(out, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0})
+
+	var encoded []byte
+	for name, value := range params {
+		for _, length := range []int{len(name), len(value)} {
+			if length < 128 {
+				encoded = append(encoded, byte(length))
+			} else {
+				encoded = append(encoded, byte(length>>24)|0x80, byte(length>>16), byte(length>>8), byte(length))
+			}
+		}
+		encoded = append(append(encoded, name...), value...)
+	}
+	writeFastCGIStream(out, fcgiParams, encoded)
+	writeFastCGIRecord(out, fcgiParams, nil)
+
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			writeFastCGIRecord(out, fcgiStdin, buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	writeFastCGIRecord(out, fcgiStdin, nil)
+	return out.Flush()
+}
+
+// writeFastCGIStream writes the data in records of the maximum size.
+func writeFastCGIStream(out *bufio.Writer, recordType byte, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		writeFastCGIRecord(out, recordType, data[:n])
+		data = data[n:]
+	}
+}
+
+// writeFastCGIRecord writes a record without padding. The errors are returned by the flush of the writer.
+func writeFastCGIRecord(out *bufio.Writer, recordType byte, content []byte) {
+	out.Write([]byte{fcgiVersion, recordType, 0, fcgiRequestID, byte(len(content) >> 8), byte(len(content)), 0, 0})
+	out.Write(content)
+}
+
+// fastCGIResponse reads the stdout stream of the FastCGI response, and logs the stderr stream.
+type fastCGIResponse struct {
+	r         *bufio.Reader
+	script    string
+	remaining int // The unread content of the current stdout record.
+	padding   int // The padding after the current stdout record.
+}
+
+// Read reads the stdout stream until the end request record.
+func (f *fastCGIResponse) Read(p []byte) (int, error) {
+	for f.remaining == 0 {
+		if _, err := f.r.Discard(f.padding); err != nil {
+			return 0, err
+		}
+		f.padding = 0
+
+		var header [8]byte
+		if _, err := io.ReadFull(f.r, header[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		length, padding := int(header[4])<<8|int(header[5]), int(header[6])
+		switch header[1] {
+		case fcgiStdout:
+			f.remaining, f.padding = length, padding
+		case fcgiStderr:
+			content := make([]byte, length)
+			if _, err := io.ReadFull(f.r, content); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				if line != "" {
+					log.Println("FastCGI:", f.script+":", strings.TrimSpace(line))
+				}
+			}
+			f.padding = padding
+		case fcgiEndRequest:
+			return 0, io.EOF
+		default:
+			f.padding = length + padding
+		}
+	}
+
+	if len(p) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= n
+	return n, err
+}
+
+// errCGIHeader is returned for a response of a script without a valid header.
+var errCGIHeader = errors.New("invalid CGI response header")
+
+// writeCGIResponse writes the CGI response of a script: the header, and the rest as body. The headerDone function
+// is called after the header was read.
+func writeCGIResponse(w http.ResponseWriter, r *http.Request, response *bufio.Reader, headerDone func()) error {
+	header, err := textproto.NewReader(response).ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCGIHeader, err)
+	}
+	headerDone()
+
+	status := http.StatusOK
+	if value := header.Get("Status"); value != "" {
+		code, _, _ := strings.Cut(value, " ")
+		status, err = strconv.Atoi(code)
+		if err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("%w: invalid status %q", errCGIHeader, value)
+		}
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	header.Del("Status")
+
+	addHeaders(w)
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = io.Copy(w, response)
+	return err
+}
@@ -0,0 +1,398 @@
+// Package filecache keeps the files of an origin in memory and serves them. The origin is any fs.FS, e.g.
+// os.DirFS for a directory on disk, an embed.FS that is compiled into the binary, or a file system backed by
+// object storage. When the memory limit is reached, an Evictor decides which entries are removed.
+//
+// Example:
+//
+//	cache := &filecache.Cache{Origin: os.DirFS("www"), MaxFileSize: 1 << 20, MaxMemory: 64 << 20, Evictor: filecache.NewLRU(), ReadThrough: true}
+//	cache.Fill()
+//	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+//		entry, err := cache.Get(name)
+//		if err != nil {
+//			http.NotFound(w, r)
+//			return
+//		}
+//		filecache.ServeEntry(w, r, name, entry, entry.ModTime)
+//	}))
+package filecache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a file of the cache.
+type Entry struct {
+	Content []byte    // Content of the file, if it is kept in memory
+	File    fs.File   // Open file that is too large to be kept in memory. It has to be closed by the caller of Get.
+	ModTime time.Time // Modification time of the file
+	Size    int64     // Size of the file
+	Hash    string    // Base64url encoded SHA-256 of the content, only for files that are kept in memory or were hashed
+}
+
+// NewEntry creates an entry for a file that is kept in memory.
+func NewEntry(data []byte, modTime time.Time) Entry {
+	hash := sha256.Sum256(data)
+	return Entry{Content: data, ModTime: modTime, Size: int64(len(data)), Hash: base64.RawURLEncoding.EncodeToString(hash[:])}
+}
+
+// Cache keeps the files of the origin in memory. The names are slash separated paths relative to the origin.
+type Cache struct {
+	// The file system with the files.
+	Origin fs.FS
+
+	// Maximum size of files that are kept in memory. If MaxFileSizeFor is set, it is used instead.
+	MaxFileSize    int64
+	MaxFileSizeFor func(name string) int64
+
+	// Maximum total size of the files in memory. 0 means unlimited.
+	MaxMemory int64
+
+	// Decides which entries are removed to make room for new ones. Nil means that new entries are not
+	// stored when the memory limit is reached.
+	Evictor Evictor
+
+	// Get reads files from the origin that are not cached or have changed.
+	ReadThrough bool
+
+	// Fill does not read the files into memory. They are read by Get when they are requested (with ReadThrough),
+	// and OnLargeFile is called for each file, so that their metadata can be recorded.
+	LazyFill bool
+
+	// Called by Fill for each file that is too large to be kept in memory.
+	OnLargeFile func(name string, info fs.FileInfo)
+
+	// Optional verification of the content of a file before it is kept in memory and transformed. Files that fail
+	// the verification are not stored, and Get returns the error instead of the file.
+	Verify func(name string, data []byte) error
+
+	// Optional transformation of the content of a file before it is kept in memory, e.g. a minification. The size
+	// and the hash of the entry are those of the transformed content. Files that are too large are not transformed.
+	Transform func(name string, data []byte) []byte
+
+	// Optional log function.
+	Logf func(format string, args ...interface{})
+
+	mu         sync.RWMutex
+	entries    map[string]Entry
+	large      map[string]Entry
+	compressed map[string]map[string]compressedEntry
+	size       int64
+}
+
+// compressedEntry is a compressed representation of an entry in memory.
+type compressedEntry struct {
+	source string // Hash of the entry that was compressed
+	entry  Entry
+}
+
+// maxFileSize returns the maximum size of the file that is kept in memory.
+func (c *Cache) maxFileSize(name string) int64 {
+	if c.MaxFileSizeFor != nil {
+		return c.MaxFileSizeFor(name)
+	}
+	return c.MaxFileSize
+}
+
+// logf logs, if a log function is set.
+func (c *Cache) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+// verify returns the error of the verification of the content of the file, if a verification is set.
+func (c *Cache) verify(name string, data []byte) error {
+	if c.Verify == nil {
+		return nil
+	}
+	return c.Verify(name, data)
+}
+
+// transform returns the transformed content of the file, if a transformation is set.
+func (c *Cache) transform(name string, data []byte) []byte {
+	if c.Transform == nil {
+		return data
+	}
+	return c.Transform(name, data)
+}
+
+// Store stores the entry in memory. If the memory limit would be exceeded and the evictor can not make
+// enough room, an older entry of the same name is removed and false is returned.
+func (c *Cache) Store(name string, entry Entry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]Entry{}
+	}
+
+	c.remove(name)
+	needed := int64(len(entry.Content))
+	for c.MaxMemory > 0 && c.size+needed > c.MaxMemory {
+		if c.Evictor == nil || needed > c.MaxMemory {
+			return false
+		}
+		victim, ok := c.Evictor.Victim()
+		if !ok {
+			return false
+		}
+		c.logf("Evicting from cache: %s", victim)
+		c.remove(victim)
+	}
+
+	c.entries[name] = entry
+	c.size += needed
+	if c.Evictor != nil {
+		c.Evictor.Added(name)
+	}
+	return true
+}
+
+// remove removes the entry from memory. It has to be called with c.mu held. The evictor forgets the name also if
+// there is no entry, so that Store can not get the same victim again.
+func (c *Cache) remove(name string) {
+	if c.Evictor != nil {
+		c.Evictor.Removed(name)
+	}
+	old, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	delete(c.entries, name)
+	c.size -= int64(len(old.Content))
+	for _, compressed := range c.compressed[name] {
+		c.size -= int64(len(compressed.entry.Content))
+	}
+	delete(c.compressed, name)
+}
+
+// Lookup returns the entry, if it is kept in memory.
+func (c *Cache) Lookup(name string) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[name]
+	// The evictor is told under the lock, so that it can not add an entry again that Store has just removed.
+	if ok && c.Evictor != nil {
+		c.Evictor.Accessed(name)
+	}
+	return entry, ok
+}
+
+// Compressed returns an entry with the content of the entry in memory compressed by compress, e.g. for the
+// Content-Encoding of a response. The compressed content is kept with the entry, if it is the current entry of
+// the name and the memory limit allows it, so that the content is compressed once per encoding. It is removed
+// with the entry.
+func (c *Cache) Compressed(name, encoding string, entry Entry, compress func([]byte) ([]byte, error)) (Entry, error) {
+	c.mu.RLock()
+	compressed, ok := c.compressed[name][encoding]
+	c.mu.RUnlock()
+	if ok && compressed.source == entry.Hash {
+		return compressed.entry, nil
+	}
+
+	data, err := compress(entry.Content)
+	if err != nil {
+		return Entry{}, err
+	}
+	compressed = compressedEntry{source: entry.Hash, entry: NewEntry(data, entry.ModTime)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, ok := c.entries[name]
+	if !ok || current.Hash != entry.Hash || (c.MaxMemory > 0 && c.size+int64(len(data)) > c.MaxMemory) {
+		return compressed.entry, nil
+	}
+	if c.compressed == nil {
+		c.compressed = map[string]map[string]compressedEntry{}
+	}
+	if c.compressed[name] == nil {
+		c.compressed[name] = map[string]compressedEntry{}
+	}
+	if old, ok := c.compressed[name][encoding]; ok {
+		c.size -= int64(len(old.entry.Content))
+	}
+	c.compressed[name][encoding] = compressed
+	c.size += int64(len(data))
+	return compressed.entry, nil
+}
+
+// SetMetadata stores the metadata (modification time, size, and hash) of a file that is too large to be kept in memory.
+func (c *Cache) SetMetadata(name string, entry Entry) {
+	entry.Content, entry.File = nil, nil
+	c.mu.Lock()
+	if c.large == nil {
+		c.large = map[string]Entry{}
+	}
+	c.large[name] = entry
+	c.mu.Unlock()
+}
+
+// Metadata returns the entry of the file from memory, or the metadata of a large file.
+func (c *Cache) Metadata(name string) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if entry, ok := c.entries[name]; ok {
+		return entry, true
+	}
+	entry, ok := c.large[name]
+	return entry, ok
+}
+
+// Range calls fn for the files in memory and the large files with metadata. inMemory tells which of them it is.
+// fn must not call other methods of the cache.
+func (c *Cache) Range(fn func(name string, entry Entry, inMemory bool)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name, entry := range c.entries {
+		fn(name, entry, true)
+	}
+	for name, entry := range c.large {
+		if _, ok := c.entries[name]; !ok {
+			fn(name, entry, false)
+		}
+	}
+}
+
+// Fill reads all files of the origin that are not too large into memory, or none with LazyFill. Symbolic links are skipped.
+func (c *Cache) Fill() error {
+	return fs.WalkDir(c.Origin, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			c.logf("Symlink - not supported yet: %s", name)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if c.LazyFill || info.Size() > c.maxFileSize(name) {
+			if !c.LazyFill {
+				c.logf(" Warning, file too large for caching: %s", name)
+			}
+			if c.OnLargeFile != nil {
+				c.OnLargeFile(name, info)
+			}
+			return nil
+		}
+
+		data, err := fs.ReadFile(c.Origin, name)
+		if err != nil {
+			return err
+		}
+		if err := c.verify(name, data); err != nil {
+			c.logf(" Warning, verification failed, not caching: %v", err)
+			return nil
+		}
+		if !c.Store(name, NewEntry(c.transform(name, data), info.ModTime())) {
+			c.logf(" Warning, cache memory limit reached, not caching: %s", name)
+			return nil
+		}
+		c.logf("  %s", name)
+		return nil
+	})
+}
+
+// Get returns the entry of the file. With ReadThrough, files that are not cached or have changed are read from
+// the origin, and files that are too large are returned as open File that has to be closed. If the origin can not
+// be read, the cached entry is returned.
+func (c *Cache) Get(name string) (Entry, error) {
+	entry, isCached := c.Lookup(name)
+	if !c.ReadThrough {
+		if !isCached {
+			return Entry{}, fmt.Errorf("file not cached and reading from the origin is disabled: %s", name)
+		}
+		return entry, nil
+	}
+
+	file, err := c.Origin.Open(name)
+	if err != nil {
+		if isCached {
+			// If the file is cached, it doesn't matter that it can't be opened (e.g. if the origin is outside of a jail).
+			c.logf("Returning cached entry, cannot open file: %s", name)
+			return entry, nil
+		}
+		return Entry{}, fmt.Errorf("can't open file and not cached: %s", name)
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		if isCached {
+			c.logf("Returning cached entry, cannot read file info: %s", name)
+			return entry, nil
+		}
+		return Entry{}, fmt.Errorf("can't read file info and not cached: %s", name)
+	}
+	if isCached && info.ModTime().Equal(entry.ModTime) {
+		file.Close()
+		return entry, nil
+	}
+
+	if info.Size() > c.maxFileSize(name) {
+		// Return the large file as open file, which has to be closed.
+		metadata, _ := c.Metadata(name)
+		hash := ""
+		if metadata.ModTime.Equal(info.ModTime()) && metadata.Size == info.Size() {
+			hash = metadata.Hash
+		}
+		return Entry{File: file, ModTime: info.ModTime(), Size: info.Size(), Hash: hash}, nil
+	}
+
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return Entry{}, fmt.Errorf("can't read file content: %s", name)
+	}
+	if err := c.verify(name, data); err != nil {
+		c.logf("Verification failed, not serving: %v", err)
+		return Entry{}, err
+	}
+	entry = NewEntry(c.transform(name, data), info.ModTime())
+	if c.Store(name, entry) {
+		c.logf("Updating cache with new file: %s", name)
+	} else {
+		c.logf("Cache memory limit reached, serving without caching: %s", name)
+	}
+	return entry, nil
+}
+
+// HashFile computes the base64url encoded SHA-256 of a file of the origin.
+func HashFile(origin fs.FS, name string) (string, error) {
+	file, err := origin.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ServeEntry writes the entry to the response with http.ServeContent, and closes its File. If modTime is zero,
+// http.ServeContent neither sends Last-Modified nor evaluates If-Modified-Since.
+func ServeEntry(w http.ResponseWriter, r *http.Request, name string, entry Entry, modTime time.Time) {
+	if entry.File == nil {
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(entry.Content))
+		return
+	}
+	defer entry.File.Close()
+	content, ok := entry.File.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, modTime, content)
+}
@@ -0,0 +1,82 @@
+package filecache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentLookupStore checks that concurrent lookups and stores with a small memory limit do not leave
+// entries in the evictor that are not in memory, so that Store always finds a victim to evict.
+func TestConcurrentLookupStore(t *testing.T) {
+	lru := NewLRU()
+	c := &Cache{MaxMemory: 4 * 8, Evictor: lru}
+	names := make([]string, 16)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%d", i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					name := names[(g+i)%len(names)]
+					if g%2 == 0 {
+						c.Store(name, NewEntry(make([]byte, 8), time.Time{}))
+					} else {
+						c.Lookup(name)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Store did not finish")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size > c.MaxMemory {
+		t.Errorf("size %d exceeds the memory limit %d", c.size, c.MaxMemory)
+	}
+	if len(lru.elements) != len(c.entries) {
+		t.Errorf("the evictor has %d names, the cache %d entries", len(lru.elements), len(c.entries))
+	}
+	for name := range lru.elements {
+		if _, ok := c.entries[name]; !ok {
+			t.Errorf("the evictor has %s, which is not in memory", name)
+		}
+	}
+}
+
+// TestStoreWithUnknownVictim checks that Store evicts a victim that is not in memory, instead of getting it again.
+func TestStoreWithUnknownVictim(t *testing.T) {
+	lru := NewLRU()
+	c := &Cache{MaxMemory: 8, Evictor: lru}
+	c.Store("a", NewEntry(make([]byte, 8), time.Time{}))
+	lru.Accessed("ghost")
+	lru.Added("a")
+
+	done := make(chan bool)
+	go func() { done <- c.Store("b", NewEntry(make([]byte, 8), time.Time{})) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("b was not stored")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Store did not finish")
+	}
+	if _, ok := c.Lookup("a"); ok {
+		t.Error("a was not evicted")
+	}
+}
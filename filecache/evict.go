@@ -0,0 +1,68 @@
+package filecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Evictor decides which entries are removed from memory, when the memory limit of the cache is reached.
+// The cache calls it while holding its lock. Accessed can be called concurrently.
+type Evictor interface {
+	// Added is called when an entry is stored.
+	Added(name string)
+	// Accessed is called when an entry is read.
+	Accessed(name string)
+	// Removed is called when an entry is removed.
+	Removed(name string)
+	// Victim returns the entry that should be removed next.
+	Victim() (string, bool)
+}
+
+// LRU evicts the least recently used entries first.
+type LRU struct {
+	mu       sync.Mutex
+	order    *list.List // Front is the most recently used entry.
+	elements map[string]*list.Element
+}
+
+// NewLRU creates an LRU evictor.
+func NewLRU() *LRU {
+	return &LRU{order: list.New(), elements: map[string]*list.Element{}}
+}
+
+// Added marks the entry as most recently used.
+func (l *LRU) Added(name string) {
+	l.Accessed(name)
+}
+
+// Accessed marks the entry as most recently used.
+func (l *LRU) Accessed(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elements[name]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elements[name] = l.order.PushFront(name)
+}
+
+// Removed forgets the entry.
+func (l *LRU) Removed(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elements[name]; ok {
+		l.order.Remove(e)
+		delete(l.elements, name)
+	}
+}
+
+// Victim returns the least recently used entry.
+func (l *LRU) Victim() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
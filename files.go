@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -12,62 +11,70 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/net/idna"
+	"matscheko.eu/sslserver/filecache"
 )
 
-// A map to store the contents of the files that have been served by the web
-// server. The map keys are the file paths, and the values are the contents of
-// the files.
-type CacheEntry struct {
-	FileContent []byte    // Content of file that is kept in memory
-	FilePointer *os.File  // Pointer to file that is too large and needs to be read from disk
-	ModTime     time.Time // Modification time of the file
-}
+// webFiles caches the files of the web root. The names are the domain and the URL path without the leading
+// slash, e.g. "example.com/index.html".
+var webFiles *filecache.Cache
 
-var fileCache = make(map[string]CacheEntry)
+// Eviction strategies of the file cache.
+const (
+	cacheEvictionNone = "none" // New files are not cached when max-cache-memory is reached.
+	cacheEvictionLRU  = "lru"  // The least recently used files are removed to make room for new ones.
+)
 
-// fillCache reads all files in the given directory and its subdirectories
-// and stores their contents in the cache.
-// TODO: Either don't use fillCache or first read all main folders (domains) and then read in them, following symlinks, but only after being jailed.
-func fillCache(dir string) error {
-	dir = filepath.Clean(dir)
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
+// newWebFiles creates the file cache for the web root with the settings of the config.
+func newWebFiles(dir string) *filecache.Cache {
+	cache := &filecache.Cache{
+		Origin: mountFS{os.DirFS(filepath.Clean(dir))},
+		MaxFileSizeFor: func(name string) int64 {
+			return lowMemoryMaxFileSize(settingsForDomain(strings.SplitN(name, "/", 2)[0]).maxCacheableFileSize)
+		},
+		MaxMemory:   config.MaxCacheMemory,
+		ReadThrough: config.ServeFilesNotInCache,
+		LazyFill:    config.LowMemory,
+		Logf:        log.Printf,
+		Verify:      verifyManifest,
+		Transform:   minifyFile,
+	}
+	if config.CacheEviction == cacheEvictionLRU {
+		cache.Evictor = filecache.NewLRU()
+	}
 
-		path2, err := filepath.EvalSymlinks(path)
-		if err != nil {
-			return err
-		}
-		if path != path2 {
-			log.Printf("Directory is symlink - not supported yet: %s -> %s\n", path, path2)
-			return nil
+	cache.OnLargeFile = func(name string, info fs.FileInfo) {
+		domain := strings.SplitN(name, "/", 2)[0]
+		settings := settingsForDomain(domain)
+		urlPath := "/" + strings.TrimPrefix(name, domain+"/")
+		if settings.downloadsPage != "" || inChecksumSidecarPath(settings, urlPath) || settings.manifest != "" || settings.etag == "hash" {
+			// The checksum is needed for the downloads page, the checksum sidecar, the manifest, or the ETag.
+			hashUncachedFile(cache, name, info)
 		}
-
-		// Get the path without the web root directory
-		trimmedPath := strings.TrimPrefix(path, config.WebRootDirectory)
-		trimmedPath = strings.TrimPrefix(trimmedPath, "/")
-
-		// Get the file size in bytes
-		size := info.Size()
-		if size > config.MaxCacheableFileSize {
-			// File is to large for caching
-			log.Println(" Warning, file too large for caching:", trimmedPath)
-			return nil
+		if settings.manifest != "" && !isManifestFile(settings, urlPath) {
+			// The file is verified again when it is served, but the violations are already logged now.
+			if err := checkManifest(domain, settings, urlPath, fileHash(name)); err != nil {
+				log.Println(" Warning, verification failed:", err)
+			}
 		}
+	}
+	return cache
+}
 
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return err
-		}
+// fillCache reads all files in the given directory and its subdirectories
+// and stores their contents in the cache.
+// TODO: Either don't use fillCache or first read all main folders (domains) and then read in them, following symlinks, but only after being jailed.
+func fillCache(dir string) error {
+	if webFiles == nil {
+		webFiles = newWebFiles(dir)
+	}
+	err := webFiles.Fill()
 
-		log.Println(" ", trimmedPath)
-		fileCache[trimmedPath] = CacheEntry{FileContent: data, ModTime: info.ModTime()}
-		return nil
-	})
+	// Verify the existing checksum sidecars, now that the checksums of all files are known.
+	verifyChecksumSidecars()
+	return err
 }
 
 // for serveFiles
@@ -77,14 +84,21 @@ var matchPath = regexp.MustCompile(`^(/[a-zA-Z0-9_-]+)+(\.[a-zA-Z0-9]+)+$`).Matc
 // It reads the contents of the requested file from disk (or from the cache if
 // it has already been read), and writes the contents to the HTTP response.
 func serveFiles(w http.ResponseWriter, r *http.Request) {
+	chaosCheckpoint()
+
 	// Extract URL path and domain from the request
 	urlPath := r.URL.Path
 	domain := r.Host
 	// Get the IP address of the client.
-	clientIP := r.RemoteAddr
+	clientIP := logAddr(r.RemoteAddr)
 
 	if config.LogRequests {
-		log.Println("Request:", clientIP, "", urlPath)
+		// Log the escaped path, so that a request can not inject log lines.
+		if fingerprint := requestTLSFingerprint(r); fingerprint != nil {
+			log.Println("Request:", clientIP, domain, r.URL.EscapedPath(), "ja3="+fingerprint.ja3Hash, "ja4="+fingerprint.ja4)
+		} else {
+			log.Println("Request:", clientIP, domain, r.URL.EscapedPath())
+		}
 	}
 
 	domain, err := validateDomain(domain)
@@ -93,29 +107,214 @@ func serveFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse URL paths with "." or ".." elements or duplicate slashes before they are matched against the rules of
+	// the domain, which would not protect "/admin" from "/x/../admin" or "//admin".
+	if urlPath != cleanURLPath(urlPath) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Only serve domains with client authentication on connections that verified the client certificate for them.
+	if !checkClientAuth(w, r, domain, settingsForDomain(domain)) {
+		return
+	}
+
+	// Ask for the credentials of the protected URL paths before anything else.
+	if !checkBasicAuth(w, r, urlPath, settingsForDomain(domain)) {
+		return
+	}
+
+	// Answer the requests of redirected URL paths before the files are looked up.
+	if serveRedirect(w, r, domain, settingsForDomain(domain)) {
+		return
+	}
+
+	// Forward the requests of proxied URL paths to their upstreams.
+	if serveProxy(w, r, domain, settingsForDomain(domain)) {
+		return
+	}
+
+	// Execute the CGI scripts of the cgi-bin directory.
+	if serveCGI(w, r, domain, settingsForDomain(domain)) {
+		return
+	}
+
+	// Serve the new content version of a rollout to its share of the clients.
+	domain = rolloutDomain(w, r, domain, settingsForDomain(domain))
+
+	// Map the URL path to another file with the rewrite rules.
+	urlPath = rewritePath(urlPath, settingsForDomain(domain))
+
+	// The rules of the rewritten URL path apply as well, so that a rewrite does not bypass them.
+	if urlPath != r.URL.Path && !checkBasicAuth(w, r, urlPath, settingsForDomain(domain)) {
+		return
+	}
+
+	// Single-page applications get /index.html instead of 404 Not Found, so that their client-side routing handles
+	// the paths that are not files.
+	notFound := func() {
+		if !serveSPAFallback(w, r, domain) {
+			http.NotFound(w, r)
+		}
+	}
+
+	// Serve the index file of a directory, or the generated listing of a directory without index file.
+	if settings := settingsForDomain(domain); matchDirectoryPath(urlPath) {
+		index := indexFile(domain, urlPath, settings)
+		if index == "" && settings.autoIndex {
+			serveAutoIndex(w, r, domain, urlPath, settings)
+			return
+		}
+		if index == "" {
+			notFound()
+			return
+		}
+		urlPath = index
+	}
+
 	urlPath, err = validateAndCleanPath(urlPath)
 	if err != nil {
-		http.NotFound(w, r)
+		notFound()
+		return
+	}
+
+	// The same for the index file of a directory.
+	if urlPath != r.URL.Path && !checkBasicAuth(w, r, urlPath, settingsForDomain(domain)) {
 		return
 	}
 
-	// Prepend domain and webroot to the URL path to get the file path
-	filePath := filepath.FromSlash(domain + urlPath)
+	// Forward the requests of scripts to their FastCGI server.
+	if serveFastCGI(w, r, domain, urlPath, settingsForDomain(domain)) {
+		return
+	}
+
+	// Serve the generated checksum sidecars.
+	if serveChecksumSidecar(w, r, domain, urlPath) {
+		return
+	}
+
+	// Serve the generated downloads page.
+	if page := settingsForDomain(domain).downloadsPage; page != "" && urlPath == page {
+		serveDownloadsPage(w, r, domain, page)
+		return
+	}
 
-	entry, err := getFileEntry(filePath, domain+urlPath)
+	// Prepend the domain to the URL path to get the name of the file in the web root.
+	entry, err := webFiles.Get(domain + urlPath)
 	if err != nil {
+		// Domains without their own icons get the default icons.
+		if !serveDefaultIcon(w, r, urlPath, settingsForDomain(domain)) {
+			notFound()
+		}
+		return
+	}
+	serveFileEntry(w, r, domain, urlPath, entry)
+}
+
+// serveFileEntry writes the file of the domain with the URL path to the HTTP response.
+func serveFileEntry(w http.ResponseWriter, r *http.Request, domain, urlPath string, entry filecache.Entry) {
+	// Files that are too large to be kept in memory are verified against the manifest each time they are served.
+	if err := verifyLargeFile(domain, urlPath, entry); err != nil {
+		log.Println("Verification failed, not serving:", err)
+		entry.File.Close()
 		http.NotFound(w, r)
 		return
 	}
 
+	// Large files that changed since they were hashed get the hash ETag after they were hashed again.
+	if entry.File != nil && entry.Hash == "" && settingsForDomain(domain).etag == "hash" {
+		hashLargeFileInBackground(domain+urlPath, entry)
+	}
+
+	// Serve the compressed content, if the client accepts one of the compression encodings.
+	entry = compressEntry(w, r, domain+urlPath, entry)
+
 	// Write the file contents to the HTTP response.
 	addHeaders(w)
-	if entry.FilePointer != nil {
-		http.ServeContent(w, r, urlPath, entry.ModTime, entry.FilePointer)
-		entry.FilePointer.Close()
-	} else {
-		http.ServeContent(w, r, urlPath, entry.ModTime, bytes.NewReader(entry.FileContent))
+	setCacheControl(w, urlPath, settingsForDomain(domain))
+	modTime, notModified := setValidators(w, r, entry, settingsForDomain(domain))
+	if notModified {
+		if entry.File != nil {
+			entry.File.Close()
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
+	filecache.ServeEntry(w, r, urlPath, entry, modTime)
+}
+
+// isValidETagPolicy returns true if the value is a known setting for etag.
+func isValidETagPolicy(policy string) bool {
+	return policy == "" || policy == "hash" || policy == "mtime-size"
+}
+
+// hashingLargeFiles are the names of the large files that are hashed in the background.
+var hashingLargeFiles = map[string]bool{}
+var hashingLargeFilesMu sync.Mutex
+
+// hashLargeFileInBackground computes the hash of a file that is too large to be kept in memory, and records it with
+// the metadata of the file, unless the file changed in the meantime. Until then, the file gets the mtime-size ETag.
+func hashLargeFileInBackground(name string, entry filecache.Entry) {
+	hashingLargeFilesMu.Lock()
+	defer hashingLargeFilesMu.Unlock()
+	if hashingLargeFiles[name] {
+		return
+	}
+	hashingLargeFiles[name] = true
+
+	go func() {
+		defer func() {
+			hashingLargeFilesMu.Lock()
+			delete(hashingLargeFiles, name)
+			hashingLargeFilesMu.Unlock()
+		}()
+		hash, err := filecache.HashFile(webFiles.Origin, name)
+		if err != nil {
+			log.Println("Could not compute checksum:", name, err)
+			return
+		}
+		if info, err := fs.Stat(webFiles.Origin, name); err != nil || !info.ModTime().Equal(entry.ModTime) || info.Size() != entry.Size {
+			// The file changed while it was hashed. It is hashed again with the next request.
+			return
+		}
+		webFiles.SetMetadata(name, filecache.Entry{ModTime: entry.ModTime, Size: entry.Size, Hash: hash})
+	}()
+}
+
+// setValidators sets the ETag and Last-Modified headers according to the settings of the domain.
+// It returns the modification time that has to be passed to http.ServeContent, which is zero if
+// http.ServeContent should neither send Last-Modified nor evaluate If-Modified-Since.
+// If the request can be answered with 304 Not Modified by the settings alone, notModified is true.
+func setValidators(w http.ResponseWriter, r *http.Request, entry filecache.Entry, settings domainSettings) (modTime time.Time, notModified bool) {
+	switch settings.etag {
+	case "hash":
+		if entry.Hash != "" {
+			w.Header().Set("ETag", `"`+entry.Hash+`"`)
+		} else {
+			// Files that are not kept in memory are not hashed.
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, entry.ModTime.Unix(), entry.Size))
+		}
+	case "mtime-size":
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, entry.ModTime.Unix(), entry.Size))
+	}
+
+	// Both enabled: http.ServeContent handles everything.
+	if settings.lastModified && settings.ifModifiedSince {
+		return entry.ModTime, false
+	}
+
+	if settings.lastModified {
+		w.Header().Set("Last-Modified", entry.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	// If-None-Match has precedence over If-Modified-Since and is handled by http.ServeContent.
+	if settings.ifModifiedSince && r.Header.Get("If-None-Match") == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !entry.ModTime.Truncate(time.Second).After(t) {
+			return time.Time{}, true
+		}
+	}
+
+	return time.Time{}, false
 }
 
 func validateDomain(domain string) (string, error) {
@@ -125,28 +324,32 @@ func validateDomain(domain string) (string, error) {
 	}
 
 	// Check if the domain is allowed
-	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	asciiDomain, err := canonicalHost(domain)
 	if err != nil {
 		return "", fmt.Errorf("invalid domain: %v", err)
 	}
-	if !config.allDomains[asciiDomain] {
+	if !isAllowedDomain(asciiDomain) {
 		return "", errors.New("domain not allowed")
 	}
 
 	return asciiDomain, nil
 }
 
+// cleanURLPath returns the URL path without "." and ".." elements and duplicate slashes. A trailing slash is kept.
+func cleanURLPath(urlPath string) string {
+	clean := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
 func validateAndCleanPath(urlPath string) (string, error) {
 	// Clean the URL path for security
 	if urlPath != path.Clean(urlPath) {
 		return "", errors.New("invalid URL path")
 	}
 
-	// Set default file to index.html if URL path is root
-	if urlPath == "/" {
-		urlPath = "/index.html"
-	}
-
 	// Check if the URL path matches the expected file pattern
 	if !matchPath(urlPath) {
 		return "", errors.New("invalid URL path pattern")
@@ -155,59 +358,6 @@ func validateAndCleanPath(urlPath string) (string, error) {
 	return urlPath, nil
 }
 
-func getFileEntry(filePath, domainAndUrlPath string) (CacheEntry, error) {
-	// Check if the file has already been read and cached
-	entry, isCached := fileCache[filePath]
-
-	// Try to open the file if serving files not in cache
-	if config.ServeFilesNotInCache {
-		file, err := os.Open(filePath)
-		if err != nil {
-			if isCached { // If the file is cached, it doesn't matter that it can't be opened (is the case if the webroot is outside the jail)
-				log.Printf("Returning cached entry, cannot open file: %s", domainAndUrlPath)
-				return entry, nil
-			}
-			return CacheEntry{}, fmt.Errorf("can't open file and not cached: %s", domainAndUrlPath)
-		}
-		// defer file.Close() // Don't always close the file descriptor in this func. It will sometimes be closed in serveFiles()
-
-		info, err := file.Stat()
-		if err != nil {
-			// We don't return the file descriptor so we can close it
-			file.Close()
-			if isCached { // If the file is cached, it doesn't matter that the file info can't be read (is the case if the webroot is outside the jail)
-				log.Printf("Returning cached entry, cannot read file info: %s", domainAndUrlPath)
-				return entry, nil
-			}
-			return CacheEntry{}, fmt.Errorf("can't read file info and not cached: %s", domainAndUrlPath)
-		}
-
-		// Update cache if file modification time differs
-		if !isCached || !info.ModTime().Equal(entry.ModTime) {
-			if info.Size() > config.MaxCacheableFileSize {
-				// Return large file as file descriptor (that needs to be closed)
-				return CacheEntry{FilePointer: file, ModTime: info.ModTime()}, nil
-			}
-
-			// We don't return the file descriptor so we can close it
-			defer file.Close()
-
-			data, err := io.ReadAll(file)
-			if err != nil {
-				return CacheEntry{}, fmt.Errorf("can't read file content: %s", domainAndUrlPath)
-			}
-
-			log.Println("Updating cache with new file:", domainAndUrlPath)
-			entry = CacheEntry{FileContent: data, ModTime: info.ModTime()}
-			fileCache[filePath] = entry
-		}
-	} else if !isCached {
-		return CacheEntry{}, fmt.Errorf("file not cached and reading from disk is disabled: %s", domainAndUrlPath)
-	}
-
-	return entry, nil
-}
-
 // addHeaders adds basic HTTP headers to the response.
 func addHeaders(w http.ResponseWriter) {
 	if config.ServerName != "" {
@@ -233,25 +383,3 @@ func addHeaders(w http.ResponseWriter) {
 	w.Header().Set("Referrer-Policy", "no-referrer")
 	w.Header().Set("Permissions-Policy", "geolocation=(), microphone=(), camera=()")
 }
-
-func setPermissions(dir string) error {
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			// Change the directory permissions to "rx".
-			err := os.Chmod(path, 0555)
-			return err
-		}
-
-		// Change the file permissions to "r".
-		err = os.Chmod(path, 0444)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	})
-}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header profiles.
+const (
+	// headerProfileGo sends the headers as the Go HTTP server does.
+	headerProfileGo = "go"
+	// headerProfileNeutral makes the server less identifiable as a Go server.
+	headerProfileNeutral = "neutral"
+)
+
+// neutralHeaderNames maps the canonical Go form of header names to the casing that most other servers use.
+// Go writes header names exactly as they are stored in the header map, but canonicalizes them when they are set.
+// This only has an effect on HTTP/1.1, because HTTP/2 always sends lower case header names.
+var neutralHeaderNames = map[string]string{
+	"Etag":             "ETag",
+	"Www-Authenticate": "WWW-Authenticate",
+	"X-Xss-Protection": "X-XSS-Protection",
+	"Content-Md5":      "Content-MD5",
+	"X-Ua-Compatible":  "X-UA-Compatible",
+}
+
+// headerProfileHandler applies the configured header profile to all responses of the handler.
+//
+// With the "neutral" profile, the header names are sent with the casing that most other servers use,
+// the Date header is rounded to the full minute, and the bodies of error responses do not contain the
+// Go specific error messages (like "404 page not found"). The order of the headers can not be changed,
+// because Go always sorts them.
+func headerProfileHandler(next http.Handler) http.Handler {
+	if config.HeaderProfile != headerProfileNeutral {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&neutralResponseWriter{ResponseWriter: w}, r)
+	})
+}
+
+// neutralResponseWriter applies the "neutral" header profile before the header is written.
+type neutralResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	discardBody bool
+}
+
+// WriteHeader applies the profile to the header and writes it.
+func (w *neutralResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.ResponseWriter.Header()
+
+	// Replace the body of error responses with a neutral one.
+	var body string
+	if code >= 400 {
+		body = strconv.Itoa(code) + " " + http.StatusText(code) + "\n"
+		h.Del("Content-Length")
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.discardBody = true
+	}
+
+	// Round the Date header to the full minute. Go does not overwrite an existing Date header.
+	h.Set("Date", time.Now().UTC().Truncate(time.Minute).Format(http.TimeFormat))
+
+	// Change the casing of the header names.
+	for goName, name := range neutralHeaderNames {
+		if values, ok := h[goName]; ok {
+			delete(h, goName)
+			h[name] = values
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+	if body != "" {
+		w.ResponseWriter.Write([]byte(body))
+	}
+}
+
+// Write writes the body, unless it is the body of an error response.
+func (w *neutralResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discardBody {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush writes the header with the profile applied, and sends the buffered data to the client, if the original
+// ResponseWriter supports it.
+func (w *neutralResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack takes over the connection, if the original ResponseWriter supports it.
+func (w *neutralResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (w *neutralResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The parent runs the lifecycle hooks, which are commands of the operator, e.g. to register the server at a load
+// balancer, to send notifications, or to open firewall ports. The hooks run with the user and the working directory
+// of the parent, never in the jail of the child. The event is passed in the environment variable SSLSERVER_EVENT,
+// and the domain of a renewed certificate in SSLSERVER_DOMAIN. A hook that fails or runs too long is logged, but
+// does not stop the server.
+
+// Lifecycle events.
+const (
+	hookBeforeBind       = "before-bind"        // Before the child is started, which binds the ports.
+	hookAfterReady       = "after-ready"        // After the child announced that it is ready.
+	hookBeforeShutdown   = "before-shutdown"    // Before the child is asked to terminate.
+	hookAfterCertRenewal = "after-cert-renewal" // After a new certificate of a domain was stored in the certificate cache.
+)
+
+// hookEvents are the names of all lifecycle events.
+var hookEvents = []string{hookBeforeBind, hookAfterReady, hookBeforeShutdown, hookAfterCertRenewal}
+
+// checkLifecycleHooks returns an error if an event of the lifecycle-hooks setting is unknown or has no command.
+func checkLifecycleHooks() error {
+	for event, command := range config.LifecycleHooks {
+		known := false
+		for _, name := range hookEvents {
+			if event == name {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("lifecycle-hooks: unknown event %q, it must be one of: %s", event, strings.Join(hookEvents, ", "))
+		}
+		if len(command) == 0 || command[0] == "" {
+			return fmt.Errorf("lifecycle-hooks: the command of %s is empty", event)
+		}
+	}
+	if config.LifecycleHookTimeout <= 0 {
+		return fmt.Errorf("lifecycle-hook-timeout must be positive")
+	}
+	return nil
+}
+
+// runLifecycleHook runs the command of the event, if there is one, and waits at most lifecycle-hook-timeout for it.
+// The additional environment variables are given as "KEY=value". It is called in the parent.
+func runLifecycleHook(event string, env ...string) {
+	command, ok := config.LifecycleHooks[event]
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.LifecycleHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(append(os.Environ(), "SSLSERVER_EVENT="+event), env...)
+	output, err := cmd.CombinedOutput()
+
+	for _, line := range strings.Split(string(bytes.TrimSpace(output)), "\n") {
+		if line != "" {
+			log.Printf("hook %s: %s", event, line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("hook %s: killed after %s", event, config.LifecycleHookTimeout)
+	} else if err != nil {
+		log.Printf("hook %s: failed: %v", event, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// The host policy limits protect against minting unlimited certificates, e.g. if many domains (or a wildcard
+// DNS entry) suddenly point to the server. They are checked before a new certificate is ordered.
+
+// newCertificates holds the hosts whose first certificate was ordered within the last hour, with the time of the order.
+var newCertificates = map[string]time.Time{}
+var newCertificatesMu sync.Mutex
+
+// checkHostPolicyLimits returns an error if a new certificate for the (ASCII) host is not allowed by the
+// denylist, the maximum subdomain depth, or the maximum number of new certificates per hour.
+// Renewals do not count as new certificates.
+func checkHostPolicyLimits(host string) error {
+	for _, pattern := range config.HostPolicyDenylist {
+		if matchesDomainPattern(host, pattern) {
+			return fmt.Errorf("host policy: %s is denied by %s", host, pattern)
+		}
+	}
+
+	if config.HostPolicyMaxDepth > 0 {
+		if depth := subdomainDepth(host); depth > config.HostPolicyMaxDepth {
+			return fmt.Errorf("host policy: %s has %d subdomain levels, at most %d are allowed", host, depth, config.HostPolicyMaxDepth)
+		}
+	}
+
+	if config.HostPolicyMaxNewCertificatesPerHour > 0 && !hasCachedCertificate(host) {
+		return reserveNewCertificate(host, time.Now())
+	}
+	return nil
+}
+
+// reserveNewCertificate counts the first certificate of the host against the maximum number of new certificates per
+// hour. The check and the count are done under one lock, so that concurrent orders can not exceed the limit. A host is
+// only counted once per hour, because autocert checks the host policy again for each request of an ACME HTTP
+// challenge, and for each handshake until the certificate is stored.
+func reserveNewCertificate(host string, now time.Time) error {
+	newCertificatesMu.Lock()
+	defer newCertificatesMu.Unlock()
+
+	// Forget the certificates that are older than one hour.
+	hourAgo := now.Add(-time.Hour)
+	for h, ordered := range newCertificates {
+		if ordered.Before(hourAgo) {
+			delete(newCertificates, h)
+		}
+	}
+	if _, ok := newCertificates[host]; ok {
+		return nil
+	}
+	if len(newCertificates) >= config.HostPolicyMaxNewCertificatesPerHour {
+		return fmt.Errorf("host policy: %d new certificates within the last hour, %s has to wait", len(newCertificates), host)
+	}
+	newCertificates[host] = now
+	return nil
+}
+
+// hasCachedCertificate returns true if the certificate cache has a certificate from a CA for the (ASCII) host, so that
+// a new certificate is a renewal. Self-signed certificates are stored under other names.
+func hasCachedCertificate(host string) bool {
+	if m == nil {
+		return false
+	}
+	for _, name := range []string{host, host + rsaCertSuffix} {
+		if _, err := m.Cache.Get(context.Background(), name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDomainPattern returns true if the domain is the pattern, or if the pattern starts with "*." and
+// the domain is a subdomain of the rest of the pattern.
+func matchesDomainPattern(domain, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return domain == pattern
+}
+
+// subdomainDepth returns the number of labels in front of the registrable domain, e.g. 2 for a.b.example.co.uk.
+func subdomainDepth(domain string) int {
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(domain, registrable), ".")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReserveNewCertificate checks that a host is counted once per hour, and that concurrent orders can not exceed the
+// maximum number of new certificates per hour.
+func TestReserveNewCertificate(t *testing.T) {
+	savedConfig := config
+	defer func() {
+		config = savedConfig
+		newCertificates = map[string]time.Time{}
+	}()
+	config.HostPolicyMaxNewCertificatesPerHour = 2
+	newCertificates = map[string]time.Time{}
+	now := time.Now()
+
+	for _, host := range []string{"a.example", "a.example", "b.example", "b.example"} {
+		if err := reserveNewCertificate(host, now); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+	if err := reserveNewCertificate("c.example", now); err == nil {
+		t.Error("c.example: the limit was exceeded")
+	}
+	if err := reserveNewCertificate("c.example", now.Add(61*time.Minute)); err != nil {
+		t.Errorf("c.example after one hour: %v", err)
+	}
+
+	// Concurrent orders for different hosts.
+	newCertificates = map[string]time.Time{}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if reserveNewCertificate(fmt.Sprintf("host%d.example", i), now) == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if allowed != config.HostPolicyMaxNewCertificatesPerHour {
+		t.Errorf("%d concurrent orders were allowed, want %d", allowed, config.HostPolicyMaxNewCertificatesPerHour)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Requests on the HTTP port are redirected to HTTPS, except for the paths in http-exempt-paths of their domain,
+// e.g. health checks or captive portal checks, which are served over HTTP.
+
+// httpExempt returns true if the request on the HTTP port is served instead of redirected to HTTPS.
+func httpExempt(r *http.Request) bool {
+	domain, err := requestDomain(r)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range settingsForDomain(domain).httpExemptPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpRedirectHandler serves the exempt paths with the files handler, and redirects all other requests to HTTPS.
+func httpRedirectHandler(files http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if httpExempt(r) {
+			files.ServeHTTP(w, r)
+			return
+		}
+		redirectToHTTPS(w, r)
+	})
+}
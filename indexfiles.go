@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+)
+
+// The requests of directories (URL paths that end with "/", e.g. "/" or "/blog/") are answered with the first file
+// of index-files that exists in the directory. Directories without index file get the generated listing with
+// auto-index, and 404 Not Found otherwise.
+
+// matchIndexFileName matches the names of index files, with the same names as matchPath.
+var matchIndexFileName = regexp.MustCompile(`^[a-zA-Z0-9_-]+(\.[a-zA-Z0-9]+)+$`).MatchString
+
+// checkIndexFiles returns an error if a name of the index files can not be served.
+func checkIndexFiles(names []string) error {
+	for _, name := range names {
+		if !matchIndexFileName(name) {
+			return fmt.Errorf("'%s' is not a valid file name", name)
+		}
+	}
+	return nil
+}
+
+// indexFile returns the URL path of the first index file in the directory with the URL path, or "" if the
+// directory has none that can be served.
+func indexFile(domain, directory string, settings domainSettings) string {
+	for _, index := range settings.indexFiles {
+		name := domain + directory + index
+		if _, ok := webFiles.Metadata(name); ok {
+			return directory + index
+		}
+		if !config.ServeFilesNotInCache {
+			continue
+		}
+		if info, err := fs.Stat(webFiles.Origin, name); err == nil && !info.IsDir() {
+			return directory + index
+		}
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxIpcLineLength is the maximum length of a header line or a log line of the IPC protocol.
+// Longer lines are truncated.
+const maxIpcLineLength = 64 * 1024
+
+// isCommandType returns true if the line is one of the known command types.
+func isCommandType(line string) bool {
+	switch line {
+	case cmdGet, cmdPut, cmdDelete, cmdTerminate, cmdTerminated, cmdReload, cmdIssue, cmdClientCA, cmdCertificate, cmdOperatorCertificate, cmdRotateSelfSigned, cmdRotateLocalCA, cmdSchedule, cmdReady, cmdACMEOrder, cmdForgetCertificate, cmdResolve, cmdIssuanceLock, cmdIssuanceUnlock, cmdClientCRL, cmdSandboxState:
+		return true
+	}
+	return false
+}
+
+// readLine reads one line from the reader without the line ending.
+// Lines longer than maxIpcLineLength are truncated, so that the other side cannot make us allocate unbounded memory.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	truncated := false
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if !truncated {
+			if len(line)+len(chunk) > maxIpcLineLength {
+				chunk = chunk[:maxIpcLineLength-len(line)]
+				truncated = true
+			}
+			line = append(line, chunk...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if truncated {
+		log.Println("Warning: truncated IPC line that was longer than", maxIpcLineLength, "bytes")
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// readCommand reads one frame from the reader.
+// If the first line is not a command type, a Command with only the Type set to that line is returned.
+// Frames that declare more than maxFrameSize bytes of data are rejected.
+func readCommand(reader *bufio.Reader, maxFrameSize int64) (Command, error) {
+	// Read the first line, which is the command type.
+	commandType, err := readLine(reader)
+	if err != nil {
+		return Command{}, err
+	}
+
+	// If it is not a command, then return it as it is.
+	if !isCommandType(commandType) {
+		return Command{Type: commandType}, nil
+	}
+
+	// Read the second line, which is the optional file name for the command.
+	fileName, err := readLine(reader)
+	if err != nil {
+		return Command{}, err
+	}
+
+	// Read the next line, which is the number of bytes of data.
+	dataLengthStr, err := readLine(reader)
+	if err != nil {
+		return Command{}, err
+	}
+	dataLength, err := strconv.ParseInt(dataLengthStr, 10, 64)
+	if err != nil {
+		return Command{}, err
+	}
+	if dataLength < 0 || dataLength > maxFrameSize {
+		return Command{}, fmt.Errorf("IPC frame for %s %s has invalid data length %d (maximum is %d)", commandType, fileName, dataLength, maxFrameSize)
+	}
+
+	// Read the data.
+	data := make([]byte, dataLength)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return Command{}, err
+	}
+
+	// Create a Command struct with the command type and data.
+	return Command{
+		Type: commandType,
+		Name: fileName,
+		Data: data,
+	}, nil
+}
+
+// writeCommand writes one frame to the writer and flushes it.
+func writeCommand(w *bufio.Writer, command Command) error {
+	// Write the command type.
+	if _, err := w.WriteString(command.Type + "\n"); err != nil {
+		return err
+	}
+
+	// Write the file name for the command.
+	if _, err := w.WriteString(command.Name + "\n"); err != nil {
+		return err
+	}
+
+	// Write the number of bytes of data.
+	if _, err := w.WriteString(strconv.Itoa(len(command.Data)) + "\n"); err != nil {
+		return err
+	}
+
+	// Write the data.
+	if _, err := w.Write(command.Data); err != nil {
+		return err
+	}
+
+	// Flush the writer to ensure the command is sent.
+	return w.Flush()
+}
+
+// rateLimiter is a simple token bucket that limits the number of IPC frames per second.
+type rateLimiter struct {
+	rate   float64   // Frames per second. Zero or less means unlimited.
+	tokens float64   // Currently available frames.
+	last   time.Time // Time of the last refill.
+}
+
+// newRateLimiter creates a rate limiter that allows rate frames per second with a burst of the same size.
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until the next frame is allowed.
+func (l *rateLimiter) wait() {
+	if l.rate <= 0 {
+		return
+	}
+
+	// Refill the bucket.
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	// Sleep until one token is available.
+	if l.tokens < 1 {
+		time.Sleep(time.Duration((1 - l.tokens) / l.rate * float64(time.Second)))
+		l.tokens = 1
+		l.last = time.Now()
+	}
+	l.tokens--
+}
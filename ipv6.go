@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// The server also runs on IPv6-only hosts. The listen addresses accept IPv6 literals in brackets (e.g. "[::]:443"),
+// and an empty host listens on IPv4 and IPv6. Client addresses are logged in their canonical form, with IPv4
+// clients on dual-stack sockets as plain IPv4 addresses. Outgoing connections of the certificate subsystem try the
+// addresses of both families alternately (Happy Eyeballs, RFC 8305), so that an unreachable address family does not
+// delay them. The preflight checks tell how Let's Encrypt will reach the domains over IPv4 and IPv6.
+
+// happyEyeballsDelay is the time after which the next address is tried, while the previous attempt still runs.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// logAddr returns the remote address (host:port) for the log. IPv4-mapped IPv6 addresses (e.g. "[::ffff:192.0.2.1]")
+// are logged as IPv4 addresses, and IPv6 addresses in their shortest form.
+func logAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.JoinHostPort(ip4.String(), port)
+	}
+	return net.JoinHostPort(ip.String()+zone, port)
+}
+
+// ipv6AddrHint returns a hint for an address with an IPv6 literal without brackets, which can not be split into
+// host and port. Otherwise it returns "".
+func ipv6AddrHint(addr string) string {
+	if strings.Count(addr, ":") < 2 || strings.HasPrefix(addr, "[") {
+		return ""
+	}
+	return " (IPv6 addresses must be in brackets, e.g. [2001:db8::1]:443)"
+}
+
+// acceptsIPv6 returns true if a listener on the address accepts IPv6 connections. An empty host and "::" listen on
+// all addresses of both families.
+func acceptsIPv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// interleaveAddressFamilies returns the addresses with the IPv6 and IPv4 addresses alternating, starting with IPv6.
+func interleaveAddressFamilies(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	interleaved := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			interleaved = append(interleaved, v6[i])
+		}
+		if i < len(v4) {
+			interleaved = append(interleaved, v4[i])
+		}
+	}
+	return interleaved
+}
+
+// dialResult is the result of one connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs connects to the first of the addresses that accepts the connection. The next address is tried
+// when the previous attempt failed, or after happyEyeballsDelay, while the previous attempts still run.
+func dialHappyEyeballs(ctx context.Context, network string, ips []net.IPAddr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ips = interleaveAddressFamilies(ips)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	results := make(chan dialResult, len(ips))
+
+	started := 0
+	start := func() {
+		ip := ips[started]
+		started++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- dialResult{conn, err}
+		}()
+	}
+	start()
+
+	delay := time.NewTimer(happyEyeballsDelay)
+	defer delay.Stop()
+	var err error
+	for failed := 0; failed < len(ips); {
+		select {
+		case <-delay.C:
+			if started < len(ips) {
+				start()
+				delay.Reset(happyEyeballsDelay)
+			}
+		case result := <-results:
+			if result.err == nil {
+				// The attempts that are still running are canceled, but can have connected in the meantime.
+				go closeConnections(results, started-failed-1)
+				return result.conn, nil
+			}
+			err = result.err
+			failed++
+			if started < len(ips) && started == failed {
+				// No attempt is running anymore, so the next address is tried right away.
+				if !delay.Stop() {
+					<-delay.C
+				}
+				start()
+				delay.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, err
+}
+
+// closeConnections closes the connections of the count remaining results.
+func closeConnections(results chan dialResult, count int) {
+	for i := 0; i < count; i++ {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// checkACMEAddressFamilies checks how Let's Encrypt reaches the domains that are validated with HTTP-01 or
+// TLS-ALPN-01 challenges. Let's Encrypt connects over IPv6 if the domain has an AAAA record, and falls back to IPv4
+// only if the IPv6 connection fails.
+func checkACMEAddressFamilies() []preflightResult {
+	domainsMu.RLock()
+	var domains []string
+	for _, domain := range config.letsEncryptDomains {
+		if settingsForDomain(domain).dnsProvider == "" {
+			domains = append(domains, domain)
+		}
+	}
+	domainsMu.RUnlock()
+
+	results := make([]preflightResult, len(domains))
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		go func(i int, domain string) {
+			defer wg.Done()
+			results[i] = checkACMEAddressFamily(domain)
+		}(i, domain)
+	}
+	wg.Wait()
+	return results
+}
+
+// checkACMEAddressFamily checks the A and AAAA records of the domain against the listen addresses.
+func checkACMEAddressFamily(domain string) preflightResult {
+	ctx, cancel := context.WithTimeout(context.Background(), config.CertDnsTimeout)
+	defer cancel()
+	host := domain
+	if asciiDomain, err := idna.Lookup.ToASCII(domain); err == nil {
+		host = asciiDomain
+	}
+	ips, err := certResolver().LookupIPAddr(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return preflightResult{preflightWarn, fmt.Sprintf("domain %s has no A or AAAA record, so Let's Encrypt can not validate it. Add the records, or use a dns-provider for the domain.", domain)}
+	}
+
+	hasA, hasAAAA := false, false
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			hasA = true
+		} else {
+			hasAAAA = true
+		}
+	}
+	ipv6Listeners := acceptsIPv6(config.HttpAddr) && acceptsIPv6(config.HttpsAddr)
+	switch {
+	case !hasAAAA:
+		return preflightResult{preflightOK, fmt.Sprintf("domain %s has only A records, Let's Encrypt validates it over IPv4", domain)}
+	case !ipv6Listeners && !hasA:
+		return preflightResult{preflightWarn, fmt.Sprintf("domain %s has no A record, so Let's Encrypt validates it over IPv6, but http-addr %s or https-addr %s does not accept IPv6. Use an empty host or an IPv6 address, e.g. [::]:443.", domain, config.HttpAddr, config.HttpsAddr)}
+	case !ipv6Listeners:
+		return preflightResult{preflightWarn, fmt.Sprintf("domain %s has an AAAA record, but http-addr %s or https-addr %s does not accept IPv6. Let's Encrypt tries IPv6 first, and only falls back to IPv4 if the connection is refused.", domain, config.HttpAddr, config.HttpsAddr)}
+	case !hasA:
+		return preflightResult{preflightOK, fmt.Sprintf("domain %s has no A record, Let's Encrypt validates it over IPv6", domain)}
+	}
+	return preflightResult{preflightOK, fmt.Sprintf("domain %s has A and AAAA records, Let's Encrypt validates it over IPv6 with fallback to IPv4", domain)}
+}
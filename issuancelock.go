@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// With acme-issuance-lock, several servers that share the certificate cache do not order the same certificate at
+// the same time. Before the child orders a certificate, it asks the parent for the issuance lock of the certificate,
+// which the parent takes in the certificate cache backend. If another server holds the lock, the child waits for it,
+// and then uses the certificate that the other server has stored in the shared cache instead of ordering its own.
+// The lock expires after acme-issuance-lock-ttl, so that a server that dies during an order does not block the others.
+
+// issuanceLockSuffix is appended to the cache name of the certificate to get the name of its lock. Names with "+"
+// are not pushed to the child as certificates.
+const issuanceLockSuffix = "+lock"
+
+// issuanceLockPollInterval is the interval in which a waiting child asks again for a lock that another server holds.
+const issuanceLockPollInterval = 2 * time.Second
+
+// Answers of the parent to an issuance lock request.
+const (
+	issuanceLockAcquired = "acquired"
+	issuanceLockHeld     = "held"
+)
+
+// certStoreLocker is implemented by the certificate cache backends that can take locks atomically.
+type certStoreLocker interface {
+	// TryLock takes the lock for the owner, if it is free or expired, and returns whether it was taken.
+	TryLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+
+	// Unlock releases the lock, if the owner holds it.
+	Unlock(ctx context.Context, name, owner string) error
+}
+
+// issuanceLockOwner identifies this server as owner of locks.
+var issuanceLockOwner = newIssuanceLockOwner()
+
+// newIssuanceLockOwner returns a unique name of this server process.
+func newIssuanceLockOwner() string {
+	hostname, _ := os.Hostname()
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random))
+}
+
+// issuanceLockAnswers are the channels of the lock requests of the child that wait for the answer of the parent.
+var issuanceLockAnswers = map[string]chan string{}
+var issuanceLockAnswersMu sync.Mutex
+
+// acquireIssuanceLock takes the issuance lock of the certificate before it is ordered. It is called in the child.
+// If another server has stored a valid certificate while the child waited for the lock, or before, it is returned
+// instead, and the lock is released again. release has to be called after the order.
+func acquireIssuanceLock(hello *tls.ClientHelloInfo, name, variant string) (release func(), cached *tls.Certificate, err error) {
+	release = func() {}
+	// Only the domains for Let's Encrypt are ordered. The TLS-ALPN-01 challenges belong to an order that holds the lock already.
+	if !config.AcmeIssuanceLock || !isLetsEncryptDomain(name) || isACMEChallengeHello(hello) {
+		return release, nil, nil
+	}
+
+	key := name + variant
+	deadline := time.Now().Add(config.AcmeIssuanceLockWait)
+	for {
+		acquired, err := requestIssuanceLock(key)
+		if err == nil && !acquired && time.Now().Before(deadline) {
+			time.Sleep(issuanceLockPollInterval)
+			continue
+		}
+		if err == nil && !acquired {
+			err = fmt.Errorf("another server is ordering the certificate for %s", key)
+		}
+		if err != nil {
+			// A renewal must not replace a certificate that is still valid with a self-signed one.
+			if cert, cacheErr := cachedCertificateVariant(context.Background(), name, variant); cacheErr == nil && certValidAt(cert.Leaf, time.Now()) {
+				log.Printf("certificate: could not take the issuance lock for %s, using the cached certificate: %v", key, err)
+				return release, cert, nil
+			}
+			return release, nil, fmt.Errorf("could not take the issuance lock: %v", err)
+		}
+		break
+	}
+	release = func() {
+		childToParentCh <- Command{Type: cmdIssuanceUnlock, Name: key}
+	}
+
+	// Read the certificate from the shared cache instead of the memory of the child, because another server
+	// may have stored a new one.
+	certCacheMu.Lock()
+	delete(certCacheBytes, key)
+	certCacheMu.Unlock()
+	if cert, err := cachedCertificateVariant(context.Background(), name, variant); err == nil && !certNeedsRenewal(cert.Leaf, config.CertificateExpiryRefreshThreshold) {
+		log.Printf("certificate: using the certificate for %s from the certificate cache", key)
+		release()
+		return func() {}, cert, nil
+	}
+	return release, nil, nil
+}
+
+// requestIssuanceLock asks the parent for the issuance lock of the certificate. It is called in the child.
+func requestIssuanceLock(key string) (bool, error) {
+	answer := make(chan string, 1)
+	issuanceLockAnswersMu.Lock()
+	issuanceLockAnswers[key] = answer
+	issuanceLockAnswersMu.Unlock()
+	defer func() {
+		issuanceLockAnswersMu.Lock()
+		if issuanceLockAnswers[key] == answer {
+			delete(issuanceLockAnswers, key)
+		}
+		issuanceLockAnswersMu.Unlock()
+	}()
+
+	childToParentCh <- Command{Type: cmdIssuanceLock, Name: key}
+	select {
+	case state := <-answer:
+		switch state {
+		case issuanceLockAcquired:
+			return true, nil
+		case issuanceLockHeld:
+			return false, nil
+		default:
+			return false, errors.New(strings.TrimSpace(strings.TrimPrefix(state, "error:")))
+		}
+	case <-time.After(30 * time.Second):
+		return false, errors.New("timeout while waiting for the parent")
+	}
+}
+
+// receiveIssuanceLockAnswer passes the answer of the parent to the waiting lock request. It is called in the child.
+func receiveIssuanceLockAnswer(key string, data []byte) {
+	issuanceLockAnswersMu.Lock()
+	answer := issuanceLockAnswers[key]
+	issuanceLockAnswersMu.Unlock()
+	if answer == nil {
+		return
+	}
+	select {
+	case answer <- string(data):
+	default:
+	}
+}
+
+// validIssuanceLockKey returns true if the key is the cache name of a certificate, so that the child can not make
+// the parent lock arbitrary entries.
+func validIssuanceLockKey(key string) bool {
+	return validResolveName(strings.TrimSuffix(key, rsaCertSuffix))
+}
+
+// answerIssuanceLock tries to take the issuance lock for the child and sends the result to the child.
+// It is called in the parent.
+func answerIssuanceLock(key string) {
+	state := issuanceLockHeld
+	if !validIssuanceLockKey(key) {
+		state = "error: invalid certificate name"
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		acquired, err := issuanceLocker(certStorage).TryLock(ctx, key+issuanceLockSuffix, issuanceLockOwner, config.AcmeIssuanceLockTtl)
+		cancel()
+		if err != nil {
+			log.Println("Could not take the issuance lock:", key, err)
+			state = "error: " + err.Error()
+		} else if acquired {
+			state = issuanceLockAcquired
+		}
+	}
+	parentToChildCh <- Command{Type: cmdIssuanceLock, Name: key, Data: []byte(state)}
+}
+
+// releaseIssuanceLock releases the issuance lock of the child. It is called in the parent.
+func releaseIssuanceLock(key string) {
+	if !validIssuanceLockKey(key) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := issuanceLocker(certStorage).Unlock(ctx, key+issuanceLockSuffix, issuanceLockOwner); err != nil {
+		log.Println("Could not release the issuance lock:", key, err)
+	}
+}
+
+// issuanceLocker returns the locker of the certificate cache backend. The locks contain no secrets, so they are
+// not encrypted. Backends that can not take locks atomically use entries in the cache.
+func issuanceLocker(store certStore) certStoreLocker {
+	if encrypted, ok := store.(*encryptedCertStore); ok {
+		store = encrypted.certStore
+	}
+	if locker, ok := store.(certStoreLocker); ok {
+		return locker
+	}
+	return entryLocker{store}
+}
+
+// lockEntry returns the content of a lock: the owner and the expiry time in Unix nanoseconds.
+func lockEntry(owner string, ttl time.Duration) []byte {
+	return []byte(owner + "\n" + strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10))
+}
+
+// parseLockEntry returns the owner of the lock, or "" if the lock is expired or invalid.
+func parseLockEntry(data []byte) string {
+	parts := strings.SplitN(string(data), "\n", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	expires, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil || time.Now().UnixNano() > expires {
+		return ""
+	}
+	return parts[0]
+}
+
+// entryLocker stores the locks as entries of the certificate cache. Object storages and Vault can not create
+// entries atomically, so the lock is written and read again after a moment, to see whether another server has
+// overwritten it. This makes duplicate orders unlikely, but not impossible.
+type entryLocker struct {
+	store certStore
+}
+
+// TryLock takes the lock, if it is free or expired.
+func (l entryLocker) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	data, err := l.store.Get(ctx, name)
+	if err != nil && err != autocert.ErrCacheMiss {
+		return false, err
+	}
+	if holder := parseLockEntry(data); holder != "" && holder != owner {
+		return false, nil
+	}
+	if err := l.store.Put(ctx, name, lockEntry(owner, ttl)); err != nil {
+		return false, err
+	}
+
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	data, err = l.store.Get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return parseLockEntry(data) == owner, nil
+}
+
+// Unlock deletes the lock, if the owner holds it.
+func (l entryLocker) Unlock(ctx context.Context, name, owner string) error {
+	data, err := l.store.Get(ctx, name)
+	if err == autocert.ErrCacheMiss || (err == nil && parseLockEntry(data) != owner) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return l.store.Delete(ctx, name)
+}
+
+// TryLock creates the lock file exclusively. An expired lock file is replaced.
+func (d dirCertStore) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	file := filepath.Join(string(d.DirCache), name)
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(lockEntry(owner, ttl))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return err == nil, err
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+		if err == nil && parseLockEntry(data) != "" {
+			return false, nil
+		}
+		// The lock is expired (or was just released).
+		os.Remove(file)
+	}
+	return false, nil
+}
+
+// Unlock removes the lock file, if the owner holds it.
+func (d dirCertStore) Unlock(ctx context.Context, name, owner string) error {
+	file := filepath.Join(string(d.DirCache), name)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !bytes.HasPrefix(data, []byte(owner+"\n"))) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// TryLock sets the lock key with NX, so that only one server gets it. It expires by itself.
+func (s *redisCertStore) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	reply, err := s.do(ctx, "SET", s.prefix+name, owner, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// redisUnlockScript deletes the lock key only if it still has the value of the owner.
+const redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// Unlock deletes the lock key, if the owner holds it.
+func (s *redisCertStore) Unlock(ctx context.Context, name, owner string) error {
+	_, err := s.do(ctx, "EVAL", redisUnlockScript, "1", s.prefix+name, owner)
+	return err
+}
+
+// TryLock inserts the lock row, or takes it over if it is expired.
+func (s *sqliteCertStore) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result, err := s.db.ExecContext(ctx, `INSERT INTO issuance_locks (name, owner, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE issuance_locks.expires_at < ?`,
+		name, owner, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// Unlock deletes the lock row, if the owner holds it.
+func (s *sqliteCertStore) Unlock(ctx context.Context, name, owner string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM issuance_locks WHERE name = ? AND owner = ?`, name, owner)
+	return err
+}
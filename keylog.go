@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// The TLS key log file contains the secrets of all TLS connections in the NSS key log format (SSLKEYLOGFILE), so
+// that tools like Wireshark can decrypt recorded traffic to debug handshake and protocol issues. Everybody who can
+// read the file can decrypt the connections, so it is only written if the server is started with the command line
+// flag `--insecure-debug`. The parent passes the flag to the child, which opens the file before it enters the jail.
+
+// insecureDebugFlag is the command line flag that allows the tls-keylog-file.
+const insecureDebugFlag = "--insecure-debug"
+
+// Is set if the server was started with --insecure-debug.
+var insecureDebug = false
+
+// checkTLSKeyLogFile refuses to start with a tls-keylog-file without --insecure-debug or inside the web root, and
+// warns with it.
+func checkTLSKeyLogFile() {
+	if config.TlsKeylogFile == "" {
+		return
+	}
+	if !insecureDebug {
+		log.Fatal("Error: tls-keylog-file allows to decrypt all TLS connections, it is only used with the flag " + insecureDebugFlag)
+	}
+	if isInsideDir(config.TlsKeylogFile, config.WebRootDirectory) {
+		log.Fatal("Error: tls-keylog-file " + config.TlsKeylogFile + " is inside the web root, where it would be served")
+	}
+	log.Println("Warning: the secrets of all TLS connections are written to", config.TlsKeylogFile+". Everybody who can read it can decrypt the connections.")
+}
+
+// insecureDebugArgs returns the command line arguments for the child to pass on --insecure-debug.
+func insecureDebugArgs() []string {
+	if !insecureDebug {
+		return nil
+	}
+	return []string{insecureDebugFlag}
+}
+
+// tlsKeyLogWriter opens the tls-keylog-file for the KeyLogWriter of the TLS config, or returns nil if no secrets
+// are written. It is called in the child before it enters the jail.
+func tlsKeyLogWriter() io.Writer {
+	if config.TlsKeylogFile == "" || !insecureDebug {
+		return nil
+	}
+	// Never write the secrets where they would be served.
+	if isInsideDir(config.TlsKeylogFile, config.WebRootDirectory) {
+		log.Fatal("Error: tls-keylog-file " + config.TlsKeylogFile + " is inside the web root, where it would be served")
+	}
+	f, err := os.OpenFile(config.TlsKeylogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatal("Could not open tls-keylog-file: ", err)
+	}
+	// Do not close the file, because the TLS connections write into it until the server terminates.
+	return f
+}
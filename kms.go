@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// With the key storage "aws-kms", the private keys of the self-signed certificates and of the certificates from
+// DNS-01 challenges are created in AWS KMS and never leave it. The certificate cache only stores the key ID in a
+// PEM block instead of the private key, and the handshakes are signed by KMS. The keys of the certificates that
+// autocert gets with HTTP-01 and TLS-ALPN-01 challenges are created by autocert itself and are stored as files.
+
+// Key storages.
+const (
+	keyStorageFile   = "file"    // The private keys are stored in the certificate cache directory.
+	keyStorageAWSKMS = "aws-kms" // The private keys are created and used in AWS KMS.
+)
+
+// kmsKeyPEMType is the type of the PEM block that holds the ID of a KMS key instead of a private key.
+const kmsKeyPEMType = "AWS KMS KEY ID"
+
+// kmsKeyDeletionDays is the waiting period before a replaced KMS key is deleted.
+const kmsKeyDeletionDays = 7
+
+// kmsSigners holds the signers of the known KMS keys, so that the public key is only fetched once.
+var kmsSigners = map[string]*awsKMSSigner{}
+var kmsSignersMu sync.Mutex
+
+// awsKMSSigner signs with an ECC_NIST_P256 key in AWS KMS.
+type awsKMSSigner struct {
+	keyID  string
+	public crypto.PublicKey
+}
+
+// Public returns the public key.
+func (s *awsKMSSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the digest with KMS. The signature is ASN.1 encoded, like the signatures of ecdsa.PrivateKey.
+func (s *awsKMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("aws-kms: unsupported hash function %v", opts.HashFunc())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var result struct {
+		Signature []byte
+	}
+	err := awsKMSRequest(ctx, "Sign", map[string]interface{}{
+		"KeyId":            s.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}, &result)
+	return result.Signature, err
+}
+
+// awsKMSRequest sends a signed request to the AWS KMS API and decodes the JSON result.
+func awsKMSRequest(ctx context.Context, action string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://kms."+config.AwsKmsRegion+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWSRequest(req, body, config.AwsKmsAccessKeyId, string(config.AwsKmsSecretAccessKey), config.AwsKmsRegion, "kms", time.Now())
+
+	client := certHTTPClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiError struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &apiError)
+		return fmt.Errorf("aws-kms: %s failed with status %d: %s %s", action, resp.StatusCode, apiError.Type, apiError.Message)
+	}
+	return json.Unmarshal(data, result)
+}
+
+// kmsSigner returns the signer for the KMS key.
+func kmsSigner(ctx context.Context, keyID string) (*awsKMSSigner, error) {
+	kmsSignersMu.Lock()
+	signer, ok := kmsSigners[keyID]
+	kmsSignersMu.Unlock()
+	if ok {
+		return signer, nil
+	}
+
+	var result struct {
+		PublicKey []byte
+	}
+	if err := awsKMSRequest(ctx, "GetPublicKey", map[string]string{"KeyId": keyID}, &result); err != nil {
+		return nil, err
+	}
+	public, err := x509.ParsePKIXPublicKey(result.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("aws-kms: invalid public key: %v", err)
+	}
+
+	signer = &awsKMSSigner{keyID: keyID, public: public}
+	kmsSignersMu.Lock()
+	kmsSigners[keyID] = signer
+	kmsSignersMu.Unlock()
+	return signer, nil
+}
+
+// newKMSKey creates a new key in KMS for the certificate with the cache name. The key only replaces the previous key
+// of the certificate with activateKMSKey, after the certificate with the new key is stored. Until then, the previous
+// key is still used by the stored certificate.
+func newKMSKey(ctx context.Context, name string) (*awsKMSSigner, []byte, error) {
+	var result struct {
+		KeyMetadata struct {
+			KeyId string
+		}
+	}
+	err := awsKMSRequest(ctx, "CreateKey", map[string]string{
+		"KeySpec":     "ECC_NIST_P256",
+		"KeyUsage":    "SIGN_VERIFY",
+		"Description": "sslserver " + name,
+	}, &result)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := result.KeyMetadata.KeyId
+	signer, err := kmsSigner(ctx, keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signer, pem.EncodeToMemory(&pem.Block{Type: kmsKeyPEMType, Bytes: []byte(keyID)}), nil
+}
+
+// activateKMSKey stores the ID of the KMS key of the certificate with the cache name in the certificate cache, and
+// schedules the deletion of the previous key of the certificate. It must only be called after the certificate with
+// the key is stored. Keys that are not in KMS are ignored.
+func activateKMSKey(ctx context.Context, name string, key crypto.Signer) {
+	signer, ok := key.(*awsKMSSigner)
+	if !ok {
+		return
+	}
+	previous, err := m.Cache.Get(ctx, name+"+kms")
+	if err := m.Cache.Put(ctx, name+"+kms", []byte(signer.keyID)); err != nil {
+		// The previous key is kept, because it cannot be found again without the stored ID.
+		log.Println("Could not store the KMS key ID of", name+":", err)
+		return
+	}
+	if err == nil && len(previous) > 0 && string(previous) != signer.keyID {
+		scheduleKMSKeyDeletion(ctx, name, string(previous))
+	}
+}
+
+// discardKMSKey schedules the deletion of a new KMS key of the certificate with the cache name, if no certificate
+// with the key could be stored. Keys that are not in KMS are ignored.
+func discardKMSKey(ctx context.Context, name string, key crypto.Signer) {
+	if signer, ok := key.(*awsKMSSigner); ok {
+		scheduleKMSKeyDeletion(ctx, name, signer.keyID)
+	}
+}
+
+// scheduleKMSKeyDeletion schedules the deletion of the KMS key of the certificate with the cache name.
+func scheduleKMSKeyDeletion(ctx context.Context, name, keyID string) {
+	err := awsKMSRequest(ctx, "ScheduleKeyDeletion", map[string]interface{}{"KeyId": keyID, "PendingWindowInDays": kmsKeyDeletionDays}, &struct{}{})
+	if err != nil {
+		log.Println("Could not schedule the deletion of the KMS key", keyID, "of", name+":", err)
+	}
+}
+
+// parseKeyPair parses the certificate chain and the private key (or the KMS key ID) from the PEM data of the certificate cache.
+func parseKeyPair(data []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	var keyID string
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case kmsKeyPEMType:
+			keyID = string(block.Bytes)
+		case "CERTIFICATE":
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if keyID == "" {
+		return tls.X509KeyPair(data, data)
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, errors.New("aws-kms: no certificate found")
+	}
+
+	signer, err := kmsSigner(context.Background(), keyID)
+	if err != nil {
+		return cert, err
+	}
+	cert.PrivateKey = signer
+	return cert, nil
+}
@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package main
+
+// Passwd is the Go type that corresponds to the C `struct passwd` defined in
+// `pwd.h`; see man page `getpwnam(3)`.
+type Passwd struct {
+	// Name is the user's login name.
+	Name string
+	// Passwd is the user's encrypted password.
+	Passwd string
+	// UID is the user's ID.
+	UID int
+	// GID is the user's group ID.
+	GID int
+	// Gecos is the user's login information.
+	Gecos string
+	// Dir is the user's home directory.
+	Dir string
+	// Shell is the user's default shell.
+	Shell string
+}
@@ -1,10 +1,11 @@
-//go:build linux
-// +build linux
+//go:build linux && cgo
+// +build linux,cgo
 
 // This file is licensed under the MIT license.
 
 // It wraps the system password functions `getpwnam(3)` and `getpwuid()` and
 // is mostly a copy from https://github.com/nogproject/nog/blob/master/backend/pkg/pwd/pwd.go.
+// Without CGO, linux_pwd_nocgo.go reads /etc/passwd instead.
 package main
 
 /*
@@ -19,25 +20,6 @@ import (
 	"unsafe"
 )
 
-// Passwd is the Go type that corresponds to the C `struct passwd` defined in
-// `pwd.h`; see man page `getpwnam(3)`.
-type Passwd struct {
-	// Name is the user's login name.
-	Name string
-	// Passwd is the user's encrypted password.
-	Passwd string
-	// UID is the user's ID.
-	UID int
-	// GID is the user's group ID.
-	GID int
-	// Gecos is the user's login information.
-	Gecos string
-	// Dir is the user's home directory.
-	Dir string
-	// Shell is the user's default shell.
-	Shell string
-}
-
 // newPasswdFromC creates a new Passwd instance from a C `struct_passwd`.
 func newPasswdFromC(c *C.struct_passwd) *Passwd {
 	if c == nil {
@@ -47,7 +29,7 @@ func newPasswdFromC(c *C.struct_passwd) *Passwd {
 		Name:   C.GoString(c.pw_name),
 		Passwd: C.GoString(c.pw_passwd),
 		UID:    int(c.pw_uid),
-		GID:    int(c.pw_uid),
+		GID:    int(c.pw_gid),
 		Gecos:  C.GoString(c.pw_gecos),
 		Dir:    C.GoString(c.pw_dir),
 		Shell:  C.GoString(c.pw_shell),
@@ -0,0 +1,74 @@
+//go:build linux && !cgo
+// +build linux,!cgo
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Without CGO (e.g. for static builds with musl or for cross-compilation), the users are looked up in /etc/passwd.
+// Unlike getpwnam(3), this does not find users of other NSS sources like LDAP. The user for the jail is therefore
+// best a local system user.
+
+// passwdFile is the file with the local users.
+const passwdFile = "/etc/passwd"
+
+// Getpwnam retrieves a user's password information by login name from /etc/passwd.
+func Getpwnam(name string) *Passwd {
+	return lookupPasswd(func(p *Passwd) bool { return p.Name == name })
+}
+
+// Getpwuid retrieves a user's password information by user ID from /etc/passwd.
+func Getpwuid(uid int) *Passwd {
+	return lookupPasswd(func(p *Passwd) bool { return p.UID == uid })
+}
+
+// lookupPasswd returns the first entry of /etc/passwd that matches, or nil.
+func lookupPasswd(match func(*Passwd) bool) *Passwd {
+	file, err := os.Open(passwdFile)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if p := parsePasswdLine(scanner.Text()); p != nil && match(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+// parsePasswdLine parses a line of /etc/passwd (name:passwd:uid:gid:gecos:dir:shell).
+// It returns nil for comments and invalid lines.
+func parsePasswdLine(line string) *Passwd {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	fields := strings.Split(line, ":")
+	if len(fields) != 7 {
+		return nil
+	}
+	uid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil
+	}
+	gid, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil
+	}
+	return &Passwd{
+		Name:   fields[0],
+		Passwd: fields[1],
+		UID:    uid,
+		GID:    gid,
+		Gecos:  fields[4],
+		Dir:    fields[5],
+		Shell:  fields[6],
+	}
+}
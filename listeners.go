@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Each domain chooses the handler stack that serves its requests on the HTTP listener (http-handler) and on the
+// HTTPS listener (https-handler). By default, the HTTP listener redirects to HTTPS, and the HTTPS listener serves
+// the files. The ACME challenges are answered on both listeners regardless of the handler stack.
+
+// Handler stacks of the listeners.
+const (
+	handlerRedirect      = "redirect"       // Redirect the requests to HTTPS, except for http-exempt-paths (HTTP listener only).
+	handlerStatic        = "static"         // Serve the files of the domain.
+	handlerChallengeOnly = "challenge-only" // Only answer the ACME challenges, and all other requests with 404 Not Found.
+)
+
+// validHandler returns true if the handler stack can be used on the listener.
+func validHandler(handler string, https bool) bool {
+	switch handler {
+	case handlerStatic, handlerChallengeOnly:
+		return true
+	case handlerRedirect:
+		return !https
+	}
+	return false
+}
+
+// requestDomain returns the ASCII domain of the host of the request, without the port.
+func requestDomain(r *http.Request) (string, error) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return canonicalHost(host)
+}
+
+// domainHandler returns a handler that passes each request to the handler stack that its domain selects.
+// Requests for unknown hosts use the stack of the global setting.
+func domainHandler(stacks map[string]http.Handler, selectStack func(domainSettings) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain, err := requestDomain(r)
+		if err != nil {
+			domain = ""
+		}
+		stacks[selectStack(settingsForDomain(domain))].ServeHTTP(w, r)
+	})
+}
+
+// httpHandler returns the handler of the HTTP listener.
+func httpHandler(manager *autocert.Manager) http.Handler {
+	files := readinessHandler(maintenanceHandler(quotaHandler(http.HandlerFunc(serveFiles))))
+	handler := domainHandler(map[string]http.Handler{
+		handlerRedirect:      httpRedirectHandler(files),
+		handlerStatic:        files,
+		handlerChallengeOnly: http.NotFoundHandler(),
+	}, func(settings domainSettings) string { return settings.httpHandler })
+	handler = canonicalHostHandler(handler)
+
+	// The handler of autocert answers the HTTP-01 challenges, and passes all other requests to the handler stacks.
+	// Calling HTTPHandler enables the HTTP-01 challenge type in autocert, so without HTTP-01, only the stacks are used.
+	if acmeChallengeAllowed(acmeChallengeHTTP01) {
+		handler = manager.HTTPHandler(handler)
+	}
+	return handler
+}
+
+// httpsHandler returns the handler of the HTTPS listener. The TLS-ALPN-01 challenges are answered in the handshake.
+func httpsHandler() http.Handler {
+	return canonicalHostHandler(readinessHandler(scannerHandler(domainHandler(map[string]http.Handler{
+		handlerStatic:        maintenanceHandler(quotaHandler(http.HandlerFunc(serveFiles))),
+		handlerChallengeOnly: http.NotFoundHandler(),
+	}, func(settings domainSettings) string { return settings.httpsHandler }))))
+}
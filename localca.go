@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// In the local development CA mode, the server creates a CA once and signs the certificates for the
+// self-signed domains with it. Developers only have to trust the CA certificate once, instead of
+// accepting a warning for each domain. The CA is persisted through the certificate cache of the parent.
+//
+// The CA is rotated with an overlap: local-ca-overlap before it is replaced, the next CA is created, so that it can be
+// added to the trust stores while the current CA still signs. The current CA is replaced local-ca-overlap before it
+// expires, and it stays trusted until then, because the certificates that it signed do not outlive it.
+
+// localCACacheKey is the name under which the local CA (key and certificate) is stored in the certificate cache.
+const localCACacheKey = "local-ca+key"
+
+// localCANextCacheKey is the name under which the next local CA is stored until it replaces the current one.
+const localCANextCacheKey = "local-ca+next"
+
+// localCAPreviousCacheKey is the name under which the replaced local CA is stored until it expires.
+const localCAPreviousCacheKey = "local-ca+previous"
+
+// localCARotationInterval is the interval in which the child checks if the local CA has to be rotated.
+const localCARotationInterval = time.Hour
+
+// localCA holds the local CA after it was loaded or created, and localCAPrevious the replaced CA, if it is still valid.
+var localCA *tls.Certificate
+var localCAPrevious *x509.Certificate
+var localCAMu sync.Mutex
+
+// getLocalCA returns the local CA. It is loaded from the certificate cache, or created and stored if it does not exist.
+func getLocalCA() (*tls.Certificate, error) {
+	localCAMu.Lock()
+	defer localCAMu.Unlock()
+	if localCA != nil {
+		return localCA, nil
+	}
+	if m == nil {
+		return nil, errors.New("local CA: certificate cache not initialized")
+	}
+
+	ctx := context.Background()
+	data, err := m.Cache.Get(ctx, localCACacheKey)
+	if err == autocert.ErrCacheMiss {
+		log.Println("Creating local development CA")
+		data, err = createLocalCA()
+		if err != nil {
+			return nil, fmt.Errorf("local CA: %v", err)
+		}
+		if err := m.Cache.Put(ctx, localCACacheKey, data); err != nil {
+			return nil, fmt.Errorf("local CA: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("local CA: %v", err)
+	}
+
+	ca, err := parseLocalCA(data)
+	if err != nil {
+		return nil, fmt.Errorf("local CA: %v", err)
+	}
+	localCA = ca
+
+	// The certificates of the replaced CA are still used until they are regenerated.
+	if data, err := m.Cache.Get(ctx, localCAPreviousCacheKey); err == nil {
+		if previous, err := parseLocalCA(data); err == nil && time.Now().Before(previous.Leaf.NotAfter) {
+			localCAPrevious = previous.Leaf
+		}
+	}
+	return localCA, nil
+}
+
+// parseLocalCA parses the key and the certificate of a local CA.
+func parseLocalCA(data []byte) (*tls.Certificate, error) {
+	// The data contains the private key and the certificate as PEM blocks.
+	ca, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &ca, nil
+}
+
+// createLocalCA creates the key and the certificate of the local CA and returns them as PEM blocks.
+func createLocalCA() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "sslserver local development CA " + hostname,
+			Organization: []string{"sslserver local development CA"},
+		},
+		NotBefore:             time.Now().Add(-config.ClockSkewLeeway),
+		NotAfter:              time.Now().Add(config.LocalCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	return buf.Bytes(), nil
+}
+
+// localCAIssuer returns the certificate and the key with which the certificates for the self-signed domains are signed.
+func localCAIssuer() (*x509.Certificate, crypto.Signer, error) {
+	ca, err := getLocalCA()
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("local CA: invalid private key")
+	}
+	return ca.Leaf, signer, nil
+}
+
+// signedByLocalCA returns true if the certificate was signed by the current or by the replaced local CA. Certificates
+// of CAs that were replaced with rotate-local-ca are not.
+func signedByLocalCA(leaf *x509.Certificate) bool {
+	localCAMu.Lock()
+	defer localCAMu.Unlock()
+	if localCA != nil && bytes.Equal(leaf.AuthorityKeyId, localCA.Leaf.SubjectKeyId) {
+		return true
+	}
+	return localCAPrevious != nil && bytes.Equal(leaf.AuthorityKeyId, localCAPrevious.SubjectKeyId)
+}
+
+// startLocalCARotation checks right away and then every localCARotationInterval if the local CA has to be rotated.
+func startLocalCARotation() {
+	go rotateLocalCA(false)
+	jobs.every(jobLocalCARotation, localCARotationInterval, func() { rotateLocalCA(false) })
+}
+
+// rotateLocalCA creates the next local CA local-ca-overlap before the current one is replaced, and replaces the current
+// one local-ca-overlap before it expires. With force, the current CA is replaced right away, e.g. because its key was
+// exposed: it is not trusted any more, and the certificates of the self-signed domains are replaced. It runs in the
+// child every localCARotationInterval, and for the admin command "rotate-local-ca".
+func rotateLocalCA(force bool) {
+	current, err := getLocalCA()
+	if err != nil {
+		log.Println("Could not rotate local CA:", err)
+		return
+	}
+	ctx := context.Background()
+	now := time.Now()
+
+	// Forget the replaced CA, when the certificates that it signed have expired.
+	localCAMu.Lock()
+	forget := localCAPrevious != nil && (force || !now.Before(localCAPrevious.NotAfter))
+	if forget {
+		localCAPrevious = nil
+	}
+	localCAMu.Unlock()
+	if forget {
+		m.Cache.Delete(ctx, localCAPreviousCacheKey)
+	}
+
+	replaceAt := current.Leaf.NotAfter.Add(-config.LocalCAOverlap)
+	if !force && now.Before(replaceAt.Add(-config.LocalCAOverlap)) {
+		return
+	}
+
+	// Create the next CA, so that it can be added to the trust stores before it is used.
+	data, err := m.Cache.Get(ctx, localCANextCacheKey)
+	if err == autocert.ErrCacheMiss {
+		data, err = createLocalCA()
+		if err == nil {
+			err = m.Cache.Put(ctx, localCANextCacheKey, data)
+		}
+		if err == nil && !force {
+			log.Println("Created the next local development CA. Add it to the trust stores before", replaceAt.Format(time.RFC3339)+", when it replaces the current CA. It is printed with: sslserver local-ca")
+		}
+	}
+	if err != nil {
+		log.Println("Could not create next local CA:", err)
+		return
+	}
+	if !force && now.Before(replaceAt) {
+		return
+	}
+
+	// Replace the current CA. The replaced CA stays trusted until it expires, unless the rotation is forced.
+	next, err := parseLocalCA(data)
+	if err != nil {
+		log.Println("Could not read next local CA:", err)
+		return
+	}
+	if !force {
+		currentData, err := m.Cache.Get(ctx, localCACacheKey)
+		if err == nil {
+			err = m.Cache.Put(ctx, localCAPreviousCacheKey, currentData)
+		}
+		if err != nil {
+			log.Println("Could not keep replaced local CA:", err)
+			return
+		}
+	}
+	if err := m.Cache.Put(ctx, localCACacheKey, data); err != nil {
+		log.Println("Could not replace local CA:", err)
+		return
+	}
+	m.Cache.Delete(ctx, localCANextCacheKey)
+
+	localCAMu.Lock()
+	localCA = next
+	if !force {
+		localCAPrevious = current.Leaf
+	}
+	localCAMu.Unlock()
+	log.Println("Replaced the local development CA. It is valid until", next.Leaf.NotAfter.Format(time.RFC3339))
+
+	if force {
+		for domain := range allowedDomainsSelfSignedWhiteList {
+			rotateSelfSignedCertificate(domain)
+		}
+	}
+}
+
+// issuedLocally returns true if the certificate is self-signed or signed by the local CA.
+func issuedLocally(leaf *x509.Certificate) bool {
+	if leaf.Issuer.String() == leaf.Subject.String() {
+		return true
+	}
+	localCAMu.Lock()
+	defer localCAMu.Unlock()
+	return localCA != nil && leaf.Issuer.String() == localCA.Leaf.Subject.String()
+}
+
+// runLocalCA implements the `local-ca` subcommand. It prints the certificate of the local CA, so that it can be
+// added to the trust stores of the development machines. During the overlaps of a rotation, it also prints the next
+// CA, or the replaced CA until it expires.
+func runLocalCA() {
+	readConfig()
+
+	store := openCertStore()
+	data, err := store.Get(context.Background(), localCACacheKey)
+	if err != nil {
+		log.Fatal("The local CA does not exist yet. Start the server with local-ca set to true first: ", err)
+	}
+	for _, name := range []string{localCANextCacheKey, localCAPreviousCacheKey} {
+		if other, err := store.Get(context.Background(), name); err == nil {
+			if leaf := parseFirstCertificate(other); leaf != nil && time.Now().Before(leaf.NotAfter) {
+				data = append(data, other...)
+			}
+		}
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(os.Stdout, block)
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// memoryCache is an autocert.Cache in memory for the tests.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (c *memoryCache) Get(ctx context.Context, name string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.entries[name]
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (c *memoryCache) Put(ctx context.Context, name string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = data
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+	return nil
+}
+
+// signLeaf returns a certificate that is signed by the current local CA.
+func signLeaf(t *testing.T) *x509.Certificate {
+	parent, signer, err := localCAIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+// TestRotateLocalCA checks that the next local CA is created one overlap before it replaces the current CA, that the
+// replaced CA stays trusted, and that a forced rotation does not keep it.
+func TestRotateLocalCA(t *testing.T) {
+	savedConfig, savedManager := config, m
+	defer func() {
+		config, m = savedConfig, savedManager
+		localCA, localCAPrevious = nil, nil
+	}()
+	cache := &memoryCache{entries: map[string][]byte{}}
+	m = &autocert.Manager{Cache: cache}
+	localCA, localCAPrevious = nil, nil
+	config.LocalCA = true
+	config.LocalCAValidity = 10 * time.Hour
+
+	// The CA expires within two overlaps: the next CA is created, but the current CA still signs.
+	config.LocalCAOverlap = 6 * time.Hour
+	first, err := getLocalCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLeaf := signLeaf(t)
+	rotateLocalCA(false)
+	if _, err := cache.Get(context.Background(), localCANextCacheKey); err != nil {
+		t.Fatal("the next CA was not created:", err)
+	}
+	if current, _ := getLocalCA(); current != first {
+		t.Fatal("the current CA was replaced before the overlap")
+	}
+
+	// The CA expires within one overlap: the next CA replaces it, and the replaced CA stays trusted.
+	config.LocalCAOverlap = 20 * time.Hour
+	rotateLocalCA(false)
+	second, _ := getLocalCA()
+	if second == first {
+		t.Fatal("the current CA was not replaced")
+	}
+	if _, err := cache.Get(context.Background(), localCANextCacheKey); err != autocert.ErrCacheMiss {
+		t.Error("the next CA was not removed after it replaced the current CA")
+	}
+	if _, err := cache.Get(context.Background(), localCAPreviousCacheKey); err != nil {
+		t.Error("the replaced CA was not stored:", err)
+	}
+	secondLeaf := signLeaf(t)
+	if !signedByLocalCA(firstLeaf) || !signedByLocalCA(secondLeaf) {
+		t.Error("the certificates of the current and the replaced CA are not both trusted")
+	}
+
+	// A forced rotation replaces the CA right away and does not keep the replaced CA.
+	config.LocalCAOverlap = time.Hour
+	rotateLocalCA(true)
+	third, _ := getLocalCA()
+	if third == second {
+		t.Fatal("the forced rotation did not replace the CA")
+	}
+	if signedByLocalCA(firstLeaf) || signedByLocalCA(secondLeaf) {
+		t.Error("the certificates of replaced CAs are still trusted after a forced rotation")
+	}
+	if _, err := cache.Get(context.Background(), localCAPreviousCacheKey); err != autocert.ErrCacheMiss {
+		t.Error("the replaced CA is still stored after a forced rotation")
+	}
+	if !signedByLocalCA(signLeaf(t)) {
+		t.Error("the certificates of the new CA are not trusted")
+	}
+}
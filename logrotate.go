@@ -1,11 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"sync"
 )
 
+// logFile is the log file of the parent, or nil if no log file is written.
+var logFile *os.File
+var logFileMu sync.Mutex
+
 func initLogging() {
 	// Set default logging pattern.
 	log.SetFlags(log.LstdFlags)
@@ -19,8 +25,17 @@ func initLogging() {
 	}
 	log.SetPrefix("P ")
 
-	// Return if no log file should be written. Logging will still be done to stdout.
+	// Open the W3C log file, into which the parent writes the W3C log entries of the child.
+	if config.W3cLogFile != "" {
+		if err := openW3CLogFile(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Return if no log file should be written. Logging will still be done to stderr,
+	// and the recent lines are kept for the admin command "tail".
 	if config.LogFile == "" {
+		log.SetOutput(io.MultiWriter(os.Stderr, logTail))
 		return
 	}
 
@@ -29,92 +44,53 @@ func initLogging() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	logFile = f
 	// Do not close the file, because the logger should always be able to write into it!
 	// defer f.Close()
 
-	// Create a writer that writes to the log file and to stdout.
-	w := io.MultiWriter(f, os.Stdout)
+	// Create a writer that writes to the log file and to stdout, and keeps the recent lines for the admin command "tail".
+	w := io.MultiWriter(f, os.Stdout, logTail)
 
 	// Modify the output of the default logger.
 	log.SetOutput(w)
+}
 
-	/*
-		// Log rotation only works, when the server is not in a jail.
-		// TODO: move logging into parent
-		if !config.JailProcess {
-			// Rotate the log files every day.
-			go func() {
-				for range time.Tick(24 * time.Hour) {
-					fileInfo, err := f.Stat()
-					if err == nil && fileInfo.Size() < 5*1024*1024 {
-						// Only rotate log files if they are too big.
-						continue
-					}
-
-					// Remove the oldest log file.
-					os.Remove(config.LogFile + ".3")
-
-					// Closing the current log file is not necessary,
-					// because os.Rename() closes the file automatically.
-					// f.Close()
-
-					// Rename the log files.
-					os.Rename(config.LogFile+".2", config.LogFile+".3")
-					os.Rename(config.LogFile+".1", config.LogFile+".2")
-					os.Rename(config.LogFile, config.LogFile+".1")
-
-					// Create a new log file.
-					f, err := os.Create(config.LogFile)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					// Create a writer that writes to the log file and to stdout.
-					w = io.MultiWriter(f, os.Stdout)
-
-					// Modify the output of the default logger.
-					log.SetOutput(w)
-				}
-			}()
-		}
-
-
-		////// OR something like this:
-
-
-		// Rotate the log files every day.
-		go func() {
-			for range time.Tick(24 * time.Hour) {
-				// Check if the log file size exceeds a threshold before rotating
-				fileInfo, err := f.Stat()
-				if err != nil || fileInfo.Size() >= 5*1024*1024 {
-					rotateLogs()
-				}
-			}
-		}()
-
-		func rotateLogs() {
-			// Remove the oldest log file.
-			os.Remove(config.LogFile + ".3")
-			os.Rename(config.LogFile+".2", config.LogFile+".3")
-			os.Rename(config.LogFile+".1", config.LogFile+".2")
-			os.Rename(config.LogFile, config.LogFile+".1")
-
-			// Create a new log file.
-			f, err := os.Create(config.LogFile)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// Create a writer that writes to the log file and to stdout.
-			w := io.MultiWriter(f, os.Stdout)
-
-			// Modify the output of the default logger.
-			log.SetOutput(w)
-		}
-
-
+// logFileBackups is the number of rotated log files that are kept.
+const logFileBackups = 3
+
+// rotateLogFile renames the log file to <log-file>.1 and continues in a new log file, if the log file is bigger
+// than log-file-max-size. The older files are renamed to <log-file>.2 and so on, and the oldest one is removed.
+// Only the parent writes the log file, so the rotation also works when the child is jailed.
+func rotateLogFile() {
+	logFileMu.Lock()
+	f := logFile
+	logFileMu.Unlock()
+	info, err := f.Stat()
+	if err != nil || info.Size() < config.LogFileMaxSize {
+		return
+	}
 
-	*/
+	os.Remove(fmt.Sprintf("%s.%d", config.LogFile, logFileBackups))
+	for i := logFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", config.LogFile, i), fmt.Sprintf("%s.%d", config.LogFile, i+1))
+	}
+	if err := os.Rename(config.LogFile, config.LogFile+".1"); err != nil {
+		log.Println("Could not rotate log file:", err)
+		return
+	}
 
+	newFile, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		// Continue to write into the renamed file.
+		log.Println("Could not create new log file:", err)
+		return
+	}
+	logFileMu.Lock()
+	logFile = newFile
+	logFileMu.Unlock()
+
+	// After SetOutput returns, the logger does not write into the old file anymore.
+	log.SetOutput(io.MultiWriter(newFile, os.Stdout, logTail))
+	f.Close()
+	log.Println("Log file rotated, the previous log file is", config.LogFile+".1")
 }
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The parent keeps the most recent log lines (of the parent and of the child) in memory, so that
+// operators can page through them and follow them live with the admin command
+// "tail [after=<seq>] [limit=<n>] [level=<level>] [component=<name>] [follow]".
+// The answer starts with the line "ok: tail", followed by one line "<seq> <log line>" per entry.
+// Without "after", these are the last lines. Without "follow", the last line is "next: after=<seq>",
+// which continues with the next page. With "follow", the new lines are sent until the connection is closed.
+
+// Log levels, from the least to the most important.
+const (
+	logLevelInfo    = "info"
+	logLevelWarning = "warning"
+	logLevelError   = "error"
+)
+
+// logTailEntry is one log line with its sequence number.
+type logTailEntry struct {
+	seq  uint64
+	line string
+}
+
+// logTailSubscriber receives the new log lines for a "tail follow" command.
+type logTailSubscriber struct {
+	ch      chan logTailEntry
+	dropped int
+}
+
+// logTailBuffer is a writer for the logger that keeps the most recent lines.
+type logTailBuffer struct {
+	sync.Mutex
+	seq         uint64
+	entries     []logTailEntry
+	subscribers map[*logTailSubscriber]bool
+}
+
+// logTail keeps the recent log lines of the parent.
+var logTail = &logTailBuffer{subscribers: map[*logTailSubscriber]bool{}}
+
+// Write stores the log line and sends it to the subscribers. The logger calls Write once per line.
+func (b *logTailBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.seq++
+	entry := logTailEntry{seq: b.seq, line: strings.TrimRight(string(p), "\r\n")}
+
+	b.entries = append(b.entries, entry)
+	if len(b.entries) > config.LogTailEntries {
+		// Copy the entries, so that the dropped entries can be freed.
+		b.entries = append([]logTailEntry(nil), b.entries[len(b.entries)-config.LogTailEntries:]...)
+	}
+
+	// Never block the logger because of a slow subscriber.
+	for s := range b.subscribers {
+		select {
+		case s.ch <- entry:
+		default:
+			s.dropped++
+		}
+	}
+	return len(p), nil
+}
+
+// page returns at most limit entries after the sequence number that match the filter, and the
+// sequence number after which the next page starts.
+func (b *logTailBuffer) page(after uint64, limit int, filter logTailFilter) ([]logTailEntry, uint64) {
+	b.Lock()
+	defer b.Unlock()
+	// The sequence numbers start again at 1 after a restart.
+	if after > b.seq {
+		after = 0
+	}
+	var page []logTailEntry
+	for _, entry := range b.entries {
+		if entry.seq <= after || !filter.match(entry.line) {
+			continue
+		}
+		if len(page) == limit {
+			return page, page[limit-1].seq
+		}
+		page = append(page, entry)
+	}
+	return page, b.seq
+}
+
+// last returns the last limit entries that match the filter, and the sequence number of the newest entry.
+func (b *logTailBuffer) last(limit int, filter logTailFilter) ([]logTailEntry, uint64) {
+	b.Lock()
+	defer b.Unlock()
+	var page []logTailEntry
+	for i := len(b.entries) - 1; i >= 0 && len(page) < limit; i-- {
+		if filter.match(b.entries[i].line) {
+			page = append([]logTailEntry{b.entries[i]}, page...)
+		}
+	}
+	return page, b.seq
+}
+
+// subscribe registers a subscriber for new log lines.
+func (b *logTailBuffer) subscribe() *logTailSubscriber {
+	b.Lock()
+	defer b.Unlock()
+	s := &logTailSubscriber{ch: make(chan logTailEntry, 256)}
+	b.subscribers[s] = true
+	return s
+}
+
+// unsubscribe removes the subscriber.
+func (b *logTailBuffer) unsubscribe(s *logTailSubscriber) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribers, s)
+}
+
+// takeDropped returns and resets the number of lines that the subscriber missed, because it was too slow.
+func (b *logTailBuffer) takeDropped(s *logTailSubscriber) int {
+	b.Lock()
+	defer b.Unlock()
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
+
+// logTailFilter selects log lines by level and component.
+type logTailFilter struct {
+	// The minimum level, or "" for all lines.
+	level string
+	// The process ("parent" or "child") or the tag of the message (e.g. "certificate" or "request"), or "" for all lines.
+	component string
+}
+
+// logLineParts splits a log line into the process and the message.
+// The lines start with the prefix "P " or "C " and the date and time of the standard flags.
+func logLineParts(line string) (process string, message string) {
+	const headerLength = len("P 2006/01/02 15:04:05 ")
+	if len(line) < headerLength || line[1] != ' ' {
+		return "", line
+	}
+	switch line[0] {
+	case 'P':
+		process = "parent"
+	case 'C':
+		process = "child"
+	case 'S':
+		process = "selftest"
+	}
+	return process, line[headerLength:]
+}
+
+// logLineLevel guesses the level of a log message, because the logger does not know levels.
+func logLineLevel(message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.HasPrefix(lower, "error") || strings.Contains(lower, "could not") || strings.Contains(lower, "failed"):
+		return logLevelError
+	case strings.HasPrefix(lower, "warning") || strings.Contains(lower, "warning:"):
+		return logLevelWarning
+	}
+	return logLevelInfo
+}
+
+// logLineTag returns the tag of a log message, which is the lower case text before the first colon, e.g. "certificate".
+func logLineTag(message string) string {
+	i := strings.Index(message, ":")
+	if i < 0 || strings.Count(message[:i], " ") > 2 {
+		return ""
+	}
+	return strings.ToLower(message[:i])
+}
+
+// logLevelRank orders the log levels.
+func logLevelRank(level string) int {
+	switch level {
+	case logLevelWarning:
+		return 1
+	case logLevelError:
+		return 2
+	}
+	return 0
+}
+
+// match returns true if the log line passes the filter.
+func (f logTailFilter) match(line string) bool {
+	process, message := logLineParts(line)
+	if f.level != "" && logLevelRank(logLineLevel(message)) < logLevelRank(f.level) {
+		return false
+	}
+	if f.component != "" && f.component != process && f.component != logLineTag(message) {
+		return false
+	}
+	return true
+}
+
+// handleTailCommand answers the admin command "tail" on the connection.
+func handleTailCommand(conn net.Conn, args []string) {
+	var after uint64
+	hasAfter := false
+	limit := 100
+	follow := false
+	var filter logTailFilter
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		var err error
+		switch key {
+		case "after":
+			after, err = strconv.ParseUint(value, 10, 64)
+			hasAfter = true
+		case "limit":
+			limit, err = strconv.Atoi(value)
+			if err == nil && limit < 1 {
+				err = errors.New("must be positive")
+			}
+		case "level":
+			filter.level = value
+			if value != logLevelInfo && value != logLevelWarning && value != logLevelError {
+				err = errors.New("must be info, warning, or error")
+			}
+		case "component":
+			filter.component = strings.ToLower(value)
+		case "follow":
+			follow = true
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "error: invalid option %s: %v\n", arg, err)
+			return
+		}
+	}
+	if hasAfter && follow {
+		fmt.Fprintln(conn, "error: after can not be used with follow")
+		return
+	}
+
+	// Subscribe before the page is read, so that no line is missed in between.
+	var s *logTailSubscriber
+	if follow {
+		s = logTail.subscribe()
+		defer logTail.unsubscribe(s)
+	}
+
+	w := bufio.NewWriter(conn)
+	// Without "after", the last page is sent.
+	page, next := logTail.last(limit, filter)
+	if hasAfter {
+		page, next = logTail.page(after, limit, filter)
+	}
+	fmt.Fprintln(w, "ok: tail")
+	for _, entry := range page {
+		fmt.Fprintln(w, entry.seq, entry.line)
+	}
+	if !follow {
+		fmt.Fprintf(w, "next: after=%d\n", next)
+		w.Flush()
+		return
+	}
+	if w.Flush() != nil {
+		return
+	}
+
+	// Follow the new lines until the administrator closes the connection.
+	// At most log-tail-rate lines are sent per second, the rest is skipped and counted.
+	conn.SetDeadline(time.Time{})
+	closed := make(chan struct{})
+	go func() {
+		// Reading returns when the administrator closes the connection.
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	windowStart := time.Now()
+	sent := 0
+	skipped := 0
+	for {
+		var entry logTailEntry
+		select {
+		case entry = <-s.ch:
+		case <-closed:
+			return
+		}
+		if entry.seq <= next || !filter.match(entry.line) {
+			continue
+		}
+		if time.Since(windowStart) >= time.Second {
+			windowStart = time.Now()
+			sent = 0
+		}
+		if sent >= config.LogTailRate {
+			skipped++
+			continue
+		}
+		sent++
+
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if dropped := logTail.takeDropped(s) + skipped; dropped > 0 {
+			fmt.Fprintf(w, "- skipped %d lines\n", dropped)
+			skipped = 0
+		}
+		fmt.Fprintln(w, entry.seq, entry.line)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// runTail prints the log lines from the admin socket of the running server.
+func runTail(args []string) {
+	readConfig()
+	if config.AdminSocket == "" {
+		log.Fatal("admin-socket is not configured")
+	}
+
+	conn, err := net.DialTimeout("unix", config.AdminSocket, 5*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, strings.Join(append([]string{"tail"}, args...), " ")); err != nil {
+		log.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	if strings.HasPrefix(answer, "error:") {
+		log.Fatal(strings.TrimSpace(strings.TrimPrefix(answer, "error:")))
+	}
+	io.Copy(os.Stdout, reader)
+	os.Exit(0)
+}
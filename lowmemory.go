@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"golang.org/x/net/http2"
+)
+
+// With low-memory, the server fits on devices with 128 MB RAM, e.g. small VPS and ARM boards: the files are not read
+// into memory at startup, but from the disk on demand, with a small cache for the files that are requested often.
+// The buffers of HTTP/2 are smaller, and the garbage collector runs more often. The TLS records of new connections are
+// small anyway, because Go sizes them dynamically.
+
+const (
+	lowMemoryMaxCacheMemory        = 4 * 1024 * 1024 // The size of the cache for often requested files.
+	lowMemoryMaxCacheableFileSize  = 64 * 1024       // Larger files are always streamed from the disk.
+	lowMemoryLogTailEntries        = 1000
+	lowMemoryMaxHeaderBytes        = 16 * 1024
+	lowMemoryMaxConcurrentStreams  = 32
+	lowMemoryHTTP2FrameSize        = 16 * 1024
+	lowMemoryHTTP2UploadBuffer     = 64 * 1024
+	lowMemoryHTTP2StreamBufferSize = 16 * 1024
+	lowMemoryGCPercent             = 50
+)
+
+// applyLowMemoryProfile limits the memory settings for low-memory. Settings that are already lower are kept.
+func applyLowMemoryProfile() {
+	if !config.LowMemory {
+		return
+	}
+	if !config.ServeFilesNotInCache {
+		log.Fatal("Error: low-memory needs serve-files-not-in-cache, because the files are read from the disk on demand")
+	}
+	if config.MaxCacheMemory == 0 || config.MaxCacheMemory > lowMemoryMaxCacheMemory {
+		config.MaxCacheMemory = lowMemoryMaxCacheMemory
+	}
+	config.MaxCacheableFileSize = lowMemoryMaxFileSize(config.MaxCacheableFileSize)
+	config.CacheEviction = cacheEvictionLRU
+	if config.LogTailEntries > lowMemoryLogTailEntries {
+		config.LogTailEntries = lowMemoryLogTailEntries
+	}
+	debug.SetGCPercent(lowMemoryGCPercent)
+}
+
+// lowMemoryMaxFileSize limits the maximum size of cached files for low-memory.
+func lowMemoryMaxFileSize(size int64) int64 {
+	if config.LowMemory && size > lowMemoryMaxCacheableFileSize {
+		return lowMemoryMaxCacheableFileSize
+	}
+	return size
+}
+
+// configureLowMemoryServer makes the buffers of the HTTPS server smaller for low-memory.
+func configureLowMemoryServer(server *http.Server) {
+	if !config.LowMemory {
+		return
+	}
+	server.MaxHeaderBytes = lowMemoryMaxHeaderBytes
+
+	// HTTP/2 is only configured if it is enabled. ConfigureServer adds missing protocols, so the configured ones are kept.
+	protos := server.TLSConfig.NextProtos
+	for _, proto := range protos {
+		if proto != "h2" {
+			continue
+		}
+		err := http2.ConfigureServer(server, &http2.Server{
+			MaxConcurrentStreams:         lowMemoryMaxConcurrentStreams,
+			MaxReadFrameSize:             lowMemoryHTTP2FrameSize,
+			MaxUploadBufferPerConnection: lowMemoryHTTP2UploadBuffer,
+			MaxUploadBufferPerStream:     lowMemoryHTTP2StreamBufferSize,
+			IdleTimeout:                  config.MaxIdleTimeout,
+		})
+		if err != nil {
+			log.Println("Could not configure HTTP/2 for low-memory:", err)
+		}
+		server.TLSConfig.NextProtos = protos
+	}
+}
@@ -1,18 +1,19 @@
 package main
 
-// TODO: push new certificates through the clinet-server communication and enable the jail again
+// TODO: enable the jail again
 
 import (
 	"bufio"
 	"context"
+	"crypto/x509/pkix"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -29,31 +30,84 @@ type Command struct {
 
 // Command types.
 const (
-	cmdGet       = "[get]"
-	cmdPut       = "[put]"
-	cmdDelete    = "[delete]"
-	cmdTerminate = "[terminate]"
+	cmdGet                 = "[get]"
+	cmdPut                 = "[put]"
+	cmdDelete              = "[delete]"
+	cmdTerminate           = "[terminate]"
+	cmdTerminated          = "[terminated]"
+	cmdReload              = "[reload]"
+	cmdIssue               = "[issue]"
+	cmdClientCA            = "[client-ca]"
+	cmdCertificate         = "[certificate]"
+	cmdOperatorCertificate = "[operator-certificate]"
+	cmdRotateSelfSigned    = "[rotate-self-signed]"
+	cmdRotateLocalCA       = "[rotate-local-ca]"
+	cmdSchedule            = "[schedule]"
+	cmdReady               = "[ready]"
+	cmdACMEOrder           = "[acme-order]"
+	cmdForgetCertificate   = "[forget-certificate]"
+	cmdResolve             = "[resolve]"
+	cmdIssuanceLock        = "[issuance-lock]"
+	cmdIssuanceUnlock      = "[issuance-unlock]"
+	cmdClientCRL           = "[client-crl]"
+	cmdSandboxState        = "[sandbox-state]"
 )
 
 // Create the channels for communication between the parent and child.
 var parentToChildCh = make(chan Command)
 var childToParentCh = make(chan Command)
 
+// Create the channel for long running commands that the child executes in the background.
+var childTaskCh = make(chan Command, 16)
+
 // If the current process is the child.
 var isChild = false
 
+// The exit error of the child. It is set by the parent after the child has exited.
+var childExitErr error
+
 func main() {
-	// Check if the current process is the child.
+	// Run the subcommands. They exit the program.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "selftest":
+			runSelftest()
+		case "add-domain":
+			runAddDomain(os.Args[2:])
+		case "client-ca":
+			runClientCA(os.Args[2:])
+		case "local-ca":
+			runLocalCA()
+		case "access-log":
+			runAccessLog(os.Args[2:])
+		case "tail":
+			runTail(os.Args[2:])
+		case "preflight":
+			runPreflight()
+		case "certs":
+			runCerts(os.Args[2:])
+		}
+	}
+
+	// Check if the current process is the child and if chaos hooks are enabled.
 	for _, arg := range os.Args[1:] {
 		if arg == "-child" {
 			isChild = true
-			break
+		} else if arg == insecureDebugFlag || arg == "-insecure-debug" {
+			insecureDebug = true
+		} else if strings.HasPrefix(arg, "-chaos=") {
+			if err := parseChaosFlag(strings.TrimPrefix(arg, "-chaos=")); err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
 	// Read config file.
 	readConfig()
 
+	// Refuse to write the TLS secrets without --insecure-debug.
+	checkTLSKeyLogFile()
+
 	// Initialize the output for the logger.
 	initLogging()
 
@@ -66,14 +120,43 @@ func main() {
 
 		log.Println("This program is the parent")
 		initParent()
+
+		code, err := parentExitCode()
+		if err != nil {
+			log.Println("Child exited with error:", err)
+		}
+		syncLogFile()
+		os.Exit(code)
 	}
 
-	os.Exit(0)
+	os.Exit(exitCode)
 }
 
 // This is the parent program that handles the certificate storage and logging.
 func initParent() {
-	cmd := exec.Command(os.Args[0], "-child")
+	// Check the common reasons why the server does not start, before anything is changed.
+	if !runPreflightChecks() {
+		log.Fatal("Preflight checks failed. Fix the items marked with FAIL.")
+	}
+
+	// Change the owner of the web root to the jail user, so that the files do not have to be world-readable.
+	if config.ChownWebRoot {
+		log.Println("Setting file owner for web root")
+		if err := ChownWebRoot(config.WebRootDirectory); err != nil {
+			log.Fatal("Could not set owner:", err)
+		}
+	}
+
+	// Open the certificate cache before the child is started, so that a broken cache stops the server right away.
+	certStorage = openCertStore()
+
+	// Use the absolute path of the executable, so that the child can be started even if the working directory changed.
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+
+	cmd := exec.Command(executable, append(append([]string{"-child"}, chaosArgs()...), insecureDebugArgs()...)...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		log.Fatal(err)
@@ -84,57 +167,30 @@ func initParent() {
 	}
 
 	log.Println("Setting handler for commands from child")
+	readerDone := make(chan struct{})
 	go func() {
+		// Signal that the child closed its standard output, when the function returns.
+		defer close(readerDone)
+
 		// Create a new bufio.Reader to read from standard output.
 		reader := bufio.NewReader(stdout)
 
-		for {
-			// Read the first line of output, which is the command type.
-			commandType, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			commandType = strings.TrimSpace(commandType)
-
-			// If it is not a command, then it will be sent to the logger.
-			if !(commandType == cmdGet || commandType == cmdPut || commandType == cmdDelete || commandType == cmdTerminate) {
-				childToParentCh <- Command{
-					Type: commandType,
-					Name: "",
-					Data: nil,
-				}
-				continue
-			}
+		// Limit the rate of commands, so that a compromised child cannot keep the parent busy.
+		limiter := newRateLimiter(config.IpcMaxCommandsPerSecond)
 
-			// Read the second line of output, which is the optional file name for the command.
-			fileName, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			fileName = strings.TrimSpace(fileName)
-
-			// Read the next line of output, which is the number of bytes of data.
-			dataLengthStr, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			dataLength, err := strconv.Atoi(strings.TrimSpace(dataLengthStr))
-			if err != nil {
-				log.Fatal(err)
+		for {
+			// Read the next frame. If it is not a command, then it will be sent to the logger.
+			command, err := readCommand(reader, config.IpcMaxFrameSize)
+			if err == io.EOF {
+				// The child has exited.
+				return
 			}
-
-			// Read the data from the output.
-			data := make([]byte, dataLength)
-			_, err = io.ReadFull(reader, data)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			// Create a Command struct with the command type and data.
-			command := Command{
-				Type: commandType,
-				Name: fileName,
-				Data: data,
+			if isCommandType(command.Type) {
+				limiter.wait()
 			}
 
 			// log.Println("Command from child:", command)
@@ -157,28 +213,8 @@ func initParent() {
 
 				// log.Println("Command to child:", command)
 
-				// Write the command type to the childs stdin.
-				if _, err := w.WriteString(command.Type + "\n"); err != nil {
-					log.Fatal(err)
-				}
-
-				// Write the file name for the command to the childs stdin.
-				if _, err := w.WriteString(command.Name + "\n"); err != nil {
-					log.Fatal(err)
-				}
-
-				// Write the number of bytes of data to the childs stdin.
-				if _, err := w.WriteString(strconv.Itoa(len(command.Data)) + "\n"); err != nil {
-					log.Fatal(err)
-				}
-
-				// Flush the writer to ensure the command is sent.
-				if err := w.Flush(); err != nil {
-					log.Fatal(err)
-				}
-
-				// Write the data to the childs stdin.
-				if _, err := stdin.Write(command.Data); err != nil {
+				// Write the command to the childs stdin.
+				if err := writeCommand(w, command); err != nil {
 					log.Fatal(err)
 				}
 
@@ -188,21 +224,91 @@ func initParent() {
 		}
 	}()
 
+	// Some sandboxes have to be set up when the child is started.
+	prepareSandbox(cmd)
+
+	// The hook can e.g. open the firewall ports, before the child binds them.
+	runLifecycleHook(hookBeforeBind)
+
 	log.Println("Running child")
 	if err := cmd.Start(); err != nil {
 		log.Fatal(err)
 	}
+	childProcess = cmd.Process
+
+	// Shut down the child gracefully on SIGINT and SIGTERM.
+	handleTerminateSignals()
+
+	// Send the operator-provided certificates first, so that the child has them before it initializes the certificates.
+	go watchOperatorCertificates()
 
 	log.Println("Setting trap to exit when child exits")
 	go func() {
-		cmd.Wait()
+		// Wait until all output of the child has been read, because cmd.Wait() closes the pipe.
+		<-readerDone
+		childExitErr = cmd.Wait()
+		close(childExited)
 		// Closing the child-to-parent-channel, so that the command loop terminates and so the program.
 		close(childToParentCh)
 	}()
 
-	log.Println("Waiting for commands")
-	cache := autocert.DirCache(config.CertificateCacheDirectory)
+	cache := certStorage
 	ctx := context.Background()
+	loadACMERateEvents()
+
+	if config.HttpChallengeInParent {
+		log.Println("Starting ACME HTTP challenge responder")
+		startChallengeResponder(cache)
+	}
+
+	if config.AdminSocket != "" {
+		log.Println("Starting admin socket")
+		startAdminSocket(cache)
+	}
+
+	if config.TenantSocket != "" {
+		log.Println("Starting tenant socket")
+		startTenantSocket()
+	}
+
+	// Warn early if the system clock is wrong, because this breaks certificate validation and renewals.
+	checkSystemClock()
+
+	// Push new or changed certificates from the certificate cache directory to the child.
+	if config.CertificatePushInterval > 0 {
+		go watchCertificateCache()
+	}
+
+	// Log the expiry of the certificates and send alerts for certificates that expire soon or are not renewed.
+	if config.CertificateMonitorInterval > 0 {
+		go monitorCertificates()
+	}
+
+	// Rotate the log file and the W3C log file when they get too big.
+	if (logFile != nil || config.W3cLogFile != "") && config.LogFileMaxSize > 0 {
+		jobs.every(jobLogRotation, time.Minute, func() {
+			rotateLogFile()
+			rotateW3CLogFile()
+		})
+	}
+
+	// Evaluate the scheduled windows and send their state to the child.
+	if len(config.Schedules) > 0 {
+		go runSchedules()
+	}
+
+	// Send the client CA bundles to the child, which can not read them from the jail.
+	go pushClientCABundles(cache)
+
+	// Send the CRL files for the client certificates to the child, and send them again when they change.
+	if len(clientCRLFileNames()) > 0 {
+		go func() {
+			reloadClientCRLFiles()
+			jobs.every(jobClientCRLReload, time.Minute, reloadClientCRLFiles)
+		}()
+	}
+
+	log.Println("Waiting for commands")
 	for command := range childToParentCh {
 		// Handle the command from the child program.
 		switch command.Type {
@@ -217,17 +323,54 @@ func initParent() {
 			parentToChildCh <- response
 		case cmdPut:
 			// Handle the "put" command.
+			// Only certificates are looked up before, so that the other entries do not wait for a remote backend.
+			var existing error
+			if isCertificateCacheName(command.Name) {
+				_, existing = cache.Get(ctx, command.Name)
+			}
 			err := cache.Put(ctx, command.Name, command.Data)
 			if err != nil {
 				log.Println("Could not store certificate:", err)
+			} else if isCertificateCacheName(command.Name) {
+				domain := strings.TrimSuffix(command.Name, rsaCertSuffix)
+				go recordACMECertificate(domain, existing == nil)
+				go runLifecycleHook(hookAfterCertRenewal, "SSLSERVER_DOMAIN="+domain)
 			}
+			// The child has the certificate already. It does not have to be pushed back.
+			markCertificateKnown(command.Name)
 		case cmdDelete:
 			// Handle the "delete" command.
 			err := cache.Delete(ctx, command.Name)
 			if err != nil {
 				log.Println("Could not delete certificate:", err)
 			}
+		case cmdReady:
+			// The child has loaded its certificates and serves files.
+			markChildReady()
+		case cmdACMEOrder:
+			// The state of an ACME order of the child changed.
+			updateACMEOrder(command.Name, command.Data)
+		case cmdSandboxState:
+			// The child has entered its sandbox.
+			receiveSandboxState(command.Data)
+		case cmdTerminated:
+			// The child has closed its servers and exits with the exit code.
+			receiveTerminateAck(command.Data)
+		case cmdResolve:
+			// Resolve a host name for the child, in the background, because the lookup can take a while.
+			go answerResolve(command.Name)
+		case cmdIssuanceLock:
+			// Take the issuance lock of a certificate for the child, in the background, because the backend can be remote.
+			go answerIssuanceLock(command.Name)
+		case cmdIssuanceUnlock:
+			// Release the issuance lock of a certificate after the order of the child.
+			go releaseIssuanceLock(command.Name)
 		default:
+			if recordW3CLog(command.Type) {
+				// The W3C log entries are only written into the W3C log file.
+				continue
+			}
+			recordAccessLog(command.Type)
 			log.SetPrefix("")
 			log.SetFlags(0)
 			log.Println(command.Type)
@@ -239,58 +382,68 @@ func initParent() {
 
 // This is the child program that runs the server.
 func initChild() {
+	// The parent coordinates the shutdown.
+	ignoreTerminateSignals()
+
+	// Execute long running commands from the parent one after the other, so that they do not block
+	// the communication with the parent and so that e.g. a reload is done before a certificate is issued.
+	go func() {
+		for command := range childTaskCh {
+			switch command.Type {
+			case cmdReload:
+				reloadDomains()
+			case cmdIssue:
+				issueCertificate(command.Name)
+			}
+		}
+	}()
+
 	go func() {
 		// Create a new bufio.Reader to read from standard input.
 		reader := bufio.NewReader(os.Stdin)
 
 		for {
-			// Read the first line of output, which is the command type.
-			commandType, err := reader.ReadString('\n')
+			// Read the next frame.
+			command, err := readCommand(reader, config.IpcMaxFrameSize)
+			chaosCheckpoint()
 			if err != nil {
 				log.Fatal(err)
 			}
-			commandType = strings.TrimSpace(commandType)
 
 			// If it is not a command, then it will be ignored.
-			if !(commandType == cmdGet || commandType == cmdPut || commandType == cmdDelete || commandType == cmdTerminate) {
+			if !isCommandType(command.Type) {
 				continue
 			}
 
-			// Read the second line of output, which is the optional file name for the command.
-			fileName, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			fileName = strings.TrimSpace(fileName)
-
-			// Read the next line of output, which is the number of bytes of data.
-			dataLengthStr, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			dataLength, err := strconv.Atoi(strings.TrimSpace(dataLengthStr))
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// Read the data from the output.
-			data := make([]byte, dataLength)
-			_, err = io.ReadFull(reader, data)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// Create a Command struct with the command type and data.
-			command := Command{
-				Type: commandType,
-				Name: fileName,
-				Data: data,
-			}
-
-			if command.Type == cmdTerminate {
-				// The child does not have to send the command to the parent-to-child. It can handle it directly.
-				terminateServer()
-			} else {
+			// The child does not have to send some commands to the parent-to-child channel. It can handle them directly.
+			switch command.Type {
+			case cmdTerminate:
+				// Drain the connections in the background, because the requests may still need the parent.
+				go terminateChild()
+			case cmdClientCA:
+				setClientCABundle(command.Name, command.Data)
+			case cmdClientCRL:
+				setClientCRLFile(command.Name, command.Data)
+			case cmdCertificate:
+				receiveCertificate(command.Name, command.Data)
+			case cmdOperatorCertificate:
+				receiveOperatorCertificate(command.Name, command.Data)
+			case cmdRotateSelfSigned:
+				rotateSelfSignedCertificate(command.Name)
+			case cmdRotateLocalCA:
+				go rotateLocalCA(true)
+			case cmdForgetCertificate:
+				forgetCertificate(command.Name)
+			case cmdSchedule:
+				applySchedule(command.Data)
+			case cmdResolve:
+				receiveResolveAnswer(command.Name, command.Data)
+			case cmdIssuanceLock:
+				receiveIssuanceLockAnswer(command.Name, command.Data)
+			case cmdReload, cmdIssue:
+				// Long running commands are executed one after the other by the task worker.
+				childTaskCh <- command
+			default:
 				// Send the Command struct to the parent-to-child channel.
 				parentToChildCh <- command
 			}
@@ -306,29 +459,14 @@ func initChild() {
 				if !ok {
 					log.Fatal("childToParentCh closed")
 				}
+				chaosCheckpoint()
 
-				// Write the command type to the childs stdout.
-				if _, err := w.WriteString(command.Type + "\n"); err != nil {
-					log.Fatal(err)
-				}
-
-				// Write the file name for the command to the childs stdout.
-				if _, err := w.WriteString(command.Name + "\n"); err != nil {
-					log.Fatal(err)
-				}
-
-				// Write the number of bytes of data to the childs stdout.
-				if _, err := w.WriteString(strconv.Itoa(len(command.Data)) + "\n"); err != nil {
+				// Write the command to the childs stdout.
+				if err := writeCommand(w, command); err != nil {
 					log.Fatal(err)
 				}
-				// Flush the writer to ensure the command is sent.
-				if err := w.Flush(); err != nil {
-					log.Fatal(err)
-				}
-
-				// Write the data to the childs stdout.
-				if _, err := os.Stdout.Write(command.Data); err != nil {
-					log.Fatal(err)
+				if command.Type == cmdTerminated {
+					close(terminateAcked)
 				}
 
 			case <-time.After(10 * time.Second):
@@ -341,13 +479,19 @@ func initChild() {
 	manager := &autocert.Manager{
 		Cache:       DirCache(""),
 		Prompt:      autocert.AcceptTOS,
-		HostPolicy:  autocert.HostWhitelist(config.letsEncryptDomains...),
+		HostPolicy:  letsEncryptHostPolicy,
 		RenewBefore: config.CertificateExpiryRefreshThreshold + 24*time.Hour, // This way, RenewBefore is always longer than the certificate expiry timeout when the server terminates.
 		Email:       "admin-le@14.gy",                                        // TODO
-		// Use staging server
-		// Client: &acme.Client{
-		// 	DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
-		// },
+		Client: &acme.Client{
+			DirectoryURL: config.AcmeDirectoryURL,
+			HTTPClient:   certHTTPClient(0), // The requests are limited by their contexts.
+		},
+		ExternalAccountBinding: acmeExternalAccountBinding(),
+	}
+
+	// Request certificates with the OCSP Must-Staple extension.
+	if config.OcspMustStaple {
+		manager.ExtraExtensions = []pkix.Extension{mustStapleExtension}
 	}
 
 	// Initialize (fill) the white list and the cert cache.
@@ -368,5 +512,8 @@ func initChild() {
 		log.Fatal(err)
 	}
 
+	// Start the chaos hooks, if enabled.
+	startChaos()
+
 	runServer(manager)
 }
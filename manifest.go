@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"matscheko.eu/sslserver/filecache"
+)
+
+// The files of a domain with a manifest are only served if their SHA-256 matches the manifest. The manifest is a
+// file in the domain directory in the format of sha256sum, and "<manifest>.sig" contains its base64 encoded Ed25519
+// signature. The files are verified before they are kept in memory (and minified), whenever they are read again from
+// disk, and files that are too large to be cached are verified before they are served. The hash of a large file is
+// only computed again if its inode, size, or modification time changed. So if the web root is modified, only the
+// content that was signed with the key of the operator is served, except for a large file that is overwritten in
+// place while it is served, or whose modification time is set back after it was overwritten.
+
+// domainManifest is the verified manifest of a domain.
+type domainManifest struct {
+	modTime    time.Time         // Modification time of the manifest file
+	sigModTime time.Time         // Modification time of the signature file
+	hashes     map[string]string // Hex encoded SHA-256 by URL path
+	err        error             // Why the manifest can not be used
+}
+
+var manifests = map[string]*domainManifest{}
+var manifestsMu sync.Mutex
+
+// verifiedLargeFile is the hash of a large file that was computed when it was verified.
+type verifiedLargeFile struct {
+	info fs.FileInfo // Of the file when it was hashed, to compare the inode, the size, and the modification time
+	hash string      // Hex encoded SHA-256
+}
+
+// The verified large files by cache key.
+var verifiedLargeFiles = map[string]verifiedLargeFile{}
+var verifiedLargeFilesMu sync.Mutex
+
+// isValidManifestPublicKey returns true if the key is a base64 encoded Ed25519 public key.
+func isValidManifestPublicKey(key string) bool {
+	data, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(data) == ed25519.PublicKeySize
+}
+
+// isManifestFile returns true if the URL path is the manifest or its signature, which are not listed in the manifest.
+func isManifestFile(settings domainSettings, urlPath string) bool {
+	return urlPath == settings.manifest || urlPath == settings.manifest+".sig"
+}
+
+// loadManifest returns the manifest of the domain. It is read again if the manifest or its signature changed.
+// If they can not be read anymore (e.g. in the jail), the manifest that was read before is used.
+func loadManifest(domain string, settings domainSettings) *domainManifest {
+	manifestName := domain + settings.manifest
+	manifestInfo, err := fs.Stat(webFiles.Origin, manifestName)
+	sigInfo, sigErr := fs.Stat(webFiles.Origin, manifestName+".sig")
+
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	loaded := manifests[domain]
+	if err != nil || sigErr != nil {
+		if loaded != nil {
+			return loaded
+		}
+		return &domainManifest{err: errors.New("the manifest or its signature can not be read")}
+	}
+	if loaded != nil && loaded.modTime.Equal(manifestInfo.ModTime()) && loaded.sigModTime.Equal(sigInfo.ModTime()) {
+		return loaded
+	}
+
+	loaded = &domainManifest{modTime: manifestInfo.ModTime(), sigModTime: sigInfo.ModTime()}
+	loaded.hashes, loaded.err = readManifest(manifestName, settings.manifestPublicKey)
+	manifests[domain] = loaded
+	return loaded
+}
+
+// readManifest reads the manifest, verifies its signature, and returns the hashes by URL path.
+func readManifest(manifestName, publicKey string) (map[string]string, error) {
+	data, err := fs.ReadFile(webFiles.Origin, manifestName)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := fs.ReadFile(webFiles.Origin, manifestName+".sig")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	key, _ := base64.StdEncoding.DecodeString(publicKey)
+	if !ed25519.Verify(key, data, sig) {
+		return nil, errors.New("the signature of the manifest is not valid")
+	}
+
+	// Each line contains the hash and the path relative to the domain directory, e.g. "<hash>  ./index.html".
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		hash, name := strings.ToLower(fields[0]), strings.TrimLeft(fields[1], " *")
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid hash in the manifest: %s", fields[0])
+		}
+		hashes[path.Clean("/"+strings.TrimPrefix(name, "./"))] = hash
+	}
+	return hashes, scanner.Err()
+}
+
+// checkManifest returns an error if the hex encoded hash of the file with the URL path does not match the manifest.
+func checkManifest(domain string, settings domainSettings, urlPath, hash string) error {
+	manifest := loadManifest(domain, settings)
+	if manifest.err != nil {
+		return fmt.Errorf("manifest of %s: %v", domain, manifest.err)
+	}
+	expected, ok := manifest.hashes[urlPath]
+	if !ok {
+		return fmt.Errorf("%s%s is not in the manifest", domain, urlPath)
+	}
+	if expected != hash {
+		return fmt.Errorf("%s%s does not match the manifest", domain, urlPath)
+	}
+	return nil
+}
+
+// verifyManifest verifies the content of the file with the cache key, if its domain has a manifest.
+// It is used by the cache before the file is kept in memory.
+func verifyManifest(name string, data []byte) error {
+	parts := strings.SplitN(name, "/", 2)
+	settings := settingsForDomain(parts[0])
+	if settings.manifest == "" || len(parts) != 2 || isManifestFile(settings, "/"+parts[1]) {
+		return nil
+	}
+	hash := sha256.Sum256(data)
+	return checkManifest(parts[0], settings, "/"+parts[1], hex.EncodeToString(hash[:]))
+}
+
+// verifyLargeFile verifies a file that is too large to be kept in memory before it is served, if its domain has a
+// manifest. The hash of the open file is reused while its inode, size, and modification time do not change, so that
+// large files and their range requests are not read twice. Otherwise the file is hashed and rewound.
+func verifyLargeFile(domain, urlPath string, entry filecache.Entry) error {
+	settings := settingsForDomain(domain)
+	if settings.manifest == "" || entry.File == nil || isManifestFile(settings, urlPath) {
+		return nil
+	}
+	info, err := entry.File.Stat()
+	if err != nil {
+		return err
+	}
+	name := domain + urlPath
+	verifiedLargeFilesMu.Lock()
+	verified, ok := verifiedLargeFiles[name]
+	verifiedLargeFilesMu.Unlock()
+	if ok && sameFileVersion(verified.info, info) {
+		// The manifest is checked again, because it can have changed.
+		return checkManifest(domain, settings, urlPath, verified.hash)
+	}
+
+	seeker, ok := entry.File.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("%s%s can not be verified", domain, urlPath)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, entry.File); err != nil {
+		return err
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	verified = verifiedLargeFile{info: info, hash: hex.EncodeToString(hash.Sum(nil))}
+	if err := checkManifest(domain, settings, urlPath, verified.hash); err != nil {
+		verifiedLargeFilesMu.Lock()
+		delete(verifiedLargeFiles, name)
+		verifiedLargeFilesMu.Unlock()
+		return err
+	}
+
+	// Only keep the hash if the file did not change while it was hashed.
+	if after, err := entry.File.Stat(); err == nil && sameFileVersion(info, after) {
+		verifiedLargeFilesMu.Lock()
+		verifiedLargeFiles[name] = verified
+		verifiedLargeFilesMu.Unlock()
+	}
+	return nil
+}
+
+// sameFileVersion returns true if both infos are of the same file (the same inode) with the same size and
+// modification time.
+func sameFileVersion(a, b fs.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"matscheko.eu/sslserver/filecache"
+)
+
+// countingFile counts the reads of a file.
+type countingFile struct {
+	fs.File
+	reads int
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	f.reads++
+	return f.File.Read(p)
+}
+
+func (f *countingFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+// TestVerifyLargeFile checks that a large file is only hashed again after it changed, and that a changed file does
+// not pass the manifest.
+func TestVerifyLargeFile(t *testing.T) {
+	large := make([]byte, 1<<20)
+	rand.Read(large)
+	hash := sha256.Sum256(large)
+	manifest := []byte(hex.EncodeToString(hash[:]) + "  ./large.bin\n")
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifest)))
+	s := newE2EServer(t, map[string][]byte{
+		"localhost/large.bin":           large,
+		"localhost/manifest.sha256":     manifest,
+		"localhost/manifest.sha256.sig": sig,
+	})
+	manifestPath, key := "/manifest.sha256", base64.StdEncoding.EncodeToString(publicKey)
+	config.Domains = map[string]DomainConfig{"localhost": {Manifest: &manifestPath, ManifestPublicKey: &key}}
+	t.Cleanup(func() {
+		verifiedLargeFilesMu.Lock()
+		delete(verifiedLargeFiles, "localhost/large.bin")
+		verifiedLargeFilesMu.Unlock()
+	})
+
+	verify := func() (int, error) {
+		t.Helper()
+		f, err := webFiles.Origin.Open("localhost/large.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		file := &countingFile{File: f}
+		err = verifyLargeFile("localhost", "/large.bin", filecache.Entry{File: file})
+		return file.reads, err
+	}
+
+	if reads, err := verify(); err != nil || reads == 0 {
+		t.Fatalf("first verification: %d reads, %v, want the file to be hashed", reads, err)
+	}
+	if reads, err := verify(); err != nil || reads != 0 {
+		t.Errorf("second verification: %d reads, %v, want the hash to be reused", reads, err)
+	}
+
+	// A file that was overwritten with the same size is hashed again and rejected.
+	path := filepath.Join(s.webRoot, "localhost", "large.bin")
+	large[0]++
+	if err := os.WriteFile(path, large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if reads, err := verify(); err == nil || reads == 0 {
+		t.Errorf("changed file: %d reads, %v, want it to be hashed and rejected", reads, err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"strings"
+)
+
+// The files of domains with minify are minified when they are read into the memory cache: comments and unneeded
+// white space are removed from HTML, CSS, and JavaScript. The minification is conservative, so that it can not
+// change what the files do: line breaks in JavaScript are kept because of the automatic semicolon insertion, white
+// space in HTML text is collapsed instead of removed, and the contents of <pre> and <textarea> are not changed.
+// Comments that start with "/*!" (e.g. licenses) are kept. If a file can not be parsed (e.g. because of an
+// unterminated string or comment), it is served unchanged.
+
+// minifyFile minifies the content of a file of the cache, if minify is enabled for its domain and the file is
+// HTML, CSS, or JavaScript.
+func minifyFile(name string, data []byte) []byte {
+	if !settingsForDomain(strings.SplitN(name, "/", 2)[0]).minify {
+		return data
+	}
+
+	var minified []byte
+	var ok bool
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm":
+		minified, ok = minifyHTML(data)
+	case ".css":
+		minified, ok = minifyCSS(data)
+	case ".js", ".mjs":
+		minified, ok = minifyJS(data)
+	default:
+		return data
+	}
+	if !ok {
+		log.Println("Could not minify, serving the file unchanged:", name)
+		return data
+	}
+	return minified
+}
+
+// isMinifySpace returns true for the white space characters of HTML, CSS, and JavaScript source code.
+func isMinifySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// quotedEnd returns the index of the quote that ends the string that starts at data[start], or -1.
+// Strings can not contain unescaped line breaks.
+func quotedEnd(data []byte, start int) int {
+	quote := data[start]
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '\n':
+			return -1
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// minifyCSS removes the comments and the unneeded white space from a style sheet.
+func minifyCSS(data []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(data))
+	space := false
+
+	// The white space is removed after these characters, and before the characters of spaceBefore. It is kept
+	// before ":" (e.g. in "a :hover") and "(" (e.g. in "and (min-width: 1px)"), where it changes the meaning.
+	const spaceAfter, spaceBefore = "{};,:>(", "{};,>)"
+	emit := func(data ...byte) {
+		if space && len(out) > 0 && !strings.ContainsRune(spaceAfter, rune(out[len(out)-1])) && !strings.ContainsRune(spaceBefore, rune(data[0])) {
+			out = append(out, ' ')
+		}
+		space = false
+		out = append(out, data...)
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, false
+			}
+			end += i + 4
+			if i+2 < len(data) && data[i+2] == '!' {
+				emit(data[i:end]...)
+			} else {
+				// A comment separates the tokens like white space.
+				space = true
+			}
+			i = end - 1
+		case c == '"' || c == '\'':
+			end := quotedEnd(data, i)
+			if end < 0 {
+				return nil, false
+			}
+			emit(data[i : end+1]...)
+			i = end
+		case isMinifySpace(c):
+			space = true
+		case c == '}' && len(out) > 0 && out[len(out)-1] == ';':
+			// The last declaration of a block does not need a semicolon.
+			out[len(out)-1] = '}'
+			space = false
+		default:
+			emit(c)
+		}
+	}
+	return out, true
+}
+
+// jsRegexpKeywords are the keywords after which a "/" starts a regular expression instead of a division.
+var jsRegexpKeywords = []string{"return", "typeof", "case", "do", "else", "in", "of", "new", "delete", "void", "throw", "yield", "await", "instanceof"}
+
+// isJSWordChar returns true for the characters of identifiers, keywords, and numbers.
+func isJSWordChar(c byte) bool {
+	return c == '_' || c == '$' || c == '\\' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// jsRegexpAllowed returns true if a "/" after the minified code starts a regular expression.
+func jsRegexpAllowed(out []byte) bool {
+	end := len(out)
+	for end > 0 && isMinifySpace(out[end-1]) {
+		end--
+	}
+	if end == 0 {
+		return true
+	}
+	if !isJSWordChar(out[end-1]) {
+		return out[end-1] != ')' && out[end-1] != ']'
+	}
+	start := end
+	for start > 0 && isJSWordChar(out[start-1]) {
+		start--
+	}
+	word := string(out[start:end])
+	for _, keyword := range jsRegexpKeywords {
+		if word == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// minifyJS removes the comments and the unneeded white space from a script. Line breaks are kept, because they
+// can end statements.
+func minifyJS(data []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(data))
+	space, newline := false, false
+
+	// The brace depths at which the expressions (${...}) of the open template literals started.
+	var templates []int
+	depth := 0
+
+	emit := func(data ...byte) {
+		if len(out) > 0 {
+			prev, next := out[len(out)-1], data[0]
+			switch {
+			case newline:
+				out = append(out, '\n')
+			case space && isJSWordChar(prev) && isJSWordChar(next):
+				out = append(out, ' ')
+			case space && strings.IndexByte("+-/.", prev) >= 0 && strings.IndexByte("+-/.", next) >= 0:
+				// E.g. "a + +b", "a - -b", or "1 .toString()".
+				out = append(out, ' ')
+			case space && (prev == '.' || next == '.') && (isJSWordChar(prev) || isJSWordChar(next)):
+				out = append(out, ' ')
+			}
+		}
+		space, newline = false, false
+		out = append(out, data...)
+	}
+
+	// template copies the text of a template literal from data[start] (the "`" at its start or the "}" at the end
+	// of an expression) until its end or the start of the next expression, and returns the index of the last
+	// copied character.
+	template := func(start int) int {
+		for i := start + 1; i < len(data); i++ {
+			switch {
+			case data[i] == '\\':
+				i++
+			case data[i] == '`':
+				emit(data[start : i+1]...)
+				return i
+			case data[i] == '$' && i+1 < len(data) && data[i+1] == '{':
+				emit(data[start : i+2]...)
+				templates = append(templates, depth)
+				return i + 1
+			}
+		}
+		return -1
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			space = true
+			i += end - 1
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, false
+			}
+			end += i + 4
+			if i+2 < len(data) && data[i+2] == '!' {
+				emit(data[i:end]...)
+			} else {
+				// A comment with a line break can end a statement like a line break.
+				space = true
+				newline = newline || bytes.IndexByte(data[i:end], '\n') >= 0
+			}
+			i = end - 1
+		case c == '/' && jsRegexpAllowed(out):
+			// Copy the regular expression. A "/" in a character class does not end it.
+			end, class := -1, false
+			for j := i + 1; j < len(data) && end < 0; j++ {
+				switch data[j] {
+				case '\\':
+					j++
+				case '\n':
+					return nil, false
+				case '[':
+					class = true
+				case ']':
+					class = false
+				case '/':
+					if !class {
+						end = j
+					}
+				}
+			}
+			if end < 0 {
+				return nil, false
+			}
+			emit(data[i : end+1]...)
+			i = end
+		case c == '"' || c == '\'':
+			end := quotedEnd(data, i)
+			if end < 0 {
+				return nil, false
+			}
+			emit(data[i : end+1]...)
+			i = end
+		case c == '`':
+			if i = template(i); i < 0 {
+				return nil, false
+			}
+		case c == '{':
+			depth++
+			emit(c)
+		case c == '}' && len(templates) > 0 && templates[len(templates)-1] == depth:
+			// The end of the expression of a template literal.
+			templates = templates[:len(templates)-1]
+			if i = template(i); i < 0 {
+				return nil, false
+			}
+		case c == '}':
+			depth--
+			emit(c)
+		case isMinifySpace(c):
+			space = true
+			newline = newline || c == '\n'
+		default:
+			emit(c)
+		}
+	}
+	if len(templates) > 0 {
+		return nil, false
+	}
+	return out, true
+}
+
+// minifyHTML removes the comments from an HTML document and collapses the white space outside of the tags.
+// The contents of <script> and <style> are minified as JavaScript and CSS, and the contents of <pre> and
+// <textarea> are kept unchanged.
+func minifyHTML(data []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(data))
+	space, newline := false, false
+	emit := func(data ...byte) {
+		if newline && len(out) > 0 {
+			out = append(out, '\n')
+		} else if space && len(out) > 0 {
+			out = append(out, ' ')
+		}
+		space, newline = false, false
+		out = append(out, data...)
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case bytes.HasPrefix(data[i:], []byte("<!--")):
+			end := bytes.Index(data[i+4:], []byte("-->"))
+			if end < 0 {
+				return nil, false
+			}
+			end += i + 7
+			// Conditional comments of old Internet Explorers are kept.
+			if bytes.HasPrefix(data[i:], []byte("<!--[if")) || bytes.HasPrefix(data[i:], []byte("<!--<![endif")) {
+				emit(data[i:end]...)
+			}
+			i = end - 1
+		case c == '<' && i+1 < len(data) && (data[i+1] == '/' || data[i+1] == '!' || isJSWordChar(data[i+1])):
+			// Copy the tag with its attributes unchanged. A ">" in a quoted attribute value does not end it.
+			end, quote := -1, byte(0)
+			for j := i + 1; j < len(data) && end < 0; j++ {
+				switch {
+				case quote != 0:
+					if data[j] == quote {
+						quote = 0
+					}
+				case data[j] == '"' || data[j] == '\'':
+					quote = data[j]
+				case data[j] == '>':
+					end = j
+				}
+			}
+			if end < 0 {
+				return nil, false
+			}
+			tag := data[i : end+1]
+			emit(tag...)
+			i = end
+
+			// Elements with raw text or preformatted text.
+			name := strings.ToLower(string(tag[1:]))
+			if n := strings.IndexFunc(name, func(r rune) bool { return !isJSWordChar(byte(r)) }); n >= 0 {
+				name = name[:n]
+			}
+			if name != "script" && name != "style" && name != "pre" && name != "textarea" {
+				continue
+			}
+			closing := bytes.Index(bytes.ToLower(data[end+1:]), []byte("</"+name))
+			if closing < 0 {
+				return nil, false
+			}
+			content := data[end+1 : end+1+closing]
+			minified, ok := content, true
+			switch {
+			case name == "style":
+				minified, ok = minifyCSS(content)
+			case name == "script" && isJavaScriptTag(string(tag)):
+				minified, ok = minifyJS(content)
+			}
+			if !ok {
+				minified = content
+			}
+			out = append(out, minified...)
+			i = end + closing
+		case isMinifySpace(c):
+			space = true
+			newline = newline || c == '\n'
+		default:
+			emit(c)
+		}
+	}
+	return out, true
+}
+
+// isJavaScriptTag returns true if the script tag contains JavaScript, and not e.g. JSON or a template.
+func isJavaScriptTag(tag string) bool {
+	tag = strings.ToLower(tag)
+	n := strings.Index(tag, "type=")
+	if n < 0 {
+		return true
+	}
+	scriptType := strings.Trim(strings.Fields(tag[n+len("type="):] + " ")[0], `"'>/`)
+	return scriptType == "" || scriptType == "module" || strings.Contains(scriptType, "javascript") || strings.Contains(scriptType, "ecmascript")
+}
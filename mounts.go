@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// A domain can compose its content from several directories of the web root with mounts, e.g. /assets/ from a
+// directory that is shared by several domains, so that the files are not duplicated. The mounted directories are
+// merged into the directory of the domain in the file cache: a file is looked up in the mount with the longest
+// matching URL path first, then in the mounts with shorter URL paths, and last in the directory of the domain. The
+// mounted directories must be inside the web root, because the child can only read the web root in the jail.
+// Directories of the web root whose names start with "_" are not domains, so they can hold the shared content.
+
+// Mount serves the files of a directory of the web root under a URL path of the domain.
+type Mount struct {
+	// URL path of a directory, e.g. "/assets/".
+	Path string `yaml:"path"`
+
+	// Directory relative to the web root, e.g. "_shared/assets".
+	Directory string `yaml:"directory"`
+}
+
+// checkMounts returns an error if the URL path or the directory of a mount is invalid, and sorts the mounts by the
+// length of their URL paths, the longest first.
+func checkMounts(mounts []Mount) error {
+	for _, mount := range mounts {
+		if !matchDirectoryPath(mount.Path) || mount.Path == "/" {
+			return fmt.Errorf("the path '%s' must be the URL path of a directory, e.g. /assets/", mount.Path)
+		}
+		if !fs.ValidPath(mount.Directory) || mount.Directory == "." {
+			return fmt.Errorf("the directory '%s' of '%s' must be a path relative to the web root", mount.Directory, mount.Path)
+		}
+	}
+	sort.SliceStable(mounts, func(i, j int) bool { return len(mounts[i].Path) > len(mounts[j].Path) })
+	return nil
+}
+
+// isDomainDirectoryName returns false for the directories of the web root that are not domains.
+func isDomainDirectoryName(name string) bool {
+	return !strings.HasPrefix(name, "_")
+}
+
+// mountFS is the web root with the mounts of the domains merged into the directories of the domains.
+type mountFS struct {
+	fs.FS
+}
+
+// mountSources returns the names in the web root of the file with the name (e.g. "example.com/assets/app.js") in
+// the order of precedence. The name itself is the last one.
+func (m mountFS) mountSources(name string) []string {
+	domain, rest, _ := strings.Cut(name, "/")
+	if directory, ok := rolloutDirectory(domain); ok {
+		// The new content version of a rollout is in another directory.
+		name = directory
+		if rest != "" {
+			name += "/" + rest
+		}
+	}
+	var sources []string
+	for _, mount := range settingsForDomain(domain).mounts {
+		prefix := strings.Trim(mount.Path, "/")
+		if rest == prefix {
+			sources = append(sources, mount.Directory)
+		} else if strings.HasPrefix(rest, prefix+"/") {
+			sources = append(sources, mount.Directory+rest[len(prefix):])
+		}
+	}
+	return append(sources, name)
+}
+
+// Open opens the file from the first source that has it.
+func (m mountFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	var err error
+	for _, source := range m.mountSources(name) {
+		var f fs.File
+		f, err = m.FS.Open(source)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, err
+}
+
+// ReadDir returns the merged entries of the directory in all sources, and the directories of the mounts in it. The
+// directories of the web root that are not domains are left out.
+func (m mountFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == "." {
+		entries, err := fs.ReadDir(m.FS, name)
+		domains := entries[:0]
+		for _, entry := range entries {
+			if isDomainDirectoryName(entry.Name()) {
+				domains = append(domains, entry)
+			}
+		}
+		// Add the virtual domains of the new content versions of the rollouts.
+		for domain := range config.Domains {
+			directory, ok := rolloutDirectory(domain + rolloutDomainSuffix)
+			if info, statErr := fs.Stat(m.FS, directory); ok && statErr == nil && info.IsDir() {
+				domains = append(domains, renamedDirEntry{fs.FileInfoToDirEntry(info), domain + rolloutDomainSuffix})
+			}
+		}
+		sort.Slice(domains, func(i, j int) bool { return domains[i].Name() < domains[j].Name() })
+		return domains, err
+	}
+
+	merged := map[string]fs.DirEntry{}
+	sources := m.mountSources(name)
+	var lastErr error
+	found := false
+	// The sources with the lowest precedence are read first, so that the others replace their entries.
+	for i := len(sources) - 1; i >= 0; i-- {
+		entries, err := fs.ReadDir(m.FS, sources[i])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = true
+		for _, entry := range entries {
+			merged[entry.Name()] = entry
+		}
+	}
+
+	// Add the mounts that are directly in this directory, e.g. "assets" for the mount /assets/ in "example.com".
+	domain, rest, _ := strings.Cut(name, "/")
+	for _, mount := range settingsForDomain(domain).mounts {
+		parent, mountName := pathParent(strings.Trim(mount.Path, "/"))
+		if parent != rest {
+			continue
+		}
+		if info, err := fs.Stat(m.FS, mount.Directory); err == nil && info.IsDir() {
+			found = true
+			merged[mountName] = renamedDirEntry{fs.FileInfoToDirEntry(info), mountName}
+		}
+	}
+
+	if !found {
+		return nil, lastErr
+	}
+	entries := make([]fs.DirEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// pathParent splits a slash separated path into its parent ("" for the top level) and its last element.
+func pathParent(p string) (string, string) {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return "", p
+}
+
+// renamedDirEntry is a directory entry with another name, for a mount or a rollout whose directory has another name.
+type renamedDirEntry struct {
+	fs.DirEntry
+	name string
+}
+
+// Name returns the name of the mount.
+func (e renamedDirEntry) Name() string {
+	return e.name
+}
+
+// webRootSource returns the name in the web root of the file or directory with the name (e.g.
+// "example.com/index.php"), with the mounts and the rollout of its domain, e.g. for programs outside of the jail.
+func webRootSource(name string) string {
+	m, ok := webFiles.Origin.(mountFS)
+	if !ok {
+		return name
+	}
+	sources := m.mountSources(name)
+	for _, source := range sources {
+		if _, err := fs.Stat(m.FS, source); err == nil {
+			return source
+		}
+	}
+	return sources[len(sources)-1]
+}
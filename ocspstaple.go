@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// The child staples OCSP responses to the certificates of CAs that have an OCSP responder. The responses are
+// fetched in the background and refreshed after half of their validity, so that handshakes do not wait for the
+// responder. Certificates with the OCSP Must-Staple extension are only served with a valid staple. If there is
+// none yet, the handshake waits for the responder, and fails if the responder does not answer with "good".
+
+// mustStapleExtension is the TLS Feature extension (RFC 7633) with the status_request feature.
+var mustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+}
+
+// ocspFetchTimeout is the maximum duration of a request to the OCSP responder.
+const ocspFetchTimeout = 10 * time.Second
+
+// ocspStaple is a verified OCSP response of a certificate.
+type ocspStaple struct {
+	response   []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+var ocspStaples = make(map[[32]byte]*ocspStaple)
+var ocspFetches = make(map[[32]byte]chan struct{})
+var ocspMu sync.Mutex
+
+// hasMustStaple returns true if the certificate has the OCSP Must-Staple extension.
+func hasMustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(mustStapleExtension.Id) && bytes.Equal(ext.Value, mustStapleExtension.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificateWithStaple is the GetCertificate callback of the HTTPS server.
+// It returns the certificate of MyGetCertificate with the OCSP staple.
+func getCertificateWithStaple(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := MyGetCertificate(hello)
+	if err != nil || cert == nil || len(cert.Certificate) == 0 {
+		return cert, err
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("certificate: error parsing certificate: %v", err)
+		}
+	}
+	mustStaple := hasMustStaple(leaf)
+	if !config.OcspStapling && !mustStaple {
+		return cert, nil
+	}
+
+	staple := ocspStapleFor(cert, leaf, mustStaple)
+	if staple == nil {
+		if mustStaple {
+			return nil, fmt.Errorf("certificate: refusing to serve the must-staple certificate of %s without a valid OCSP staple", hello.ServerName)
+		}
+		return cert, nil
+	}
+
+	// The certificate is shared between handshakes, so the staple is set on a copy.
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	return &stapled, nil
+}
+
+// ocspStapleFor returns the valid OCSP response of the certificate, or nil if there is none.
+// Missing and aging responses are fetched in the background, or right away if wait is set.
+func ocspStapleFor(cert *tls.Certificate, leaf *x509.Certificate, wait bool) []byte {
+	if len(leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return nil
+	}
+	key := sha256.Sum256(cert.Certificate[0])
+	now := time.Now()
+
+	ocspMu.Lock()
+	staple := ocspStaples[key]
+	valid := staple != nil && now.Before(staple.nextUpdate)
+	refresh := !valid || now.After(staple.thisUpdate.Add(staple.nextUpdate.Sub(staple.thisUpdate)/2))
+	done, fetching := ocspFetches[key]
+	if refresh && !fetching {
+		done = make(chan struct{})
+		ocspFetches[key] = done
+		go fetchOCSPStaple(key, cert.Certificate, done)
+	}
+	ocspMu.Unlock()
+
+	if valid {
+		return staple.response
+	}
+	if !wait {
+		return nil
+	}
+
+	<-done
+	ocspMu.Lock()
+	defer ocspMu.Unlock()
+	if staple := ocspStaples[key]; staple != nil && time.Now().Before(staple.nextUpdate) {
+		return staple.response
+	}
+	return nil
+}
+
+// fetchOCSPStaple asks the OCSP responder for the status of the certificate and stores a good response.
+func fetchOCSPStaple(key [32]byte, chain [][]byte, done chan struct{}) {
+	defer func() {
+		ocspMu.Lock()
+		delete(ocspFetches, key)
+		ocspMu.Unlock()
+		close(done)
+	}()
+
+	staple, err := requestOCSPStaple(chain)
+	if err != nil {
+		log.Println("certificate: could not get OCSP staple:", err)
+		return
+	}
+
+	ocspMu.Lock()
+	defer ocspMu.Unlock()
+	// Remove the expired responses, e.g. of renewed certificates.
+	for k, s := range ocspStaples {
+		if time.Now().After(s.nextUpdate) {
+			delete(ocspStaples, k)
+		}
+	}
+	ocspStaples[key] = staple
+}
+
+// requestOCSPStaple requests and verifies the OCSP response for the leaf certificate of the chain.
+func requestOCSPStaple(chain [][]byte) (*ocspStaple, error) {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		return nil, err
+	}
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := certHTTPClient(ocspFetchTimeout).Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("OCSP responder %s answered with status %s", leaf.OCSPServer[0], resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(data, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if response.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP status of the certificate for %v is not good: %d", leaf.DNSNames, response.Status)
+	}
+	if response.NextUpdate.IsZero() || !time.Now().Before(response.NextUpdate) {
+		return nil, errors.New("OCSP response has no valid next update")
+	}
+	return &ocspStaple{response: data, thisUpdate: response.ThisUpdate, nextUpdate: response.NextUpdate}, nil
+}
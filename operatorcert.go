@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"time"
+)
+
+// Operators can provide certificates for domains as PEM files (cert-file and key-file), e.g. certificates of an
+// internal CA. The parent reads the files, so they do not have to be inside the jail, and pushes the certificates
+// to the child. The child prefers them over Let's Encrypt and self-signed certificates while they are valid.
+
+// operatorCerts holds the operator-provided certificates per (ASCII) domain in the child. It is guarded by certCacheMu.
+var operatorCerts = map[string]*tls.Certificate{}
+
+// operatorCertificate returns the operator-provided certificate for the domain, if there is one and it is valid.
+func operatorCertificate(domain string) *tls.Certificate {
+	certCacheMu.Lock()
+	cert := operatorCerts[domain]
+	certCacheMu.Unlock()
+	if cert == nil {
+		return nil
+	}
+	if !certValidAt(cert.Leaf, time.Now()) {
+		log.Printf("certificate: operator-provided certificate for %s is not valid, falling back", domain)
+		return nil
+	}
+	return cert
+}
+
+// receiveOperatorCertificate stores an operator-provided certificate that the parent has pushed.
+func receiveOperatorCertificate(domain string, data []byte) {
+	// The data contains the private key and the certificate chain as PEM blocks.
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		log.Println("Operator-provided certificate is invalid:", domain, err)
+		return
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Println("Operator-provided certificate is invalid:", domain, err)
+		return
+	}
+
+	certCacheMu.Lock()
+	operatorCerts[domain] = &cert
+	certCacheMu.Unlock()
+	log.Println("Operator-provided certificate set for:", domain)
+}
+
+// watchOperatorCertificates sends the operator-provided certificates to the child, and sends them again
+// whenever the files change. The files are checked every certificate-push-interval.
+func watchOperatorCertificates() {
+	modTimes := map[string]time.Time{}
+	push := func() {
+		for domain, d := range config.Domains {
+			if d.CertFile == nil || d.KeyFile == nil {
+				continue
+			}
+			pushOperatorCertificate(domain, *d.CertFile, *d.KeyFile, modTimes)
+		}
+	}
+
+	push()
+	jobs.every(jobOperatorCertificates, config.CertificatePushInterval, push)
+}
+
+// pushOperatorCertificate sends the certificate to the child, if one of its files has changed since the last push.
+func pushOperatorCertificate(domain, certFile, keyFile string, modTimes map[string]time.Time) {
+	changed := false
+	for _, file := range []string{certFile, keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Println("Could not read operator-provided certificate for", domain+":", err)
+			return
+		}
+		if !modTimes[file].Equal(info.ModTime()) {
+			changed = true
+		}
+		modTimes[file] = info.ModTime()
+	}
+	if !changed {
+		return
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		log.Println("Could not read operator-provided certificate for", domain+":", err)
+		return
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Println("Could not read operator-provided key for", domain+":", err)
+		return
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		log.Println("Operator-provided certificate and key for", domain, "do not match:", err)
+		return
+	}
+
+	log.Println("Pushing operator-provided certificate to child:", domain)
+	parentToChildCh <- Command{Type: cmdOperatorCertificate, Name: domain, Data: append(keyPEM, certPEM...)}
+}
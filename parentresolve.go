@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With resolve-through-parent, the child does not resolve host names itself, because the jail usually has no
+// resolv.conf. It sends the host name to the parent, which resolves it with the resolver of the certificate
+// subsystem and answers with the addresses. The child caches the answers, and concurrent lookups of the same
+// name wait for the same answer.
+
+// resolveNegativeCacheDuration is the time for which failed lookups are cached, so that the child does not ask
+// the parent for a failing name on every connection.
+const resolveNegativeCacheDuration = 10 * time.Second
+
+// maxResolveAddresses is the maximum number of addresses in an answer of the parent.
+const maxResolveAddresses = 32
+
+// resolveAnswer is the answer of the parent for a host name. It can be read when done is closed.
+type resolveAnswer struct {
+	ips       []net.IPAddr
+	err       error
+	requested time.Time
+	expires   time.Time
+	done      chan struct{}
+}
+
+var resolveAnswers = map[string]*resolveAnswer{}
+var resolveMu sync.Mutex
+
+// resolveThroughParentEnabled returns true if the child resolves host names through the parent.
+func resolveThroughParentEnabled() bool {
+	return isChild && config.ResolveThroughParent
+}
+
+// answered returns true if the answer of the parent has arrived.
+func (a *resolveAnswer) answered() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveThroughParent returns the addresses of the host, which are resolved by the parent. It is called in the child.
+func resolveThroughParent(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// Ask the parent if there is no valid answer, and no request that can still be answered.
+	now := time.Now()
+	resolveMu.Lock()
+	answer := resolveAnswers[host]
+	if answer == nil || (answer.answered() && now.After(answer.expires)) || (!answer.answered() && now.Sub(answer.requested) > config.CertDnsTimeout+5*time.Second) {
+		answer = &resolveAnswer{requested: now, done: make(chan struct{})}
+		resolveAnswers[host] = answer
+		resolveMu.Unlock()
+		childToParentCh <- Command{Type: cmdResolve, Name: host}
+	} else {
+		resolveMu.Unlock()
+	}
+
+	select {
+	case <-answer.done:
+		return answer.ips, answer.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timeout while resolving %s through the parent", host)
+	}
+}
+
+// receiveResolveAnswer stores the answer of the parent for the host name and wakes up the waiting lookups.
+// It is called in the child.
+func receiveResolveAnswer(host string, data []byte) {
+	var ips []net.IPAddr
+	var err error
+	if text := string(data); strings.HasPrefix(text, "error:") {
+		err = errors.New(strings.TrimSpace(strings.TrimPrefix(text, "error:")))
+	} else {
+		for _, line := range strings.Split(text, "\n") {
+			if ip := net.ParseIP(line); ip != nil && len(ips) < maxResolveAddresses {
+				ips = append(ips, net.IPAddr{IP: ip})
+			}
+		}
+		if len(ips) == 0 {
+			err = errors.New("no addresses found for " + host)
+		}
+	}
+
+	now := time.Now()
+	resolveMu.Lock()
+	defer resolveMu.Unlock()
+
+	// Remove the expired answers, e.g. of names that are not used anymore.
+	for name, a := range resolveAnswers {
+		if a.answered() && now.After(a.expires) {
+			delete(resolveAnswers, name)
+		}
+	}
+
+	answer := resolveAnswers[host]
+	if answer == nil || answer.answered() {
+		return
+	}
+	answer.ips, answer.err = ips, err
+	answer.expires = now.Add(config.ResolveCacheDuration)
+	if err != nil {
+		answer.expires = now.Add(resolveNegativeCacheDuration)
+	}
+	close(answer.done)
+}
+
+// answerResolve resolves the host name for the child and sends the addresses, or the error, to the child.
+// It is called in the parent.
+func answerResolve(host string) {
+	data := []byte{}
+	if !validResolveName(host) {
+		data = []byte("error: invalid host name")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), config.CertDnsTimeout)
+		ips, err := certResolver().LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			data = []byte("error: " + err.Error())
+		} else {
+			lines := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				lines = append(lines, ip.IP.String())
+			}
+			data = []byte(strings.Join(lines, "\n"))
+		}
+	}
+	parentToChildCh <- Command{Type: cmdResolve, Name: host, Data: data}
+}
+
+// validResolveName returns true if the name looks like a host name, so that the child can not make the parent
+// resolve arbitrary strings.
+func validResolveName(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
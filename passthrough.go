@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTPS listener can forward the TLS connections for some server names (SNI) at the TCP level to other backends,
+// e.g. to a mail or VPN daemon that shares port 443. The connections are not terminated: the ClientHello is read,
+// and the bytes are forwarded unchanged. All other connections are served normally.
+
+// errStopHandshake stops the handshake that only reads the ClientHello.
+var errStopHandshake = errors.New("passthrough: ClientHello read")
+
+// passthroughDialTimeout limits connecting to the backend.
+const passthroughDialTimeout = 10 * time.Second
+
+// passthroughBackend returns the backend (host:port) for the server name, or "" if the connection is served normally.
+func passthroughBackend(serverName string) string {
+	return config.SniPassthrough[strings.TrimSuffix(strings.ToLower(serverName), ".")]
+}
+
+// passthroughListener reads the ClientHello of each accepted connection. It forwards the connections for
+// the sni-passthrough names to their backends, and returns the other connections from Accept.
+type passthroughListener struct {
+	net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPassthroughListener wraps the listener and starts to accept connections.
+func newPassthroughListener(ln net.Listener) net.Listener {
+	l := &passthroughListener{Listener: ln, conns: make(chan net.Conn), errs: make(chan error), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts the connections and routes each of them in its own goroutine,
+// so that a slow client does not block the others.
+func (l *passthroughListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// The server decides if it retries after temporary errors.
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+// route forwards the connection to its backend, or returns it from Accept.
+func (l *passthroughListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(config.MaxRequestTimeout))
+	hello, prefix := peekClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	// Connections without a valid ClientHello are also served normally, so that the TLS server logs the error.
+	if hello != nil {
+		if backend := passthroughBackend(hello.ServerName); backend != "" {
+			proxyPassthrough(conn, prefix, hello.ServerName, backend)
+			return
+		}
+	}
+
+	select {
+	case l.conns <- &prefixConn{Conn: conn, prefix: prefix}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection that is served normally.
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. Forwarded connections are not closed.
+func (l *passthroughListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekClientHello reads the ClientHello from the connection and returns it with the bytes that were read.
+// The hello is nil if the connection does not start with a valid ClientHello.
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, []byte) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{ServerName: h.ServerName}
+			return nil, errStopHandshake
+		},
+	}).Handshake()
+	return hello, buf.Bytes()
+}
+
+// readOnlyConn reads from r and discards all writes, so that the handshake that reads the ClientHello
+// does not send anything to the client.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// prefixConn returns the bytes of prefix before reading from the connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// proxyPassthrough forwards the connection to the backend, starting with the bytes that were already read.
+func proxyPassthrough(conn net.Conn, prefix []byte, serverName, backend string) {
+	defer conn.Close()
+	if config.LogRequests {
+		log.Println("Passthrough:", logAddr(conn.RemoteAddr().String()), serverName, "->", backend)
+	}
+
+	// While the circuit breaker of the backend is open, the connection is closed right away.
+	breaker := upstreamCircuitBreaker(backend)
+	if !breaker.allow() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), passthroughDialTimeout)
+	upstream, err := upstreamDialContext(ctx, "tcp", backend)
+	cancel()
+	if err != nil {
+		log.Println("Passthrough: could not connect to backend:", backend, err)
+		breaker.failure(backend)
+		return
+	}
+	breaker.success(backend)
+	defer upstream.Close()
+	if _, err := upstream.Write(prefix); err != nil {
+		return
+	}
+
+	// Copy both directions, and pass on the end of each direction, so that half-closed connections work.
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, conn)
+		closeWrite(upstream)
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite shuts down the writing side of a TCP connection.
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
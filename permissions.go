@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// setPermissions sets the permissions for all files and directories in (and including) dir to read only.
+// If the web root is owned by the jail user, only the owner and the group get read permissions.
+func setPermissions(dir string) error {
+	var dirMode, fileMode os.FileMode = 0555, 0444
+	if config.ChownWebRoot {
+		dirMode, fileMode = 0550, 0440
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// Change the directory permissions to "rx".
+			err := os.Chmod(path, dirMode)
+			return err
+		}
+
+		// Change the file permissions to "r", or to "rx" for CGI scripts.
+		mode := fileMode
+		if rel, err := filepath.Rel(dir, path); err == nil && isCGIScriptFile(filepath.ToSlash(rel)) {
+			mode = dirMode
+		}
+		err = os.Chmod(path, mode)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// makeWritable makes the file or directory writable for the owner, e.g. to add a domain to the read only web root.
+// The returned function restores the previous permissions.
+func makeWritable(path string) (restore func(), err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, info.Mode().Perm()|0200); err != nil {
+		return nil, err
+	}
+	return func() { os.Chmod(path, info.Mode().Perm()) }, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Before the child is started, the parent checks the common reasons why the server does not start or is insecure,
+// and logs them as a checklist with a hint for each problem. The server only starts if no check failed.
+// "./sslserver preflight" only runs the checks.
+
+// Results of preflight checks.
+const (
+	preflightOK   = "ok"
+	preflightWarn = "warn"
+	preflightFail = "FAIL"
+)
+
+// preflightResult is the result of one check.
+type preflightResult struct {
+	status  string
+	message string
+}
+
+// runPreflightChecks logs the checklist and returns false if a check failed.
+func runPreflightChecks() bool {
+	results := []preflightResult{
+		checkListenAddress("http-addr", config.HttpAddr),
+		checkListenAddress("https-addr", config.HttpsAddr),
+		checkWebRootReadable(),
+	}
+	results = append(results, checkOutsideWebRoot()...)
+	results = append(results, platformPreflightChecks()...)
+	results = append(results, checkACMEAddressFamilies()...)
+
+	passed := true
+	log.Println("Preflight checks:")
+	for _, result := range results {
+		log.Printf("  [%s]%s %s", result.status, strings.Repeat(" ", len(preflightFail)-len(result.status)), result.message)
+		if result.status == preflightFail {
+			passed = false
+		}
+	}
+	return passed
+}
+
+// checkListenAddress checks that the address can be bound. The listener is closed right away, so that the child can bind it.
+func checkListenAddress(name, addr string) preflightResult {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		ln.Close()
+		return preflightResult{preflightOK, fmt.Sprintf("%s %s can be bound", name, addr)}
+	}
+
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return preflightResult{preflightFail, fmt.Sprintf("%s %s is already in use by another process (e.g. another web server). Stop the other process or change %s.", name, addr, name)}
+	case errors.Is(err, syscall.EACCES):
+		return preflightResult{preflightFail, fmt.Sprintf("%s %s needs privileges: ports below 1024 can only be bound by root or with the capability CAP_NET_BIND_SERVICE (e.g. \"setcap cap_net_bind_service=+ep sslserver\"). Run the server as root, add the capability, or use a port above 1023.", name, addr)}
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return preflightResult{preflightFail, fmt.Sprintf("%s %s is not an address of this system. Use an address of a network interface, or leave the host empty for all interfaces.", name, addr)}
+	}
+	return preflightResult{preflightFail, fmt.Sprintf("%s %s can not be bound: %v", name, addr, err)}
+}
+
+// checkWebRootReadable checks that the web root can be read.
+func checkWebRootReadable() preflightResult {
+	if _, err := os.ReadDir(config.WebRootDirectory); err != nil {
+		return preflightResult{preflightFail, fmt.Sprintf("web-root-directory %s can not be read: %v", config.WebRootDirectory, err)}
+	}
+	return preflightResult{preflightOK, fmt.Sprintf("web-root-directory %s can be read", config.WebRootDirectory)}
+}
+
+// checkOutsideWebRoot checks that no private data is stored inside the web root, where it would be served.
+func checkOutsideWebRoot() []preflightResult {
+	var results []preflightResult
+	switch config.CertificateCacheBackend {
+	case certCacheBackendDirectory:
+		results = append(results, checkOutsideWebRootPath("certificate-cache-directory", config.CertificateCacheDirectory, preflightFail))
+	case certCacheBackendSQLite:
+		results = append(results, checkOutsideWebRootPath("certificate-cache-sqlite-file", config.CertificateCacheSqliteFile, preflightFail))
+	}
+	if config.LogFile != "" {
+		results = append(results, checkOutsideWebRootPath("log-file", config.LogFile, preflightWarn))
+	}
+	if config.TlsKeylogFile != "" {
+		results = append(results, checkOutsideWebRootPath("tls-keylog-file", config.TlsKeylogFile, preflightFail))
+	}
+	return results
+}
+
+// checkOutsideWebRootPath checks that the path is not inside the web root, and returns the status if it is.
+func checkOutsideWebRootPath(name, path, status string) preflightResult {
+	if isInsideDir(path, config.WebRootDirectory) {
+		return preflightResult{status, fmt.Sprintf("%s %s is inside the web-root-directory %s, so its content would be served to everyone. Move it out of the web root.", name, path, config.WebRootDirectory)}
+	}
+	return preflightResult{preflightOK, fmt.Sprintf("%s %s is outside of the web root", name, path)}
+}
+
+// isInsideDir returns true if the path is the directory or inside of it. Symbolic links are resolved where possible.
+func isInsideDir(path, dir string) bool {
+	path = resolvePath(path)
+	dir = resolvePath(dir)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// resolvePath returns the absolute path with resolved symbolic links. If the path does not exist yet, the links
+// of its parent directory are resolved.
+func resolvePath(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		return filepath.Join(resolved, filepath.Base(path))
+	}
+	return path
+}
+
+// runPreflight runs the preflight checks and exits.
+func runPreflight() {
+	readConfig()
+	if !runPreflightChecks() {
+		log.Fatal("Preflight checks failed. Fix the items marked with FAIL.")
+	}
+	log.Println("Preflight checks passed.")
+	os.Exit(0)
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// platformPreflightChecks checks the privileges for the sandbox, and that the jail user can reach the web root.
+func platformPreflightChecks() []preflightResult {
+	if config.Sandbox == sandboxNone {
+		return nil
+	}
+
+	// The sandboxes switch to the jail user, which needs root.
+	if os.Geteuid() != 0 {
+		return []preflightResult{{preflightFail, fmt.Sprintf("sandbox %s switches to the jail user and needs root. Run the server as root or set sandbox to %s.", config.Sandbox, sandboxNone)}}
+	}
+	results := []preflightResult{{preflightOK, fmt.Sprintf("sandbox %s has the needed privileges", config.Sandbox)}}
+
+	// With Landlock, the jail user opens the web root by its full path, so it must be able to enter all parent directories.
+	// The chroot sandboxes enter the web root before they switch to the jail user, and the child makes the web root
+	// itself readable.
+	if config.Sandbox == sandboxLandlock {
+		uid, gid := jailUser()
+		dir, err := filepath.Abs(config.WebRootDirectory)
+		if err != nil {
+			return append(results, preflightResult{preflightFail, fmt.Sprintf("web-root-directory %s has no absolute path: %v", config.WebRootDirectory, err)})
+		}
+		for dir = filepath.Dir(dir); ; dir = filepath.Dir(dir) {
+			if !canEnter(dir, uid, gid) {
+				return append(results, preflightResult{preflightFail, fmt.Sprintf("the jail user (UID %d, GID %d) can not enter %s, so it can not read the web-root-directory. Allow it to enter (e.g. \"chmod o+x %s\") or move the web root.", uid, gid, dir, dir)})
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		results = append(results, preflightResult{preflightOK, fmt.Sprintf("the jail user (UID %d, GID %d) can reach the web-root-directory", uid, gid)})
+	}
+	return results
+}
+
+// canEnter returns true if the user with the UID and GID has the execute permission for the directory.
+func canEnter(dir string, uid, gid int) bool {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	mode := info.Mode().Perm()
+	switch {
+	case int(stat.Uid) == uid:
+		return mode&0100 != 0
+	case int(stat.Gid) == gid:
+		return mode&0010 != 0
+	}
+	return mode&0001 != 0
+}
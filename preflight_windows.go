@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// platformPreflightChecks has no checks on Windows, because there are no sandboxes and no privileged ports.
+func platformPreflightChecks() []preflightResult {
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Proxy rules forward the requests of URL path prefixes to upstream HTTP or HTTPS backends, so that the server
+// terminates TLS in front of dynamic applications. The first rule whose path matches the URL path wins, and the
+// proxy rules are checked after the redirects and before the rewrites and the files. The backends get the
+// X-Forwarded-For, X-Forwarded-Host, and X-Forwarded-Proto headers, and the Host header of the client. Request and
+// response headers can be set or removed per rule.
+//
+// The connections to an upstream go through its circuit breaker. While the breaker is open, or if the upstream
+// fails, the request is answered with the fallback file of the rule, or with an error.
+
+// proxyDialTimeout limits connecting to an upstream.
+const proxyDialTimeout = 10 * time.Second
+
+// errCircuitOpen is returned for the connections to an upstream whose circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// ProxyRule forwards the requests of a URL path prefix to an upstream.
+type ProxyRule struct {
+	// URL path prefix, e.g. "/api/" or "/" for all requests of the domain.
+	Path string `yaml:"path"`
+
+	// URL of the backend, e.g. "http://127.0.0.1:8080". A path of the URL is prepended to the forwarded URL paths.
+	Upstream string `yaml:"upstream"`
+
+	// Remove the path prefix from the URL path before the request is forwarded.
+	StripPath bool `yaml:"strip-path,omitempty"`
+
+	// Headers that are set on the forwarded requests and on the responses. An empty value removes the header.
+	RequestHeaders  map[string]string `yaml:"request-headers,omitempty"`
+	ResponseHeaders map[string]string `yaml:"response-headers,omitempty"`
+
+	// Maximum time until the upstream sends the response header.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// URL path of a file of the domain that is served with 503 Service Unavailable if the upstream is not available.
+	Fallback string `yaml:"fallback,omitempty"`
+
+	// Maximum age of the last successful response of a URL that is served if the upstream fails.
+	StaleIfError time.Duration `yaml:"stale-if-error,omitempty"`
+
+	proxy *httputil.ReverseProxy // The proxy for the upstream.
+	stale *staleCache            // The last successful responses, with stale-if-error.
+}
+
+// matches returns true if the URL path is the path of the rule or starts with it.
+func (rule ProxyRule) matches(urlPath string) bool {
+	prefix := strings.TrimSuffix(rule.Path, "/")
+	return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") || rule.Path == "/"
+}
+
+// checkProxyRules returns an error if a rule is invalid, and creates the proxies of the rules. Rules without
+// timeout get 60 seconds.
+func checkProxyRules(rules []ProxyRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		clean := path.Clean(rule.Path)
+		if !strings.HasPrefix(rule.Path, "/") || (rule.Path != clean && rule.Path != clean+"/") {
+			return fmt.Errorf("the path '%s' must be a clean URL path", rule.Path)
+		}
+		upstream, err := url.Parse(rule.Upstream)
+		if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+			return fmt.Errorf("the upstream '%s' of '%s' must be an HTTP or HTTPS URL", rule.Upstream, rule.Path)
+		}
+		if upstream.Port() == "" {
+			// The circuit breakers are per host and port.
+			upstream.Host = net.JoinHostPort(upstream.Hostname(), map[string]string{"http": "80", "https": "443"}[upstream.Scheme])
+		}
+		for name, value := range rule.RequestHeaders {
+			if name == "" || strings.ContainsAny(name+value, "\r\n") {
+				return fmt.Errorf("the request header '%s' of '%s' is invalid", name, rule.Path)
+			}
+		}
+		for name, value := range rule.ResponseHeaders {
+			if name == "" || strings.ContainsAny(name+value, "\r\n") {
+				return fmt.Errorf("the response header '%s' of '%s' is invalid", name, rule.Path)
+			}
+		}
+		if rule.Timeout < 0 {
+			return fmt.Errorf("the timeout of '%s' must not be negative", rule.Path)
+		}
+		if rule.Timeout == 0 {
+			rule.Timeout = 60 * time.Second
+		}
+		if rule.Fallback != "" && !matchPath(rule.Fallback) {
+			return fmt.Errorf("the fallback '%s' of '%s' must be the URL path of a file", rule.Fallback, rule.Path)
+		}
+		if rule.StaleIfError < 0 {
+			return fmt.Errorf("stale-if-error of '%s' must not be negative", rule.Path)
+		}
+		if rule.StaleIfError > 0 {
+			rule.stale = newStaleCache(rule.StaleIfError)
+		}
+		rule.proxy = newUpstreamProxy(rule, upstream)
+	}
+	return nil
+}
+
+// newUpstreamProxy creates the reverse proxy of the rule for the upstream.
+func newUpstreamProxy(rule *ProxyRule, upstream *url.URL) *httputil.ReverseProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = rule.Timeout
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		// While the circuit breaker of the upstream is open, the request fails right away.
+		breaker := upstreamCircuitBreaker(address)
+		if !breaker.allow() {
+			return nil, errCircuitOpen
+		}
+		ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+		defer cancel()
+		conn, err := upstreamDialContext(ctx, network, address)
+		if err != nil {
+			breaker.failure(address)
+			return nil, err
+		}
+		breaker.success(address)
+		return conn, nil
+	}
+
+	prefix := strings.TrimSuffix(rule.Path, "/")
+	return &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(r *http.Request) {
+			urlPath := r.URL.Path
+			if rule.StripPath {
+				urlPath = "/" + strings.TrimPrefix(strings.TrimPrefix(urlPath, prefix), "/")
+			}
+			r.URL.Scheme = upstream.Scheme
+			r.URL.Host = upstream.Host
+			r.URL.Path = strings.TrimSuffix(upstream.Path, "/") + urlPath
+			r.URL.RawPath = ""
+			r.Header.Set("X-Forwarded-Host", r.Host)
+			if r.TLS != nil {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+			setHeaders(r.Header, rule.RequestHeaders)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			setHeaders(resp.Header, rule.ResponseHeaders)
+			if rule.stale != nil {
+				return rule.stale.record(resp)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("Proxy: upstream", rule.Upstream, "failed:", err)
+			status := http.StatusBadGateway
+			if errors.Is(err, errCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusServiceUnavailable
+			}
+			// The last successful response of the URL is better than the fallback file.
+			if rule.stale != nil && rule.stale.serve(w, r) {
+				return
+			}
+			domain, _ := r.Context().Value(proxyDomainKey{}).(string)
+			if rule.Fallback == "" || !serveProxyFallback(w, r, domain, rule.Fallback) {
+				http.Error(w, http.StatusText(status), status)
+			}
+		},
+	}
+}
+
+// setHeaders sets the headers, and removes the ones with an empty value.
+func setHeaders(header http.Header, headers map[string]string) {
+	for name, value := range headers {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+}
+
+// serveProxyFallback serves the fallback file of the domain with 503 Service Unavailable. It returns false if the
+// file does not exist.
+func serveProxyFallback(w http.ResponseWriter, r *http.Request, domain, fallback string) bool {
+	entry, err := webFiles.Get(domain + fallback)
+	if err != nil {
+		return false
+	}
+	addHeaders(w)
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(fallback)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "30")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		if entry.File != nil {
+			entry.File.Close()
+		}
+		return true
+	}
+	if entry.File != nil {
+		defer entry.File.Close()
+		io.Copy(w, entry.File)
+	} else {
+		w.Write(entry.Content)
+	}
+	return true
+}
+
+// proxyDomainKey is the context key of the (ASCII) domain of a forwarded request, for the fallback file.
+type proxyDomainKey struct{}
+
+// serveProxy forwards the request to the upstream of the first proxy rule of the domain that matches the URL path.
+// Only the cleaned URL path is matched and forwarded, so that "/api/../admin" is not forwarded to the upstream of
+// "/api". A URL path that only matches a rule before it is cleaned is answered with 400 Bad Request. It returns false
+// if no rule matches.
+func serveProxy(w http.ResponseWriter, r *http.Request, domain string, settings domainSettings) bool {
+	clean := cleanURLPath(r.URL.Path)
+	for _, rule := range settings.proxy {
+		if rule.matches(clean) {
+			// WithContext does not copy the URL, which the outer handlers still use, e.g. for the log.
+			r = r.WithContext(context.WithValue(r.Context(), proxyDomainKey{}, domain))
+			cleanURL := *r.URL
+			cleanURL.Path, cleanURL.RawPath = clean, ""
+			r.URL = &cleanURL
+			rule.proxy.ServeHTTP(w, r)
+			return true
+		}
+		if rule.matches(r.URL.Path) {
+			log.Println("Proxy: the URL path", r.URL.EscapedPath(), "leaves", rule.Path)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestServeProxyCleanPath checks that only the cleaned URL path is matched and forwarded, and that a URL path that
+// leaves the path of the rule when it is cleaned is refused.
+func TestServeProxyCleanPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	rules := []ProxyRule{{Path: "/api", Upstream: upstream.URL + "/backend", StripPath: true}}
+	if err := checkProxyRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	settings := domainSettings{proxy: rules}
+
+	tests := []struct {
+		path     string
+		served   bool
+		status   int
+		upstream string
+	}{
+		{"/api/users", true, http.StatusOK, "/backend/users"},
+		{"/api/users/", true, http.StatusOK, "/backend/users/"},
+		{"/api//users/./list", true, http.StatusOK, "/backend/users/list"},
+		{"//api/users", true, http.StatusOK, "/backend/users"},
+		{"/api/users/../admin", true, http.StatusOK, "/backend/admin"},
+		{"/api/../admin/secret", true, http.StatusBadRequest, ""},
+		{"/api/..", true, http.StatusBadRequest, ""},
+		{"/other/../api/users", true, http.StatusOK, "/backend/users"},
+		{"/other", false, 0, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		r.URL.Path = test.path
+		w := httptest.NewRecorder()
+		if served := serveProxy(w, r, "localhost", settings); served != test.served {
+			t.Errorf("%s: served = %v, want %v", test.path, served, test.served)
+			continue
+		}
+		if !test.served {
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.path, w.Code, test.status)
+		} else if test.status == http.StatusOK && w.Body.String() != test.upstream {
+			t.Errorf("%s: forwarded as %q, want %q", test.path, w.Body.String(), test.upstream)
+		}
+		if r.URL.Path != test.path {
+			t.Errorf("%s: the URL of the request was changed to %q", test.path, r.URL.Path)
+		}
+	}
+}
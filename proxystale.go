@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With stale-if-error, a proxy rule keeps the last successful response of each URL in memory, and serves it when
+// the upstream fails, is not reachable, or answers with a server error, as long as the response is not older than
+// stale-if-error (like the Cache-Control extension of RFC 5861). The stale response gets an Age header and the
+// Warning "110 Response is Stale". Only complete 200 responses to GET requests without Authorization header are
+// kept, and only if they are not private: responses with Set-Cookie, "Cache-Control: private" or "no-store", or
+// "Vary: *" are not kept. The key of a response is the host, the URL, and the Accept-Encoding of the request, so
+// that clients only get the content encodings that they accept.
+
+// Limits of the stale responses of a proxy rule.
+const (
+	staleMaxResponseSize = 1 << 20 // Larger responses are not kept.
+	staleMaxResponses    = 1000    // The oldest response is dropped for a new one.
+)
+
+// staleWarning is the Warning header of stale responses.
+const staleWarning = `110 - "Response is Stale"`
+
+// errUpstreamServerError is returned for a server error of an upstream, if a stale response can be served instead.
+var errUpstreamServerError = errors.New("upstream answered with a server error")
+
+// staleResponse is the last successful response of a URL.
+type staleResponse struct {
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// staleCache holds the stale responses of a proxy rule.
+type staleCache struct {
+	maxAge    time.Duration
+	mu        sync.Mutex
+	responses map[string]*staleResponse
+}
+
+// newStaleCache returns a cache for the responses that are not older than maxAge.
+func newStaleCache(maxAge time.Duration) *staleCache {
+	return &staleCache{maxAge: maxAge, responses: make(map[string]*staleResponse)}
+}
+
+// staleKey returns the key of the response to the forwarded request.
+func staleKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI() + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+// isStaleCacheable returns true if the response to the forwarded request can be kept.
+func isStaleCacheable(resp *http.Response) bool {
+	if resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK || resp.Request.Header.Get("Authorization") != "" {
+		return false
+	}
+	if resp.ContentLength > staleMaxResponseSize || len(resp.Header.Values("Set-Cookie")) > 0 || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	cacheControl := strings.ToLower(strings.Join(resp.Header.Values("Cache-Control"), ","))
+	return !strings.Contains(cacheControl, "private") && !strings.Contains(cacheControl, "no-store")
+}
+
+// record keeps the response when its body was read completely, or checks whether a stale response can replace a
+// server error. It is called by ModifyResponse of the proxy.
+func (c *staleCache) record(resp *http.Response) error {
+	if resp.StatusCode >= 500 && c.get(staleKey(resp.Request)) != nil {
+		return errUpstreamServerError
+	}
+	if isStaleCacheable(resp) {
+		resp.Body = &staleRecorder{ReadCloser: resp.Body, cache: c, key: staleKey(resp.Request), header: resp.Header.Clone()}
+	}
+	return nil
+}
+
+// store keeps the response, and drops the oldest response if the cache is full.
+func (c *staleCache) store(key string, response *staleResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.responses[key]; !ok && len(c.responses) >= staleMaxResponses {
+		oldestKey := ""
+		for k, r := range c.responses {
+			if oldestKey == "" || r.stored.Before(c.responses[oldestKey].stored) {
+				oldestKey = k
+			}
+		}
+		delete(c.responses, oldestKey)
+	}
+	c.responses[key] = response
+}
+
+// get returns the response of the key if it is not older than the maximum age, or nil.
+func (c *staleCache) get(key string) *staleResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	response := c.responses[key]
+	if response == nil {
+		return nil
+	}
+	if time.Since(response.stored) > c.maxAge {
+		delete(c.responses, key)
+		return nil
+	}
+	return response
+}
+
+// serve writes the stale response to the forwarded request, and returns false if there is none.
+func (c *staleCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	response := c.get(staleKey(r))
+	if response == nil {
+		return false
+	}
+	for name, values := range response.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(response.stored).Seconds())))
+	w.Header().Add("Warning", staleWarning)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(response.body)
+	}
+	return true
+}
+
+// staleRecorder copies the body of a response, and keeps the response when the body was read completely.
+type staleRecorder struct {
+	io.ReadCloser
+	cache    *staleCache
+	key      string
+	header   http.Header
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+// Read reads the body, and keeps the response at the end of the body.
+func (s *staleRecorder) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if !s.tooLarge {
+		if s.body.Len()+n > staleMaxResponseSize {
+			s.tooLarge = true
+			s.body = bytes.Buffer{}
+		} else {
+			s.body.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !s.tooLarge {
+		s.cache.store(s.key, &staleResponse{header: s.header, body: s.body.Bytes(), stored: time.Now()})
+		s.tooLarge = true // Keep it only once.
+	}
+	return n, err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Actions for requests to domains that have exceeded one of their quotas.
+const (
+	quotaActionTooManyRequests = "too-many-requests" // Answer with 429 Too Many Requests.
+	quotaActionUnavailable     = "unavailable"       // Answer with 503 Service Unavailable.
+	quotaActionWarn            = "warn"              // Serve the request, but add a Warning header and log the exceeded quota.
+)
+
+// quotaSaveInterval is the interval in which the usage is persisted in the certificate cache directory.
+const quotaSaveInterval = time.Minute
+
+// quotaUsage is the transferred bytes and the number of requests of a domain in the current day and month (UTC).
+type quotaUsage struct {
+	Day             string `json:"day"`
+	Month           string `json:"month"`
+	DailyBytes      int64  `json:"daily-bytes"`
+	MonthlyBytes    int64  `json:"monthly-bytes"`
+	DailyRequests   int64  `json:"daily-requests"`
+	MonthlyRequests int64  `json:"monthly-requests"`
+
+	warned string // The exceeded quota that was last logged, so that it is only logged once per period.
+	dirty  bool   // True if the usage changed since it was persisted.
+}
+
+var quotaMu sync.Mutex
+var quotaUsages = map[string]*quotaUsage{}
+
+// quotaCacheKey returns the name under which the usage of the domain is stored in the certificate cache.
+func quotaCacheKey(domain string) string {
+	return "quota+" + domain
+}
+
+// hasQuota returns true if the settings limit the bytes or requests of the domain.
+func (s domainSettings) hasQuota() bool {
+	return s.quotaDailyBytes > 0 || s.quotaMonthlyBytes > 0 || s.quotaDailyRequests > 0 || s.quotaMonthlyRequests > 0
+}
+
+// lockQuotaUsage locks quotaMu and returns the usage of the domain for the current period. The usage is loaded from the
+// certificate cache on first use while quotaMu is not held, so that a slow request to the parent does not hold back the
+// requests of the other domains. The usage is reset when a new day or month has begun.
+func lockQuotaUsage(domain string, now time.Time) *quotaUsage {
+	quotaMu.Lock()
+	usage, ok := quotaUsages[domain]
+	if !ok {
+		quotaMu.Unlock()
+		loaded := loadQuotaUsage(domain)
+		quotaMu.Lock()
+
+		// Another request can have loaded the usage in the meantime.
+		if usage, ok = quotaUsages[domain]; !ok {
+			usage = loaded
+			quotaUsages[domain] = usage
+		}
+	}
+
+	day, month := now.UTC().Format("2006-01-02"), now.UTC().Format("2006-01")
+	if usage.Day != day {
+		usage.Day, usage.DailyBytes, usage.DailyRequests, usage.dirty = day, 0, 0, true
+	}
+	if usage.Month != month {
+		usage.Month, usage.MonthlyBytes, usage.MonthlyRequests, usage.dirty = month, 0, 0, true
+	}
+	return usage
+}
+
+// loadQuotaUsage reads the persisted usage of the domain from the certificate cache.
+func loadQuotaUsage(domain string) *quotaUsage {
+	usage := &quotaUsage{}
+	if m != nil {
+		if data, err := m.Cache.Get(context.Background(), quotaCacheKey(domain)); err == nil {
+			if err := json.Unmarshal(data, usage); err != nil {
+				log.Println("Could not read quota usage of", domain+":", err)
+			}
+		}
+	}
+	return usage
+}
+
+// exceededQuota returns the name of the quota that the usage has exceeded, or "" if there is none.
+func exceededQuota(usage *quotaUsage, settings domainSettings) string {
+	switch {
+	case settings.quotaDailyBytes > 0 && usage.DailyBytes >= settings.quotaDailyBytes:
+		return "quota-daily-bytes"
+	case settings.quotaMonthlyBytes > 0 && usage.MonthlyBytes >= settings.quotaMonthlyBytes:
+		return "quota-monthly-bytes"
+	case settings.quotaDailyRequests > 0 && usage.DailyRequests >= settings.quotaDailyRequests:
+		return "quota-daily-requests"
+	case settings.quotaMonthlyRequests > 0 && usage.MonthlyRequests >= settings.quotaMonthlyRequests:
+		return "quota-monthly-requests"
+	}
+	return ""
+}
+
+// quotaHandler counts the transferred bytes and requests of the domains with quotas, and applies the
+// quota action of the domain when one of its quotas is exceeded.
+func quotaHandler(next http.Handler) http.Handler {
+	enabled := false
+	for name := range config.Domains {
+		if settingsForDomain(name).hasQuota() {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return next
+	}
+	jobs.every(jobQuotaSave, quotaSaveInterval, saveQuotaUsages)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain, err := validateDomain(r.Host)
+		settings := settingsForDomain(domain)
+		if err != nil || !settings.hasQuota() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		usage := lockQuotaUsage(domain, time.Now())
+		exceeded := exceededQuota(usage, settings)
+		logExceeded := exceeded != "" && usage.warned != exceeded+" "+usage.Day
+		if logExceeded {
+			usage.warned = exceeded + " " + usage.Day
+		}
+		quotaMu.Unlock()
+
+		if logExceeded {
+			log.Printf("Quota exceeded: %s reached its %s, action: %s", domain, exceeded, settings.quotaAction)
+		}
+		if exceeded != "" {
+			switch settings.quotaAction {
+			case quotaActionTooManyRequests:
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			case quotaActionUnavailable:
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			case quotaActionWarn:
+				w.Header().Set("Warning", fmt.Sprintf("299 - \"%s exceeded\"", exceeded))
+			}
+		}
+
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+
+		usage = lockQuotaUsage(domain, time.Now())
+		usage.DailyBytes += cw.written
+		usage.MonthlyBytes += cw.written
+		usage.DailyRequests++
+		usage.MonthlyRequests++
+		usage.dirty = true
+		quotaMu.Unlock()
+	})
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+// Write counts and writes the data.
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered data to the client, if the original ResponseWriter supports it.
+func (w *countingResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack takes over the connection, if the original ResponseWriter supports it. The data that is written to the
+// hijacked connection, e.g. of a WebSocket, is not counted.
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// saveQuotaUsages persists the changed usages in the certificate cache directory, so that the quotas
+// survive restarts. It runs every quotaSaveInterval, so the usage of up to one interval can be lost.
+func saveQuotaUsages() {
+	if m == nil {
+		return
+	}
+
+	quotaMu.Lock()
+	changed := map[string][]byte{}
+	for domain, usage := range quotaUsages {
+		if !usage.dirty {
+			continue
+		}
+		data, err := json.Marshal(usage)
+		if err != nil {
+			continue
+		}
+		changed[domain] = data
+		usage.dirty = false
+	}
+	quotaMu.Unlock()
+
+	for domain, data := range changed {
+		if err := m.Cache.Put(context.Background(), quotaCacheKey(domain), data); err != nil {
+			log.Println("Could not store quota usage of", domain+":", err)
+		}
+	}
+}
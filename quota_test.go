@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// slowCache is a certificate cache whose get requests wait until release is closed.
+type slowCache struct {
+	memoryCache
+	release chan struct{}
+}
+
+func (c *slowCache) Get(ctx context.Context, name string) ([]byte, error) {
+	<-c.release
+	return c.memoryCache.Get(ctx, name)
+}
+
+// TestLockQuotaUsageSlowCache checks that loading the usage of one domain from the parent does not hold back the
+// requests of the other domains.
+func TestLockQuotaUsageSlowCache(t *testing.T) {
+	savedManager := m
+	defer func() {
+		m = savedManager
+		quotaUsages = map[string]*quotaUsage{}
+	}()
+	cache := &slowCache{memoryCache: memoryCache{entries: map[string][]byte{
+		quotaCacheKey("slow.example"): []byte(`{"day":"2026-01-01","daily-requests":5}`),
+	}}, release: make(chan struct{})}
+	m = &autocert.Manager{Cache: cache}
+	quotaUsages = map[string]*quotaUsage{"fast.example": {}}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	loaded := make(chan *quotaUsage)
+	go func() {
+		usage := lockQuotaUsage("slow.example", now)
+		quotaMu.Unlock()
+		loaded <- usage
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		lockQuotaUsage("fast.example", now)
+		quotaMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the usage of another domain waited for the certificate cache")
+	}
+
+	close(cache.release)
+	if usage := <-loaded; usage.DailyRequests != 5 {
+		t.Errorf("loaded %d daily requests, want 5", usage.DailyRequests)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The child starts in a fixed order: the file cache is filled, the listeners bind, the certificates are loaded
+// (or requested), and only then the server announces that it is ready. The listeners have to accept connections
+// while the certificates are loaded, because the ACME challenges are answered by them. Requests for files that
+// arrive before the server is ready are queued until it is ready, or answered with 503 Service Unavailable.
+
+// Behaviors for requests that arrive before the server is ready.
+const (
+	preReadyQueue       = "queue"       // Wait until the server is ready, at most pre-ready-timeout.
+	preReadyUnavailable = "unavailable" // Answer with 503 Service Unavailable right away.
+)
+
+// serverReady is closed when the child is ready.
+var serverReady = make(chan struct{})
+var serverReadyOnce sync.Once
+
+// markServerReady announces that the child is ready, to the request handlers and to the parent.
+func markServerReady() {
+	serverReadyOnce.Do(func() {
+		close(serverReady)
+		log.Println("Server is ready")
+		childToParentCh <- Command{Type: cmdReady}
+	})
+}
+
+// isServerReady returns true if the child is ready.
+func isServerReady() bool {
+	select {
+	case <-serverReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// readinessHandler holds back or rejects the requests until the server is ready.
+func readinessHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isServerReady() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if config.PreReadyRequests == preReadyQueue {
+			timer := time.NewTimer(config.PreReadyTimeout)
+			defer timer.Stop()
+			select {
+			case <-serverReady:
+				next.ServeHTTP(w, r)
+				return
+			case <-r.Context().Done():
+				// The client gave up.
+				return
+			case <-timer.C:
+			}
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(config.PreReadyTimeout.Seconds())))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	})
+}
+
+// The parent learns from the child when it is ready.
+var childReady = make(chan struct{})
+var childReadyOnce sync.Once
+
+// markChildReady is called by the parent when the child announced that it is ready.
+func markChildReady() {
+	childReadyOnce.Do(func() {
+		close(childReady)
+		log.Println("Child is ready")
+		go runLifecycleHook(hookAfterReady)
+	})
+}
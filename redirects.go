@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redirect rules answer requests with a redirect before the files are looked up. The rules of the redirects setting
+// come first, then the rules of the _redirects file in the domain directory, if redirects-file is enabled. The file
+// has the format of Netlify: one rule per line with the source path, the target and an optional status code, e.g.
+// "/old-page /new-page 301". Lines that start with "#" are comments. The file is never served, because it has no
+// file extension, and it is read again when it changed.
+//
+// A source path that ends with "*" matches all URL paths with this prefix, and ":splat" in the target is replaced
+// with the rest of the URL path. The target is a URL path or an absolute URL. The query of the request is added to
+// targets without query.
+
+// redirectsFileName is the name of the file with the redirect rules in the domain directory.
+const redirectsFileName = "/_redirects"
+
+// maxRedirectsFileSize is the maximum size of a _redirects file.
+const maxRedirectsFileSize = 1024 * 1024
+
+// RedirectRule redirects the requests of the source path to the target.
+type RedirectRule struct {
+	// URL path, or URL path prefix if it ends with "*".
+	From string `yaml:"from"`
+
+	// URL path or absolute URL, in which ":splat" is replaced with the part of the URL path that matched "*".
+	To string `yaml:"to"`
+
+	// Status code of the redirect: 301 (default), 302, 307, or 308.
+	Status int `yaml:"status,omitempty"`
+}
+
+// target returns the target of the redirect for the URL path, and false if the rule does not match.
+func (rule RedirectRule) target(urlPath string) (string, bool) {
+	var splat string
+	if prefix := strings.TrimSuffix(rule.From, "*"); prefix != rule.From {
+		if !strings.HasPrefix(urlPath, prefix) {
+			return "", false
+		}
+		splat = (&url.URL{Path: urlPath[len(prefix):]}).EscapedPath()
+	} else if urlPath != rule.From {
+		return "", false
+	}
+
+	target := strings.ReplaceAll(rule.To, ":splat", splat)
+	if strings.HasPrefix(rule.To, "/") && len(target) > 1 && (target[1] == '/' || target[1] == '\\') {
+		// A target like "//example.com" would redirect to another host.
+		target = "/" + strings.TrimLeft(target, "/\\")
+	}
+	return target, true
+}
+
+// checkRedirectRules returns an error if a rule has an invalid source, target, or status code. Rules without status
+// code get 301.
+func checkRedirectRules(rules []RedirectRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if !strings.HasPrefix(rule.From, "/") || strings.ContainsAny(rule.From, " \t\r\n") || strings.Contains(strings.TrimSuffix(rule.From, "*"), "*") {
+			return fmt.Errorf("the source '%s' must be a URL path, which can end with *", rule.From)
+		}
+		if u, err := url.Parse(rule.To); err != nil || strings.ContainsAny(rule.To, " \t\r\n") ||
+			!(strings.HasPrefix(rule.To, "/") || ((u.Scheme == "http" || u.Scheme == "https") && u.Host != "")) {
+			return fmt.Errorf("the target '%s' of '%s' must be a URL path or an absolute HTTP or HTTPS URL", rule.To, rule.From)
+		}
+		switch rule.Status {
+		case 0:
+			rule.Status = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("the status of '%s' must be 301, 302, 307, or 308", rule.From)
+		}
+	}
+	return nil
+}
+
+// parseRedirectsFile returns the valid rules of a _redirects file. Invalid lines are logged and skipped.
+func parseRedirectsFile(name string, data []byte) []RedirectRule {
+	var rules []RedirectRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			log.Printf("Redirects file %s, line %d: a rule needs a source, a target, and an optional status code", name, lineNumber)
+			continue
+		}
+		parsed := []RedirectRule{{From: fields[0], To: fields[1]}}
+		var err error
+		if len(fields) == 3 {
+			if parsed[0].Status, err = strconv.Atoi(fields[2]); err != nil {
+				err = fmt.Errorf("the status '%s' of '%s' is not a number", fields[2], fields[0])
+			}
+		}
+		if err == nil {
+			err = checkRedirectRules(parsed)
+		}
+		if err != nil {
+			log.Printf("Redirects file %s, line %d: %v", name, lineNumber, err)
+			continue
+		}
+		rules = append(rules, parsed[0])
+	}
+	return rules
+}
+
+// domainRedirects are the rules of the _redirects file of a domain.
+type domainRedirects struct {
+	modTime time.Time
+	rules   []RedirectRule
+}
+
+var redirectsFiles = map[string]*domainRedirects{}
+var redirectsFilesMu sync.Mutex
+
+// loadRedirectsFile returns the rules of the _redirects file of the domain. It is read again if it changed. If it can
+// not be read anymore, the rules that were read before are used.
+func loadRedirectsFile(domain string) []RedirectRule {
+	name := domain + redirectsFileName
+	info, err := fs.Stat(webFiles.Origin, name)
+
+	redirectsFilesMu.Lock()
+	defer redirectsFilesMu.Unlock()
+	loaded := redirectsFiles[domain]
+	if err != nil || (loaded != nil && loaded.modTime.Equal(info.ModTime())) {
+		if loaded != nil {
+			return loaded.rules
+		}
+		return nil
+	}
+
+	loaded = &domainRedirects{modTime: info.ModTime()}
+	if info.Size() > maxRedirectsFileSize {
+		log.Printf("Redirects file %s is larger than %d bytes, ignoring it", name, maxRedirectsFileSize)
+	} else if data, err := fs.ReadFile(webFiles.Origin, name); err != nil {
+		log.Println("Could not read redirects file:", err)
+	} else {
+		loaded.rules = parseRedirectsFile(name, data)
+	}
+	redirectsFiles[domain] = loaded
+	return loaded.rules
+}
+
+// serveRedirect answers the request with the first redirect rule of the domain that matches the URL path. It
+// returns false if no rule matches.
+func serveRedirect(w http.ResponseWriter, r *http.Request, domain string, settings domainSettings) bool {
+	rules := settings.redirects
+	if settings.redirectsFile {
+		rules = append(append([]RedirectRule(nil), rules...), loadRedirectsFile(domain)...)
+	}
+	for _, rule := range rules {
+		target, ok := rule.target(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+			target += "?" + r.URL.RawQuery
+		}
+		addHeaders(w)
+		http.Redirect(w, r, target, rule.Status)
+		return true
+	}
+	return false
+}
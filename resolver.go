@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The certificate subsystem (ACME and the DNS providers for DNS-01 challenges) resolves host names with its
+// own resolver. This way, certificates can be renewed even if the resolv.conf of the host is unusable, e.g.
+// inside of the jail or in containers.
+
+// certResolverNext is the index of the next DNS server, so that retries go to different servers.
+var certResolverNext uint32
+
+// certResolver returns the resolver for the certificate subsystem. If no DNS servers are configured, the
+// resolver of the host is used.
+func certResolver() *net.Resolver {
+	if len(config.CertDnsServers) == 0 {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// Ignore the DNS server from resolv.conf and use the configured DNS servers one after the other.
+			server := config.CertDnsServers[int(atomic.AddUint32(&certResolverNext, 1)-1)%len(config.CertDnsServers)]
+			dialer := &net.Dialer{Timeout: config.CertDnsTimeout}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// certLookupIPAddr resolves the host name with the resolver of the certificate subsystem, or through the parent
+// with resolve-through-parent. The lookup is limited by cert-dns-timeout.
+func certLookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.CertDnsTimeout)
+	defer cancel()
+	if resolveThroughParentEnabled() {
+		return resolveThroughParent(ctx, host)
+	}
+	return certResolver().LookupIPAddr(ctx, host)
+}
+
+// certDialContext connects to the address like net.Dialer.DialContext, but resolves the host name with the
+// resolver of the certificate subsystem.
+func certDialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialWithLookup(ctx, network, address, certLookupIPAddr)
+}
+
+// upstreamDialContext connects to a backend of the child. With resolve-through-parent, the host name is resolved
+// by the parent, otherwise by the resolver of the host.
+func upstreamDialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !resolveThroughParentEnabled() {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	return dialWithLookup(ctx, network, address, certLookupIPAddr)
+}
+
+// dialWithLookup connects to the address, and resolves its host name with the lookup function.
+func dialWithLookup(ctx context.Context, network, address string, lookup func(context.Context, string) ([]net.IPAddr, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+
+	// Try the addresses of both families until one of them accepts the connection.
+	return dialHappyEyeballs(ctx, network, ips, port)
+}
+
+// certHTTPClient returns an HTTP client for the certificate subsystem, which uses its resolver.
+func certHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = certDialContext
+	return &http.Client{Timeout: timeout, Transport: renewalWindowTransport{next: transport}}
+}
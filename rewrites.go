@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Rewrite rules map URL paths to other files without a redirect, so the client keeps the URL. The first rule whose
+// regular expression matches the URL path replaces the matching parts with its replacement, in which $1 or ${name}
+// refer to the groups of the expression (see Go's Regexp.ReplaceAllString). The result is served like a requested
+// URL path, so it must be a valid path of a file or a directory. The rewrites happen after the redirects.
+
+// RewriteRule maps the URL paths that match the pattern to another URL path.
+type RewriteRule struct {
+	// Regular expression (RE2 syntax) that is matched against the URL path, e.g. "^/v[0-9]+/".
+	Pattern string `yaml:"pattern"`
+
+	// Replacement for the matching parts of the URL path, e.g. "/".
+	Replacement string `yaml:"replacement"`
+
+	re *regexp.Regexp // The compiled pattern.
+}
+
+// checkRewriteRules compiles the patterns of the rules, and returns an error if a pattern is invalid.
+func checkRewriteRules(rules []RewriteRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil || rule.Pattern == "" {
+			return fmt.Errorf("the pattern '%s' is not a valid regular expression", rule.Pattern)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// rewritePath returns the URL path with the first rewrite rule of the domain that matches it applied, or the URL
+// path itself if no rule matches.
+func rewritePath(urlPath string, settings domainSettings) string {
+	for _, rule := range settings.rewrites {
+		if rule.re.MatchString(urlPath) {
+			return rule.re.ReplaceAllString(urlPath, rule.Replacement)
+		}
+	}
+	return urlPath
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A rollout serves a new content version of a domain from another directory of the web root to a percentage of the
+// clients, e.g. to canary a static release. Each client gets a bucket from 0 to 99, and the clients whose bucket is
+// below the percentage get the new version. The bucket is the hash of the domain and the client IP address, or,
+// with a rollout cookie, a random number that is kept in the cookie, so that a client stays on its version when it
+// changes its address. During the scheduled windows with the mode "rollout", all clients get the new version.
+//
+// The new version is served as a virtual domain "<domain>~rollout" in the file cache, whose directory is the
+// rollout directory, so that it is cached, compressed, and verified like the directory of the domain. The virtual
+// domain has the settings of the domain, and can not be requested directly.
+
+// rolloutDomainSuffix is appended to a domain for the files of its new content version.
+const rolloutDomainSuffix = "~rollout"
+
+// rolloutCookieMaxAge is the lifetime of the rollout cookie.
+const rolloutCookieMaxAge = 30 * 24 * time.Hour
+
+// RolloutConfig serves the content of the directory to the percentage of the clients.
+type RolloutConfig struct {
+	// Directory with the new content version, relative to the web root, e.g. "_example.com-v2".
+	Directory string `yaml:"directory"`
+
+	// Percentage of the clients that get the new content version, from 0 to 100.
+	Percentage int `yaml:"percentage"`
+
+	// Name of the cookie that keeps the bucket of a client. If it is empty, the bucket is derived from the client IP.
+	Cookie string `yaml:"cookie,omitempty"`
+}
+
+// checkRollout returns an error if the directory, the percentage, or the cookie name of the rollout is invalid.
+func checkRollout(rollout *RolloutConfig) error {
+	if rollout == nil {
+		return nil
+	}
+	if !fs.ValidPath(rollout.Directory) || rollout.Directory == "." {
+		return fmt.Errorf("the directory '%s' must be a path relative to the web root", rollout.Directory)
+	}
+	if rollout.Percentage < 0 || rollout.Percentage > 100 {
+		return fmt.Errorf("the percentage must be between 0 and 100")
+	}
+	if rollout.Cookie != "" && strings.ContainsAny(rollout.Cookie, " \t\r\n;,=()<>@:\\\"/[]?{}") {
+		return fmt.Errorf("the cookie '%s' is not a valid cookie name", rollout.Cookie)
+	}
+	return nil
+}
+
+// rolloutDomain returns the virtual domain of the new content version if the client gets it, otherwise the domain.
+func rolloutDomain(w http.ResponseWriter, r *http.Request, domain string, settings domainSettings) string {
+	rollout := settings.rollout
+	if rollout == nil {
+		return domain
+	}
+	if getSchedule().Rollout || rolloutBucket(w, r, domain, rollout) < rollout.Percentage {
+		return domain + rolloutDomainSuffix
+	}
+	return domain
+}
+
+// rolloutBucket returns the bucket of the client, from 0 to 99. A new client with a rollout cookie gets the cookie.
+func rolloutBucket(w http.ResponseWriter, r *http.Request, domain string, rollout *RolloutConfig) int {
+	if rollout.Cookie == "" {
+		host, _, err := net.SplitHostPort(logAddr(r.RemoteAddr))
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		h := fnv.New32a()
+		h.Write([]byte(domain + " " + host))
+		return int(h.Sum32() % 100)
+	}
+
+	if cookie, err := r.Cookie(rollout.Cookie); err == nil {
+		if bucket, err := strconv.Atoi(cookie.Value); err == nil && bucket >= 0 && bucket < 100 {
+			return bucket
+		}
+	}
+	bucket := rand.Intn(100)
+	http.SetCookie(w, &http.Cookie{
+		Name:     rollout.Cookie,
+		Value:    strconv.Itoa(bucket),
+		Path:     "/",
+		MaxAge:   int(rolloutCookieMaxAge.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return bucket
+}
+
+// rolloutDirectory returns the rollout directory of a virtual domain of a new content version, and false for other
+// domains.
+func rolloutDirectory(domain string) (string, bool) {
+	realDomain := strings.TrimSuffix(domain, rolloutDomainSuffix)
+	if realDomain == domain {
+		return "", false
+	}
+	rollout := settingsForDomain(realDomain).rollout
+	if rollout == nil {
+		return "", false
+	}
+	return rollout.Directory, true
+}
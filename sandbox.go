@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// The child restricts itself with a sandbox after it bound the ports and before it serves requests. The strategy is
+// selected with the setting "sandbox". Strategies that need the cooperation of the parent (e.g. new namespaces for
+// the child) prepare the command of the child before it is started.
+
+// Sandbox is a strategy to restrict the child.
+type Sandbox interface {
+	// Prepare is called by the parent before the child is started.
+	Prepare(cmd *exec.Cmd) error
+
+	// Enter is called by the child after the ports are bound. It returns the path of the web root inside
+	// the sandbox, e.g. "." after a chroot into the web root.
+	Enter(webRoot string) (string, error)
+}
+
+// Sandbox strategies.
+const (
+	sandboxNone       = "none"       // No restrictions.
+	sandboxChroot     = "chroot"     // Chroot into the web root, switch to the jail user, and drop all capabilities (Linux).
+	sandboxNamespaces = "namespaces" // Like chroot, in new mount, PID, IPC, and UTS namespaces (Linux).
+	sandboxLandlock   = "landlock"   // Read only access to the web root with Landlock, switch to the jail user, and drop all capabilities (Linux 5.13+).
+)
+
+// sandboxes are the strategies that are available on this system. The files for the systems add theirs.
+var sandboxes = map[string]func() Sandbox{
+	sandboxNone: func() Sandbox { return noSandbox{} },
+}
+
+// newSandbox returns the sandbox strategy with the name.
+func newSandbox(name string) (Sandbox, error) {
+	create, ok := sandboxes[name]
+	if !ok {
+		names := make([]string, 0, len(sandboxes))
+		for name := range sandboxes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("sandbox '%s' is not available on this system, available are: %v", name, names)
+	}
+	return create(), nil
+}
+
+// prepareSandbox lets the configured sandbox prepare the command of the child.
+func prepareSandbox(cmd *exec.Cmd) {
+	sandbox, err := newSandbox(config.Sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sandbox.Prepare(cmd); err != nil {
+		log.Fatal("Could not prepare the sandbox: ", err)
+	}
+}
+
+// enterSandbox restricts the child with the configured sandbox, and points the file cache to the web root inside it.
+// It must be called before the servers serve requests.
+func enterSandbox() {
+	sandbox, err := newSandbox(config.Sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The parent gets the state of the sandbox, with the web root to verify the root directory in the sandbox.
+	webRootInfo, _ := os.Stat(config.WebRootDirectory)
+	webRootPath, _ := filepath.Abs(config.WebRootDirectory)
+	defer reportSandboxState(webRootPath, webRootInfo)
+
+	if config.Sandbox == sandboxNone {
+		return
+	}
+
+	// Load the CA certificates of the system now, because they can not be read in the sandbox.
+	x509.SystemCertPool()
+
+	log.Println("Entering sandbox:", config.Sandbox)
+	webRoot, err := sandbox.Enter(config.WebRootDirectory)
+	if err != nil {
+		log.Fatal("Could not enter the sandbox: ", err)
+	}
+
+	// Try not to have too many things in memory.
+	os.Clearenv()
+
+	config.WebRootDirectory = webRoot
+	if webFiles != nil {
+		webFiles.Origin = mountFS{os.DirFS(webRoot)}
+	}
+}
+
+// noSandbox does not restrict the child.
+type noSandbox struct{}
+
+func (noSandbox) Prepare(cmd *exec.Cmd) error { return nil }
+
+func (noSandbox) Enter(webRoot string) (string, error) { return webRoot, nil }
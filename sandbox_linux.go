@@ -0,0 +1,239 @@
+//go:build linux
+// +build linux
+
+// Needs Go 1.16+!
+// Prior to the release of Go 1.16 in 2021, the `syscall.Setuid()` function
+// did not work reliably on Linux to drop the privilege of a setuid-root
+// Go program. The issue was reported in 2011 but was not resolved until
+// the release of Go 1.16. With Go 1.16 and later, `syscall.Setuid()` can be
+// used to drop setuid-root privilege in native Go and when using CGo with
+// the assistance of glibc's `nptl:setxid` mechanism.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+func init() {
+	sandboxes[sandboxChroot] = func() Sandbox { return chrootSandbox{} }
+	sandboxes[sandboxNamespaces] = func() Sandbox { return namespacesSandbox{} }
+	sandboxes[sandboxLandlock] = func() Sandbox { return landlockSandbox{} }
+}
+
+// chrootSandbox changes the root directory of the child to the web root, switches to the jail user,
+// and drops all capabilities.
+type chrootSandbox struct{}
+
+func (chrootSandbox) Prepare(cmd *exec.Cmd) error { return nil }
+
+func (chrootSandbox) Enter(webRoot string) (string, error) {
+	// Look up the jail user before /etc/passwd is out of reach.
+	uid, gid := jailUser()
+
+	// Change the working directory and then the root directory to the web root.
+	if err := os.Chdir(filepath.Clean(webRoot)); err != nil {
+		return "", fmt.Errorf("chdir: %v", err)
+	}
+	if err := syscall.Chroot("."); err != nil {
+		return "", fmt.Errorf("chroot: %v", err)
+	}
+	if err := dropPrivileges(uid, gid); err != nil {
+		return "", err
+	}
+	return ".", nil
+}
+
+// namespacesSandbox starts the child in new mount, PID, IPC, and UTS namespaces, and then works like chrootSandbox.
+// The network namespace is kept, because the child serves on the network.
+type namespacesSandbox struct{}
+
+func (namespacesSandbox) Prepare(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	return nil
+}
+
+func (namespacesSandbox) Enter(webRoot string) (string, error) {
+	// Do not propagate mount events between the namespace of the child and the namespace of the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return "", fmt.Errorf("make mounts private: %v", err)
+	}
+	return chrootSandbox{}.Enter(webRoot)
+}
+
+// Landlock system calls and access rights (see linux/landlock.h).
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockAccessFsExecute    = 1 << 0
+	landlockAccessFsWriteFile  = 1 << 1
+	landlockAccessFsReadFile   = 1 << 2
+	landlockAccessFsReadDir    = 1 << 3
+	landlockAccessFsRemoveDir  = 1 << 4
+	landlockAccessFsRemoveFile = 1 << 5
+	landlockAccessFsMakeChar   = 1 << 6
+	landlockAccessFsMakeDir    = 1 << 7
+	landlockAccessFsMakeReg    = 1 << 8
+	landlockAccessFsMakeSock   = 1 << 9
+	landlockAccessFsMakeFifo   = 1 << 10
+	landlockAccessFsMakeBlock  = 1 << 11
+	landlockAccessFsMakeSym    = 1 << 12
+	landlockAccessFsRefer      = 1 << 13 // ABI 2
+	landlockAccessFsTruncate   = 1 << 14 // ABI 3
+
+	prSetNoNewPrivs = 38
+
+	// O_PATH is not defined by the syscall package on all architectures.
+	oPath = 0x200000
+)
+
+// landlockReadOnlySystemPaths can still be read in the Landlock sandbox, so that the child can resolve host names and
+// verify the certificates of the ACME server.
+var landlockReadOnlySystemPaths = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/ssl", "/etc/pki", "/etc/ca-certificates"}
+
+// landlockSandbox allows the child to read the web root and a few system files, but nothing else in the file system.
+// It then switches to the jail user and drops all capabilities. Unlike chroot, the paths stay the same.
+type landlockSandbox struct{}
+
+func (landlockSandbox) Prepare(cmd *exec.Cmd) error { return nil }
+
+func (landlockSandbox) Enter(webRoot string) (string, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return "", fmt.Errorf("landlock is not supported by the kernel: %v", errno)
+	}
+
+	// Handle all file system access rights that the kernel knows.
+	var handled uint64 = landlockAccessFsExecute | landlockAccessFsWriteFile | landlockAccessFsReadFile | landlockAccessFsReadDir |
+		landlockAccessFsRemoveDir | landlockAccessFsRemoveFile | landlockAccessFsMakeChar | landlockAccessFsMakeDir |
+		landlockAccessFsMakeReg | landlockAccessFsMakeSock | landlockAccessFsMakeFifo | landlockAccessFsMakeBlock | landlockAccessFsMakeSym
+	if abi >= 2 {
+		handled |= landlockAccessFsRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessFsTruncate
+	}
+
+	rulesetAttr := struct{ HandledAccessFs uint64 }{handled}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&rulesetAttr)), unsafe.Sizeof(rulesetAttr), 0)
+	if errno != 0 {
+		return "", fmt.Errorf("landlock_create_ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	// The web root can be read completely, the system paths only if they exist.
+	if err := landlockAllowRead(int(fd), webRoot); err != nil {
+		return "", err
+	}
+	for _, path := range landlockReadOnlySystemPaths {
+		if err := landlockAllowRead(int(fd), path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Landlock: could not allow", path, err)
+		}
+	}
+
+	// The CGI scripts in the cgi-bin directories can be executed.
+	for domain := range config.Domains {
+		if cgiBin := settingsForDomain(domain).cgiBin; cgiBin != "" {
+			path := filepath.Join(webRoot, domain, filepath.FromSlash(cgiBin))
+			if err := landlockAllow(int(fd), path, landlockAccessFsExecute); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Println("Landlock: could not allow", path, err)
+			}
+		}
+	}
+
+	// Switch the user before the restriction, because the lookup of the user reads /etc/passwd.
+	if err := dropPrivileges(jailUser()); err != nil {
+		return "", err
+	}
+
+	// Restrict all threads of the process. Landlock needs no_new_privs without CAP_SYS_ADMIN.
+	if _, _, errno := psx.Syscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return "", fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", errno)
+	}
+	if _, _, errno := psx.Syscall3(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return "", fmt.Errorf("landlock_restrict_self: %v", errno)
+	}
+	landlockABI = int(abi)
+	return webRoot, nil
+}
+
+// landlockAllowRead adds a rule that allows to read the file or everything beneath the directory.
+func landlockAllowRead(rulesetFd int, path string) error {
+	return landlockAllow(rulesetFd, path, 0)
+}
+
+// landlockAllow adds a rule that allows to read the file or everything beneath the directory, with the additional
+// access rights.
+func landlockAllow(rulesetFd int, path string, additionalAccess uint64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var access uint64 = landlockAccessFsReadFile | additionalAccess
+	if info.IsDir() {
+		access |= landlockAccessFsReadDir
+	}
+
+	pathFd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(pathFd)
+
+	// struct landlock_path_beneath_attr is packed: the file descriptor directly follows the access rights.
+	attr := struct {
+		AllowedAccess uint64
+		ParentFd      int32
+	}{access, int32(pathFd)}
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_add_rule %s: %v", path, errno)
+	}
+	return nil
+}
+
+// dropPrivileges switches to the user and drops all capabilities.
+func dropPrivileges(uid, gid int) error {
+	// Switch UID and GID rights of the process to user user.UID and user.GID.
+	log.Printf("Switching to new user (UID: %d GID: %d)", uid, gid)
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("failed to drop supplementary groups: %v", err)
+	}
+	if err := syscall.Setregid(gid, gid); err != nil {
+		return fmt.Errorf("failed to switch REGID rights: %v", err)
+	}
+	if err := syscall.Setreuid(uid, uid); err != nil {
+		return fmt.Errorf("failed to switch REUID rights: %v", err)
+	}
+
+	// Drop any privilege a process might have (including for root,
+	// but note root 'owns' a lot of system files so a cap-limited
+	// root can still do considerable damage to a running system).
+	old := cap.GetProc()
+	empty := cap.NewSet()
+	if err := empty.SetProc(); err != nil {
+		return fmt.Errorf("failed to drop privilege: %q -> %q: %v", old, empty, err)
+	}
+	now := cap.GetProc()
+	if cf, _ := now.Cf(empty); cf != 0 {
+		return fmt.Errorf("failed to fully drop privilege: have=%q, wanted=%q", now, empty)
+	}
+	return nil
+}
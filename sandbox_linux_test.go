@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestSandboxHelperProcess is run as a child process by the sandbox tests, because a sandbox can not be left
+// again. It enters the sandbox in SSLSERVER_TEST_SANDBOX with the web root in SSLSERVER_TEST_WEBROOT, and prints
+// what it can access afterwards.
+func TestSandboxHelperProcess(t *testing.T) {
+	name := os.Getenv("SSLSERVER_TEST_SANDBOX")
+	if name == "" {
+		return
+	}
+	sandbox, err := newSandbox(name)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	webRoot, err := sandbox.Enter(os.Getenv("SSLSERVER_TEST_WEBROOT"))
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("webroot:", webRoot)
+	marker, err := os.ReadFile(filepath.Join(webRoot, "marker"))
+	fmt.Println("marker:", strings.TrimSpace(string(marker)), err == nil)
+	_, err = os.ReadFile("/etc/passwd")
+	fmt.Println("outside:", err == nil)
+	fmt.Println("uid:", os.Getuid())
+	os.Exit(0)
+}
+
+// runSandboxHelper runs TestSandboxHelperProcess with the sandbox and a new web root, and returns its output.
+func runSandboxHelper(t *testing.T, name string) (webRoot, output string) {
+	if os.Getuid() != 0 {
+		t.Skip("the sandbox needs root")
+	}
+	webRoot = t.TempDir()
+	// The jail user has to read the web root, and to reach it for landlock.
+	for _, dir := range []string{filepath.Dir(webRoot), webRoot} {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(webRoot, "marker"), []byte("inside\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandboxHelperProcess$")
+	cmd.Env = append(os.Environ(), "SSLSERVER_TEST_SANDBOX="+name, "SSLSERVER_TEST_WEBROOT="+webRoot)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Logf("output: %s", out)
+		if name == sandboxLandlock && strings.Contains(string(out), "not supported") {
+			t.Skip("landlock is not supported by the kernel")
+		}
+		t.Fatal(err)
+	}
+	return webRoot, string(out)
+}
+
+// TestChrootSandbox checks that the chroot strategy returns "." as the web root, in which the files of the web
+// root are, and that the files outside and root privileges are out of reach.
+func TestChrootSandbox(t *testing.T) {
+	_, output := runSandboxHelper(t, sandboxChroot)
+	for _, want := range []string{"webroot: .\n", "marker: inside true\n", "outside: false\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output %q does not contain %q", output, want)
+		}
+	}
+	if strings.Contains(output, "uid: 0\n") {
+		t.Errorf("the sandbox kept root: %q", output)
+	}
+}
+
+// TestLandlockSandbox checks that the landlock strategy keeps the path of the web root, and that only the web root
+// can be read.
+func TestLandlockSandbox(t *testing.T) {
+	webRoot, output := runSandboxHelper(t, sandboxLandlock)
+	for _, want := range []string{"webroot: " + webRoot + "\n", "marker: inside true\n", "outside: false\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output %q does not contain %q", output, want)
+		}
+	}
+	if strings.Contains(output, "uid: 0\n") {
+		t.Errorf("the sandbox kept root: %q", output)
+	}
+}
+
+// TestNamespacesSandboxPrepare checks that the namespaces strategy starts the child in new namespaces, but in the
+// network namespace of the parent, and keeps the other attributes of the command.
+func TestNamespacesSandboxPrepare(t *testing.T) {
+	cmd := exec.Command("child")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := (namespacesSandbox{}).Prepare(cmd); err != nil {
+		t.Fatal(err)
+	}
+	want := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if cmd.SysProcAttr.Cloneflags&want != want {
+		t.Errorf("clone flags %#x do not contain %#x", cmd.SysProcAttr.Cloneflags, want)
+	}
+	if cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWNET != 0 {
+		t.Error("the child gets a new network namespace")
+	}
+	if !cmd.SysProcAttr.Setpgid {
+		t.Error("Prepare replaced the attributes of the command")
+	}
+
+	// chroot does not need the parent.
+	cmd = exec.Command("child")
+	if err := (chrootSandbox{}).Prepare(cmd); err != nil || cmd.SysProcAttr != nil {
+		t.Errorf("chroot Prepare changed the command: %v, %v", err, cmd.SysProcAttr)
+	}
+}
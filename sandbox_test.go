@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestNewSandbox checks that the sandbox strategies are selected by their names, and that the strategies of other
+// systems and unknown names are rejected.
+func TestNewSandbox(t *testing.T) {
+	linux := runtime.GOOS == "linux"
+	tests := []struct {
+		name      string
+		wantType  string
+		available bool
+	}{
+		{sandboxNone, "main.noSandbox", true},
+		{sandboxChroot, "main.chrootSandbox", linux},
+		{sandboxNamespaces, "main.namespacesSandbox", linux},
+		{sandboxLandlock, "main.landlockSandbox", linux},
+		{"jail", "", false},
+		{"", "", false},
+		{"None", "", false},
+	}
+	for _, test := range tests {
+		sandbox, err := newSandbox(test.name)
+		if !test.available {
+			if err == nil {
+				t.Errorf("newSandbox(%q) = %T, want an error", test.name, sandbox)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newSandbox(%q): %v", test.name, err)
+		} else if got := fmt.Sprintf("%T", sandbox); got != test.wantType {
+			t.Errorf("newSandbox(%q) = %s, want %s", test.name, got, test.wantType)
+		}
+	}
+}
+
+// TestNewSandboxError checks that the error of an unknown sandbox lists the available sandboxes.
+func TestNewSandboxError(t *testing.T) {
+	_, err := newSandbox("jail")
+	if err == nil {
+		t.Fatal("newSandbox(\"jail\") did not fail")
+	}
+	want := "[none]"
+	if runtime.GOOS == "linux" {
+		want = "[chroot landlock namespaces none]"
+	}
+	if !strings.Contains(err.Error(), "'jail'") || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("error %q does not name the sandbox and end with %s", err, want)
+	}
+}
+
+// TestSandboxDefault checks that the child is not restricted without the sandbox setting, and that the default is
+// available on all systems.
+func TestSandboxDefault(t *testing.T) {
+	if config.Sandbox != sandboxNone {
+		t.Errorf("default sandbox %q, want %q", config.Sandbox, sandboxNone)
+	}
+	if _, err := newSandbox(config.Sandbox); err != nil {
+		t.Errorf("default sandbox: %v", err)
+	}
+}
+
+// TestNoSandbox checks that the none strategy does not change the command of the child nor the web root.
+func TestNoSandbox(t *testing.T) {
+	cmd := exec.Command("child")
+	if err := (noSandbox{}).Prepare(cmd); err != nil || cmd.SysProcAttr != nil {
+		t.Errorf("Prepare changed the command: %v, %v", err, cmd.SysProcAttr)
+	}
+	for _, webRoot := range []string{"www_static", "/srv/www", "."} {
+		if got, err := (noSandbox{}).Enter(webRoot); err != nil || got != webRoot {
+			t.Errorf("Enter(%q) = %q, %v, want %q", webRoot, got, err, webRoot)
+		}
+	}
+}
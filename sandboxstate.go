@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// After the child entered its sandbox, it reports the state of its confinement to the parent: the user and groups,
+// the capabilities, no_new_privs, seccomp, Landlock, whether the root directory is the web root, and the listening
+// sockets and the number of open file descriptors. The child inspects itself with system calls, because /proc can
+// not be read in the sandbox. The parent adds the root directory of the child from /proc on Linux, which the child
+// can not influence, logs the state with warnings where it does not match the configured sandbox, and answers the
+// admin command "sandbox" with it, so that auditors can verify that the child is actually confined.
+
+// sandboxState is the confinement of the child.
+type sandboxState struct {
+	Sandbox       string            `json:"sandbox"`
+	PID           int               `json:"pid"` // The PID of the child outside of its PID namespace.
+	UID           int               `json:"uid"`
+	EUID          int               `json:"euid"`
+	GID           int               `json:"gid"`
+	EGID          int               `json:"egid"`
+	Groups        []int             `json:"groups"`
+	Capabilities  string            `json:"capabilities"` // In the text form of libcap, "=" for none.
+	NoNewPrivs    bool              `json:"no_new_privs"`
+	Seccomp       string            `json:"seccomp"`  // "disabled", "strict", "filter", or "unknown".
+	Landlock      string            `json:"landlock"` // "not enforced", or "enforced (ABI <version>)".
+	WebRoot       string            `json:"web_root"`
+	Chroot        bool              `json:"chroot"`                   // The root directory of the child is the web root.
+	RootDirectory string            `json:"root_directory,omitempty"` // The root directory of the child, seen by the parent.
+	Listeners     []sandboxListener `json:"listeners"`
+	OpenFiles     int               `json:"open_files"`
+	Reported      time.Time         `json:"reported"`
+	Warnings      []string          `json:"warnings,omitempty"`
+}
+
+// sandboxListener is a listening socket of the child.
+type sandboxListener struct {
+	FD      int    `json:"fd"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// childSandboxState is the last state that the child has reported.
+var childSandboxState struct {
+	sync.Mutex
+	state *sandboxState
+}
+
+// reportSandboxState sends the state of the sandbox from the child to the parent. The web root is the directory
+// before the sandbox was entered, which is compared with the root directory in the sandbox.
+func reportSandboxState(webRoot string, webRootInfo os.FileInfo) {
+	state := sandboxState{
+		Sandbox:  config.Sandbox,
+		UID:      os.Getuid(),
+		EUID:     os.Geteuid(),
+		GID:      os.Getgid(),
+		EGID:     os.Getegid(),
+		WebRoot:  webRoot,
+		Reported: time.Now(),
+	}
+	state.Groups, _ = os.Getgroups()
+	if rootInfo, err := os.Stat("/"); err == nil && webRootInfo != nil {
+		state.Chroot = os.SameFile(rootInfo, webRootInfo)
+	}
+	inspectSandbox(&state)
+
+	data, _ := json.Marshal(state)
+	childToParentCh <- Command{Type: cmdSandboxState, Data: data}
+}
+
+// receiveSandboxState stores and logs the state of the sandbox that the child has reported.
+func receiveSandboxState(data []byte) {
+	var state sandboxState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println("Invalid sandbox state from child:", err)
+		return
+	}
+	if childProcess != nil {
+		state.PID = childProcess.Pid
+		state.RootDirectory = childRootDirectory(childProcess.Pid)
+	}
+	state.Warnings = sandboxWarnings(state)
+
+	listeners := make([]string, len(state.Listeners))
+	for i, listener := range state.Listeners {
+		listeners[i] = fmt.Sprintf("%s %s (fd %d)", listener.Network, listener.Address, listener.FD)
+	}
+	log.Printf("Sandbox of the child: %s, uid %d, gid %d, capabilities %q, no_new_privs %t, seccomp %s, landlock %s, chroot to the web root %t, root directory %q, %d open files, listeners: %s",
+		state.Sandbox, state.EUID, state.EGID, state.Capabilities, state.NoNewPrivs, state.Seccomp, state.Landlock, state.Chroot, state.RootDirectory, state.OpenFiles, strings.Join(listeners, ", "))
+	for _, warning := range state.Warnings {
+		log.Println("Warning: the child is not confined as configured:", warning)
+	}
+
+	childSandboxState.Lock()
+	childSandboxState.state = &state
+	childSandboxState.Unlock()
+}
+
+// sandboxWarnings returns the differences between the state and the configured sandbox.
+func sandboxWarnings(state sandboxState) []string {
+	var warnings []string
+	if state.Sandbox == sandboxNone {
+		return nil
+	}
+	if state.UID == 0 || state.EUID == 0 || state.GID == 0 || state.EGID == 0 {
+		warnings = append(warnings, "it runs as root")
+	}
+	if state.Capabilities != "=" {
+		warnings = append(warnings, fmt.Sprintf("it has the capabilities %q", state.Capabilities))
+	}
+	switch state.Sandbox {
+	case sandboxChroot, sandboxNamespaces:
+		if !state.Chroot {
+			warnings = append(warnings, "its root directory is not the web root")
+		}
+		if state.RootDirectory != "" && state.RootDirectory != state.WebRoot {
+			warnings = append(warnings, fmt.Sprintf("its root directory is %s instead of %s", state.RootDirectory, state.WebRoot))
+		}
+	case sandboxLandlock:
+		if !strings.HasPrefix(state.Landlock, "enforced") {
+			warnings = append(warnings, "Landlock is not enforced")
+		}
+	}
+	return warnings
+}
+
+// sandboxStatus returns the last state of the sandbox of the child as JSON, for the admin command "sandbox".
+func sandboxStatus() (string, error) {
+	childSandboxState.Lock()
+	defer childSandboxState.Unlock()
+	if childSandboxState.state == nil {
+		return "", errors.New("the child has not reported its sandbox yet")
+	}
+	data, _ := json.Marshal(childSandboxState.state)
+	return string(data), nil
+}
@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// prctl options to read the state of the process.
+const (
+	prGetSeccomp    = 21
+	prGetNoNewPrivs = 39
+
+	// SO_DOMAIN is not defined by the syscall package on all architectures.
+	soDomain = 39
+)
+
+// maxInspectedFDs limits the file descriptors that are inspected.
+const maxInspectedFDs = 65536
+
+// landlockABI is the Landlock ABI version with which the child restricted itself, or 0.
+var landlockABI int
+
+// inspectSandbox adds the capabilities, no_new_privs, seccomp, Landlock, the listening sockets, and the number of
+// open file descriptors of the process to the state.
+func inspectSandbox(state *sandboxState) {
+	state.Capabilities = cap.GetProc().String()
+
+	noNewPrivs, _, errno := syscall.Syscall(syscall.SYS_PRCTL, prGetNoNewPrivs, 0, 0)
+	state.NoNewPrivs = errno == 0 && noNewPrivs == 1
+	seccomp, _, errno := syscall.Syscall(syscall.SYS_PRCTL, prGetSeccomp, 0, 0)
+	switch {
+	case errno != 0:
+		state.Seccomp = "unknown"
+	case seccomp == 0:
+		state.Seccomp = "disabled"
+	case seccomp == 1:
+		state.Seccomp = "strict"
+	default:
+		state.Seccomp = "filter"
+	}
+	state.Landlock = "not enforced"
+	if landlockABI > 0 {
+		state.Landlock = fmt.Sprintf("enforced (ABI %d)", landlockABI)
+	}
+
+	limit := maxInspectedFDs
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil && rlimit.Cur < uint64(limit) {
+		limit = int(rlimit.Cur)
+	}
+	for fd := 0; fd < limit; fd++ {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0); errno != 0 {
+			continue
+		}
+		state.OpenFiles++
+		if listening, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); err == nil && listening == 1 {
+			state.Listeners = append(state.Listeners, inspectListener(fd))
+		}
+	}
+}
+
+// inspectListener returns the network and the address of the listening socket.
+func inspectListener(fd int) sandboxListener {
+	listener := sandboxListener{FD: fd, Network: "unknown"}
+	if family, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, soDomain); err == nil {
+		switch family {
+		case syscall.AF_INET:
+			listener.Network = "tcp4"
+		case syscall.AF_INET6:
+			listener.Network = "tcp6"
+		case syscall.AF_UNIX:
+			listener.Network = "unix"
+		}
+	}
+	sockaddr, err := syscall.Getsockname(fd)
+	if err != nil {
+		return listener
+	}
+	switch addr := sockaddr.(type) {
+	case *syscall.SockaddrInet4:
+		listener.Address = net.JoinHostPort(net.IP(addr.Addr[:]).String(), strconv.Itoa(addr.Port))
+	case *syscall.SockaddrInet6:
+		listener.Address = net.JoinHostPort(net.IP(addr.Addr[:]).String(), strconv.Itoa(addr.Port))
+	case *syscall.SockaddrUnix:
+		listener.Address = addr.Name
+	}
+	return listener
+}
+
+// childRootDirectory returns the root directory of the child from /proc, or "" if it can not be read.
+func childRootDirectory(pid int) string {
+	root, err := os.Readlink(fmt.Sprintf("/proc/%d/root", pid))
+	if err != nil {
+		return ""
+	}
+	return root
+}
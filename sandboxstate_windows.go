@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+// inspectSandbox has nothing to add on Windows, because there are no sandboxes.
+func inspectSandbox(state *sandboxState) {
+	state.Capabilities = "="
+	state.Seccomp = "unknown"
+	state.Landlock = "not enforced"
+}
+
+// childRootDirectory returns "", because Windows has no root directories of processes.
+func childRootDirectory(pid int) string {
+	return ""
+}
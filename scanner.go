@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Actions for requests that look like exploit probes of scanners.
+const (
+	scannerActionNotFound   = "not-found"   // Answer with 404 Not Found like for every other missing file.
+	scannerActionClose      = "close"       // Reset the connection immediately.
+	scannerActionNoResponse = "no-response" // Close the connection without a response (like the nginx status 444).
+	scannerActionTarpit     = "tarpit"      // Send the response very slowly to waste the time of the scanner.
+)
+
+// maxTarpitConnections limits the number of connections that are held in the tarpit at the same time,
+// so that the tarpit itself can not be used to exhaust the server. Additional scanners are disconnected.
+const maxTarpitConnections = 100
+
+// The number of connections that are currently held in the tarpit.
+var tarpitConnections int32
+
+// isScannerProbe returns true if the URL path contains one of the configured scanner patterns.
+func isScannerProbe(urlPath string) bool {
+	return matchingScannerPattern(urlPath) != ""
+}
+
+// matchingScannerPattern returns the first of the configured scanner patterns that the URL path contains, or "".
+func matchingScannerPattern(urlPath string) string {
+	lowerPath := strings.ToLower(urlPath)
+	for _, pattern := range config.ScannerPatterns {
+		if pattern != "" && strings.Contains(lowerPath, strings.ToLower(pattern)) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// checkScriptPath returns an error if the URL path of a script would be treated as an exploit probe, because the
+// scanner-action would then answer it instead of the script.
+func checkScriptPath(urlPath string) error {
+	if config.ScannerAction == scannerActionNotFound {
+		return nil
+	}
+	if pattern := matchingScannerPattern(urlPath); pattern != "" {
+		return fmt.Errorf("scripts like '%s' match the scanner-patterns entry '%s', so the scanner-action '%s' would answer them instead. Remove the entry from scanner-patterns", urlPath, pattern, config.ScannerAction)
+	}
+	return nil
+}
+
+// scannerHandler handles requests that look like exploit probes with the configured scanner action.
+func scannerHandler(next http.Handler) http.Handler {
+	if config.ScannerAction == scannerActionNotFound || len(config.ScannerPatterns) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isScannerProbe(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if config.LogRequests {
+			log.Println("Scanner probe:", logAddr(r.RemoteAddr), "", r.URL.Path, "", config.ScannerAction)
+		}
+
+		switch config.ScannerAction {
+		case scannerActionClose:
+			closeConnection(w, true)
+		case scannerActionNoResponse:
+			closeConnection(w, false)
+		case scannerActionTarpit:
+			tarpit(w)
+		}
+	})
+}
+
+// closeConnection closes the connection without sending a response. If reset is true, the connection is reset
+// instead of closed gracefully. For HTTP/2 connections, which can not be hijacked, only the stream is aborted.
+func closeConnection(w http.ResponseWriter, reset bool) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if reset {
+		setLingerZero(conn)
+	}
+	conn.Close()
+}
+
+// setLingerZero makes Close reset the TCP connection instead of closing it gracefully. The TCP connection is found
+// below the wrappers of the TLS connection, the strict HTTP parsing, the TLS fingerprints, and the sni-passthrough.
+func setLingerZero(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetLinger(0)
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		case *strictConn:
+			conn = c.Conn
+		case *fingerprintConn:
+			conn = c.Conn
+		case *prefixConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
+
+// tarpit sends a response very slowly until the tarpit duration is over.
+func tarpit(w http.ResponseWriter) {
+	if atomic.AddInt32(&tarpitConnections, 1) > maxTarpitConnections {
+		atomic.AddInt32(&tarpitConnections, -1)
+		closeConnection(w, true)
+		return
+	}
+	defer atomic.AddInt32(&tarpitConnections, -1)
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+
+	deadline := time.Now().Add(config.ScannerTarpitDuration)
+	for time.Now().Before(deadline) {
+		if _, err := w.Write([]byte(" ")); err != nil {
+			return
+		}
+		controller.Flush()
+		time.Sleep(5 * time.Second)
+	}
+
+	closeConnection(w, true)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduled windows start at the times of a cron expression and last for their duration. The parent evaluates
+// the windows every minute and sends the resulting state to the child, which applies it.
+
+// Modes of the scheduled windows.
+const (
+	scheduleModeMaintenance = "maintenance" // The child answers all requests with 503 Service Unavailable.
+	scheduleModeRenewals    = "renewals"    // Certificates are only renewed within these windows.
+	scheduleModeRollout     = "rollout"     // All clients get the new content version of the domains with a rollout.
+)
+
+// maxScheduleDuration is the maximum duration of a window.
+const maxScheduleDuration = 7 * 24 * time.Hour
+
+// ScheduleConfig is a window that starts at the times of the cron expression and lasts for the duration.
+type ScheduleConfig struct {
+	// Cron expression with minute, hour, day of month, month, and day of week, e.g. "0 2 * * 0" for 2:00 on Sundays.
+	Cron string `yaml:"cron"`
+
+	// Duration of the window.
+	Duration time.Duration `yaml:"duration"`
+
+	// Mode of the window: "maintenance" or "renewals".
+	Mode string `yaml:"mode"`
+}
+
+// scheduleState is the state that the parent sends to the child.
+type scheduleState struct {
+	Maintenance      bool      `json:"maintenance"`
+	MaintenanceUntil time.Time `json:"maintenance-until"`
+	RenewalsAllowed  bool      `json:"renewals-allowed"`
+	Rollout          bool      `json:"rollout"`
+}
+
+var scheduleMu sync.Mutex
+var currentSchedule = scheduleState{RenewalsAllowed: true}
+
+// cronSchedule holds the allowed values of each field of a cron expression.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool
+}
+
+// parseCron parses a cron expression with five fields. Each field can be "*", a number, a range "a-b",
+// a step "*/n" or "a-b/n", or a comma separated list of them. Day of week 0 and 7 are Sunday.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("a cron expression needs 5 fields: minute hour day-of-month month day-of-week")
+	}
+	c := &cronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	limits := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*map[int]bool{&c.minutes, &c.hours, &c.days, &c.months, &c.weekdays}
+	for i, field := range fields {
+		set, err := parseCronField(field, limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron field '%s': %v", field, err)
+		}
+		*sets[i] = set
+	}
+	if c.weekdays[7] {
+		c.weekdays[0] = true
+	}
+	return c, nil
+}
+
+// parseCronField returns the values of the field between min and max.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, errors.New("invalid step")
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("invalid number")
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid number")
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("values must be between %d and %d", min, max)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matches returns true if the minute of t is one of the times of the cron expression.
+// If day of month and day of week are both restricted, one of them has to match, like in cron.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// activeUntil returns the end of the window that is active at now, or the zero time if no window is active.
+func (s ScheduleConfig) activeUntil(now time.Time) time.Time {
+	c, err := parseCron(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	// Search the latest start of a window within the duration.
+	start := now.Truncate(time.Minute)
+	for t := start; now.Sub(t) < s.Duration; t = t.Add(-time.Minute) {
+		if c.matches(t) {
+			return t.Add(s.Duration)
+		}
+	}
+	return time.Time{}
+}
+
+// evaluateSchedules returns the state of the scheduled windows at now.
+func evaluateSchedules(now time.Time) scheduleState {
+	state := scheduleState{RenewalsAllowed: true}
+	hasRenewalWindows := false
+	for _, s := range config.Schedules {
+		until := s.activeUntil(now)
+		switch s.Mode {
+		case scheduleModeMaintenance:
+			if !until.IsZero() {
+				state.Maintenance = true
+				if until.After(state.MaintenanceUntil) {
+					state.MaintenanceUntil = until
+				}
+			}
+		case scheduleModeRenewals:
+			if !hasRenewalWindows {
+				hasRenewalWindows = true
+				state.RenewalsAllowed = false
+			}
+			if !until.IsZero() {
+				state.RenewalsAllowed = true
+			}
+		case scheduleModeRollout:
+			if !until.IsZero() {
+				state.Rollout = true
+			}
+		}
+	}
+	return state
+}
+
+// runSchedules evaluates the scheduled windows every minute in the parent and sends changes to the child.
+func runSchedules() {
+	var last *scheduleState
+	evaluate := func() {
+		state := evaluateSchedules(time.Now())
+		if last == nil || *last != state {
+			log.Printf("Schedule: maintenance: %t, renewals allowed: %t, rollout: %t", state.Maintenance, state.RenewalsAllowed, state.Rollout)
+			data, _ := json.Marshal(state)
+			parentToChildCh <- Command{Type: cmdSchedule, Data: data}
+			last = &state
+		}
+	}
+
+	evaluate()
+	// Evaluate again at the start of each minute.
+	jobs.everyAligned(jobScheduleWindows, time.Minute, evaluate)
+}
+
+// applySchedule sets the state that the parent has sent in the child.
+func applySchedule(data []byte) {
+	var state scheduleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println("Invalid schedule from parent:", err)
+		return
+	}
+	scheduleMu.Lock()
+	currentSchedule = state
+	scheduleMu.Unlock()
+	log.Printf("Schedule: maintenance: %t, renewals allowed: %t, rollout: %t", state.Maintenance, state.RenewalsAllowed, state.Rollout)
+}
+
+// getSchedule returns the current state of the scheduled windows in the child.
+func getSchedule() scheduleState {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	return currentSchedule
+}
+
+// maintenanceHandler answers all requests with 503 Service Unavailable during maintenance windows.
+func maintenanceHandler(next http.Handler) http.Handler {
+	if len(config.Schedules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := getSchedule()
+		if !state.Maintenance {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if retryAfter := int(time.Until(state.MaintenanceUntil).Seconds()); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	})
+}
+
+// renewalWindowTransport refuses ACME orders for domains that still have a valid certificate outside of the
+// renewal windows. Orders for new domains and for expired certificates are always allowed. The ACME client
+// retries failed renewals, so that the renewal happens in the next window.
+type renewalWindowTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip checks whether the request is a new order, and whether it is allowed now.
+func (t renewalWindowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodPost || r.Body == nil || getSchedule().RenewalsAllowed {
+		return t.next.RoundTrip(r)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// The body of ACME requests is a JWS. Only the payload of a new order has identifiers.
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	var order struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if json.Unmarshal(body, &jws) == nil {
+		if payload, err := base64.RawURLEncoding.DecodeString(jws.Payload); err == nil && json.Unmarshal(payload, &order) == nil {
+			for _, id := range order.Identifiers {
+				if cert, err := cachedCertificate(r.Context(), id.Value); err == nil && certValidAt(cert.Leaf, time.Now()) {
+					return nil, fmt.Errorf("schedule: renewal of %s is deferred to the next renewal window", id.Value)
+				}
+			}
+		}
+	}
+	return t.next.RoundTrip(r)
+}
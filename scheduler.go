@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The periodic jobs of the parent and of the child run on one scheduler per process, instead of each job having
+// its own goroutine with time.Tick or time.Sleep. Each job has a name and an interval, which can be changed with
+// job-intervals. A job runs in its own goroutine, so that a slow job does not delay the other jobs, and it is not
+// started again while it is still running. The scheduler only decides which jobs are due at a given time, so the
+// scheduling can be tested by calling runDueJobs with any time.
+
+// Names of the scheduled jobs.
+const (
+	jobCertificateMonitor     = "certificate-monitor"      // Parent: log the expiry of the certificates and send alerts.
+	jobCertificatePush        = "certificate-push"         // Parent: push new or changed certificates to the child.
+	jobOperatorCertificates   = "operator-certificates"    // Parent: push changed operator-provided certificates to the child.
+	jobScheduleWindows        = "schedule-windows"         // Parent: evaluate the scheduled windows.
+	jobLogRotation            = "log-rotation"             // Parent: rotate the log files when they are too big.
+	jobClientCRLReload        = "client-crl-reload"        // Parent: send the changed CRL files of client-crl-files to the child.
+	jobDomainDiscovery        = "domain-discovery"         // Child: reload the domains when domain directories are created.
+	jobLocalCARotation        = "local-ca-rotation"        // Child: create the next local CA and replace the current one.
+	jobQuotaSave              = "quota-save"               // Child: persist the changed quota usages.
+	jobSelfSignedRegeneration = "self-signed-regeneration" // Child: replace self-signed certificates before they expire.
+	jobSessionTicketRotation  = "session-ticket-rotation"  // Child: rotate the session ticket keys.
+	jobTLSDryRunSummary       = "tls-dry-run-summary"      // Child: log the summary of the TLS dry-run.
+)
+
+// jobNames are the names of all jobs, which can be used in job-intervals.
+var jobNames = []string{
+	jobCertificateMonitor, jobCertificatePush, jobOperatorCertificates, jobScheduleWindows, jobLogRotation, jobClientCRLReload,
+	jobDomainDiscovery, jobLocalCARotation, jobQuotaSave, jobSelfSignedRegeneration, jobSessionTicketRotation, jobTLSDryRunSummary,
+}
+
+// minJobInterval is the minimum interval that can be set with job-intervals.
+const minJobInterval = time.Second
+
+// scheduledJob is a job of the scheduler.
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	aligned  bool // Run at multiples of the interval (e.g. at the start of each minute) instead of relative to the start.
+	run      func()
+	next     time.Time
+	running  bool
+}
+
+// scheduler runs the registered jobs when they are due.
+type scheduler struct {
+	mu        sync.Mutex
+	jobs      []*scheduledJob
+	wake      chan struct{}
+	startOnce sync.Once
+}
+
+// jobs is the scheduler of the process.
+var jobs = &scheduler{wake: make(chan struct{}, 1)}
+
+// jobInterval returns the interval of the job, which is the one from job-intervals, if it is set there.
+// Jobs that are disabled with an interval of 0 stay disabled.
+func jobInterval(name string, defaultInterval time.Duration) time.Duration {
+	if interval, ok := config.JobIntervals[name]; ok && defaultInterval > 0 {
+		return interval
+	}
+	return defaultInterval
+}
+
+// every adds a job that runs every interval, for the first time one interval after now.
+func (s *scheduler) every(name string, interval time.Duration, run func()) {
+	s.add(&scheduledJob{name: name, interval: jobInterval(name, interval), run: run})
+}
+
+// everyAligned adds a job that runs at the multiples of the interval, e.g. at the start of each minute.
+func (s *scheduler) everyAligned(name string, interval time.Duration, run func()) {
+	s.add(&scheduledJob{name: name, interval: jobInterval(name, interval), aligned: true, run: run})
+}
+
+// add adds the job and starts the scheduler, if it is not running yet.
+func (s *scheduler) add(job *scheduledJob) {
+	if job.interval <= 0 {
+		return
+	}
+	job.next = job.nextRun(time.Now())
+
+	s.mu.Lock()
+	s.jobs = append(s.jobs, job)
+	s.mu.Unlock()
+
+	s.startOnce.Do(func() { go s.loop() })
+	// Wake up the loop, because the new job can be due before the one it is waiting for.
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextRun returns the next time the job is due after now.
+func (job *scheduledJob) nextRun(now time.Time) time.Time {
+	if job.aligned {
+		return now.Truncate(job.interval).Add(job.interval)
+	}
+	return now.Add(job.interval)
+}
+
+// loop runs the due jobs until the process exits.
+func (s *scheduler) loop() {
+	for {
+		next := s.runDueJobs(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// runDueJobs starts the jobs that are due at now and returns the time when the next job is due.
+// A job that is still running is skipped and runs again one interval later.
+func (s *scheduler) runDueJobs(now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := now.Add(time.Hour)
+	for _, job := range s.jobs {
+		if !now.Before(job.next) {
+			job.next = job.nextRun(now)
+			if !job.running {
+				job.running = true
+				go s.runJob(job)
+			}
+		}
+		if job.next.Before(next) {
+			next = job.next
+		}
+	}
+	return next
+}
+
+// runJob runs the job and marks it as not running afterwards.
+func (s *scheduler) runJob(job *scheduledJob) {
+	defer func() {
+		s.mu.Lock()
+		job.running = false
+		s.mu.Unlock()
+	}()
+	job.run()
+}
+
+// checkJobIntervals verifies the job-intervals setting.
+func checkJobIntervals() error {
+	for name, interval := range config.JobIntervals {
+		known := false
+		for _, jobName := range jobNames {
+			if name == jobName {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("job-intervals: unknown job %q", name)
+		}
+		if interval < minJobInterval {
+			return fmt.Errorf("job-intervals: the interval of %s must be at least %s", name, minJobInterval)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+
+	"matscheko.eu/sslserver/certchain"
+)
+
+// Self-signed certificates are persisted through the certificate cache of the parent, so that a restart does not
+// create new keys (and new browser warnings). They are rotated every self-signed-validity: the certificate is valid
+// for the rotation interval plus certificate-expiry-refresh-threshold, and it is replaced once it enters the refresh
+// threshold. This way, the old certificate is still valid for the overlap period when the new one is created.
+
+// selfSignedCacheKey returns the name under which the self-signed certificate of the domain is stored in the certificate cache.
+func selfSignedCacheKey(domain string) string {
+	return domain + certchain.SelfSignedSuffix
+}
+
+// newSelfSignedCertificates returns the creator of the self-signed certificates. They are persisted through the
+// parent, and signed by the local CA in the local development CA mode.
+func newSelfSignedCertificates() *certchain.SelfSigned {
+	s := &certchain.SelfSigned{
+		Validity:     config.SelfSignedValidity,
+		RenewBefore:  config.CertificateExpiryRefreshThreshold,
+		Leeway:       config.ClockSkewLeeway,
+		Organization: config.SelfSignedOrganization,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if !allowedDomainsSelfSignedWhiteList[host] {
+				return errors.New("server name not in white list: " + host)
+			}
+			return nil
+		},
+		NewKey:       newSelfSignedKey,
+		ParseKeyPair: parseKeyPair,
+		KeyStored:    activateKMSKey,
+		KeyUnused:    discardKMSKey,
+	}
+	if m != nil {
+		s.Cache = m.Cache
+	}
+	if config.LocalCA {
+		s.Issuer = localCAIssuer
+		// Replace the certificates of local CAs that were replaced with rotate-local-ca.
+		s.Accept = func(leaf *x509.Certificate) bool {
+			_, err := getLocalCA()
+			return err == nil && signedByLocalCA(leaf)
+		}
+	}
+	return s
+}
+
+// newSelfSignedKey creates the private key of a self-signed certificate, in KMS or as RSA-4096 key.
+func newSelfSignedKey(ctx context.Context, name string) (crypto.Signer, []byte, error) {
+	if config.KeyStorage == keyStorageAWSKMS {
+		key, keyPEM, err := newKMSKey(ctx, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, keyPEM, nil
+	}
+	return newPrivateKey(keyTypeRSA4096)
+}
+
+// regenerateSelfSignedCertificates replaces the cached self-signed certificates before they enter the refresh
+// threshold, so that no handshake has to wait for the generation of a new RSA key.
+// It runs every self-signed-regeneration-interval.
+func regenerateSelfSignedCertificates() {
+	for domain := range allowedDomainsSelfSignedWhiteList {
+		regenerateSelfSignedCertificate(domain)
+	}
+}
+
+// regenerateSelfSignedCertificate replaces the self-signed certificate of the domain, if it enters the refresh
+// threshold before the next check.
+func regenerateSelfSignedCertificate(domain string) {
+	// Domains for Let's Encrypt only fall back to self-signed certificates. They try Let's Encrypt again, when the
+	// self-signed certificate expires, so their self-signed certificates are not regenerated.
+	if isLetsEncryptDomain(domain) {
+		return
+	}
+
+	// With dual-certificates, the self-signed certificate can also be cached for the clients without ECDSA support.
+	// issuedLocally is called without holding certCacheMu, because loading the local CA needs it.
+	var due []string
+	var current []*tls.Certificate
+	for _, key := range []string{domain, domain + rsaCertSuffix} {
+		certCacheMu.Lock()
+		cert := certCache[key]
+		certCacheMu.Unlock()
+		if cert == nil || cert.Leaf == nil || !issuedLocally(cert.Leaf) {
+			continue
+		}
+		if certNeedsRenewal(cert.Leaf, config.CertificateExpiryRefreshThreshold+config.SelfSignedRegenerationInterval) {
+			due = append(due, key)
+			current = append(current, cert)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	cert, err := selfSignedCertificates.Create(domain)
+	if err != nil {
+		log.Println("Could not regenerate self-signed certificate for", domain+":", err)
+		return
+	}
+
+	// Only replace the certificates that were not changed in the meantime, e.g. by the rotate-self-signed command.
+	certCacheMu.Lock()
+	for i, key := range due {
+		if certCache[key] == current[i] {
+			certCache[key] = cert
+		}
+	}
+	certCacheMu.Unlock()
+	log.Println("Regenerated self-signed certificate for:", domain)
+}
+
+// rotateSelfSignedCertificate forces a new self-signed certificate for the domain. It is called in the child for the
+// admin command "rotate-self-signed". The parent has already deleted the persisted certificate.
+func rotateSelfSignedCertificate(domain string) {
+	// Only remove certificates that were issued locally, and not the certificates from Let's Encrypt.
+	// issuedLocally is called without holding certCacheMu, because loading the local CA needs it.
+	// With dual-certificates, the self-signed certificate can also be cached for the clients without ECDSA support.
+	for _, key := range []string{domain, domain + rsaCertSuffix} {
+		certCacheMu.Lock()
+		cert := certCache[key]
+		certCacheMu.Unlock()
+		local := cert != nil && cert.Leaf != nil && issuedLocally(cert.Leaf)
+
+		certCacheMu.Lock()
+		if local && certCache[key] == cert {
+			certCache[key] = nil
+		}
+		certCacheMu.Unlock()
+	}
+
+	certCacheMu.Lock()
+	if certCacheBytes != nil {
+		certCacheBytes[selfSignedCacheKey(domain)] = nil
+	}
+	certCacheMu.Unlock()
+	log.Println("Self-signed certificate will be rotated for:", domain)
+}
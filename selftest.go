@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The domain for which the self-test stores a certificate in the certificate cache.
+// It exercises the path where the child gets certificates from the parent.
+const selftestCachedDomain = "selftest.example"
+
+// The second domain with a self-signed certificate. Its files must never be served for the other domains.
+const selftestOtherDomain = "other.example"
+
+// The size of the file that is downloaded during the graceful shutdown. It is larger than the socket buffers,
+// so that the request is still open when the shutdown starts.
+const selftestLargeFileSize = 64 * 1024 * 1024
+
+// runSelftest starts the parent and the child in an ephemeral mode (high ports, temporary directories),
+// checks serving, headers, virtual host isolation, not found paths, the refresh of the file cache, and the
+// graceful shutdown, and exits with a non-zero exit code on any failure.
+func runSelftest() {
+	log.SetPrefix("S ")
+	log.Println("Running self-test")
+
+	err := selftest()
+	if err != nil {
+		log.SetPrefix("S ")
+		log.Println("Self-test failed:", err)
+		os.Exit(1)
+	}
+
+	log.SetPrefix("S ")
+	log.Println("Self-test passed")
+	os.Exit(0)
+}
+
+// selftest does the work for runSelftest.
+func selftest() error {
+	// Create the temporary directory and remove it when done.
+	tempDir, err := os.MkdirTemp("", "sslserver-selftest-")
+	if err != nil {
+		return err
+	}
+	defer removeAll(tempDir)
+
+	// Create the web root with the test files.
+	content := make([]byte, 16)
+	if _, err := rand.Read(content); err != nil {
+		return err
+	}
+	testFile := []byte("<html><body>" + hex.EncodeToString(content) + "</body></html>\n")
+	otherFile := []byte("<html><body>" + selftestOtherDomain + " " + hex.EncodeToString(content) + "</body></html>\n")
+	largeFile := make([]byte, selftestLargeFileSize)
+	if _, err := rand.Read(largeFile); err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		"localhost/index.html":                      testFile,
+		"localhost/only-localhost.html":             testFile,
+		selftestCachedDomain + "/index.html":        testFile,
+		selftestOtherDomain + "/index.html":         otherFile,
+		selftestOtherDomain + "/other-only.html":    otherFile,
+		selftestOtherDomain + "/sub/deep/file.html": otherFile,
+		"localhost/large.bin":                       largeFile,
+	}
+	for name, data := range files {
+		path := filepath.Join(tempDir, "www_static", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	// Store a certificate in the certificate cache, which the child has to get from the parent.
+	if err := os.MkdirAll(filepath.Join(tempDir, "certcache"), 0700); err != nil {
+		return err
+	}
+	cachedCert, err := writeSelftestCertificate(filepath.Join(tempDir, "certcache"), selftestCachedDomain)
+	if err != nil {
+		return fmt.Errorf("could not create cached certificate: %v", err)
+	}
+
+	// Find free high ports.
+	httpAddr, err := freeLocalAddr()
+	if err != nil {
+		return err
+	}
+	httpsAddr, err := freeLocalAddr()
+	if err != nil {
+		return err
+	}
+
+	// Write the config for the parent and the child.
+	configData := fmt.Sprintf("web-root-directory: www_static\ncertificate-cache-directory: certcache\nhttp-addr: %s\nhttps-addr: %s\nself-signed-domains: [localhost, %s]\nlog-file: \"\"\n", httpAddr, httpsAddr, selftestOtherDomain)
+	if err := os.WriteFile(filepath.Join(tempDir, "config.yml"), []byte(configData), 0644); err != nil {
+		return err
+	}
+	if err := os.Chdir(tempDir); err != nil {
+		return err
+	}
+
+	// Start the parent, which starts the child.
+	readConfig()
+	initLogging()
+	parentDone := make(chan struct{})
+	go func() {
+		initParent()
+		close(parentDone)
+	}()
+
+	// Wait until the server is ready.
+	if err := waitForServer(httpsAddr, 30*time.Second); err != nil {
+		return err
+	}
+	select {
+	case <-childReady:
+	case <-time.After(30 * time.Second):
+		return errors.New("timeout while waiting for the child to be ready")
+	}
+
+	// Request the test file for the domain with the self-signed certificate.
+	if err := selftestRequest(httpsAddr, "localhost", "/", http.StatusOK, testFile, nil); err != nil {
+		return err
+	}
+
+	// Request the test file for the domain with the certificate from the parent.
+	if err := selftestRequest(httpsAddr, selftestCachedDomain, "/index.html", http.StatusOK, testFile, cachedCert); err != nil {
+		return err
+	}
+
+	// Request a file in a subdirectory.
+	if err := selftestRequest(httpsAddr, selftestOtherDomain, "/sub/deep/file.html", http.StatusOK, otherFile, nil); err != nil {
+		return err
+	}
+
+	// Request files that do not exist.
+	for _, path := range []string{"/missing.html", "/sub/missing.html", "/missing/"} {
+		if err := selftestRequest(httpsAddr, "localhost", path, http.StatusNotFound, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	// Paths that must not leave the web root of the domain are refused, because they are not clean.
+	for _, path := range []string{"/../" + selftestOtherDomain + "/index.html", "/%2e%2e/" + selftestOtherDomain + "/index.html"} {
+		if err := selftestRequest(httpsAddr, "localhost", path, http.StatusBadRequest, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	// Check the isolation of the virtual hosts: every domain serves its own files only.
+	if err := selftestRequest(httpsAddr, selftestOtherDomain, "/", http.StatusOK, otherFile, nil); err != nil {
+		return err
+	}
+	if err := selftestRequest(httpsAddr, selftestOtherDomain, "/only-localhost.html", http.StatusNotFound, nil, nil); err != nil {
+		return err
+	}
+	if err := selftestRequest(httpsAddr, "localhost", "/other-only.html", http.StatusNotFound, nil, nil); err != nil {
+		return err
+	}
+	// A domain that is not configured gets no certificate, or at least no content.
+	if resp, _, err := selftestGet(httpsAddr, "unknown.example", "/", false); err == nil && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("request for unknown.example/ returned status %d", resp.StatusCode)
+	}
+	log.Println("Self-test request passed: unknown.example/")
+
+	// Check the headers of a served file.
+	if err := selftestHeaders(httpsAddr, "localhost", "/index.html", map[string]string{
+		"Content-Type":              "text/html; charset=utf-8",
+		"Strict-Transport-Security": config.HttpHeaderStrictTransportSecurity,
+		"X-Content-Type-Options":    config.HttpHeaderXContentTypeOptions,
+		"Referrer-Policy":           "no-referrer",
+	}); err != nil {
+		return err
+	}
+
+	// The HTTP server redirects to HTTPS.
+	if err := selftestRedirect(httpAddr, "localhost", "/index.html"); err != nil {
+		return err
+	}
+
+	// Change a file and reload, the child has to serve the new content.
+	changedFile := []byte("<html><body>changed " + hex.EncodeToString(content) + "</body></html>\n")
+	if err := os.WriteFile(filepath.Join(tempDir, "www_static", "localhost", "index.html"), changedFile, 0644); err != nil {
+		return err
+	}
+	parentToChildCh <- Command{Type: cmdReload}
+	if err := selftestEventually(10*time.Second, func() error {
+		return selftestRequest(httpsAddr, "localhost", "/index.html", http.StatusOK, changedFile, nil)
+	}); err != nil {
+		return fmt.Errorf("the file cache was not refreshed: %v", err)
+	}
+
+	// Start the download of a large file, which has to be finished during the graceful shutdown.
+	download, err := selftestStartDownload(httpsAddr, "localhost", "/large.bin")
+	if err != nil {
+		return err
+	}
+	defer download.Body.Close()
+
+	// Terminate the child. While the download is drained, new connections are refused.
+	requestTerminate()
+	if err := selftestEventually(5*time.Second, func() error {
+		conn, err := net.DialTimeout("tcp", httpsAddr, time.Second)
+		if err == nil {
+			conn.Close()
+			return errors.New("the server still accepts connections after the terminate command")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(download.Body)
+	if err != nil {
+		return fmt.Errorf("the download was not finished during the shutdown: %v", err)
+	}
+	if !bytes.Equal(body, largeFile) {
+		return fmt.Errorf("the download returned %d bytes instead of %d during the shutdown", len(body), len(largeFile))
+	}
+	log.Println("Self-test drain passed: localhost/large.bin")
+
+	// Wait for the parent to finish. The child has to acknowledge the graceful shutdown.
+	select {
+	case <-parentDone:
+	case <-time.After(30 * time.Second):
+		return errors.New("timeout while waiting for the child to terminate")
+	}
+	if code, err := parentExitCode(); err != nil || code != exitGraceful {
+		return fmt.Errorf("child did not terminate gracefully: exit code %d, error: %v", code, err)
+	}
+
+	// After the graceful shutdown, the ports have to be released.
+	for _, addr := range []string{httpAddr, httpsAddr} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("the server did not release %s: %v", addr, err)
+		}
+		ln.Close()
+	}
+	log.Println("Self-test shutdown passed")
+
+	return nil
+}
+
+// selftestRequest requests the path from the HTTPS server with the given server name and checks the response.
+// If expectedCert is not nil, the server has to present exactly this certificate.
+func selftestRequest(addr, serverName, path string, expectedStatus int, expectedBody []byte, expectedCert []byte) error {
+	resp, body, err := selftestGet(addr, serverName, path, expectedCert != nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("request for %s%s returned status %d instead of %d", serverName, path, resp.StatusCode, expectedStatus)
+	}
+	if expectedBody != nil && !bytes.Equal(body, expectedBody) {
+		return fmt.Errorf("request for %s%s returned unexpected content", serverName, path)
+	}
+
+	// Check the certificate.
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("request for %s%s returned no certificate", serverName, path)
+	}
+	leaf := resp.TLS.PeerCertificates[0]
+	if expectedStatus == http.StatusOK {
+		if err := leaf.VerifyHostname(serverName); err != nil && leaf.Subject.CommonName != serverName {
+			return fmt.Errorf("certificate for %s is not valid: %v", serverName, err)
+		}
+	}
+	if expectedCert != nil && !bytes.Equal(leaf.Raw, expectedCert) {
+		return fmt.Errorf("certificate for %s was not the certificate from the certificate cache", serverName)
+	}
+
+	log.Println("Self-test request passed:", serverName+path)
+	return nil
+}
+
+// selftestHeaders requests the path from the HTTPS server and checks the response headers.
+func selftestHeaders(addr, serverName, path string, expected map[string]string) error {
+	resp, _, err := selftestGet(addr, serverName, path, false)
+	if err != nil {
+		return err
+	}
+	for name, value := range expected {
+		if got := resp.Header.Get(name); got != value {
+			return fmt.Errorf("request for %s%s returned header %s: %q instead of %q", serverName, path, name, got, value)
+		}
+	}
+
+	log.Println("Self-test headers passed:", serverName+path)
+	return nil
+}
+
+// selftestRedirect requests the path from the HTTP server and checks that it redirects to HTTPS.
+func selftestRedirect(addr, serverName, path string) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = serverName
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP request for %s%s failed: %v", serverName, path, err)
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode > 399 || location != "https://"+serverName+path {
+		return fmt.Errorf("HTTP request for %s%s returned status %d and location %q instead of a redirect to HTTPS", serverName, path, resp.StatusCode, location)
+	}
+
+	log.Println("Self-test redirect passed:", serverName+path)
+	return nil
+}
+
+// selftestEventually calls check until it succeeds or the timeout expires, and returns the last error.
+func selftestEventually(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// selftestStartDownload requests the path from the HTTPS server and returns the response with the unread body.
+func selftestStartDownload(addr, serverName, path string) (*http.Response, error) {
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = serverName
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request for %s%s failed: %v", serverName, path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request for %s%s returned status %d", serverName, path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// selftestGet requests the path from the HTTPS server with the given server name and returns the response and its body.
+// With rsaOnly, the client only supports RSA certificates.
+func selftestGet(addr, serverName, path string, rsaOnly bool) (*http.Response, []byte, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // The certificates are self-signed. They are checked below.
+	}
+	if rsaOnly {
+		// The cached certificate is an RSA certificate. Without ECDSA support, autocert selects it even if the
+		// child has not cached it in memory yet.
+		tlsConfig.MaxVersion = tls.VersionTLS12
+		tlsConfig.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+addr+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Host = serverName
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("request for %s%s failed: %v", serverName, path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response for %s%s failed: %v", serverName, path, err)
+	}
+	return resp, body, nil
+}
+
+// writeSelftestCertificate creates a self-signed certificate for the domain and stores it in the
+// format of the autocert cache. It returns the DER encoded certificate.
+func writeSelftestCertificate(dir, domain string) ([]byte, error) {
+	// The certificate is stored with the "+rsa" suffix, because the child requests the certificates
+	// during startup without knowing whether the clients support ECDSA.
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	if err := os.WriteFile(filepath.Join(dir, domain+"+rsa"), buf.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+
+	return certificate, nil
+}
+
+// freeLocalAddr returns a currently unused TCP address on the loopback interface.
+func freeLocalAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// waitForServer waits until a TCP connection to the address can be established.
+func waitForServer(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timeout while waiting for the server on %s", addr)
+}
+
+// removeAll makes all files and directories in dir writable again and removes them.
+func removeAll(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			makeWritable(path)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		log.Println("Could not remove temporary directory:", err)
+	}
+}
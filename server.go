@@ -6,10 +6,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
-	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -20,22 +20,32 @@ var httpsServer *http.Server
 func loggingHTTPHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("HTTP Request: %s %s", r.Method, r.URL.Path)
+		if strings.HasPrefix(r.URL.Path, challengePathPrefix) {
+			// The parent ignores this for domains without a running order.
+			reportACMEOrder(r.Host, acmeChallengeHTTP01, acmeOrderValidating, nil)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
 func runServer(manager *autocert.Manager) {
-	// Create a wait group with a count of 2.
-	// This indicates that we are waiting for two signals.
-	// The two signals will be sent when the two servers have finished binding to their addresses.
+	// The number of servers to start. If the parent answers the ACME HTTP challenges, the child only runs the HTTPS server.
+	serverCount := 2
+	if config.HttpChallengeInParent {
+		serverCount = 1
+	}
+
+	// Create a wait group with a count of the number of servers.
+	// This indicates that we are waiting for one signal per server.
+	// The signals will be sent when the servers have finished binding to their addresses.
 	var wgBindDone sync.WaitGroup
-	wgBindDone.Add(2)
+	wgBindDone.Add(serverCount)
 
-	// Create a wait group with a count of 2.
-	// This indicates that we are waiting for two signals.
-	// The two signals will be sent when the two servers have been terminated.
+	// Create a wait group with a count of the number of servers.
+	// This indicates that we are waiting for one signal per server.
+	// The signals will be sent when the servers have been terminated.
 	var wgServerClosed sync.WaitGroup
-	wgServerClosed.Add(2)
+	wgServerClosed.Add(serverCount)
 
 	// Create a wait group with a count of 1.
 	// This indicates that we are waiting for one signal.
@@ -50,7 +60,15 @@ func runServer(manager *autocert.Manager) {
 	//
 
 	// Start the HTTP server.
-	go startHTTPServer(manager, &wgBindDone, &wgJailed, &wgServerClosed)
+	if config.HttpChallengeInParent {
+		// The parent answers the HTTP challenges from the certificate cache. Calling HTTPHandler is still
+		// necessary, because it enables the HTTP-01 challenge type in the autocert manager.
+		if acmeChallengeAllowed(acmeChallengeHTTP01) {
+			manager.HTTPHandler(nil)
+		}
+	} else {
+		go startHTTPServer(manager, &wgBindDone, &wgJailed, &wgServerClosed)
+	}
 
 	// Start the HTTPS server.
 	go startHTTPSServer(&wgBindDone, &wgJailed, &wgServerClosed)
@@ -64,16 +82,8 @@ func runServer(manager *autocert.Manager) {
 	// ========
 	//
 
-	// Jail process as good as possible
-
-	// Convert the relative path to an absolute path.
-	// absoluteBaseDirectory, err := filepath.Abs(config.WebRootDirectory)
-	// if err != nil {
-	// 	log.Fatalln("Could not get absolute path for web root:", err)
-	// }
-
-	// Remove write permissions, drop privileges and jail process if running on Linux. Only remove write permissions on windows.
-	// Jail(absoluteBaseDirectory)
+	// Restrict the process with the configured sandbox, now that the ports are bound and before requests are served.
+	enterSandbox()
 
 	// Send a signal on the wait group when the server has been jailed.
 	wgJailed.Done()
@@ -85,19 +95,39 @@ func runServer(manager *autocert.Manager) {
 	//
 
 	// Initialize (fill) the white list and the cert cache.
+	// The listeners already accept connections, so that ACME challenges can be answered, but requests for
+	// files are held back by the readinessHandler until the certificates are loaded.
 	log.Println("Checking certificates...")
 	initCertificates(manager)
 	log.Println("Checking certificates done")
 
+	// Serve the domains of new directories in the web root without a restart.
+	jobs.every(jobDomainDiscovery, config.DomainDiscoveryInterval, discoverDomains)
+
+	// Replace the self-signed certificates in the background before they expire.
+	if config.SelfSignedRegenerationInterval > 0 {
+		jobs.every(jobSelfSignedRegeneration, config.SelfSignedRegenerationInterval, regenerateSelfSignedCertificates)
+	}
+
+	// Rotate the local CA with an overlap before it expires.
+	if config.LocalCA {
+		startLocalCARotation()
+	}
+
 	// Close both server.	// TODO: do this on signal terminate.
 	// terminateServer(httpServer, httpsServer)
 
 	log.Println("Serving files ...")
+	markServerReady()
 
 	// Wait for the wait group to reach zero.
 	// This will happen when both the HTTP and the HTTPS server terminate.
 	wgServerClosed.Wait()
 
+	// The servers return right away on shutdown. Wait until the open requests are finished and the parent
+	// has been told, before the child exits.
+	waitForTerminateAck()
+
 	//
 	// ========
 	// BOTH SERVER HAVE CLOSED
@@ -107,14 +137,14 @@ func runServer(manager *autocert.Manager) {
 	log.Println("Server terminated.")
 }
 
-// Create an HTTP server that redirects all requests to HTTPS.
+// Create an HTTP server that redirects all requests to HTTPS, or uses the http-handler of the domains.
 func startHTTPServer(manager *autocert.Manager, wgBindDone, wgJailed, wgServerClosed *sync.WaitGroup) {
 	httpServer = &http.Server{
 		Addr:         config.HttpAddr,
 		ReadTimeout:  config.MaxRequestTimeout,
 		WriteTimeout: config.MaxResponseTimeout,
 		IdleTimeout:  config.MaxIdleTimeout,
-		Handler:      loggingHTTPHandler(manager.HTTPHandler(nil)), // from autocert manager
+		Handler:      w3cLogHandler(headerProfileHandler(scannerHandler(loggingHTTPHandler(httpHandler(manager))))), // Use the http-handler of the domains.
 		// Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 	// Redirect the request to HTTPS.
 		// 	http.Redirect(w, r, "https://"+r.Host+r.URL.Path, http.StatusFound) // TODO: get config.HttpsAddr and redirect to this port. Or better, create a config variable for this, because there can be a proxy in front.
@@ -139,6 +169,13 @@ func startHTTPServer(manager *autocert.Manager, wgBindDone, wgJailed, wgServerCl
 	// This will happen when the server has been jailed.
 	wgJailed.Wait()
 
+	// Check the requests before they are parsed, and close the connections with ambiguous requests.
+	if config.StrictHttpParsing {
+		ln = strictListener{ln}
+		httpServer.ConnContext = strictConnContext
+		httpServer.Handler = strictHandler(httpServer.Handler)
+	}
+
 	// Serve HTTP connections on the listener.
 	err = httpServer.Serve(ln)
 	if err != nil && err != http.ErrServerClosed {
@@ -157,28 +194,45 @@ func startHTTPSServer(wgBindDone, wgJailed, wgServerClosed *sync.WaitGroup) {
 		WriteTimeout: config.MaxResponseTimeout,
 		IdleTimeout:  config.MaxIdleTimeout,
 		TLSConfig: &tls.Config{
-			// Set secure cipher suites and prefer server cipher suites. See: https://ssl-config.mozilla.org/#server=go&version=1.14.4&config=intermediate&guideline=5.7
+			// Set the configured TLS versions and cipher suites (secure by default), and prefer server cipher suites.
 			PreferServerCipherSuites: true,
-			MinVersion:               tls.VersionTLS12,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			},
+			MinVersion:               tlsMinVersion(),
+			MaxVersion:               tlsMaxVersion(),
+			CipherSuites:             tlsCipherSuites(),
+			// Set the key exchanges, with the hybrid post-quantum ones first if tls-post-quantum is enabled.
+			CurvePreferences: tlsCurvePreferences(),
+			// Write the secrets of the connections for debugging, only with tls-keylog-file and --insecure-debug.
+			KeyLogWriter: tlsKeyLogWriter(),
 			// Set the GetCertificate callback for the TLS config to a function
-			// that tries to fetch a certificate.
-			GetCertificate: MyGetCertificate,
-			NextProtos: []string{
-				"h2", "http/1.1", // enable HTTP/2 and HTTP/1.1
-				acme.ALPNProto, // enable tls-alpn ACME challenges
-			},
+			// that tries to fetch a certificate, and staples the OCSP response.
+			GetCertificate: getCertificateWithStaple,
+			// Set the configured ALPN protocols (HTTP/2 and HTTP/1.1 by default), and enable tls-alpn ACME challenges.
+			NextProtos: httpsNextProtos(),
 		},
-		Handler: http.HandlerFunc(serveFiles), // Serve files from the "static" directory.
+		Handler: w3cLogHandler(headerProfileHandler(httpsHandler())), // Use the https-handler of the domains, which serves files from the "static" directory by default.
+	}
+
+	// Enable client authentication for the domains that use it.
+	httpsServer.TLSConfig.GetConfigForClient = getConfigForClient(httpsServer.TLSConfig)
+
+	// Observe the handshakes for the TLS dry-run.
+	if tlsDryRunEnabled() {
+		startTLSDryRun()
+		clientAuthConfig := httpsServer.TLSConfig.GetConfigForClient
+		cipherSuites := httpsServer.TLSConfig.CipherSuites
+		httpsServer.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			observeHandshake(hello, cipherSuites)
+			return clientAuthConfig(hello)
+		}
 	}
 
+	// Use smaller buffers for low-memory.
+	configureLowMemoryServer(httpsServer)
+
+	// Configure session tickets. The session ticket keys are rotated on this config,
+	// so it is used directly for the TLS listener instead of the copy that ServeTLS would make.
+	configureSessionResumption(httpsServer.TLSConfig)
+
 	log.Println("Starting HTTPS server on", httpsServer.Addr)
 
 	// Listen on the specified address.
@@ -197,8 +251,34 @@ func startHTTPSServer(wgBindDone, wgJailed, wgServerClosed *sync.WaitGroup) {
 	// This will happen when the server has been jailed.
 	wgJailed.Wait()
 
+	// Forward the connections for the sni-passthrough names to their backends.
+	if len(config.SniPassthrough) > 0 {
+		ln = newPassthroughListener(ln)
+	}
+
+	// Compute the JA3 and JA4 fingerprints of the ClientHellos, and add them to the contexts of the requests.
+	if tlsFingerprintsEnabled() {
+		ln = fingerprintListener{ln}
+		httpsServer.ConnContext = tlsFingerprintConnContext
+	}
+
+	// Check the HTTP/1.x requests before they are parsed, and close the connections with ambiguous requests.
+	tlsListener := tls.NewListener(ln, httpsServer.TLSConfig)
+	if config.StrictHttpParsing {
+		tlsListener = newStrictTLSListener(tlsListener)
+		connContext := httpsServer.ConnContext
+		httpsServer.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+			ctx = strictConnContext(ctx, conn)
+			if connContext != nil {
+				ctx = connContext(ctx, conn)
+			}
+			return ctx
+		}
+		httpsServer.Handler = strictHandler(httpsServer.Handler)
+	}
+
 	// Serve TLS connections on the listener.
-	err = httpsServer.ServeTLS(ln, "", "")
+	err = httpsServer.Serve(tlsListener)
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
@@ -207,22 +287,30 @@ func startHTTPSServer(wgBindDone, wgJailed, wgServerClosed *sync.WaitGroup) {
 	wgServerClosed.Done()
 }
 
-// terminateServer shuts down the given servers with a timeout of 10 seconds.
+// terminateServer shuts down the given servers with a timeout of shutdown-timeout.
 //
 // This function calls the http.Server.Shutdown() method for each server and passes in
 // a context with a timeout. If the server has not completed shutdown by the end of the
-// timeout, the context is cancelled and the server is terminated immediately.
-func terminateServerList(servers ...*http.Server) {
-	// Create a context with a timeout of 10 seconds.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// timeout, the context is cancelled and the remaining connections are closed immediately.
+// It returns false if connections had to be closed.
+func terminateServerList(servers ...*http.Server) bool {
+	// Create a context with a timeout of shutdown-timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
 	defer cancel() // Cancel the context when the function returns.
 
 	// Create a wait group with a count of the number of servers.
 	var wgShutdown sync.WaitGroup
 	wgShutdown.Add(len(servers))
+	var drained int32 = 1
 
 	// Shut down the servers in parallel go routines.
 	for _, server := range servers {
+		if server == nil {
+			// The server was never started.
+			wgShutdown.Done()
+			continue
+		}
+
 		go func(server *http.Server) {
 			defer wgShutdown.Done() // Send a signal on the wait group when the server has shut down.
 			// Shut down the server using the context.
@@ -230,7 +318,9 @@ func terminateServerList(servers ...*http.Server) {
 			// and wait for all existing connections to be closed.
 			err := server.Shutdown(ctx)
 			if err != nil {
-				log.Fatal("Server shutdown:", err)
+				log.Println("Server shutdown:", err, "- closing the remaining connections")
+				atomic.StoreInt32(&drained, 0)
+				server.Close()
 			}
 		}(server)
 	}
@@ -238,8 +328,9 @@ func terminateServerList(servers ...*http.Server) {
 	// Wait for the wait group to reach zero.
 	// This will happen when all servers have shut down or the timeout has been reached.
 	wgShutdown.Wait()
+	return atomic.LoadInt32(&drained) == 1
 }
 
-func terminateServer() {
-	terminateServerList(httpServer, httpsServer)
+func terminateServer() bool {
+	return terminateServerList(httpServer, httpsServer)
 }
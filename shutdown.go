@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The shutdown is coordinated by the parent. On SIGINT, SIGTERM, or the admin command "terminate", the parent sends
+// the terminate command to the child. The child stops accepting connections, waits up to shutdown-timeout for the
+// open requests (drain), closes the remaining connections, and acknowledges the shutdown with its exit code, after
+// all its commands to the parent have been written. The parent reads the output of the child until it exits, so no
+// log line is lost, syncs its log file, and exits with the exit code of the child. A child that does not exit in time
+// is killed.
+
+// Exit codes of the parent and the child.
+const (
+	exitGraceful     = 0 // All requests were finished before the shutdown.
+	exitError        = 1 // A fatal error, or the child exited without acknowledging the shutdown.
+	exitDrainTimeout = 2 // The connections that were still open after shutdown-timeout were closed.
+	exitChaosCrash   = 3 // The chaos hook crashed the child.
+)
+
+// killGracePeriod is the time that the child gets after shutdown-timeout, before the parent kills it.
+const killGracePeriod = 10 * time.Second
+
+// exitCode is the exit code of the child after a shutdown.
+var exitCode = exitGraceful
+
+// terminateAcked is closed in the child, when the acknowledgement of the shutdown has been written to the parent.
+var terminateAcked = make(chan struct{})
+
+// childShutdownCode is the exit code that the child acknowledged to the parent, or -1 if it did not acknowledge a shutdown.
+var childShutdownCode = -1
+var childShutdownMu sync.Mutex
+
+// childProcess is the process of the child, and childExited is closed in the parent when it has exited.
+var childProcess *os.Process
+var childExited = make(chan struct{})
+
+var terminateOnce sync.Once
+
+// handleTerminateSignals lets the parent shut down the child gracefully on SIGINT and SIGTERM.
+func handleTerminateSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Println("Received signal:", sig)
+		requestTerminate()
+	}()
+}
+
+// ignoreTerminateSignals lets the child ignore SIGINT and SIGTERM, which are also sent to it e.g. by Ctrl-C in a
+// terminal, because the parent coordinates the shutdown.
+func ignoreTerminateSignals() {
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+}
+
+// requestTerminate asks the child to shut down. It is called in the parent. The child is killed if it does not exit
+// within shutdown-timeout and the grace period.
+func requestTerminate() {
+	terminateOnce.Do(func() {
+		// The hook can e.g. remove the server from a load balancer, before it stops accepting connections.
+		runLifecycleHook(hookBeforeShutdown)
+		log.Println("Asking the child to terminate")
+		parentToChildCh <- Command{Type: cmdTerminate}
+		time.AfterFunc(config.ShutdownTimeout+killGracePeriod, func() {
+			select {
+			case <-childExited:
+				return
+			default:
+			}
+			if childProcess != nil {
+				log.Println("The child did not terminate in time, killing it")
+				childProcess.Kill()
+			}
+		})
+	})
+}
+
+// terminateChild drains the connections of the servers and acknowledges the shutdown to the parent. It is called in
+// the child for the terminate command.
+func terminateChild() {
+	log.Println("Terminating: waiting up to", config.ShutdownTimeout, "for the open requests")
+	if !terminateServer() {
+		exitCode = exitDrainTimeout
+	}
+	log.Println("Terminating: servers closed, exit code", exitCode)
+	childToParentCh <- Command{Type: cmdTerminated, Data: []byte(strconv.Itoa(exitCode))}
+}
+
+// waitForTerminateAck waits until the acknowledgement of the shutdown has been written to the parent, so that the
+// child does not exit with unwritten commands.
+func waitForTerminateAck() {
+	select {
+	case <-terminateAcked:
+	case <-time.After(config.ShutdownTimeout + killGracePeriod):
+		log.Println("Terminating: timeout while waiting for the shutdown")
+	}
+}
+
+// receiveTerminateAck stores the exit code that the child acknowledged. It is called in the parent.
+func receiveTerminateAck(data []byte) {
+	code, err := strconv.Atoi(string(data))
+	if err != nil {
+		log.Println("Invalid shutdown acknowledgement from child:", string(data))
+		return
+	}
+	childShutdownMu.Lock()
+	childShutdownCode = code
+	childShutdownMu.Unlock()
+
+	if code == exitGraceful {
+		log.Println("Child finished all requests before the shutdown")
+	} else {
+		log.Println("Child closed the connections that were still open after shutdown-timeout")
+	}
+}
+
+// parentExitCode returns the exit code of the parent after the child has exited. The parent exits with the exit
+// code that the child acknowledged. A child that exited otherwise is an error.
+func parentExitCode() (int, error) {
+	childShutdownMu.Lock()
+	acknowledged := childShutdownCode
+	childShutdownMu.Unlock()
+
+	if childExitErr == nil {
+		if acknowledged > exitGraceful {
+			return exitError, errors.New("child acknowledged exit code " + strconv.Itoa(acknowledged) + ", but exited with 0")
+		}
+		return exitGraceful, nil
+	}
+
+	var exitErr *exec.ExitError
+	if acknowledged > exitGraceful && errors.As(childExitErr, &exitErr) && exitErr.ExitCode() == acknowledged {
+		return acknowledged, nil
+	}
+	return exitError, childExitErr
+}
+
+// syncLogFile writes the log file to disk before the parent exits.
+func syncLogFile() {
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+	if logFile != nil {
+		logFile.Sync()
+	}
+	syncW3CLogFile()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is run as a child process by the tests. It exits with the exit code in SSLSERVER_TEST_EXIT, or
+// sleeps until it is killed if SSLSERVER_TEST_SLEEP is set.
+func TestHelperProcess(t *testing.T) {
+	if code := os.Getenv("SSLSERVER_TEST_EXIT"); code != "" {
+		n, _ := strconv.Atoi(code)
+		os.Exit(n)
+	}
+	if os.Getenv("SSLSERVER_TEST_SLEEP") != "" {
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+// helperCommand returns the command that runs TestHelperProcess with the environment variable.
+func helperCommand(env string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), env)
+	return cmd
+}
+
+// TestTerminateChildAck checks that the child drains its server, and acknowledges the shutdown to the parent with
+// the exit code, which the parent receives through the IPC.
+func TestTerminateChildAck(t *testing.T) {
+	savedConfig, savedChildToParentCh := config, childToParentCh
+	t.Cleanup(func() {
+		config, childToParentCh = savedConfig, savedChildToParentCh
+		httpServer, httpsServer, exitCode = nil, nil, exitGraceful
+		childShutdownCode = -1
+	})
+
+	tests := []struct {
+		name     string
+		openConn bool // A request is still running when the shutdown starts.
+		want     int
+	}{
+		{"drained", false, exitGraceful},
+		{"drain timeout", true, exitDrainTimeout},
+	}
+	for _, test := range tests {
+		config.ShutdownTimeout = 200 * time.Millisecond
+		childToParentCh = make(chan Command, 1)
+		exitCode = exitGraceful
+		childShutdownCode = -1
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		started, release := make(chan struct{}), make(chan struct{})
+		httpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})}
+		httpsServer = nil
+		go httpServer.Serve(ln)
+		if test.openConn {
+			go http.Get("http://" + ln.Addr().String() + "/")
+			<-started
+		}
+
+		start := time.Now()
+		terminateChild()
+		close(release)
+		if elapsed := time.Since(start); test.openConn && elapsed < config.ShutdownTimeout {
+			t.Errorf("%s: the shutdown took %s, less than shutdown-timeout", test.name, elapsed)
+		}
+
+		var ack Command
+		select {
+		case ack = <-childToParentCh:
+		default:
+			t.Fatalf("%s: no acknowledgement was sent to the parent", test.name)
+		}
+		if ack.Type != cmdTerminated || string(ack.Data) != strconv.Itoa(test.want) {
+			t.Errorf("%s: acknowledgement %s %q, want %s %q", test.name, ack.Type, ack.Data, cmdTerminated, strconv.Itoa(test.want))
+		}
+		if exitCode != test.want {
+			t.Errorf("%s: exit code of the child %d, want %d", test.name, exitCode, test.want)
+		}
+
+		// The acknowledgement goes through the IPC to the parent.
+		var buf bytes.Buffer
+		if err := writeCommand(bufio.NewWriter(&buf), ack); err != nil {
+			t.Fatal(err)
+		}
+		received, err := readCommand(bufio.NewReader(&buf), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiveTerminateAck(received.Data)
+		if childShutdownCode != test.want {
+			t.Errorf("%s: acknowledged exit code in the parent %d, want %d", test.name, childShutdownCode, test.want)
+		}
+	}
+}
+
+// TestReceiveTerminateAckInvalid checks that an invalid acknowledgement is not taken as an exit code.
+func TestReceiveTerminateAckInvalid(t *testing.T) {
+	t.Cleanup(func() { childShutdownCode = -1 })
+	childShutdownCode = -1
+	receiveTerminateAck([]byte("drained"))
+	if childShutdownCode != -1 {
+		t.Errorf("acknowledged exit code %d, want -1", childShutdownCode)
+	}
+}
+
+// TestParentExitCode checks that the parent exits with the exit code that the child acknowledged and exited with.
+func TestParentExitCode(t *testing.T) {
+	t.Cleanup(func() { childShutdownCode, childExitErr = -1, nil })
+
+	tests := []struct {
+		name      string
+		ack       int // -1 if the child did not acknowledge a shutdown.
+		childExit int
+		want      int
+		wantErr   bool
+	}{
+		{"graceful", exitGraceful, 0, exitGraceful, false},
+		{"drain timeout", exitDrainTimeout, exitDrainTimeout, exitDrainTimeout, false},
+		{"exit without acknowledgement", -1, exitError, exitError, true},
+		{"acknowledged, but exited with 0", exitDrainTimeout, 0, exitError, true},
+		{"acknowledged, but exited with another code", exitDrainTimeout, exitChaosCrash, exitError, true},
+	}
+	for _, test := range tests {
+		childShutdownCode = test.ack
+		childExitErr = helperCommand("SSLSERVER_TEST_EXIT=" + strconv.Itoa(test.childExit)).Run()
+		code, err := parentExitCode()
+		if code != test.want || (err != nil) != test.wantErr {
+			t.Errorf("%s: parentExitCode() = %d, %v, want %d and error %v", test.name, code, err, test.want, test.wantErr)
+		}
+	}
+}
+
+// TestRequestTerminateKillsChild checks that the parent sends the terminate command, and kills a child that does
+// not exit within shutdown-timeout and the grace period.
+func TestRequestTerminateKillsChild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the kill grace period")
+	}
+	savedConfig, savedParentToChildCh, savedChildExited := config, parentToChildCh, childExited
+	t.Cleanup(func() {
+		config, parentToChildCh, childExited = savedConfig, savedParentToChildCh, savedChildExited
+		childProcess, terminateOnce = nil, sync.Once{}
+	})
+	config.ShutdownTimeout = 100 * time.Millisecond
+	config.LifecycleHooks = nil
+	parentToChildCh = make(chan Command, 1)
+	childExited = make(chan struct{})
+	terminateOnce = sync.Once{}
+
+	cmd := helperCommand("SSLSERVER_TEST_SLEEP=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	childProcess = cmd.Process
+	start := time.Now()
+	requestTerminate()
+	requestTerminate() // Only the first call sends the command.
+
+	if command := <-parentToChildCh; command.Type != cmdTerminate {
+		t.Errorf("command to the child %s, want %s", command.Type, cmdTerminate)
+	}
+	select {
+	case command := <-parentToChildCh:
+		t.Errorf("second command to the child %s", command.Type)
+	default:
+	}
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Exited() {
+		t.Errorf("the child was not killed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < config.ShutdownTimeout+killGracePeriod {
+		t.Errorf("the child was killed after %s, before shutdown-timeout and the grace period", elapsed)
+	}
+}
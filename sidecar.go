@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"matscheko.eu/sslserver/filecache"
+)
+
+// For files in the configured checksum-sidecars paths, the server serves "<file>.sha256" sidecars in the format
+// of sha256sum. Existing sidecar files are served as they are, but they are verified when the cache is filled.
+
+// inChecksumSidecarPath returns true if the URL path is in one of the checksum sidecar paths of the domain.
+func inChecksumSidecarPath(settings domainSettings, urlPath string) bool {
+	for _, prefix := range settings.checksumSidecars {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileHash returns the hex encoded SHA-256 of the file with the cache key, if it is known.
+func fileHash(key string) string {
+	entry, _ := webFiles.Metadata(key)
+	hash, err := base64.RawURLEncoding.DecodeString(entry.Hash)
+	if err != nil || entry.Hash == "" {
+		return ""
+	}
+	return hex.EncodeToString(hash)
+}
+
+// serveChecksumSidecar generates the sidecar for the URL path, if it ends with ".sha256", there is no sidecar
+// file, and the file is in a checksum sidecar path. It returns false if the request was not handled.
+func serveChecksumSidecar(w http.ResponseWriter, r *http.Request, domain, urlPath string) bool {
+	if !strings.HasSuffix(urlPath, ".sha256") {
+		return false
+	}
+	filePath := strings.TrimSuffix(urlPath, ".sha256")
+	if !inChecksumSidecarPath(settingsForDomain(domain), filePath) {
+		return false
+	}
+
+	_, sidecarExists := webFiles.Lookup(domain + urlPath)
+	checksum := fileHash(domain + filePath)
+	if sidecarExists || checksum == "" {
+		return false
+	}
+
+	addHeaders(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	content := fmt.Sprintf("%s  %s\n", checksum, path.Base(filePath))
+	http.ServeContent(w, r, urlPath, time.Time{}, strings.NewReader(content))
+	return true
+}
+
+// verifyChecksumSidecars compares the existing sidecar files in the checksum sidecar paths with the
+// checksums of their files, and logs the mismatches.
+func verifyChecksumSidecars() {
+	sidecars := map[string][]byte{}
+	webFiles.Range(func(key string, entry filecache.Entry, inMemory bool) {
+		if inMemory && strings.HasSuffix(key, ".sha256") {
+			sidecars[key] = entry.Content
+		}
+	})
+
+	for urlKey, content := range sidecars {
+		parts := strings.SplitN(urlKey, "/", 2)
+		if len(parts) != 2 || !inChecksumSidecarPath(settingsForDomain(parts[0]), "/"+strings.TrimSuffix(parts[1], ".sha256")) {
+			continue
+		}
+
+		fields := bytes.Fields(content)
+		checksum := fileHash(strings.TrimSuffix(urlKey, ".sha256"))
+		switch {
+		case checksum == "":
+			log.Println(" Warning, checksum sidecar without file:", urlKey)
+		case len(fields) == 0 || !strings.EqualFold(string(fields[0]), checksum):
+			log.Println(" Warning, checksum mismatch:", urlKey)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Single-page applications route on the client, so their URL paths (e.g. /users/42) are not files. With
+// spa-fallback, the requests of such paths are answered with the /index.html of the domain and status 200 instead
+// of 404 Not Found. The real files, index files of directories, listings and default icons are still served.
+
+// spaFallbackPath is the URL path of the file that is served for the paths that are not files.
+const spaFallbackPath = "/index.html"
+
+// serveSPAFallback serves the /index.html of the domain for a GET or HEAD request, if the domain has spa-fallback.
+// It returns false if nothing was served.
+func serveSPAFallback(w http.ResponseWriter, r *http.Request, domain string) bool {
+	if !settingsForDomain(domain).spaFallback || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	entry, err := webFiles.Get(domain + spaFallbackPath)
+	if err != nil {
+		return false
+	}
+	serveFileEntry(w, r, domain, spaFallbackPath, entry)
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package main
+
+// The SQLite driver for certificate-cache-backend "sqlite". It is pure Go, so the binary stays static:
+//
+//	go build -tags sqlite
+import _ "modernc.org/sqlite"
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With strict-http-parsing, the HTTP/1.x requests are checked before Go's HTTP server parses them, and connections
+// with ambiguous requests are closed. Go is lenient: it joins folded header lines (obs-fold), accepts duplicate
+// Content-Length headers with the same value, and ignores Content-Length if Transfer-Encoding is also set. A proxy
+// in front of the server that parses such a request differently can be tricked into forwarding a second, hidden
+// request (request smuggling). The connection is closed without a response, because a response could be mixed
+// into the response of a pipelined request that is still being written.
+//
+// The check reads the same bytes as the HTTP server, so it follows the request bodies to find the next request.
+// A request with Upgrade or CONNECT is checked like the other requests, and the connection only stops being checked
+// after the handler switched the protocol with a 101 response or took over the connection (hijacked it). Otherwise a
+// request with an Upgrade header would be enough to smuggle the following requests past the check.
+// Go's TLS server only serves HTTP/2 and sets the TLS state of the requests for a *tls.Conn. Therefore, the HTTPS
+// listener completes the handshakes itself, returns HTTP/2 connections unchanged, and wraps only HTTP/1.x
+// connections, whose requests get their TLS state from the connection context. HTTP/2 frames the requests in a
+// way that can not be ambiguous, and Go rejects HTTP/2 requests with invalid Content-Length or Transfer-Encoding.
+
+// maxStrictHeadSize is the maximum size of a request head that is checked. Go's HTTP server rejects larger heads.
+const maxStrictHeadSize = http.DefaultMaxHeaderBytes + 4096
+
+// errAmbiguousRequest is returned by the reads of a connection with an ambiguous request.
+var errAmbiguousRequest = errors.New("ambiguous HTTP request")
+
+// States of the request checker.
+const (
+	strictStateHead        = iota // Reading the request line and the headers.
+	strictStateBody               // Reading a body with Content-Length.
+	strictStateChunkSize          // Reading the size line of a chunk.
+	strictStateChunkData          // Reading the data of a chunk.
+	strictStateChunkEnd           // Reading the line end after the data of a chunk.
+	strictStateTrailers           // Reading the trailer lines after the last chunk.
+	strictStatePassthrough        // No more checks, because Go's HTTP server rejects the request.
+)
+
+// requestChecker follows the HTTP/1.x requests of a connection and rejects ambiguous requests.
+type requestChecker struct {
+	state     int
+	line      []byte // The incomplete head or line.
+	remaining int64  // The remaining bytes of the body or chunk.
+}
+
+// check processes the next bytes of the connection, and returns an error if a request is ambiguous.
+func (c *requestChecker) check(data []byte) error {
+	for len(data) > 0 {
+		switch c.state {
+		case strictStatePassthrough:
+			return nil
+
+		case strictStateBody, strictStateChunkData:
+			n := c.remaining
+			if int64(len(data)) < n {
+				n = int64(len(data))
+			}
+			data = data[n:]
+			c.remaining -= n
+			if c.remaining == 0 {
+				if c.state == strictStateBody {
+					c.state = strictStateHead
+				} else {
+					c.state = strictStateChunkEnd
+				}
+			}
+
+		case strictStateHead:
+			// The head ends with an empty line. Empty lines before the request line are ignored, like Go does.
+			c.line = append(c.line, data...)
+			data = nil
+			trimmed := bytes.TrimLeft(c.line, "\r\n")
+			end := bytes.Index(trimmed, []byte("\n\r\n"))
+			if lfEnd := bytes.Index(trimmed, []byte("\n\n")); lfEnd >= 0 && (end < 0 || lfEnd < end) {
+				end = lfEnd
+			}
+			if end < 0 {
+				if len(c.line) > maxStrictHeadSize {
+					// Go's HTTP server rejects the request.
+					c.state = strictStatePassthrough
+				}
+				continue
+			}
+			headEnd := end + len("\n\n")
+			if trimmed[end+1] == '\r' {
+				headEnd++
+			}
+			head, rest := trimmed[:end], trimmed[headEnd:]
+			c.line = nil
+			if err := c.checkHead(string(head)); err != nil {
+				return err
+			}
+			data = append([]byte(nil), rest...)
+
+		default:
+			// The lines of the chunked encoding.
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				c.line = append(c.line, data...)
+				data = nil
+				if len(c.line) > maxStrictHeadSize {
+					c.state = strictStatePassthrough
+				}
+				continue
+			}
+			line := strings.TrimRight(string(append(c.line, data[:i]...)), "\r")
+			data = data[i+1:]
+			c.line = nil
+			c.checkChunkLine(line)
+		}
+	}
+	return nil
+}
+
+// checkHead checks the request line and the headers, and sets the state for the body.
+func (c *requestChecker) checkHead(head string) error {
+	lines := strings.Split(head, "\n")
+	var contentLengths, transferEncodings []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			return errors.New("folded header line (obs-fold)")
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "content-length":
+			contentLengths = append(contentLengths, value)
+		case "transfer-encoding":
+			transferEncodings = append(transferEncodings, value)
+		}
+	}
+
+	switch {
+	case len(contentLengths) > 1:
+		return errors.New("duplicate Content-Length headers")
+	case len(contentLengths) == 1 && len(transferEncodings) > 0:
+		return errors.New("Content-Length and Transfer-Encoding headers")
+	case len(transferEncodings) > 1 || (len(transferEncodings) == 1 && !strings.EqualFold(transferEncodings[0], "chunked")):
+		return errors.New("Transfer-Encoding other than a single chunked")
+	}
+
+	switch {
+	case len(transferEncodings) == 1:
+		c.state = strictStateChunkSize
+	case len(contentLengths) == 1:
+		length, err := strconv.ParseInt(contentLengths[0], 10, 64)
+		if err != nil || length < 0 {
+			return errors.New("invalid Content-Length header")
+		}
+		if length > 0 {
+			c.state, c.remaining = strictStateBody, length
+		}
+	}
+	return nil
+}
+
+// checkChunkLine processes a line of the chunked encoding.
+func (c *requestChecker) checkChunkLine(line string) {
+	switch c.state {
+	case strictStateChunkSize:
+		sizeField, _, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		switch {
+		case err != nil || size < 0:
+			// Go's HTTP server rejects the body and closes the connection.
+			c.state = strictStatePassthrough
+		case size == 0:
+			c.state = strictStateTrailers
+		default:
+			c.state, c.remaining = strictStateChunkData, size
+		}
+	case strictStateChunkEnd:
+		c.state = strictStateChunkSize
+	case strictStateTrailers:
+		if line == "" {
+			c.state = strictStateHead
+		}
+	}
+}
+
+// strictConn checks the requests that are read from the connection.
+type strictConn struct {
+	net.Conn
+	checker     requestChecker
+	passthrough atomic.Bool // Set when the connection switched to another protocol.
+}
+
+// Read returns the bytes of the connection, unless they complete an ambiguous request. Then the connection is closed.
+func (c *strictConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.passthrough.Load() {
+		if checkErr := c.checker.check(b[:n]); checkErr != nil {
+			log.Println("Rejected request:", logAddr(c.RemoteAddr().String()), checkErr)
+			c.Conn.Close()
+			return 0, errAmbiguousRequest
+		}
+	}
+	return n, err
+}
+
+// strictListener wraps the connections of the HTTP listener.
+type strictListener struct {
+	net.Listener
+}
+
+// Accept returns the next connection, which checks its requests.
+func (l strictListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &strictConn{Conn: conn}, nil
+}
+
+// strictTLSListener completes the TLS handshakes of the HTTPS listener, and wraps the HTTP/1.x connections.
+type strictTLSListener struct {
+	net.Listener // The TLS listener.
+	conns        chan net.Conn
+	errs         chan error
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// newStrictTLSListener accepts the connections of the TLS listener, and completes their handshakes in parallel, so
+// that slow clients do not hold up the others.
+func newStrictTLSListener(ln net.Listener) *strictTLSListener {
+	l := &strictTLSListener{Listener: ln, conns: make(chan net.Conn), errs: make(chan error), done: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case l.errs <- err:
+				case <-l.done:
+					return
+				}
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			go l.handshake(conn.(*tls.Conn))
+		}
+	}()
+	return l
+}
+
+// handshake completes the handshake within max-request-timeout, and passes the connection to Accept.
+func (l *strictTLSListener) handshake(tlsConn *tls.Conn) {
+	tlsConn.SetDeadline(time.Now().Add(config.MaxRequestTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	var conn net.Conn = tlsConn
+	if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		conn = &strictConn{Conn: tlsConn}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection with a completed handshake.
+func (l *strictTLSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the TLS listener, and the connections whose handshake is not yet passed to Accept.
+func (l *strictTLSListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// strictConnKey is the context key of the wrapped HTTP/1.x connection of a request.
+type strictConnKey struct{}
+
+// connTLS returns the TLS connection of a connection of the HTTPS server, or nil.
+func connTLS(conn net.Conn) *tls.Conn {
+	if sc, ok := conn.(*strictConn); ok {
+		conn = sc.Conn
+	}
+	tlsConn, _ := conn.(*tls.Conn)
+	return tlsConn
+}
+
+// strictConnContext is used as http.Server.ConnContext. It adds a wrapped connection to the context of its requests.
+func strictConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if sc, ok := conn.(*strictConn); ok {
+		return context.WithValue(ctx, strictConnKey{}, sc)
+	}
+	return ctx
+}
+
+// strictHandler sets the TLS state of the requests of wrapped connections, which Go's HTTP server does not know,
+// because their connection is not a *tls.Conn. It stops the checks of a connection when its protocol is switched.
+func strictHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := r.Context().Value(strictConnKey{}).(*strictConn)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tlsConn, ok := sc.Conn.(*tls.Conn); ok && r.TLS == nil {
+			state := tlsConn.ConnectionState()
+			r.TLS = &state
+		}
+		next.ServeHTTP(&strictResponseWriter{ResponseWriter: w, conn: sc}, r)
+	})
+}
+
+// strictResponseWriter stops the checks of the connection when the handler switches the protocol.
+type strictResponseWriter struct {
+	http.ResponseWriter
+	conn *strictConn
+}
+
+// WriteHeader stops the checks before a 101 Switching Protocols response is sent.
+func (w *strictResponseWriter) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols {
+		w.conn.passthrough.Store(true)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends the buffered data to the client, if the original ResponseWriter supports it.
+func (w *strictResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack takes over the connection, if the original ResponseWriter supports it, and stops its checks.
+func (w *strictResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.conn.passthrough.Store(true)
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (w *strictResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
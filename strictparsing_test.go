@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// strictRequestTests are byte streams of HTTP/1.x connections, and whether the checker rejects them.
+var strictRequestTests = []struct {
+	name      string
+	stream    string
+	ambiguous bool
+}{
+	{"simple request", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"empty lines before the request line", "\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"incomplete head", "GET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b", false},
+
+	{"obs-fold with space", "GET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n", true},
+	{"obs-fold with tab", "GET / HTTP/1.1\r\nHost: a\r\nX: a\r\n\tb\r\n\r\n", true},
+	{"duplicate Content-Length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc", true},
+	{"duplicate Content-Length with other case", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\ncontent-length: 3\r\n\r\nabc", true},
+	{"Content-Length with Transfer-Encoding", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true},
+	{"Transfer-Encoding gzip", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip\r\n\r\n", true},
+	{"Transfer-Encoding list", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", true},
+	{"duplicate Transfer-Encoding", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true},
+	{"Transfer-Encoding chunked with other case", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: Chunked\r\n\r\n0\r\n\r\n", false},
+	{"invalid Content-Length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: abc\r\n\r\n", true},
+	{"negative Content-Length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", true},
+
+	{"pipelined after Content-Length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabcGET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"ambiguous request after Content-Length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabcGET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n", true},
+	{"ambiguous head in a body", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 37\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"ambiguous request after a body with a head", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 37\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n", true},
+	{"pipelined after chunked body", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"ambiguous request after chunked body", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\nPOST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 1\r\n\r\na", true},
+	{"ambiguous head in a chunk", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n1c\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"ambiguous request after a chunk with a head", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n1c\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n", true},
+	{"chunk extensions", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0;last\r\n\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n", true},
+	{"trailers", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Trailer: v\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+	{"ambiguous request after trailers", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Trailer: v\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n", true},
+	{"invalid chunk size", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n", false},
+
+	{"ambiguous request after Upgrade", "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n", true},
+	{"ambiguous request after CONNECT", "CONNECT a:443 HTTP/1.1\r\nHost: a:443\r\n\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n", true},
+	{"ambiguous Upgrade request", "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nX: a\r\n b\r\n\r\n", true},
+
+	{"bare LF head", "GET / HTTP/1.1\nHost: a\n\n", false},
+	{"bare LF obs-fold", "GET / HTTP/1.1\nHost: a\nX: a\n b\n\n", true},
+	{"pipelined bare LF heads", "POST / HTTP/1.1\nHost: a\nContent-Length: 3\n\nabcGET / HTTP/1.1\nHost: a\n\n", false},
+	{"ambiguous bare LF request after body", "POST / HTTP/1.1\nHost: a\nContent-Length: 3\n\nabcPOST / HTTP/1.1\nContent-Length: 0\nContent-Length: 0\n\n", true},
+	{"bare LF chunked body", "POST / HTTP/1.1\nHost: a\nTransfer-Encoding: chunked\n\n5\nhello\n0\n\nGET / HTTP/1.1\nX: a\n b\n\n", true},
+}
+
+// checkStream feeds the stream in the parts to a new checker, and returns true if it rejects the stream.
+func checkStream(parts ...string) bool {
+	var c requestChecker
+	for _, part := range parts {
+		if c.check([]byte(part)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequestChecker(t *testing.T) {
+	for _, test := range strictRequestTests {
+		if got := checkStream(test.stream); got != test.ambiguous {
+			t.Errorf("%s: ambiguous = %v, want %v", test.name, got, test.ambiguous)
+		}
+	}
+}
+
+// TestRequestCheckerSplitReads checks that the result does not depend on how the stream is split into reads.
+func TestRequestCheckerSplitReads(t *testing.T) {
+	for _, test := range strictRequestTests {
+		for i := 0; i <= len(test.stream); i++ {
+			if got := checkStream(test.stream[:i], test.stream[i:]); got != test.ambiguous {
+				t.Errorf("%s: split at %d: ambiguous = %v, want %v", test.name, i, got, test.ambiguous)
+			}
+		}
+		bytewise := strings.Split(test.stream, "")
+		if got := checkStream(bytewise...); got != test.ambiguous {
+			t.Errorf("%s: byte by byte: ambiguous = %v, want %v", test.name, got, test.ambiguous)
+		}
+	}
+}
+
+// TestStrictListener checks that Go's HTTP server answers the requests on the wrapped connections like on plain
+// connections, and that it does not answer ambiguous requests.
+func TestStrictListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "ok")
+	})}
+	go server.Serve(strictListener{ln})
+	defer server.Close()
+
+	responses := func(stream string) int {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, stream)
+		reader := bufio.NewReader(conn)
+		count := 0
+		for {
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				return count
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			count++
+			if resp.Close {
+				return count
+			}
+		}
+	}
+
+	pipelined := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n"
+	if got := responses(pipelined); got != 3 {
+		t.Errorf("pipelined requests: %d responses, want 3", got)
+	}
+
+	smuggled := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" +
+		"GET /admin HTTP/1.1\r\nHost: a\r\n\r\n"
+	if got := responses(smuggled); got != 0 {
+		t.Errorf("smuggled request: %d responses, want 0", got)
+	}
+
+	// An Upgrade header alone does not stop the checks, if the handler does not switch the protocol.
+	upgrade := "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n" +
+		"GET /admin HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n"
+	if got := responses(upgrade); got > 1 {
+		t.Errorf("ambiguous request after Upgrade: %d responses, want at most 1", got)
+	}
+}
+
+// TestStrictListenerHijack checks that the data of a connection is not checked anymore after the handler switched
+// the protocol.
+func TestStrictListenerHijack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{ConnContext: strictConnContext, Handler: strictHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))}
+	go server.Serve(strictListener{ln})
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: %v, %v", resp, err)
+	}
+
+	// Data of the other protocol that looks like an ambiguous request is echoed.
+	data := "GET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n"
+	io.WriteString(conn, data)
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != data {
+		t.Errorf("echo: %q, %v, want %q", echo, err, data)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+
+	"golang.org/x/crypto/acme"
+)
+
+// The TLS versions and cipher suites of the HTTPS server are taken from the tls-preset,
+// and can be overridden with tls-min-version, tls-max-version, and tls-cipher-suites.
+// The ALPN protocols of the HTTPS server are taken from https-alpn-protocols.
+// With tls-post-quantum, the hybrid post-quantum key exchanges are preferred, if the Go runtime supports them.
+
+const (
+	tlsPresetIntermediate = "intermediate" // TLS 1.2 and 1.3 with secure cipher suites.
+	tlsPresetModern       = "modern"       // TLS 1.3 only.
+)
+
+// intermediateCipherSuites are the cipher suites for TLS 1.2 of the intermediate preset.
+// See: https://ssl-config.mozilla.org/#server=go&version=1.14.4&config=intermediate&guideline=5.7
+var intermediateCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+}
+
+// tlsMinVersion returns the configured minimum TLS version, or the one of the preset.
+func tlsMinVersion() uint16 {
+	if config.TlsMinVersion != "" {
+		return tlsVersions[config.TlsMinVersion]
+	}
+	if config.TlsPreset == tlsPresetModern {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
+
+// tlsMaxVersion returns the configured maximum TLS version, or the newest version.
+func tlsMaxVersion() uint16 {
+	if config.TlsMaxVersion != "" {
+		return tlsVersions[config.TlsMaxVersion]
+	}
+	return tls.VersionTLS13
+}
+
+// tlsCipherSuites returns the IDs of the configured cipher suites for TLS 1.2 and older, or the ones of the preset.
+// The cipher suites of TLS 1.3 are not configurable in Go.
+func tlsCipherSuites() []uint16 {
+	names := config.TlsCipherSuites
+	if len(names) == 0 {
+		names = intermediateCipherSuites
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, _ := cipherSuiteByName(name)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// tlsCurvePreferences returns the key exchanges of the HTTPS server. With tls-post-quantum, the hybrid post-quantum
+// key exchanges come first, and the classic ones are kept for the other clients. Otherwise, the defaults of Go are used.
+func tlsCurvePreferences() []tls.CurveID {
+	if !config.TlsPostQuantum {
+		return nil
+	}
+	curves := append([]tls.CurveID{}, postQuantumCurves...)
+	return append(curves, tls.X25519, tls.CurveP256, tls.CurveP384)
+}
+
+// httpsNextProtos returns the ALPN protocols of the HTTPS listener in the order of preference.
+// The protocol of the ACME TLS-ALPN-01 challenge is always added, because autocert needs it.
+// HTTP/2 is only served if "h2" is in the list.
+func httpsNextProtos() []string {
+	protos := append([]string{}, config.HttpsAlpnProtocols...)
+	return append(protos, acme.ALPNProto)
+}
+
+// checkTLSSettings ensures that the TLS settings are valid.
+func checkTLSSettings() {
+	if config.TlsPreset != tlsPresetIntermediate && config.TlsPreset != tlsPresetModern {
+		log.Fatalf("Error: tls-preset '%s' is invalid, it must be '%s' or '%s'", config.TlsPreset, tlsPresetIntermediate, tlsPresetModern)
+	}
+	if _, ok := tlsVersions[config.TlsMinVersion]; config.TlsMinVersion != "" && !ok {
+		log.Fatalf("Error: tls-min-version '%s' is invalid", config.TlsMinVersion)
+	}
+	if _, ok := tlsVersions[config.TlsMaxVersion]; config.TlsMaxVersion != "" && !ok {
+		log.Fatalf("Error: tls-max-version '%s' is invalid", config.TlsMaxVersion)
+	}
+	if tlsMinVersion() > tlsMaxVersion() {
+		log.Fatal("Error: tls-min-version must not be above tls-max-version")
+	}
+	for _, name := range config.TlsCipherSuites {
+		if _, ok := cipherSuiteByName(name); !ok {
+			log.Fatalf("Error: unknown cipher suite '%s' in tls-cipher-suites", name)
+		}
+		for _, suite := range tls.InsecureCipherSuites() {
+			if suite.Name == name {
+				log.Printf("Warning: the cipher suite '%s' in tls-cipher-suites is insecure", name)
+			}
+		}
+	}
+	if len(config.TlsCipherSuites) > 0 && tlsMinVersion() == tls.VersionTLS13 {
+		log.Println("Warning: tls-cipher-suites has no effect, because only TLS 1.3 is enabled")
+	}
+
+	// The hybrid post-quantum key exchanges need Go 1.24 and TLS 1.3.
+	if config.TlsPostQuantum && !postQuantumSupported {
+		log.Fatal("Error: tls-post-quantum needs a server that was built with Go 1.24 or newer")
+	}
+	if config.TlsPostQuantum && tlsMaxVersion() < tls.VersionTLS13 {
+		log.Println("Warning: tls-post-quantum has no effect, because TLS 1.3 is disabled")
+	}
+
+	// ALPN protocol IDs are 1 to 255 bytes long (RFC 7301).
+	seen := map[string]bool{}
+	for _, proto := range config.HttpsAlpnProtocols {
+		if proto == "" || len(proto) > 255 {
+			log.Fatalf("Error: the protocol '%s' in https-alpn-protocols must be 1 to 255 bytes long", proto)
+		}
+		if proto == acme.ALPNProto {
+			log.Fatalf("Error: the protocol '%s' in https-alpn-protocols is always enabled for the ACME challenges and must not be listed", proto)
+		}
+		if seen[proto] {
+			log.Fatalf("Error: the protocol '%s' is listed twice in https-alpn-protocols", proto)
+		}
+		seen[proto] = true
+	}
+	if len(config.HttpsAlpnProtocols) > 0 && !seen["http/1.1"] && !seen["h2"] {
+		log.Println("Warning: https-alpn-protocols contains neither 'h2' nor 'http/1.1', clients that use ALPN get HTTP/1.1 with a custom protocol ID")
+	}
+}
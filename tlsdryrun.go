@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// The TLS dry-run observes the handshakes and logs the clients that would break, if the
+// settings in tls-dry-run-min-version and tls-dry-run-disabled-cipher-suites were enforced.
+// Nothing is enforced, the handshakes continue with the current settings.
+
+// maxDryRunClients is the maximum number of remembered clients, so that each client is only logged once.
+const maxDryRunClients = 10000
+
+// dryRunSummaryInterval is the interval in which the summary of the dry-run is logged.
+const dryRunSummaryInterval = time.Hour
+
+var dryRunMu sync.Mutex
+var dryRunClients = map[string]bool{}
+var dryRunHandshakes, dryRunBreakingVersion, dryRunBreakingCipher int
+
+// tlsVersions maps the version names in the config to the TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteByName returns the ID of the cipher suite with the given (Go) name.
+func cipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// tlsDryRunEnabled returns true if a dry-run is configured.
+func tlsDryRunEnabled() bool {
+	return config.TlsDryRunMinVersion != "" || len(config.TlsDryRunDisabledCipherSuites) > 0
+}
+
+// startTLSDryRun logs the summary of the dry-run periodically.
+func startTLSDryRun() {
+	log.Println("TLS dry-run enabled. Clients that would break are logged.")
+	jobs.every(jobTLSDryRunSummary, dryRunSummaryInterval, func() {
+		dryRunMu.Lock()
+		log.Printf("TLS dry-run summary: %d handshakes, %d would break because of the TLS version, %d because of the cipher suites",
+			dryRunHandshakes, dryRunBreakingVersion, dryRunBreakingCipher)
+		dryRunMu.Unlock()
+	})
+}
+
+// observeHandshake checks whether the client of the handshake would break with the dry-run settings.
+// The cipher suites of the server are the currently enabled cipher suites for TLS 1.2.
+func observeHandshake(hello *tls.ClientHelloInfo, serverCipherSuites []uint16) {
+	if serverCipherSuites == nil {
+		// Go uses its default cipher suites.
+		for _, suite := range tls.CipherSuites() {
+			serverCipherSuites = append(serverCipherSuites, suite.ID)
+		}
+	}
+
+	supportsTLS13 := false
+	maxVersion := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if v == tls.VersionTLS13 {
+			supportsTLS13 = true
+		}
+		if v > maxVersion {
+			maxVersion = v
+		}
+	}
+
+	var reason string
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	dryRunHandshakes++
+	if minVersion, ok := tlsVersions[config.TlsDryRunMinVersion]; ok && maxVersion < minVersion {
+		reason = fmt.Sprintf("TLS version %s is below %s", tlsVersionName(maxVersion), config.TlsDryRunMinVersion)
+		dryRunBreakingVersion++
+	} else if !supportsTLS13 && len(config.TlsDryRunDisabledCipherSuites) > 0 && !hasRemainingCipherSuite(hello.CipherSuites, serverCipherSuites) {
+		// The cipher suites of TLS 1.3 can not be disabled, so only clients without TLS 1.3 are affected.
+		reason = "no common cipher suite is left"
+		dryRunBreakingCipher++
+	} else {
+		return
+	}
+
+	// Log each client only once.
+	client := logAddr(hello.Conn.RemoteAddr().String())
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if dryRunClients[client+" "+reason] {
+		return
+	}
+	if len(dryRunClients) >= maxDryRunClients {
+		dryRunClients = map[string]bool{}
+	}
+	dryRunClients[client+" "+reason] = true
+
+	log.Printf("TLS dry-run: client %s (server name %q) would break: %s", client, hello.ServerName, reason)
+}
+
+// hasRemainingCipherSuite returns true if the client offers a server cipher suite that is not disabled by the dry-run.
+func hasRemainingCipherSuite(clientCipherSuites, serverCipherSuites []uint16) bool {
+	for _, s := range serverCipherSuites {
+		if isDryRunDisabledCipherSuite(s) {
+			continue
+		}
+		for _, c := range clientCipherSuites {
+			if c == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDryRunDisabledCipherSuite returns true if the cipher suite is disabled by the dry-run.
+func isDryRunDisabledCipherSuite(id uint16) bool {
+	for _, name := range config.TlsDryRunDisabledCipherSuites {
+		if disabled, _ := cipherSuiteByName(name); disabled == id {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsVersionName returns the name of the TLS version as used in the config.
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
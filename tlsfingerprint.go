@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The HTTPS listener can compute the JA3 and JA4 fingerprints of the ClientHello of each connection. Clients with
+// the same TLS library and settings have the same fingerprint, independent of their IP address and User-Agent, so
+// the fingerprints help to recognize scanners and bots. Go does not expose the order of the extensions in the
+// ClientHello, so the ClientHello is parsed from the bytes that the TLS server reads from the connection.
+
+// maxClientHelloSize is the maximum number of bytes that are buffered to parse the ClientHello.
+const maxClientHelloSize = 64 * 1024
+
+// tlsFingerprint holds the fingerprints of the ClientHello of a connection.
+type tlsFingerprint struct {
+	ja3     string // The JA3 string, e.g. "771,4865-4866,0-23-65281,29-23,0"
+	ja3Hash string // The MD5 of the JA3 string, which is the usual form of JA3
+	ja4     string // The JA4 fingerprint, e.g. "t13d1516h2_8daaf6152771_e5627efa2ab1"
+}
+
+// tlsFingerprintKey is the context key of the fingerprint of the connection of a request.
+type tlsFingerprintKey struct{}
+
+// tlsFingerprintsEnabled returns true if the fingerprints of the connections are computed.
+func tlsFingerprintsEnabled() bool {
+	return config.LogTlsFingerprints
+}
+
+// fingerprintListener returns connections that compute the fingerprint of the ClientHello that is read from them.
+type fingerprintListener struct {
+	net.Listener
+}
+
+func (l fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: conn}, nil
+}
+
+// fingerprintConn buffers the bytes that are read from the connection until the ClientHello is complete.
+// The TLS server reads the ClientHello before the first request, so the fingerprint is known to the handlers.
+type fingerprintConn struct {
+	net.Conn
+	buf         []byte
+	done        bool
+	fingerprint *tlsFingerprint
+}
+
+func (c *fingerprintConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		if hello, complete := clientHelloMessage(c.buf); complete {
+			c.fingerprint = fingerprintClientHello(hello)
+			c.done, c.buf = true, nil
+		} else if len(c.buf) > maxClientHelloSize {
+			c.done, c.buf = true, nil
+		}
+	}
+	return n, err
+}
+
+// tlsFingerprintConnContext is used as http.Server.ConnContext. It adds the fingerprint of the connection to the
+// context of its requests.
+func tlsFingerprintConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn := connTLS(conn); tlsConn != nil {
+		if fc, ok := tlsConn.NetConn().(*fingerprintConn); ok {
+			return context.WithValue(ctx, tlsFingerprintKey{}, fc)
+		}
+	}
+	return ctx
+}
+
+// requestTLSFingerprint returns the fingerprint of the connection of the request, or nil if it is not known.
+func requestTLSFingerprint(r *http.Request) *tlsFingerprint {
+	fc, ok := r.Context().Value(tlsFingerprintKey{}).(*fingerprintConn)
+	if !ok || r.TLS == nil {
+		// Without r.TLS, the handshake has not finished, and the fingerprint must not be read yet.
+		return nil
+	}
+	return fc.fingerprint
+}
+
+// clientHelloMessage returns the ClientHello handshake message from the TLS records in data. complete is false
+// if more data is needed. If the data does not start with a ClientHello, complete is true and the message is nil.
+func clientHelloMessage(data []byte) (message []byte, complete bool) {
+	var handshake []byte
+	for len(data) >= 5 {
+		if data[0] != 22 { // Handshake record
+			return nil, true
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			return nil, false
+		}
+		handshake = append(handshake, data[5:5+length]...)
+		data = data[5+length:]
+
+		// The ClientHello can span several records.
+		if len(handshake) >= 4 {
+			if handshake[0] != 1 { // ClientHello
+				return nil, true
+			}
+			size := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+size {
+				return handshake[4 : 4+size], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isGREASE returns true for the reserved GREASE values (RFC 8701), which clients send randomly and which are
+// therefore ignored by the fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloReader reads the fields of a ClientHello. After an error, all reads return zero values.
+type helloReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *helloReader) uint8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *helloReader) uint16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// uint16s returns the list of 16 bit values of the length in bytes, without the GREASE values.
+func (r *helloReader) uint16s(length int) []uint16 {
+	list := &helloReader{data: r.bytes(length)}
+	var values []uint16
+	for len(list.data) >= 2 {
+		if v := uint16(list.uint16()); !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// fingerprintClientHello computes the JA3 and JA4 fingerprints of the ClientHello message.
+// It returns nil if the message is invalid.
+func fingerprintClientHello(message []byte) *tlsFingerprint {
+	r := &helloReader{data: message}
+	version := uint16(r.uint16())
+	r.bytes(32)        // Random
+	r.bytes(r.uint8()) // Session ID
+	ciphers := r.uint16s(r.uint16())
+	r.bytes(r.uint8()) // Compression methods
+	extensionData := r.bytes(r.uint16())
+	if r.err {
+		return nil
+	}
+
+	var extensions, groups, signatureAlgorithms, supportedVersions []uint16
+	var pointFormats []byte
+	var alpn string
+	hasServerName := false
+	e := &helloReader{data: extensionData}
+	for len(e.data) >= 4 && !e.err {
+		extension := uint16(e.uint16())
+		body := &helloReader{data: e.bytes(e.uint16())}
+		if isGREASE(extension) {
+			continue
+		}
+		extensions = append(extensions, extension)
+		switch extension {
+		case 0: // server_name
+			hasServerName = true
+		case 10: // supported_groups
+			groups = body.uint16s(body.uint16())
+		case 11: // ec_point_formats
+			pointFormats = body.bytes(body.uint8())
+		case 13: // signature_algorithms
+			signatureAlgorithms = body.uint16s(body.uint16())
+		case 16: // application_layer_protocol_negotiation
+			list := &helloReader{data: body.bytes(body.uint16())}
+			alpn = string(list.bytes(list.uint8()))
+		case 43: // supported_versions
+			supportedVersions = body.uint16s(body.uint8())
+		}
+	}
+	if e.err {
+		return nil
+	}
+
+	// JA3: the decimal values of the version, the cipher suites, the extensions, the groups, and the point formats.
+	formats := make([]uint16, len(pointFormats))
+	for i, f := range pointFormats {
+		formats[i] = uint16(f)
+	}
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", version, joinUint16s(ciphers, "%d", "-"), joinUint16s(extensions, "%d", "-"),
+		joinUint16s(groups, "%d", "-"), joinUint16s(formats, "%d", "-"))
+	ja3Hash := md5.Sum([]byte(ja3))
+
+	// JA4: "t" for TCP, the highest TLS version, "d" with or "i" without server name, the numbers of the cipher
+	// suites and of the extensions, the first and last character of the first ALPN protocol, and the truncated
+	// SHA-256 of the sorted cipher suites and of the sorted extensions with the signature algorithms.
+	for _, v := range supportedVersions {
+		if v > version {
+			version = v
+		}
+	}
+	versions := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}
+	ja4Version, ok := versions[version]
+	if !ok {
+		ja4Version = "00"
+	}
+	sni := "i"
+	if hasServerName {
+		sni = "d"
+	}
+	alpnChars := "00"
+	if alpn != "" {
+		alpnChars = alpn[:1] + alpn[len(alpn)-1:]
+		if !isAlphanumeric(alpn[0]) || !isAlphanumeric(alpn[len(alpn)-1]) {
+			hexALPN := hex.EncodeToString([]byte(alpn))
+			alpnChars = hexALPN[:1] + hexALPN[len(hexALPN)-1:]
+		}
+	}
+
+	var sortedExtensions []uint16
+	for _, extension := range extensions {
+		// The server name and ALPN are already part of the first section.
+		if extension != 0 && extension != 16 {
+			sortedExtensions = append(sortedExtensions, extension)
+		}
+	}
+	extensionsHashInput := joinUint16s(sortUint16s(sortedExtensions), "%04x", ",")
+	if len(signatureAlgorithms) > 0 {
+		extensionsHashInput += "_" + joinUint16s(signatureAlgorithms, "%04x", ",")
+	}
+	ja4 := fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", ja4Version, sni, min99(len(ciphers)), min99(len(extensions)), alpnChars,
+		truncatedHash(joinUint16s(sortUint16s(ciphers), "%04x", ","), len(ciphers) == 0),
+		truncatedHash(extensionsHashInput, len(sortedExtensions) == 0))
+
+	return &tlsFingerprint{ja3: ja3, ja3Hash: hex.EncodeToString(ja3Hash[:]), ja4: ja4}
+}
+
+// joinUint16s formats the values and joins them with the separator.
+func joinUint16s(values []uint16, format, separator string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		if format == "%d" {
+			parts[i] = strconv.Itoa(int(v))
+		} else {
+			parts[i] = fmt.Sprintf(format, v)
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+// sortUint16s returns a sorted copy of the values.
+func sortUint16s(values []uint16) []uint16 {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// truncatedHash returns the first 12 hex characters of the SHA-256 of the input, or zeros if the list is empty.
+func truncatedHash(input string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// min99 limits the count to two digits.
+func min99(count int) int {
+	if count > 99 {
+		return 99
+	}
+	return count
+}
+
+// isAlphanumeric returns true for ASCII letters and digits.
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
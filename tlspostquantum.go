@@ -0,0 +1,14 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// postQuantumSupported is true, because the Go runtime supports hybrid post-quantum key exchanges.
+const postQuantumSupported = true
+
+// postQuantumCurves are the hybrid post-quantum key exchanges in the order of preference.
+var postQuantumCurves = []tls.CurveID{tls.X25519MLKEM768}
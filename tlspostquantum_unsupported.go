@@ -0,0 +1,14 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// postQuantumSupported is false, because the Go runtime does not support hybrid post-quantum key exchanges before Go 1.24.
+const postQuantumSupported = false
+
+// postQuantumCurves are the hybrid post-quantum key exchanges in the order of preference.
+var postQuantumCurves []tls.CurveID
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log"
+	"time"
+)
+
+// Go's TLS server resumes sessions with stateless session tickets, so there is no server side session cache.
+// TLS 1.3 0-RTT (early data) is not supported by Go's TLS server and is therefore always disabled.
+
+// ticketKeyCount is the number of session ticket keys that are kept for decryption while rotating them.
+const ticketKeyCount = 4
+
+// maxSessionTicketLifetime is the maximum lifetime of session tickets that Go's TLS server accepts.
+const maxSessionTicketLifetime = 7 * 24 * time.Hour
+
+// configureSessionResumption applies the session ticket settings to the TLS config.
+// If a session ticket lifetime is configured, the session ticket keys are rotated, so
+// that tickets can not be used for longer than the lifetime.
+func configureSessionResumption(tlsConfig *tls.Config) {
+	tlsConfig.SessionTicketsDisabled = !config.TlsSessionTickets
+	if !config.TlsSessionTickets || config.TlsSessionTicketLifetime == 0 {
+		// Use the automatic key rotation of Go.
+		return
+	}
+
+	// New tickets are encrypted with the first key. Tickets are accepted as long as their key is in the list.
+	// With a rotation after a quarter of the lifetime, tickets are valid for at least 3/4 and at most the whole lifetime.
+	interval := config.TlsSessionTicketLifetime / ticketKeyCount
+	keys := make([][32]byte, 0, ticketKeyCount)
+	rotate := func() {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			log.Println("Could not create session ticket key:", err)
+			return
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > ticketKeyCount {
+			keys = keys[:ticketKeyCount]
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+
+	rotate()
+	jobs.every(jobSessionTicketRotation, interval, rotate)
+}
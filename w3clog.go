@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With w3c-log-file, the requests are also written in the W3C Extended Log File Format, which log analytics tools
+// read without conversion. The child records each request after its response was written, and sends the entry as
+// a log line with the W3C marker to the parent. The parent writes these lines only into the W3C log file, and starts
+// the file with the #Version, #Fields, and #Date directives. Values with spaces are written with "+" instead, and
+// missing values as "-", like IIS does.
+
+// w3cLogMarker is the part of a log line of the child that marks a W3C log entry.
+const w3cLogMarker = " W3C: "
+
+// w3cLogFields are the supported fields, besides the request headers "cs(<header>)" and response headers
+// "sc(<header>)".
+var w3cLogFields = map[string]bool{
+	"date":         true, // The date of the request in UTC, e.g. 2006-01-02.
+	"time":         true, // The time of the request in UTC, e.g. 15:04:05.
+	"c-ip":         true, // The IP address of the client.
+	"c-port":       true, // The port of the client.
+	"s-ip":         true, // The IP address of the server.
+	"s-port":       true, // The port of the server.
+	"cs-method":    true, // The request method.
+	"cs-uri-stem":  true, // The escaped URL path.
+	"cs-uri-query": true, // The query string.
+	"cs-version":   true, // The protocol, e.g. HTTP/2.0.
+	"cs-host":      true, // The host of the request.
+	"sc-status":    true, // The status code of the response.
+	"sc-bytes":     true, // The size of the response body.
+	"time-taken":   true, // The seconds until the response was written, with milliseconds.
+}
+
+// w3cLog holds the W3C log file of the parent. The file is nil if no W3C log file is written.
+var w3cLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// checkW3CLogFields returns an error if a field of w3c-log-fields is unknown.
+func checkW3CLogFields(fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("w3c-log-fields must not be empty")
+	}
+	for _, field := range fields {
+		if header, ok := w3cHeaderField(field); ok {
+			if header == "" || strings.ContainsAny(header, " ()") {
+				return fmt.Errorf("w3c-log-fields: invalid header field %q", field)
+			}
+			continue
+		}
+		if !w3cLogFields[field] {
+			return fmt.Errorf("w3c-log-fields: unknown field %q", field)
+		}
+	}
+	return nil
+}
+
+// w3cHeaderField returns the header name of a field "cs(<header>)" or "sc(<header>)".
+func w3cHeaderField(field string) (string, bool) {
+	if !strings.HasSuffix(field, ")") || !(strings.HasPrefix(field, "cs(") || strings.HasPrefix(field, "sc(")) {
+		return "", false
+	}
+	return field[len("cs(") : len(field)-1], true
+}
+
+// w3cValue returns the value for the W3C log, with "+" for spaces and "-" if it is empty.
+func w3cValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ':
+			return '+'
+		case r < ' ' || r == 0x7f:
+			// Control characters could inject log lines.
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// w3cResponseWriter records the status and the size of the response.
+type w3cResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status and writes the header.
+func (w *w3cResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the size and writes the body.
+func (w *w3cResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered data to the client, if the original ResponseWriter supports it.
+func (w *w3cResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack takes over the connection, if the original ResponseWriter supports it.
+func (w *w3cResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (w *w3cResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// w3cLogHandler sends a W3C log entry of each request of the handler to the parent, if w3c-log-file is set.
+func w3cLogHandler(next http.Handler) http.Handler {
+	if config.W3cLogFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &w3cResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		log.Println("W3C:", w3cLogEntry(r, recorder, start))
+	})
+}
+
+// w3cLogEntry returns the values of the w3c-log-fields for the request, separated by spaces.
+func w3cLogEntry(r *http.Request, w *w3cResponseWriter, start time.Time) string {
+	clientHost, clientPort, _ := net.SplitHostPort(logAddr(r.RemoteAddr))
+	var serverHost, serverPort string
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		serverHost, serverPort, _ = net.SplitHostPort(logAddr(addr.String()))
+	}
+	status := w.status
+	if status == 0 && w.bytes == 0 {
+		// The handler wrote nothing, so Go's HTTP server sends an empty 200 response.
+		status = http.StatusOK
+	}
+
+	values := make([]string, len(config.W3cLogFields))
+	for i, field := range config.W3cLogFields {
+		var value string
+		switch field {
+		case "date":
+			value = start.UTC().Format("2006-01-02")
+		case "time":
+			value = start.UTC().Format("15:04:05")
+		case "c-ip":
+			value = clientHost
+		case "c-port":
+			value = clientPort
+		case "s-ip":
+			value = serverHost
+		case "s-port":
+			value = serverPort
+		case "cs-method":
+			value = r.Method
+		case "cs-uri-stem":
+			value = r.URL.EscapedPath()
+		case "cs-uri-query":
+			value = r.URL.RawQuery
+		case "cs-version":
+			value = r.Proto
+		case "cs-host":
+			value = r.Host
+		case "sc-status":
+			value = strconv.Itoa(status)
+		case "sc-bytes":
+			value = strconv.FormatInt(w.bytes, 10)
+		case "time-taken":
+			value = strconv.FormatFloat(time.Since(start).Seconds(), 'f', 3, 64)
+		default:
+			header, _ := w3cHeaderField(field)
+			if strings.HasPrefix(field, "cs(") {
+				value = r.Header.Get(header)
+			} else {
+				value = w.Header().Get(header)
+			}
+		}
+		values[i] = w3cValue(value)
+	}
+	return strings.Join(values, " ")
+}
+
+// openW3CLogFile opens the W3C log file for appending, and writes the directives. It is called in the parent.
+func openW3CLogFile() error {
+	f, err := os.OpenFile(config.W3cLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// The directives are repeated after each start, because the fields can have changed.
+	_, err = fmt.Fprintf(f, "#Version: 1.0\n#Software: sslserver\n#Date: %s\n#Fields: %s\n",
+		time.Now().UTC().Format("2006-01-02 15:04:05"), strings.Join(config.W3cLogFields, " "))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w3cLog.Lock()
+	w3cLog.file = f
+	w3cLog.Unlock()
+	return nil
+}
+
+// recordW3CLog writes a log line of the child into the W3C log file, if it is a W3C log entry. It returns true if
+// the line was a W3C log entry, which is not written into the log file.
+func recordW3CLog(line string) bool {
+	if !strings.HasPrefix(line, "C ") {
+		return false
+	}
+	i := strings.Index(line, w3cLogMarker)
+	if i < 0 {
+		return false
+	}
+
+	w3cLog.Lock()
+	defer w3cLog.Unlock()
+	if w3cLog.file != nil {
+		w3cLog.file.WriteString(line[i+len(w3cLogMarker):] + "\n")
+	}
+	return true
+}
+
+// rotateW3CLogFile renames the W3C log file like rotateLogFile renames the log file, if it is bigger than
+// log-file-max-size, and starts the new file with the directives.
+func rotateW3CLogFile() {
+	w3cLog.Lock()
+	f := w3cLog.file
+	w3cLog.Unlock()
+	info, err := f.Stat()
+	if err != nil || info.Size() < config.LogFileMaxSize {
+		return
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", config.W3cLogFile, logFileBackups))
+	for i := logFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", config.W3cLogFile, i), fmt.Sprintf("%s.%d", config.W3cLogFile, i+1))
+	}
+	if err := os.Rename(config.W3cLogFile, config.W3cLogFile+".1"); err != nil {
+		log.Println("Could not rotate W3C log file:", err)
+		return
+	}
+
+	// Lines that are written until the new file is open go into the renamed file.
+	if err := openW3CLogFile(); err != nil {
+		// Continue to write into the renamed file.
+		log.Println("Could not create new W3C log file:", err)
+		return
+	}
+	f.Close()
+	log.Println("W3C log file rotated, the previous W3C log file is", config.W3cLogFile+".1")
+}
+
+// syncW3CLogFile commits the W3C log file to stable storage.
+func syncW3CLogFile() {
+	w3cLog.Lock()
+	defer w3cLog.Unlock()
+	if w3cLog.file != nil {
+		w3cLog.file.Sync()
+	}
+}
@@ -0,0 +1,146 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// On Windows, os.Chmod only toggles the read only attribute, which does not protect the web root. Instead, the web
+// root gets an NTFS access control list: the account of the server may read, and it is explicitly denied to write,
+// while SYSTEM and the Administrators keep full control. The ACLs inherited from the parent directories are removed.
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = advapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+	procConvertSecurityDescriptorToStringSecurityDescriptorW = advapi32.NewProc("ConvertSecurityDescriptorToStringSecurityDescriptorW")
+	procGetSecurityDescriptorDacl                            = advapi32.NewProc("GetSecurityDescriptorDacl")
+	procGetNamedSecurityInfoW                                = advapi32.NewProc("GetNamedSecurityInfoW")
+	procSetNamedSecurityInfoW                                = advapi32.NewProc("SetNamedSecurityInfoW")
+)
+
+const (
+	seFileObject                     = 1
+	daclSecurityInformation          = 0x00000004
+	protectedDaclSecurityInformation = 0x80000000
+	unprotectedDaclSecurityInfo      = 0x20000000
+	sddlRevision1                    = 1
+
+	// The rights that are denied to the account of the server: FILE_WRITE_DATA (add file), FILE_APPEND_DATA
+	// (add subdirectory), FILE_WRITE_EA, FILE_DELETE_CHILD, FILE_WRITE_ATTRIBUTES, and DELETE. WRITE_DAC is not
+	// denied, so that the owner can still change the ACL, e.g. at the next start.
+	denyWriteMask = 0x00000002 | 0x00000004 | 0x00000010 | 0x00000040 | 0x00000100 | 0x00010000
+)
+
+// setPermissions sets the ACLs of all files and directories in (and including) dir to read only for the account of the server.
+func setPermissions(dir string) error {
+	sid, err := currentUserSID()
+	if err != nil {
+		return err
+	}
+	sddl := fmt.Sprintf("D:P(D;OICI;0x%x;;;%s)(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)(A;OICI;FR;;;%s)", denyWriteMask, sid, sid)
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return setSDDL(path, sddl)
+	})
+}
+
+// makeWritable gives the account of the server full control over the file or directory, e.g. to add a domain to
+// the read only web root. The returned function restores the previous ACL.
+func makeWritable(path string) (restore func(), err error) {
+	sid, err := currentUserSID()
+	if err != nil {
+		return nil, err
+	}
+	previous, err := getSDDL(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSDDL(path, fmt.Sprintf("D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)(A;OICI;FA;;;%s)", sid)); err != nil {
+		return nil, err
+	}
+	return func() { setSDDL(path, previous) }, nil
+}
+
+// currentUserSID returns the SID of the account of the server as string.
+func currentUserSID() (string, error) {
+	token, err := syscall.OpenCurrentProcessToken()
+	if err != nil {
+		return "", err
+	}
+	defer token.Close()
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	return user.User.Sid.String()
+}
+
+// setSDDL sets the DACL of the file or directory from the security descriptor string.
+func setSDDL(path, sddl string) error {
+	sddlPtr, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return err
+	}
+	var sd uintptr
+	r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(uintptr(unsafe.Pointer(sddlPtr)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return fmt.Errorf("invalid security descriptor %s: %v", sddl, err)
+	}
+	defer syscall.LocalFree(syscall.Handle(sd))
+
+	var present, defaulted int32
+	var dacl uintptr
+	r, _, err = procGetSecurityDescriptorDacl.Call(sd, uintptr(unsafe.Pointer(&present)), uintptr(unsafe.Pointer(&dacl)), uintptr(unsafe.Pointer(&defaulted)))
+	if r == 0 {
+		return err
+	}
+
+	// A protected DACL does not inherit the ACEs of the parent directory.
+	var securityInfo uint32 = daclSecurityInformation | unprotectedDaclSecurityInfo
+	if strings.HasPrefix(sddl, "D:P") {
+		securityInfo = daclSecurityInformation | protectedDaclSecurityInformation
+	}
+
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ret, _, _ := procSetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(pathPtr)), seFileObject, uintptr(securityInfo), 0, 0, dacl, 0)
+	if ret != 0 {
+		return fmt.Errorf("could not set the ACL of %s: %v", path, syscall.Errno(ret))
+	}
+	return nil
+}
+
+// getSDDL returns the DACL of the file or directory as security descriptor string.
+func getSDDL(path string) (string, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	var dacl, sd uintptr
+	ret, _, _ := procGetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(pathPtr)), seFileObject, daclSecurityInformation, 0, 0, uintptr(unsafe.Pointer(&dacl)), 0, uintptr(unsafe.Pointer(&sd)))
+	if ret != 0 {
+		return "", fmt.Errorf("could not get the ACL of %s: %v", path, syscall.Errno(ret))
+	}
+	defer syscall.LocalFree(syscall.Handle(sd))
+
+	var str *uint16
+	r, _, err := procConvertSecurityDescriptorToStringSecurityDescriptorW.Call(sd, sddlRevision1, daclSecurityInformation, uintptr(unsafe.Pointer(&str)), 0)
+	if r == 0 {
+		return "", err
+	}
+	defer syscall.LocalFree(syscall.Handle(unsafe.Pointer(str)))
+	return syscall.UTF16ToString((*[1 << 20]uint16)(unsafe.Pointer(str))[:]), nil
+}